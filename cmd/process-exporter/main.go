@@ -1,13 +1,21 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/ncabatoff/fakescraper"
@@ -67,150 +75,595 @@ Config file process selection (filename.yml):
 }
 
 var (
+	numprocsDesc                *prometheus.Desc
+	numChildProcsDesc           *prometheus.Desc
+	procStartsDesc              *prometheus.Desc
+	cpuUserSecsDesc             *prometheus.Desc
+	cpuSystemSecsDesc           *prometheus.Desc
+	cpuSchedSecsDesc            *prometheus.Desc
+	netRxBytesDesc              *prometheus.Desc
+	netTxBytesDesc              *prometheus.Desc
+	delaySecsDesc               *prometheus.Desc
+	readBytesDesc               *prometheus.Desc
+	writeBytesDesc              *prometheus.Desc
+	cancelledWriteBytesDesc     *prometheus.Desc
+	readCharsDesc               *prometheus.Desc
+	writeCharsDesc              *prometheus.Desc
+	readSyscallsDesc            *prometheus.Desc
+	writeSyscallsDesc           *prometheus.Desc
+	majorPageFaultsDesc         *prometheus.Desc
+	minorPageFaultsDesc         *prometheus.Desc
+	contextSwitchesDesc         *prometheus.Desc
+	cpuMigrationsDesc           *prometheus.Desc
+	schedWaitSecsDesc           *prometheus.Desc
+	lifetimeSecsDesc            *prometheus.Desc
+	membytesDesc                *prometheus.Desc
+	openFDsDesc                 *prometheus.Desc
+	openFDTypesDesc             *prometheus.Desc
+	inotifyInstancesDesc        *prometheus.Desc
+	inotifyWatchesDesc          *prometheus.Desc
+	worstFDRatioDesc            *prometheus.Desc
+	worstFDProcDesc             *prometheus.Desc
+	openFDLimitDesc             *prometheus.Desc
+	openFDHardLimitDesc         *prometheus.Desc
+	podInfoDesc                 *prometheus.Desc
+	worstNiceDesc               *prometheus.Desc
+	bestNiceDesc                *prometheus.Desc
+	worstPriorityDesc           *prometheus.Desc
+	bestPriorityDesc            *prometheus.Desc
+	worstOOMScoreDesc           *prometheus.Desc
+	oomScoreAdjDesc             *prometheus.Desc
+	trackedSecsDesc             *prometheus.Desc
+	startTimeDesc               *prometheus.Desc
+	numThreadsDesc              *prometheus.Desc
+	statesDesc                  *prometheus.Desc
+	userProcsDesc               *prometheus.Desc
+	threadStatesDesc            *prometheus.Desc
+	scrapeErrorsDesc            *prometheus.Desc
+	scrapeProcFSUnavailableDesc *prometheus.Desc
+	scrapeProcReadErrorsDesc    *prometheus.Desc
+	scrapePartialErrorsDesc     *prometheus.Desc
+	scrapeDurationDesc          *prometheus.Desc
+	scrapeProcsDesc             *prometheus.Desc
+	scrapeDetailSkippedDesc     *prometheus.Desc
+	scrapeProcErrorsDesc        *prometheus.Desc
+	permissionDegradedDesc      *prometheus.Desc
+	threadWchanDesc             *prometheus.Desc
+	threadCountDesc             *prometheus.Desc
+	threadCpuSecsDesc           *prometheus.Desc
+	threadIoBytesDesc           *prometheus.Desc
+	threadMajorPageFaultsDesc   *prometheus.Desc
+	threadMinorPageFaultsDesc   *prometheus.Desc
+	threadContextSwitchesDesc   *prometheus.Desc
+	coredumpProcsDesc           *prometheus.Desc
+	tracedProcsDesc             *prometheus.Desc
+	setuidProcsDesc             *prometheus.Desc
+	chrootedProcsDesc           *prometheus.Desc
+	frozenProcsDesc             *prometheus.Desc
+	pressureDesc                *prometheus.Desc
+	cgroupMembytesDesc          *prometheus.Desc
+	memberMembytesDesc          *prometheus.Desc
+	cpuRatioDesc                *prometheus.Desc
+	memberCPURateDesc           *prometheus.Desc
+	memberIORateDesc            *prometheus.Desc
+	memoryLimitDesc             *prometheus.Desc
+	memoryGrowthDesc            *prometheus.Desc
+	leakSuspectedDesc           *prometheus.Desc
+	hungProcsDesc               *prometheus.Desc
+	finalDesc                   *prometheus.Desc
+	procsExceedingMaxAgeDesc    *prometheus.Desc
+	procAgeDesc                 *prometheus.Desc
+	vszBloatProcsDesc           *prometheus.Desc
+	pidCpuSecsDesc              *prometheus.Desc
+	pidMembytesDesc             *prometheus.Desc
+	pidReadBytesDesc            *prometheus.Desc
+	pidWriteBytesDesc           *prometheus.Desc
+	pidOpenFDsDesc              *prometheus.Desc
+	pidNumThreadsDesc           *prometheus.Desc
+	pidStartTimeDesc            *prometheus.Desc
+)
+
+// initDescs creates the metric descriptors.  All metric names start with
+// namespace, and those of the group metrics continue with subsystem.
+func initDescs(namespace, subsystem string) {
+	createdCounters = make(map[string]bool)
+
 	numprocsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_num_procs",
+		prometheus.BuildFQName(namespace, subsystem, "num_procs"),
 		"number of processes in this group",
 		[]string{"groupname"},
 		nil)
 
-	cpuUserSecsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_cpu_user_seconds_total",
-		"Cpu user usage in seconds",
+	numChildProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "num_child_procs"),
+		"number of processes in this group because their parent is, rather than matching themselves",
 		[]string{"groupname"},
 		nil)
 
-	cpuSystemSecsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_cpu_system_seconds_total",
+	procStartsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "process_start_total"),
+		"number of processes that joined this group, not counting those running when the exporter started",
+		[]string{"groupname"})
+
+	cpuUserSecsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "cpu_user_seconds_total"),
+		"Cpu user usage in seconds",
+		[]string{"groupname"})
+
+	cpuSystemSecsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "cpu_system_seconds_total"),
 		"Cpu system usage in seconds",
+		[]string{"groupname"})
+
+	cpuSchedSecsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "cpu_sched_seconds_total"),
+		"Cpu user and system usage in seconds, by the scheduling class of the processes",
+		[]string{"groupname", "schedclass"})
+
+	netRxBytesDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "net_rx_bytes_total"),
+		"number of bytes received on the network namespaces attributed to this group, excluding loopback",
+		[]string{"groupname"})
+
+	netTxBytesDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "net_tx_bytes_total"),
+		"number of bytes transmitted on the network namespaces attributed to this group, excluding loopback",
+		[]string{"groupname"})
+
+	delaySecsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "delay_seconds_total"),
+		"seconds this group spent waiting for a resource, from delay accounting",
+		[]string{"groupname", "resource"})
+
+	readBytesDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "read_bytes_total"),
+		"number of bytes read by this group",
+		[]string{"groupname"})
+
+	writeBytesDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "write_bytes_total"),
+		"number of bytes written by this group",
+		[]string{"groupname"})
+
+	cancelledWriteBytesDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "cancelled_write_bytes_total"),
+		"number of bytes written by this group that never reached storage because the pages were truncated first",
+		[]string{"groupname"})
+
+	readCharsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "read_chars_total"),
+		"number of bytes read by this group using read syscalls and the like, including from the page cache",
+		[]string{"groupname"})
+
+	writeCharsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "write_chars_total"),
+		"number of bytes written by this group using write syscalls and the like",
+		[]string{"groupname"})
+
+	readSyscallsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "read_syscalls_total"),
+		"number of read syscalls and the like made by this group",
+		[]string{"groupname"})
+
+	writeSyscallsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "write_syscalls_total"),
+		"number of write syscalls and the like made by this group",
+		[]string{"groupname"})
+
+	majorPageFaultsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "major_page_faults_total"),
+		"Major page faults",
+		[]string{"groupname"})
+
+	minorPageFaultsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "minor_page_faults_total"),
+		"Minor page faults",
+		[]string{"groupname"})
+
+	contextSwitchesDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "context_switches_total"),
+		"Context switches",
+		[]string{"groupname", "ctxswitchtype"})
+
+	cpuMigrationsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "cpu_migrations_total"),
+		"Number of times threads in this group migrated between CPUs",
+		[]string{"groupname"})
+
+	schedWaitSecsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "sched_wait_seconds_total"),
+		"seconds threads in this group spent runnable but waiting for a CPU",
+		[]string{"groupname"})
+
+	lifetimeSecsDesc = newGroupCounterDesc(
+		prometheus.BuildFQName(namespace, subsystem, "lifetime_seconds_total"),
+		"process-seconds lived by the procs of this group, i.e. wall-clock time summed over procs",
+		[]string{"groupname"})
+
+	membytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "memory_bytes"),
+		"number of bytes of memory in use",
+		[]string{"groupname", "memtype"},
+		nil)
+
+	openFDsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "open_filedesc"),
+		"number of open file descriptors for this group",
 		[]string{"groupname"},
 		nil)
 
-	readBytesDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_read_bytes_total",
-		"number of bytes read by this group",
+	openFDTypesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "open_filedesc_by_type"),
+		"number of open file descriptors for this group, by what they refer to",
+		[]string{"groupname", "type"},
+		nil)
+
+	inotifyInstancesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "inotify_instances"),
+		"number of inotify instances open in this group",
 		[]string{"groupname"},
 		nil)
 
-	writeBytesDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_write_bytes_total",
-		"number of bytes written by this group",
+	inotifyWatchesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "inotify_watches"),
+		"number of inotify watches held by this group",
 		[]string{"groupname"},
 		nil)
 
-	majorPageFaultsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_major_page_faults_total",
-		"Major page faults",
+	worstFDRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "worst_fd_ratio"),
+		"the worst (closest to 1) ratio between open fds and max fds among all procs in this group",
 		[]string{"groupname"},
 		nil)
 
-	minorPageFaultsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_minor_page_faults_total",
-		"Minor page faults",
+	worstFDProcDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "worst_fd_proc_open_filedesc"),
+		"number of open fds of the proc in this group with the worst ratio between open fds and max fds",
+		[]string{"groupname", "pid", "name"},
+		nil)
+
+	openFDLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "open_filedesc_limit"),
+		"the lowest soft limit on open fds among all procs in this group",
 		[]string{"groupname"},
 		nil)
 
-	contextSwitchesDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_context_switches_total",
-		"Context switches",
-		[]string{"groupname", "ctxswitchtype"},
+	openFDHardLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "open_filedesc_hard_limit"),
+		"the lowest hard limit on open fds among all procs in this group",
+		[]string{"groupname"},
 		nil)
 
-	membytesDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_memory_bytes",
-		"number of bytes of memory in use",
-		[]string{"groupname", "memtype"},
+	podInfoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "pod_info"),
+		"a Kubernetes pod container in which procs of this group run, always 1",
+		[]string{"groupname", "namespace", "pod", "uid", "container"},
 		nil)
 
-	openFDsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_open_filedesc",
-		"number of open file descriptors for this group",
+	worstNiceDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "worst_nice"),
+		"the highest nice value among all procs in this group, i.e. that of the least favourably scheduled",
 		[]string{"groupname"},
 		nil)
 
-	worstFDRatioDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_worst_fd_ratio",
-		"the worst (closest to 1) ratio between open fds and max fds among all procs in this group",
+	bestNiceDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "best_nice"),
+		"the lowest nice value among all procs in this group, i.e. that of the most favourably scheduled",
+		[]string{"groupname"},
+		nil)
+
+	worstPriorityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "worst_priority"),
+		"the highest scheduling priority value among all procs in this group, i.e. that of the least favourably scheduled",
+		[]string{"groupname"},
+		nil)
+
+	bestPriorityDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "best_priority"),
+		"the lowest scheduling priority value among all procs in this group, negative if any has a realtime policy",
+		[]string{"groupname"},
+		nil)
+
+	worstOOMScoreDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "worst_oom_score"),
+		"the highest oom_score among all procs in this group, i.e. that of the proc the OOM killer would pick first",
+		[]string{"groupname"},
+		nil)
+
+	oomScoreAdjDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "oom_score_adj"),
+		"the oom_score_adj of the proc in this group with the highest oom_score",
+		[]string{"groupname"},
+		nil)
+
+	trackedSecsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "tracked_seconds"),
+		"Seconds since this group was first seen; divide cpu_seconds_total by this for average utilization",
 		[]string{"groupname"},
 		nil)
 
 	startTimeDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_oldest_start_time_seconds",
+		prometheus.BuildFQName(namespace, subsystem, "oldest_start_time_seconds"),
 		"start time in seconds since 1970/01/01 of oldest process in group",
 		[]string{"groupname"},
 		nil)
 
 	numThreadsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_num_threads",
+		prometheus.BuildFQName(namespace, subsystem, "num_threads"),
 		"Number of threads",
 		[]string{"groupname"},
 		nil)
 
 	statesDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_states",
+		prometheus.BuildFQName(namespace, subsystem, "states"),
 		"Number of processes in states Running, Sleeping, Waiting, Zombie, or Other",
 		[]string{"groupname", "state"},
 		nil)
 
+	userProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "user_procs"),
+		"number of processes in this group owned by each effective user",
+		[]string{"groupname", "uid", "username"},
+		nil)
+
+	threadStatesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "thread_states"),
+		"Number of threads in states Running, Sleeping, Waiting, Zombie, or Other",
+		[]string{"groupname", "state"},
+		nil)
+
 	scrapeErrorsDesc = prometheus.NewDesc(
-		"namedprocess_scrape_errors",
+		prometheus.BuildFQName(namespace, "scrape", "errors"),
 		"general scrape errors: no proc metrics collected during a cycle",
 		nil,
 		nil)
 
+	scrapeProcFSUnavailableDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "procfs_unavailable"),
+		"incremented each time a scrape fails because procfs can't be read at all",
+		nil,
+		nil)
+
 	scrapeProcReadErrorsDesc = prometheus.NewDesc(
-		"namedprocess_scrape_procread_errors",
+		prometheus.BuildFQName(namespace, "scrape", "procread_errors"),
 		"incremented each time a proc's metrics collection fails",
 		nil,
 		nil)
 
 	scrapePartialErrorsDesc = prometheus.NewDesc(
-		"namedprocess_scrape_partial_errors",
+		prometheus.BuildFQName(namespace, "scrape", "partial_errors"),
 		"incremented each time a tracked proc's metrics collection fails partially, e.g. unreadable I/O stats",
 		nil,
 		nil)
 
+	scrapeDurationDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "duration_seconds"),
+		"time taken by the last scrape to read procs and aggregate them into groups",
+		nil,
+		nil)
+
+	scrapeProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "procs"),
+		"number of procs read by the last scrape",
+		nil,
+		nil)
+
+	scrapeProcErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "proc_errors_total"),
+		"procs that couldn't be read, by what failed and why, including those that exited while being read",
+		[]string{"stage", "reason"},
+		nil)
+
+	permissionDegradedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "permission_degraded"),
+		"1 if some procs' metric family couldn't be read for lack of privileges during the last scrape, making metrics derived from it incomplete, else 0",
+		[]string{"metric"},
+		nil)
+
+	scrapeDetailSkippedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "scrape", "detail_skipped"),
+		"incremented each time a proc's more expensive metrics aren't read due to -detail-deadline or -sample-size",
+		nil,
+		nil)
+
 	threadWchanDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_threads_wchan",
+		prometheus.BuildFQName(namespace, subsystem, "threads_wchan"),
 		"Number of threads in this group waiting on each wchan",
 		[]string{"groupname", "wchan"},
 		nil)
 
 	threadCountDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_thread_count",
+		prometheus.BuildFQName(namespace, subsystem, "thread_count"),
 		"Number of threads in this group with same threadname",
 		[]string{"groupname", "threadname"},
 		nil)
 
 	threadCpuSecsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_thread_cpu_seconds_total",
+		prometheus.BuildFQName(namespace, subsystem, "thread_cpu_seconds_total"),
 		"Cpu user/system usage in seconds",
 		[]string{"groupname", "threadname", "cpumode"},
 		nil)
 
 	threadIoBytesDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_thread_io_bytes_total",
+		prometheus.BuildFQName(namespace, subsystem, "thread_io_bytes_total"),
 		"number of bytes read/written by these threads",
 		[]string{"groupname", "threadname", "iomode"},
 		nil)
 
 	threadMajorPageFaultsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_thread_major_page_faults_total",
+		prometheus.BuildFQName(namespace, subsystem, "thread_major_page_faults_total"),
 		"Major page faults for these threads",
 		[]string{"groupname", "threadname"},
 		nil)
 
 	threadMinorPageFaultsDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_thread_minor_page_faults_total",
+		prometheus.BuildFQName(namespace, subsystem, "thread_minor_page_faults_total"),
 		"Minor page faults for these threads",
 		[]string{"groupname", "threadname"},
 		nil)
 
 	threadContextSwitchesDesc = prometheus.NewDesc(
-		"namedprocess_namegroup_thread_context_switches_total",
+		prometheus.BuildFQName(namespace, subsystem, "thread_context_switches_total"),
 		"Context switches for these threads",
 		[]string{"groupname", "threadname", "ctxswitchtype"},
 		nil)
-)
+
+	coredumpProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "coredump_enabled_procs"),
+		"Number of processes in this group with a nonzero soft limit on core file size",
+		[]string{"groupname"},
+		nil)
+
+	tracedProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "traced_procs"),
+		"Number of processes in this group being traced, e.g. by a debugger",
+		[]string{"groupname"},
+		nil)
+
+	setuidProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "setuid_procs"),
+		"Number of processes in this group running a setuid or setgid executable",
+		[]string{"groupname"},
+		nil)
+
+	chrootedProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "chrooted_procs"),
+		"Number of processes in this group whose root directory isn't /",
+		[]string{"groupname"},
+		nil)
+
+	frozenProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "frozen_procs"),
+		"Number of processes in this group whose cgroup is frozen",
+		[]string{"groupname"},
+		nil)
+
+	pressureDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "pressure_some_avg10"),
+		"Worst percentage of the last 10s some task was stalled on a resource, among this group's cgroups",
+		[]string{"groupname", "resource"},
+		nil)
+
+	cgroupMembytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "cgroup_memory_bytes"),
+		"number of bytes of file memory in this group's cgroups that is dirty or under writeback",
+		[]string{"groupname", "memtype"},
+		nil)
+
+	memoryLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "memory_limit_bytes"),
+		"lowest memory limit among this group's cgroups",
+		[]string{"groupname"},
+		nil)
+
+	memoryGrowthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "resident_memory_growth_bytes_per_second"),
+		"Trend of this group's resident memory over the last -leak-window scrapes",
+		[]string{"groupname"},
+		nil)
+
+	leakSuspectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "leak_suspected"),
+		"1 if this group's resident memory is growing faster than -leak-threshold, else 0",
+		[]string{"groupname"},
+		nil)
+
+	memberMembytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "member_memory_bytes"),
+		"min, max or average over this group's processes of their memory usage",
+		[]string{"groupname", "memtype", "agg"},
+		nil)
+
+	memberCPURateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "member_cpu_seconds_per_second"),
+		"min, max or average over this group's processes of their CPU usage rate during the last scrape interval",
+		[]string{"groupname", "agg"},
+		nil)
+
+	memberIORateDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "member_io_bytes_per_second"),
+		"min, max or average over this group's processes of their I/O rate during the last scrape interval",
+		[]string{"groupname", "iotype", "agg"},
+		nil)
+
+	cpuRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "cpu_ratio"),
+		"user plus system CPU seconds used per second by this group during the last scrape interval",
+		[]string{"groupname"},
+		nil)
+
+	hungProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "hung_procs"),
+		"Number of processes in this group that made no progress for -hung-cycles scrapes",
+		[]string{"groupname"},
+		nil)
+
+	finalDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "final"),
+		"1 if all processes in this group have exited and it will soon stop being reported, else 0",
+		[]string{"groupname"},
+		nil)
+
+	procsExceedingMaxAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "procs_exceeding_max_age"),
+		"Number of processes in this group running for longer than the group's configured max age",
+		[]string{"groupname"},
+		nil)
+
+	procAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "proc_age_seconds"),
+		"Histogram of the ages of the processes in this group",
+		[]string{"groupname"},
+		nil)
+
+	vszBloatProcsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "vsz_bloat_procs"),
+		"Number of processes in this group whose virtual memory exceeds -vsz-bloat-ratio times their resident memory",
+		[]string{"groupname"},
+		nil)
+
+	pidCpuSecsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pid", "cpu_seconds_total"),
+		"Cpu usage in seconds of this process",
+		[]string{"groupname", "pid", "name", "mode"},
+		nil)
+
+	pidMembytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pid", "memory_bytes"),
+		"number of bytes of memory in use by this process",
+		[]string{"groupname", "pid", "name", "memtype"},
+		nil)
+
+	pidReadBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pid", "read_bytes_total"),
+		"number of bytes read by this process",
+		[]string{"groupname", "pid", "name"},
+		nil)
+
+	pidWriteBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pid", "write_bytes_total"),
+		"number of bytes written by this process",
+		[]string{"groupname", "pid", "name"},
+		nil)
+
+	pidOpenFDsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pid", "open_filedesc"),
+		"number of open file descriptors for this process",
+		[]string{"groupname", "pid", "name"},
+		nil)
+
+	pidNumThreadsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pid", "num_threads"),
+		"Number of threads of this process",
+		[]string{"groupname", "pid", "name"},
+		nil)
+
+	pidStartTimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "pid", "start_time_seconds"),
+		"start time in seconds since 1970/01/01 of this process",
+		[]string{"groupname", "pid", "name"},
+		nil)
+}
 
 type (
 	prefixRegex struct {
@@ -277,39 +730,261 @@ func (nmr *nameMapperRegex) MatchAndName(nacl common.ProcAttributes) (bool, stri
 	return false, ""
 }
 
+// parseAgeBuckets returns the histogram buckets given as the -age-buckets
+// argument.
+func parseAgeBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, tok := range strings.Split(s, ",") {
+		bucket, err := strconv.ParseFloat(tok, 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be in increasing order")
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets, nil
+}
+
+// parsePidNamespace returns the pid namespace inode given as the -pidns
+// argument.
+func parsePidNamespace(procfsPath, s string) (uint64, error) {
+	if s != "host" {
+		return strconv.ParseUint(s, 10, 64)
+	}
+	fs, err := proc.NewFS(procfsPath, false)
+	if err != nil {
+		return 0, err
+	}
+	return fs.PidNamespace(1)
+}
+
+// printClassified writes a line to w for each proc read from procfsPath,
+// giving its pid, the group it would be tracked in or "unmatched", and its
+// command line, or its name if the command line is empty.
+func printClassified(w io.Writer, procfsPath string, n common.MatchNamer, children, gatherEnviron, gatherListenPorts, debug bool, opts proc.Options) error {
+	fs, err := proc.NewFS(procfsPath, debug)
+	if err != nil {
+		return err
+	}
+	fs.GatherEnviron = gatherEnviron
+	fs.GatherListenPorts = gatherListenPorts
+	classified, err := proc.Classify(fs.AllProcs(), n, children, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range classified {
+		group := c.GroupName
+		if group == "" {
+			group = "unmatched"
+		}
+		cmd := strings.Join(c.Cmdline, " ")
+		if cmd == "" {
+			cmd = "[" + c.Name + "]"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\n", c.Pid, group, cmd)
+	}
+	return nil
+}
+
+// reloadConfig rereads the config file at path and makes pc use its
+// matchers.  If the file can't be read, or would need settings that can
+// only be applied at startup, the error is returned and pc is unchanged.
+func reloadConfig(pc *NamedProcessCollector, path string, exeInode, perProcess, gatherEnviron, gatherListenPorts, debug bool) error {
+	cfg, err := config.ReadFile(path, debug)
+	if err != nil {
+		return err
+	}
+	if cfg.NeedsEnviron() && !gatherEnviron {
+		return fmt.Errorf("matching on the environment requires a restart")
+	}
+	if cfg.NeedsListenPorts() && !gatherListenPorts {
+		return fmt.Errorf("matching on listening ports requires a restart")
+	}
+	if !sameMaxAges(cfg.MaxAges, pc.opts.MaxAges) {
+		return fmt.Errorf("changing max_ages requires a restart")
+	}
+	if perProcess && !sameGroups(cfg.PerProcess, pc.copts.PerProcess) {
+		return fmt.Errorf("changing per_process requires a restart")
+	}
+
+	var matchnamer common.MatchNamer = cfg.MatchNamers
+	if exeInode {
+		matchnamer = config.NewExeInodeNamer(matchnamer)
+	}
+	pc.SetNamer(matchnamer)
+	if debug {
+		log.Printf("using config matchnamer: %v", cfg.MatchNamers)
+	}
+	return nil
+}
+
+// sameMaxAges reports whether a and b give the same groups the same max ages.
+func sameMaxAges(a, b map[string]time.Duration) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for gname, age := range a {
+		if bage, ok := b[gname]; !ok || bage != age {
+			return false
+		}
+	}
+	return true
+}
+
+// sameGroups reports whether a and b hold the same groups.
+func sameGroups(a, b map[string]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for gname, v := range a {
+		if b[gname] != v {
+			return false
+		}
+	}
+	return true
+}
+
 func main() {
 	var (
 		listenAddress = flag.String("web.listen-address", ":9256",
 			"Address on which to expose metrics and web interface.")
 		metricsPath = flag.String("web.telemetry-path", "/metrics",
 			"Path under which to expose metrics.")
+		openMetrics = flag.Bool("web.enable-openmetrics", false,
+			"serve the OpenMetrics format to scrapers that ask for it")
+		namespace = flag.String("metrics.namespace", "namedprocess",
+			"prefix of all metric names")
+		subsystem = flag.String("metrics.subsystem", "namegroup",
+			"prefix of the group metric names, following the namespace")
 		onceToStdoutDelay = flag.Duration("once-to-stdout-delay", 0,
 			"Don't bind, just wait this much time, print the metrics once to stdout, and exit")
 		procNames = flag.String("procnames", "",
 			"comma-seperated list of process names to monitor")
 		procfsPath = flag.String("procfs", "/proc",
 			"path to read proc data from")
+		cgroupfsPath = flag.String("cgroupfs", "",
+			"path to the cgroup v2 hierarchy, enables per-group cgroup metrics if set")
+		cgroupMemory = flag.Bool("cgroup-memory", false,
+			"for procs alone in their cgroup, report the cgroup's memory.current as resident memory; requires -cgroupfs")
+		dockerSocket = flag.String("docker-socket", "",
+			"path to the Docker API socket, e.g. /var/run/docker.sock, used to resolve container ids to names for matching")
+		kubeletURL = flag.String("kubelet.url", "",
+			"URL of the kubelet's read-only API, e.g. http://localhost:10255, used to resolve the pods procs run in and report pod_info")
 		nameMapping = flag.String("namemapping", "",
 			"comma-seperated list, alternating process name and capturing regex to apply to cmdline")
 		children = flag.Bool("children", true,
 			"if a proc is tracked, track with it any children that aren't part of their own group")
 		man = flag.Bool("man", false,
 			"print manual")
+		dryRun = flag.Bool("dry-run", false,
+			"don't bind, just print the group each current process would be put in, and exit")
 		configPath = flag.String("config.path", "",
 			"path to YAML config file")
+		checkConfig = flag.Bool("check-config", false,
+			"don't bind, just validate the file given by -config.path, print any problems found, and exit")
 		recheck = flag.Bool("recheck", false,
 			"recheck process names on each scrape")
+		untrackedGroup = flag.String("untracked-group", "",
+			"if set, report the usage of everything not in a group as a synthetic group of this name")
+		warmup = flag.Duration("warmup", 0,
+			"don't report a group until it has existed for this long")
+		pidNamespace = flag.String("pidns", "",
+			"only track procs in this pid namespace: an inode number, or 'host' for that of pid 1")
+		linger = flag.Duration("linger", 0,
+			"if set, stop reporting a group this long after its last process exits")
+		lingerCycles = flag.Int("linger-cycles", 0,
+			"if set, stop reporting a group after this many scrapes without processes")
+		staleCycles = flag.Int("stale-cycles", 0,
+			"keep reporting a process missed by up to this many consecutive scrapes, e.g. because reading it failed")
+		leakWindow = flag.Int("leak-window", 0,
+			"if set, fit a trend to each group's resident memory over this many scrapes")
+		leakThreshold = flag.Float64("leak-threshold", 1<<20,
+			"resident memory growth in bytes per second above which a leak is suspected, see -leak-window")
+		workers = flag.Int("workers", runtime.NumCPU(),
+			"number of goroutines reading procs concurrently on each scrape")
+		ioUring = flag.Bool("io-uring", false,
+			"read the files every proc needs on each scrape many at a time through io_uring, falling back to the usual reads if it's unavailable")
+		sampleSize = flag.Int("sample-size", 0,
+			"if set, only read expensive metrics like fd counts for this many procs per group, and extrapolate")
+		hungCycles = flag.Int("hung-cycles", 0,
+			"if set, count procs that used no CPU and did no I/O while runnable or blocked for this many scrapes as hung")
+		detailDeadline = flag.Duration("detail-deadline", 0,
+			"if a scrape has spent this long reading procs, skip expensive reads like fd counts for the rest")
+		threadStates = flag.Bool("thread-states", false,
+			"report the states of all threads in each group, not just of the processes")
+		userProcs = flag.Bool("user-procs", false,
+			"report the number of processes in each group owned by each effective user")
+		ageHistogram = flag.Bool("age-histogram", false,
+			"report a histogram of the ages of the processes in each group")
+		ageBuckets = flag.String("age-buckets", "",
+			"comma-separated histogram buckets in seconds for -age-histogram, default ranges from a second to a week")
+		vszBloatRatio = flag.Float64("vsz-bloat-ratio", 0,
+			"if set, count procs whose virtual memory is more than this many times their resident memory")
+		gatherSMaps = flag.Bool("gather-smaps", false,
+			"read /proc/[pid]/smaps_rollup for memory metrics like PSS; this is expensive")
+		gatherFDTypes = flag.Bool("gather-fd-types", false,
+			"classify open fds as files, sockets, pipes etc. by reading every /proc/[pid]/fd symlink")
+		gatherNetDev = flag.Bool("gather-netdev", false,
+			"read /proc/[pid]/net/dev once per network namespace to report the network traffic of each group")
+		gatherDelays = flag.Bool("gather-delays", false,
+			"query taskstats over netlink for the time each group spent waiting for CPU, block I/O and swap-in; needs CAP_NET_ADMIN")
+		gatherMigrations = flag.Bool("gather-migrations", false,
+			"read /proc/[pid]/task/[tid]/sched to report how often each group's threads migrated between CPUs")
+		gatherSchedWait = flag.Bool("gather-sched-wait", false,
+			"read /proc/[pid]/task/[tid]/schedstat to report how long each group's threads waited for a CPU")
+		gatherThreadIO = flag.Bool("gather-thread-io", false,
+			"read /proc/[pid]/task/[tid]/io to report the I/O of each group's threads by thread name")
+		gatherInotify = flag.Bool("gather-inotify", false,
+			"count the inotify instances and watches of each group by reading /proc/[pid]/fdinfo for every inotify fd")
+		permissionDegraded = flag.Bool("permission-degraded", false,
+			"log once and report via permission_degraded each metric family that some processes' files couldn't be read for, for lack of privileges")
+		counterWrap = flag.Bool("counter-wrap", false,
+			"treat counters that go backwards from near their maximum value as having wrapped rather than reset")
+		memberAggregates = flag.Bool("member-aggregates", false,
+			"also report the min, max and average over each group's processes of their memory usage and CPU and I/O rates")
+		cpuRatio = flag.Bool("cpu-ratio", false,
+			"also report each group's CPU usage over the last scrape interval as a gauge")
+		excludeSelf = flag.Bool("exclude-self", false,
+			"never track this exporter or any processes it spawns")
+		perProcess = flag.Bool("per-process", false,
+			"also report each process individually, for the groups listed under per_process in the config file")
+		exeInode = flag.Bool("exeinode", false,
+			"merge matched procs running the same executable file into a group named after its path")
+		defaultGroup = flag.String("default-group", "",
+			"if set, put procs that aren't matched into a group of this name")
 		debug = flag.Bool("debug", false,
 			"log debugging information to stdout")
 	)
 	flag.Parse()
+	initDescs(*namespace, *subsystem)
 
 	if *man {
 		printManual()
 		return
 	}
 
-	var matchnamer common.MatchNamer
+	if *checkConfig {
+		if *configPath == "" {
+			log.Fatalf("-check-config requires -config.path")
+		}
+		if _, err := config.ReadFile(*configPath, *debug); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", *configPath, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: config OK\n", *configPath)
+		return
+	}
+
+	var (
+		matchnamer    common.MatchNamer
+		maxAges       map[string]time.Duration
+		perProcGroups map[string]bool
+		gatherEnviron bool
+		gatherListens bool
+	)
 
 	if *configPath != "" {
 		if *nameMapping != "" || *procNames != "" {
@@ -322,10 +997,19 @@ func main() {
 		}
 		log.Printf("Reading metrics from %s based on %q", *procfsPath, *configPath)
 		matchnamer = cfg.MatchNamers
+		maxAges = cfg.MaxAges
+		if *perProcess {
+			perProcGroups = cfg.PerProcess
+		}
+		gatherEnviron = cfg.NeedsEnviron()
+		gatherListens = cfg.NeedsListenPorts()
 		if *debug {
 			log.Printf("using config matchnamer: %v", cfg.MatchNamers)
 		}
 	} else {
+		if *perProcess {
+			log.Fatalf("-per-process requires -config.path")
+		}
 		namemapper, err := parseNameMapper(*nameMapping)
 		if err != nil {
 			log.Fatalf("Error parsing -namemapping argument '%s': %v", *nameMapping, err)
@@ -348,13 +1032,114 @@ func main() {
 		matchnamer = namemapper
 	}
 
-	pc, err := NewProcessCollector(*procfsPath, *children, matchnamer, *recheck, *debug)
+	if *exeInode {
+		matchnamer = config.NewExeInodeNamer(matchnamer)
+	}
+
+	opts := proc.Options{
+		CgroupRoot:         *cgroupfsPath,
+		CgroupMemory:       *cgroupMemory,
+		UntrackedGroupName: *untrackedGroup,
+		DefaultGroup:       *defaultGroup,
+		Warmup:             *warmup,
+		MaxAges:            maxAges,
+		DetailDeadline:     *detailDeadline,
+		Linger:             *linger,
+		LingerCycles:       *lingerCycles,
+		StaleCycles:        *staleCycles,
+		HungCycles:         *hungCycles,
+		ThreadStates:       *threadStates,
+		UserProcs:          *userProcs,
+		CounterWrap:        *counterWrap,
+		MemberAggregates:   *memberAggregates,
+		CPURatio:           *cpuRatio,
+		VSZBloatRatio:      *vszBloatRatio,
+		SampleSize:         *sampleSize,
+		Workers:            *workers,
+		LeakWindow:         *leakWindow,
+		LeakThreshold:      *leakThreshold,
+		ExcludeSelf:        *excludeSelf,
+	}
+
+	if *dockerSocket != "" {
+		opts.ContainerNamer = proc.NewDockerNamer(*dockerSocket)
+	}
+
+	if *kubeletURL != "" {
+		opts.PodResolver = proc.NewKubeletPods(*kubeletURL, 10*time.Second)
+	}
+
+	if *ageHistogram {
+		opts.AgeBuckets = proc.DefaultAgeBuckets
+		if *ageBuckets != "" {
+			buckets, err := parseAgeBuckets(*ageBuckets)
+			if err != nil {
+				log.Fatalf("Error parsing -age-buckets argument '%s': %v", *ageBuckets, err)
+			}
+			opts.AgeBuckets = buckets
+		}
+	}
+
+	if *pidNamespace != "" {
+		pidns, err := parsePidNamespace(*procfsPath, *pidNamespace)
+		if err != nil {
+			log.Fatalf("Error parsing -pidns argument '%s': %v", *pidNamespace, err)
+		}
+		opts.PidNamespace = pidns
+	}
+
+	if *dryRun {
+		err := printClassified(os.Stdout, *procfsPath, matchnamer, *children, gatherEnviron, gatherListens, *debug, opts)
+		if err != nil {
+			log.Fatalf("Error reading procs: %v", err)
+		}
+		return
+	}
+
+	pc, err := NewProcessCollector(matchnamer, CollectorOptions{
+		ProcfsPath:         *procfsPath,
+		Children:           *children,
+		Recheck:            *recheck,
+		GatherSMaps:        *gatherSMaps,
+		GatherFDTypes:      *gatherFDTypes,
+		GatherNetDev:       *gatherNetDev,
+		GatherDelays:       *gatherDelays,
+		GatherMigrations:   *gatherMigrations,
+		GatherSchedWait:    *gatherSchedWait,
+		GatherThreadIO:     *gatherThreadIO,
+		GatherInotify:      *gatherInotify,
+		GatherEnviron:      gatherEnviron,
+		GatherListenPorts:  gatherListens,
+		IOUring:            *ioUring,
+		PermissionDegraded: *permissionDegraded,
+		PerProcess:         perProcGroups,
+		Debug:              *debug,
+		Proc:               opts,
+	})
+	if err == proc.ErrProcFSUnavailable {
+		log.Fatalf("Error initializing: unable to read procfs at %q", *procfsPath)
+	}
 	if err != nil {
 		log.Fatalf("Error initializing: %v", err)
 	}
 
 	prometheus.MustRegister(pc)
 
+	if *configPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				err := reloadConfig(pc, *configPath, *exeInode, *perProcess, gatherEnviron, gatherListens, *debug)
+				if err != nil {
+					log.Printf("error reloading config file %q, keeping the old config: %v", *configPath, err)
+				} else {
+					log.Printf("reloaded config file %q", *configPath)
+				}
+			}
+		}()
+	}
+
 	if *onceToStdoutDelay != 0 {
 		// We throw away the first result because that first collection primes the pump, and
 		// otherwise we won't see our counter metrics.  This is specific to the implementation
@@ -366,7 +1151,13 @@ func main() {
 		return
 	}
 
-	http.Handle(*metricsPath, prometheus.Handler())
+	if *openMetrics {
+		http.Handle(*metricsPath, prometheus.InstrumentHandler("prometheus",
+			openMetricsHandler(prometheus.DefaultGatherer, pc.createdTimes, prometheus.UninstrumentedHandler())))
+	} else {
+		http.Handle(*metricsPath, prometheus.Handler())
+	}
+	http.HandleFunc("/groups.json", pc.ServeGroups)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -374,6 +1165,7 @@ func main() {
 			<body>
 			<h1>Named Process Exporter</h1>
 			<p><a href="` + *metricsPath + `">Metrics</a></p>
+			<p><a href="/groups.json">Groups as of the last scrape (JSON)</a></p>
 			</body>
 			</html>`))
 	})
@@ -383,6 +1175,38 @@ func main() {
 }
 
 type (
+	// CollectorOptions configures a NamedProcessCollector.
+	CollectorOptions struct {
+		// ProcfsPath is where procfs is mounted.
+		ProcfsPath string
+		// Children and Recheck are passed to proc.NewGrouper.
+		Children bool
+		Recheck  bool
+		// GatherSMaps and the like set the proc.FS fields of the same
+		// names, and enable the metrics based on what they read.
+		GatherSMaps       bool
+		GatherFDTypes     bool
+		GatherNetDev      bool
+		GatherDelays      bool
+		GatherMigrations  bool
+		GatherSchedWait   bool
+		GatherThreadIO    bool
+		GatherInotify     bool
+		GatherEnviron     bool
+		GatherListenPorts bool
+		// IOUring sets proc.FS.IOUring.
+		IOUring bool
+		// PermissionDegraded enables reporting which metric families are
+		// incomplete for lack of privileges.
+		PermissionDegraded bool
+		// PerProcess names the groups whose procs are also reported
+		// individually.
+		PerProcess map[string]bool
+		Debug      bool
+		// Proc holds the options of the Grouper.
+		Proc proc.Options
+	}
+
 	scrapeRequest struct {
 		results chan<- prometheus.Metric
 		done    chan struct{}
@@ -393,39 +1217,87 @@ type (
 		*proc.Grouper
 		source               proc.Source
 		scrapeErrors         int
+		scrapeProcFSErrors   int
 		scrapeProcReadErrors int
 		scrapePartialErrors  int
-		debug                bool
+		scrapeDetailSkipped  int
+		scrapeFailures       proc.ReadFailures
+		// opts is copts.Proc, completed with the System source.
+		opts  proc.Options
+		copts CollectorOptions
+		// degradedFamilies are the metric families whose permission
+		// problems are reported, nil unless that's enabled.  warnedDegraded
+		// records those which have been logged, so each is logged once.
+		degradedFamilies []string
+		warnedDegraded   map[string]bool
+		// lastTime, lastErrs and lastGroups describe the latest successful
+		// scrape.  They're guarded by lastMu since they're also read by
+		// ServeGroups.
+		lastMu     sync.Mutex
+		lastTime   time.Time
+		lastErrs   proc.CollectErrors
+		lastGroups proc.GroupByName
+	}
+
+	// groupsSnapshot is what ServeGroups reports.  Groups maps each group
+	// name to its flattened metrics, see proc.Group.Values.
+	groupsSnapshot struct {
+		Time   time.Time
+		Errors proc.CollectErrors
+		Groups json.RawMessage
 	}
 )
 
-func NewProcessCollector(
-	procfsPath string,
-	children bool,
-	n common.MatchNamer,
-	recheck bool,
-	debug bool,
-) (*NamedProcessCollector, error) {
-	fs, err := proc.NewFS(procfsPath, debug)
+func NewProcessCollector(n common.MatchNamer, copts CollectorOptions) (*NamedProcessCollector, error) {
+	fs, err := proc.NewFS(copts.ProcfsPath, copts.Debug)
 	if err != nil {
 		return nil, err
 	}
+	fs.GatherSMaps = copts.GatherSMaps
+	fs.GatherFDTypes = copts.GatherFDTypes
+	fs.GatherNetDev = copts.GatherNetDev
+	fs.GatherDelays = copts.GatherDelays
+	fs.GatherMigrations = copts.GatherMigrations
+	fs.GatherSchedWait = copts.GatherSchedWait
+	fs.GatherThreadIO = copts.GatherThreadIO
+	fs.GatherInotify = copts.GatherInotify
+	fs.GatherEnviron = copts.GatherEnviron
+	fs.GatherListenPorts = copts.GatherListenPorts
+	fs.IOUring = copts.IOUring
+	opts := copts.Proc
+	opts.System = fs
 	p := &NamedProcessCollector{
 		scrapeChan: make(chan scrapeRequest),
-		Grouper:    proc.NewGrouper(n, children, recheck, debug),
+		Grouper:    proc.NewGrouper(n, copts.Children, copts.Recheck, copts.Debug, opts),
+		opts:       opts,
+		copts:      copts,
 		source:     fs,
-		debug:      debug,
+	}
+	if copts.PermissionDegraded {
+		p.degradedFamilies = []string{"io", "fd"}
+		if copts.GatherSMaps {
+			p.degradedFamilies = append(p.degradedFamilies, "smaps")
+		}
+		if copts.GatherEnviron {
+			p.degradedFamilies = append(p.degradedFamilies, "environ")
+		}
+		if copts.GatherInotify {
+			p.degradedFamilies = append(p.degradedFamilies, "inotify")
+		}
+		p.warnedDegraded = make(map[string]bool)
 	}
 
 	colErrs, _, err := p.Update(p.source.AllProcs())
 	if err != nil {
-		if debug {
+		if copts.Debug {
 			log.Print(err)
 		}
 		return nil, err
 	}
 	p.scrapePartialErrors += colErrs.Partial
 	p.scrapeProcReadErrors += colErrs.Read
+	p.scrapeDetailSkipped += colErrs.DetailSkipped
+	p.scrapeFailures.Add(colErrs.Failures)
 
 	go p.start()
 
@@ -436,28 +1308,132 @@ func NewProcessCollector(
 func (p *NamedProcessCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- cpuUserSecsDesc
 	ch <- cpuSystemSecsDesc
+	ch <- cpuSchedSecsDesc
 	ch <- numprocsDesc
+	ch <- numChildProcsDesc
+	ch <- procStartsDesc
 	ch <- readBytesDesc
 	ch <- writeBytesDesc
+	ch <- cancelledWriteBytesDesc
+	ch <- readCharsDesc
+	ch <- writeCharsDesc
+	ch <- readSyscallsDesc
+	ch <- writeSyscallsDesc
 	ch <- membytesDesc
 	ch <- openFDsDesc
 	ch <- worstFDRatioDesc
+	ch <- worstFDProcDesc
+	ch <- openFDLimitDesc
+	ch <- openFDHardLimitDesc
+	if p.opts.PodResolver != nil {
+		ch <- podInfoDesc
+	}
+	ch <- worstNiceDesc
+	ch <- bestNiceDesc
+	ch <- worstPriorityDesc
+	ch <- bestPriorityDesc
+	ch <- worstOOMScoreDesc
+	ch <- oomScoreAdjDesc
 	ch <- startTimeDesc
+	ch <- trackedSecsDesc
 	ch <- majorPageFaultsDesc
 	ch <- minorPageFaultsDesc
 	ch <- contextSwitchesDesc
+	if p.copts.GatherMigrations {
+		ch <- cpuMigrationsDesc
+	}
+	if p.copts.GatherSchedWait {
+		ch <- schedWaitSecsDesc
+	}
+	ch <- lifetimeSecsDesc
 	ch <- numThreadsDesc
 	ch <- statesDesc
+	ch <- coredumpProcsDesc
+	ch <- tracedProcsDesc
+	ch <- setuidProcsDesc
+	ch <- chrootedProcsDesc
 	ch <- scrapeErrorsDesc
+	ch <- scrapeProcFSUnavailableDesc
 	ch <- scrapeProcReadErrorsDesc
 	ch <- scrapePartialErrorsDesc
+	ch <- scrapeDetailSkippedDesc
+	ch <- scrapeProcErrorsDesc
+	if len(p.degradedFamilies) > 0 {
+		ch <- permissionDegradedDesc
+	}
+	ch <- scrapeDurationDesc
+	ch <- scrapeProcsDesc
 	ch <- threadWchanDesc
 	ch <- threadCountDesc
 	ch <- threadCpuSecsDesc
-	ch <- threadIoBytesDesc
+	if p.copts.GatherThreadIO {
+		ch <- threadIoBytesDesc
+	}
 	ch <- threadMajorPageFaultsDesc
 	ch <- threadMinorPageFaultsDesc
 	ch <- threadContextSwitchesDesc
+	if p.opts.CgroupRoot != "" {
+		ch <- frozenProcsDesc
+		ch <- pressureDesc
+		ch <- cgroupMembytesDesc
+		ch <- memoryLimitDesc
+	}
+	if len(p.opts.MaxAges) > 0 {
+		ch <- procsExceedingMaxAgeDesc
+	}
+	if p.opts.Linger > 0 || p.opts.LingerCycles > 0 {
+		ch <- finalDesc
+	}
+	if p.opts.HungCycles > 0 {
+		ch <- hungProcsDesc
+	}
+	if p.opts.ThreadStates {
+		ch <- threadStatesDesc
+	}
+	if p.opts.UserProcs {
+		ch <- userProcsDesc
+	}
+	if p.copts.GatherFDTypes {
+		ch <- openFDTypesDesc
+	}
+	if p.copts.GatherInotify {
+		ch <- inotifyInstancesDesc
+		ch <- inotifyWatchesDesc
+	}
+	if p.copts.GatherNetDev {
+		ch <- netRxBytesDesc
+		ch <- netTxBytesDesc
+	}
+	if p.copts.GatherDelays {
+		ch <- delaySecsDesc
+	}
+	if p.opts.VSZBloatRatio > 0 {
+		ch <- vszBloatProcsDesc
+	}
+	if len(p.opts.AgeBuckets) > 0 {
+		ch <- procAgeDesc
+	}
+	if p.opts.LeakWindow > 0 {
+		ch <- memoryGrowthDesc
+		ch <- leakSuspectedDesc
+	}
+	if p.opts.MemberAggregates {
+		ch <- memberMembytesDesc
+		ch <- memberCPURateDesc
+		ch <- memberIORateDesc
+	}
+	if p.opts.CPURatio {
+		ch <- cpuRatioDesc
+	}
+	if len(p.copts.PerProcess) > 0 {
+		ch <- pidCpuSecsDesc
+		ch <- pidMembytesDesc
+		ch <- pidReadBytesDesc
+		ch <- pidWriteBytesDesc
+		ch <- pidOpenFDsDesc
+		ch <- pidNumThreadsDesc
+		ch <- pidStartTimeDesc
+	}
 }
 
 // Collect implements prometheus.Collector.
@@ -477,34 +1453,149 @@ func (p *NamedProcessCollector) start() {
 
 func (p *NamedProcessCollector) scrape(ch chan<- prometheus.Metric) {
 	permErrs, groups, err := p.Update(p.source.AllProcs())
+	p.scrapeProcReadErrors += permErrs.Read
 	p.scrapePartialErrors += permErrs.Partial
+	p.scrapeDetailSkipped += permErrs.DetailSkipped
+	p.scrapeFailures.Add(permErrs.Failures)
 	if err != nil {
 		p.scrapeErrors++
+		if err == proc.ErrProcFSUnavailable {
+			p.scrapeProcFSErrors++
+		}
 		log.Printf("error reading procs: %v", err)
 	} else {
+		p.lastMu.Lock()
+		p.lastTime, p.lastErrs, p.lastGroups = time.Now(), permErrs, groups
+		p.lastMu.Unlock()
 		for gname, gcounts := range groups {
 			ch <- prometheus.MustNewConstMetric(numprocsDesc,
 				prometheus.GaugeValue, float64(gcounts.Procs), gname)
+			ch <- prometheus.MustNewConstMetric(numChildProcsDesc,
+				prometheus.GaugeValue, float64(gcounts.MatchedViaParent), gname)
+			ch <- prometheus.MustNewConstMetric(procStartsDesc,
+				prometheus.CounterValue, float64(gcounts.ProcStarts), gname)
 			ch <- prometheus.MustNewConstMetric(membytesDesc,
 				prometheus.GaugeValue, float64(gcounts.Memory.ResidentBytes), gname, "resident")
 			ch <- prometheus.MustNewConstMetric(membytesDesc,
 				prometheus.GaugeValue, float64(gcounts.Memory.VirtualBytes), gname, "virtual")
 			ch <- prometheus.MustNewConstMetric(membytesDesc,
 				prometheus.GaugeValue, float64(gcounts.Memory.VmSwapBytes), gname, "swapped")
+			ch <- prometheus.MustNewConstMetric(membytesDesc,
+				prometheus.GaugeValue, float64(gcounts.Memory.LockedBytes), gname, "locked")
+			ch <- prometheus.MustNewConstMetric(membytesDesc,
+				prometheus.GaugeValue, float64(gcounts.Memory.StackBytes), gname, "stack")
+			ch <- prometheus.MustNewConstMetric(membytesDesc,
+				prometheus.GaugeValue, float64(gcounts.Memory.DataBytes), gname, "data")
+			ch <- prometheus.MustNewConstMetric(membytesDesc,
+				prometheus.GaugeValue, float64(gcounts.Memory.TextBytes), gname, "text")
+			ch <- prometheus.MustNewConstMetric(membytesDesc,
+				prometheus.GaugeValue, float64(gcounts.Memory.ResidentPeak), gname, "resident_peak")
+			ch <- prometheus.MustNewConstMetric(membytesDesc,
+				prometheus.GaugeValue, float64(gcounts.Memory.VirtualPeak), gname, "virtual_peak")
+			if p.copts.GatherSMaps {
+				ch <- prometheus.MustNewConstMetric(membytesDesc,
+					prometheus.GaugeValue, float64(gcounts.Memory.ProportionalBytes), gname, "proportional")
+				ch <- prometheus.MustNewConstMetric(membytesDesc,
+					prometheus.GaugeValue, float64(gcounts.Memory.ResidentPrivateBytes), gname, "private")
+				ch <- prometheus.MustNewConstMetric(membytesDesc,
+					prometheus.GaugeValue, float64(gcounts.Memory.ResidentSharedBytes), gname, "shared")
+			}
 			ch <- prometheus.MustNewConstMetric(startTimeDesc,
 				prometheus.GaugeValue, float64(gcounts.OldestStartTime.Unix()), gname)
+			ch <- prometheus.MustNewConstMetric(trackedSecsDesc,
+				prometheus.GaugeValue, gcounts.TrackedDurationSeconds, gname)
 			ch <- prometheus.MustNewConstMetric(openFDsDesc,
 				prometheus.GaugeValue, float64(gcounts.OpenFDs), gname)
+			if p.copts.GatherFDTypes {
+				types := gcounts.OpenFDTypes
+				ch <- prometheus.MustNewConstMetric(openFDTypesDesc,
+					prometheus.GaugeValue, float64(types.Files), gname, "file")
+				ch <- prometheus.MustNewConstMetric(openFDTypesDesc,
+					prometheus.GaugeValue, float64(types.Sockets), gname, "socket")
+				ch <- prometheus.MustNewConstMetric(openFDTypesDesc,
+					prometheus.GaugeValue, float64(types.Pipes), gname, "pipe")
+				ch <- prometheus.MustNewConstMetric(openFDTypesDesc,
+					prometheus.GaugeValue, float64(types.Eventfds), gname, "eventfd")
+				ch <- prometheus.MustNewConstMetric(openFDTypesDesc,
+					prometheus.GaugeValue, float64(types.Other), gname, "other")
+			}
+			if p.copts.GatherInotify {
+				ch <- prometheus.MustNewConstMetric(inotifyInstancesDesc,
+					prometheus.GaugeValue, float64(gcounts.Inotify.Instances), gname)
+				ch <- prometheus.MustNewConstMetric(inotifyWatchesDesc,
+					prometheus.GaugeValue, float64(gcounts.Inotify.Watches), gname)
+			}
+			if p.copts.GatherNetDev {
+				ch <- prometheus.MustNewConstMetric(netRxBytesDesc,
+					prometheus.CounterValue, float64(gcounts.NetRxBytes), gname)
+				ch <- prometheus.MustNewConstMetric(netTxBytesDesc,
+					prometheus.CounterValue, float64(gcounts.NetTxBytes), gname)
+			}
+			if p.copts.GatherDelays {
+				ch <- prometheus.MustNewConstMetric(delaySecsDesc,
+					prometheus.CounterValue, gcounts.CPUDelaySeconds, gname, "cpu")
+				ch <- prometheus.MustNewConstMetric(delaySecsDesc,
+					prometheus.CounterValue, gcounts.BlockIODelaySeconds, gname, "blkio")
+				ch <- prometheus.MustNewConstMetric(delaySecsDesc,
+					prometheus.CounterValue, gcounts.SwapInDelaySeconds, gname, "swapin")
+			}
 			ch <- prometheus.MustNewConstMetric(worstFDRatioDesc,
 				prometheus.GaugeValue, float64(gcounts.WorstFDratio), gname)
+			if gcounts.WorstFDPid != 0 {
+				ch <- prometheus.MustNewConstMetric(worstFDProcDesc,
+					prometheus.GaugeValue, float64(gcounts.WorstFDOpen), gname,
+					strconv.Itoa(gcounts.WorstFDPid), gcounts.WorstFDName)
+			}
+			if gcounts.OpenFDLimit != 0 {
+				ch <- prometheus.MustNewConstMetric(openFDLimitDesc,
+					prometheus.GaugeValue, float64(gcounts.OpenFDLimit), gname)
+			}
+			if gcounts.OpenFDHardLimit != 0 {
+				ch <- prometheus.MustNewConstMetric(openFDHardLimitDesc,
+					prometheus.GaugeValue, float64(gcounts.OpenFDHardLimit), gname)
+			}
+			for _, pod := range gcounts.Pods {
+				ch <- prometheus.MustNewConstMetric(podInfoDesc,
+					prometheus.GaugeValue, 1, gname, pod.Namespace, pod.Name, pod.UID, pod.Container)
+			}
+			if gcounts.Procs > 0 {
+				ch <- prometheus.MustNewConstMetric(worstNiceDesc,
+					prometheus.GaugeValue, float64(gcounts.MaxNice), gname)
+				ch <- prometheus.MustNewConstMetric(bestNiceDesc,
+					prometheus.GaugeValue, float64(gcounts.MinNice), gname)
+				ch <- prometheus.MustNewConstMetric(worstPriorityDesc,
+					prometheus.GaugeValue, float64(gcounts.MaxPriority), gname)
+				ch <- prometheus.MustNewConstMetric(bestPriorityDesc,
+					prometheus.GaugeValue, float64(gcounts.MinPriority), gname)
+			}
+			if gcounts.WorstOOMScore >= 0 {
+				ch <- prometheus.MustNewConstMetric(worstOOMScoreDesc,
+					prometheus.GaugeValue, float64(gcounts.WorstOOMScore), gname)
+				ch <- prometheus.MustNewConstMetric(oomScoreAdjDesc,
+					prometheus.GaugeValue, float64(gcounts.OOMScoreAdj), gname)
+			}
 			ch <- prometheus.MustNewConstMetric(cpuUserSecsDesc,
 				prometheus.CounterValue, gcounts.CPUUserTime, gname)
 			ch <- prometheus.MustNewConstMetric(cpuSystemSecsDesc,
 				prometheus.CounterValue, gcounts.CPUSystemTime, gname)
+			ch <- prometheus.MustNewConstMetric(cpuSchedSecsDesc,
+				prometheus.CounterValue, gcounts.CPURealtimeSeconds, gname, "realtime")
+			ch <- prometheus.MustNewConstMetric(cpuSchedSecsDesc,
+				prometheus.CounterValue, gcounts.CPUNormalSeconds, gname, "normal")
 			ch <- prometheus.MustNewConstMetric(readBytesDesc,
 				prometheus.CounterValue, float64(gcounts.ReadBytes), gname)
 			ch <- prometheus.MustNewConstMetric(writeBytesDesc,
 				prometheus.CounterValue, float64(gcounts.WriteBytes), gname)
+			ch <- prometheus.MustNewConstMetric(cancelledWriteBytesDesc,
+				prometheus.CounterValue, float64(gcounts.CancelledWriteBytes), gname)
+			ch <- prometheus.MustNewConstMetric(readCharsDesc,
+				prometheus.CounterValue, float64(gcounts.ReadChars), gname)
+			ch <- prometheus.MustNewConstMetric(writeCharsDesc,
+				prometheus.CounterValue, float64(gcounts.WriteChars), gname)
+			ch <- prometheus.MustNewConstMetric(readSyscallsDesc,
+				prometheus.CounterValue, float64(gcounts.ReadSyscalls), gname)
+			ch <- prometheus.MustNewConstMetric(writeSyscallsDesc,
+				prometheus.CounterValue, float64(gcounts.WriteSyscalls), gname)
 			ch <- prometheus.MustNewConstMetric(majorPageFaultsDesc,
 				prometheus.CounterValue, float64(gcounts.MajorPageFaults), gname)
 			ch <- prometheus.MustNewConstMetric(minorPageFaultsDesc,
@@ -513,6 +1604,16 @@ func (p *NamedProcessCollector) scrape(ch chan<- prometheus.Metric) {
 				prometheus.CounterValue, float64(gcounts.CtxSwitchVoluntary), gname, "voluntary")
 			ch <- prometheus.MustNewConstMetric(contextSwitchesDesc,
 				prometheus.CounterValue, float64(gcounts.CtxSwitchNonvoluntary), gname, "nonvoluntary")
+			if p.copts.GatherMigrations {
+				ch <- prometheus.MustNewConstMetric(cpuMigrationsDesc,
+					prometheus.CounterValue, float64(gcounts.CPUMigrations), gname)
+			}
+			if p.copts.GatherSchedWait {
+				ch <- prometheus.MustNewConstMetric(schedWaitSecsDesc,
+					prometheus.CounterValue, gcounts.SchedWaitSeconds, gname)
+			}
+			ch <- prometheus.MustNewConstMetric(lifetimeSecsDesc,
+				prometheus.CounterValue, gcounts.LifetimeSeconds, gname)
 			ch <- prometheus.MustNewConstMetric(numThreadsDesc,
 				prometheus.GaugeValue, float64(gcounts.NumThreads), gname)
 			ch <- prometheus.MustNewConstMetric(statesDesc,
@@ -525,6 +1626,116 @@ func (p *NamedProcessCollector) scrape(ch chan<- prometheus.Metric) {
 				prometheus.GaugeValue, float64(gcounts.States.Zombie), gname, "Zombie")
 			ch <- prometheus.MustNewConstMetric(statesDesc,
 				prometheus.GaugeValue, float64(gcounts.States.Other), gname, "Other")
+			ch <- prometheus.MustNewConstMetric(coredumpProcsDesc,
+				prometheus.GaugeValue, float64(gcounts.ProcsWithCoredumpEnabled), gname)
+			ch <- prometheus.MustNewConstMetric(tracedProcsDesc,
+				prometheus.GaugeValue, float64(gcounts.ProcsBeingTraced), gname)
+			ch <- prometheus.MustNewConstMetric(setuidProcsDesc,
+				prometheus.GaugeValue, float64(gcounts.SetuidProcs), gname)
+			ch <- prometheus.MustNewConstMetric(chrootedProcsDesc,
+				prometheus.GaugeValue, float64(gcounts.ChrootedProcs), gname)
+
+			if p.opts.CgroupRoot != "" {
+				ch <- prometheus.MustNewConstMetric(frozenProcsDesc,
+					prometheus.GaugeValue, float64(gcounts.ProcsFrozen), gname)
+				ch <- prometheus.MustNewConstMetric(cgroupMembytesDesc,
+					prometheus.GaugeValue, float64(gcounts.DirtyBytes), gname, "dirty")
+				ch <- prometheus.MustNewConstMetric(cgroupMembytesDesc,
+					prometheus.GaugeValue, float64(gcounts.WritebackBytes), gname, "writeback")
+				if gcounts.MemoryLimitBytes != 0 {
+					ch <- prometheus.MustNewConstMetric(memoryLimitDesc,
+						prometheus.GaugeValue, float64(gcounts.MemoryLimitBytes), gname)
+				}
+				if pressure := gcounts.Pressure; pressure != nil {
+					ch <- prometheus.MustNewConstMetric(pressureDesc,
+						prometheus.GaugeValue, pressure.CPU, gname, "cpu")
+					ch <- prometheus.MustNewConstMetric(pressureDesc,
+						prometheus.GaugeValue, pressure.Memory, gname, "memory")
+					ch <- prometheus.MustNewConstMetric(pressureDesc,
+						prometheus.GaugeValue, pressure.IO, gname, "io")
+				}
+			}
+
+			if p.opts.LeakWindow > 0 {
+				leak := 0.0
+				if gcounts.LeakSuspected {
+					leak = 1
+				}
+				ch <- prometheus.MustNewConstMetric(memoryGrowthDesc,
+					prometheus.GaugeValue, gcounts.ResidentGrowthRate, gname)
+				ch <- prometheus.MustNewConstMetric(leakSuspectedDesc,
+					prometheus.GaugeValue, leak, gname)
+			}
+
+			if members := gcounts.Members; members != nil {
+				for _, agg := range []struct {
+					name string
+					m    proc.MemberMetrics
+				}{{"min", members.Min}, {"max", members.Max}, {"avg", members.Avg}} {
+					ch <- prometheus.MustNewConstMetric(memberMembytesDesc,
+						prometheus.GaugeValue, agg.m.ResidentBytes, gname, "resident", agg.name)
+					ch <- prometheus.MustNewConstMetric(memberMembytesDesc,
+						prometheus.GaugeValue, agg.m.VirtualBytes, gname, "virtual", agg.name)
+					ch <- prometheus.MustNewConstMetric(memberMembytesDesc,
+						prometheus.GaugeValue, agg.m.SwapBytes, gname, "swapped", agg.name)
+					ch <- prometheus.MustNewConstMetric(memberCPURateDesc,
+						prometheus.GaugeValue, agg.m.CPURate, gname, agg.name)
+					ch <- prometheus.MustNewConstMetric(memberIORateDesc,
+						prometheus.GaugeValue, agg.m.ReadBytesRate, gname, "read", agg.name)
+					ch <- prometheus.MustNewConstMetric(memberIORateDesc,
+						prometheus.GaugeValue, agg.m.WriteBytesRate, gname, "write", agg.name)
+				}
+			}
+			if gcounts.CPURatio != nil {
+				ch <- prometheus.MustNewConstMetric(cpuRatioDesc,
+					prometheus.GaugeValue, *gcounts.CPURatio, gname)
+			}
+
+			if p.opts.HungCycles > 0 {
+				ch <- prometheus.MustNewConstMetric(hungProcsDesc,
+					prometheus.GaugeValue, float64(gcounts.HungProcs), gname)
+			}
+
+			if ages := gcounts.Ages; ages != nil {
+				ch <- prometheus.MustNewConstHistogram(procAgeDesc,
+					ages.Count, ages.Sum, ages.Buckets, gname)
+			}
+
+			if p.opts.VSZBloatRatio > 0 {
+				ch <- prometheus.MustNewConstMetric(vszBloatProcsDesc,
+					prometheus.GaugeValue, float64(gcounts.ProcsWithVSZBloat), gname)
+			}
+
+			if p.opts.ThreadStates {
+				ch <- prometheus.MustNewConstMetric(threadStatesDesc,
+					prometheus.GaugeValue, float64(gcounts.ThreadStates.Running), gname, "Running")
+				ch <- prometheus.MustNewConstMetric(threadStatesDesc,
+					prometheus.GaugeValue, float64(gcounts.ThreadStates.Sleeping), gname, "Sleeping")
+				ch <- prometheus.MustNewConstMetric(threadStatesDesc,
+					prometheus.GaugeValue, float64(gcounts.ThreadStates.Waiting), gname, "Waiting")
+				ch <- prometheus.MustNewConstMetric(threadStatesDesc,
+					prometheus.GaugeValue, float64(gcounts.ThreadStates.Zombie), gname, "Zombie")
+				ch <- prometheus.MustNewConstMetric(threadStatesDesc,
+					prometheus.GaugeValue, float64(gcounts.ThreadStates.Other), gname, "Other")
+			}
+			for user, count := range gcounts.UserProcs {
+				ch <- prometheus.MustNewConstMetric(userProcsDesc,
+					prometheus.GaugeValue, float64(count), gname, strconv.Itoa(user.UID), user.Name)
+			}
+
+			if p.opts.Linger > 0 || p.opts.LingerCycles > 0 {
+				final := 0.0
+				if gcounts.Final {
+					final = 1
+				}
+				ch <- prometheus.MustNewConstMetric(finalDesc,
+					prometheus.GaugeValue, final, gname)
+			}
+
+			if _, ok := p.opts.MaxAges[gname]; ok {
+				ch <- prometheus.MustNewConstMetric(procsExceedingMaxAgeDesc,
+					prometheus.GaugeValue, float64(gcounts.ProcsExceedingMaxAge), gname)
+			}
 
 			for wchan, count := range gcounts.Wchans {
 				ch <- prometheus.MustNewConstMetric(threadWchanDesc,
@@ -541,12 +1752,14 @@ func (p *NamedProcessCollector) scrape(ch chan<- prometheus.Metric) {
 				ch <- prometheus.MustNewConstMetric(threadCpuSecsDesc,
 					prometheus.CounterValue, float64(thr.CPUSystemTime),
 					gname, thr.Name, "system")
-				ch <- prometheus.MustNewConstMetric(threadIoBytesDesc,
-					prometheus.CounterValue, float64(thr.ReadBytes),
-					gname, thr.Name, "read")
-				ch <- prometheus.MustNewConstMetric(threadIoBytesDesc,
-					prometheus.CounterValue, float64(thr.WriteBytes),
-					gname, thr.Name, "write")
+				if p.copts.GatherThreadIO {
+					ch <- prometheus.MustNewConstMetric(threadIoBytesDesc,
+						prometheus.CounterValue, float64(thr.ReadBytes),
+						gname, thr.Name, "read")
+					ch <- prometheus.MustNewConstMetric(threadIoBytesDesc,
+						prometheus.CounterValue, float64(thr.WriteBytes),
+						gname, thr.Name, "write")
+				}
 				ch <- prometheus.MustNewConstMetric(threadMajorPageFaultsDesc,
 					prometheus.CounterValue, float64(thr.MajorPageFaults),
 					gname, thr.Name)
@@ -560,12 +1773,120 @@ func (p *NamedProcessCollector) scrape(ch chan<- prometheus.Metric) {
 					prometheus.CounterValue, float64(thr.CtxSwitchNonvoluntary),
 					gname, thr.Name, "nonvoluntary")
 			}
+
+			if p.copts.PerProcess[gname] {
+				p.scrapeProcs(ch, gname)
+			}
 		}
 	}
 	ch <- prometheus.MustNewConstMetric(scrapeErrorsDesc,
 		prometheus.CounterValue, float64(p.scrapeErrors))
+	ch <- prometheus.MustNewConstMetric(scrapeProcFSUnavailableDesc,
+		prometheus.CounterValue, float64(p.scrapeProcFSErrors))
 	ch <- prometheus.MustNewConstMetric(scrapeProcReadErrorsDesc,
 		prometheus.CounterValue, float64(p.scrapeProcReadErrors))
 	ch <- prometheus.MustNewConstMetric(scrapePartialErrorsDesc,
 		prometheus.CounterValue, float64(p.scrapePartialErrors))
+	ch <- prometheus.MustNewConstMetric(scrapeDetailSkippedDesc,
+		prometheus.CounterValue, float64(p.scrapeDetailSkipped))
+	if fs, ok := p.source.(*proc.FS); ok && len(p.degradedFamilies) > 0 {
+		denied := fs.PermissionDenied()
+		if p.copts.GatherEnviron {
+			denied["environ"] = p.EnvironUnreadable()
+		}
+		for _, family := range p.degradedFamilies {
+			degraded := 0.0
+			if denied[family] {
+				degraded = 1
+				if !p.warnedDegraded[family] {
+					p.warnedDegraded[family] = true
+					log.Printf("some processes' %s couldn't be read for lack of privileges, so metrics derived from it are incomplete", family)
+				}
+			}
+			ch <- prometheus.MustNewConstMetric(permissionDegradedDesc,
+				prometheus.GaugeValue, degraded, family)
+		}
+	}
+	for _, stage := range []struct {
+		name    string
+		reasons proc.FailureReasons
+	}{{"metrics", p.scrapeFailures.Metrics}, {"static", p.scrapeFailures.Static}} {
+		ch <- prometheus.MustNewConstMetric(scrapeProcErrorsDesc,
+			prometheus.CounterValue, float64(stage.reasons.Permission), stage.name, "permission")
+		ch <- prometheus.MustNewConstMetric(scrapeProcErrorsDesc,
+			prometheus.CounterValue, float64(stage.reasons.Vanished), stage.name, "vanished")
+		ch <- prometheus.MustNewConstMetric(scrapeProcErrorsDesc,
+			prometheus.CounterValue, float64(stage.reasons.Other), stage.name, "other")
+	}
+	stats := p.LastUpdateStats()
+	ch <- prometheus.MustNewConstMetric(scrapeDurationDesc,
+		prometheus.GaugeValue, stats.Duration.Seconds())
+	ch <- prometheus.MustNewConstMetric(scrapeProcsDesc,
+		prometheus.GaugeValue, float64(stats.Scanned))
+}
+
+// ServeGroups writes as JSON the groups reported by the latest scrape, along
+// with the errors it encountered, for debugging.  Nothing is reported until
+// the first successful scrape.
+func (p *NamedProcessCollector) ServeGroups(w http.ResponseWriter, r *http.Request) {
+	p.lastMu.Lock()
+	snap := groupsSnapshot{Time: p.lastTime, Errors: p.lastErrs}
+	groups := p.lastGroups
+	p.lastMu.Unlock()
+	if groups == nil {
+		http.Error(w, "no successful scrape yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The groups of a scrape are never modified afterwards, so they can be
+	// serialized without holding the lock.
+	var err error
+	snap.Groups, err = groups.JSON("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snap)
+}
+
+// createdTimes returns, for each group of the latest scrape, the time from
+// which its counters have been accumulating, i.e. when it was first seen.
+func (p *NamedProcessCollector) createdTimes() map[string]time.Time {
+	p.lastMu.Lock()
+	defer p.lastMu.Unlock()
+	created := make(map[string]time.Time, len(p.lastGroups))
+	for gname, group := range p.lastGroups {
+		created[gname] = p.lastTime.Add(-time.Duration(group.TrackedDurationSeconds * float64(time.Second)))
+	}
+	return created
+}
+
+// scrapeProcs emits the metrics of each of the procs in the named group.
+func (p *NamedProcessCollector) scrapeProcs(ch chan<- prometheus.Metric, gname string) {
+	for _, idinfo := range p.RawProcs(gname) {
+		pid, name := strconv.Itoa(idinfo.Pid), idinfo.Name
+		ch <- prometheus.MustNewConstMetric(pidCpuSecsDesc,
+			prometheus.CounterValue, idinfo.CPUUserTime, gname, pid, name, "user")
+		ch <- prometheus.MustNewConstMetric(pidCpuSecsDesc,
+			prometheus.CounterValue, idinfo.CPUSystemTime, gname, pid, name, "system")
+		ch <- prometheus.MustNewConstMetric(pidMembytesDesc,
+			prometheus.GaugeValue, float64(idinfo.ResidentBytes), gname, pid, name, "resident")
+		ch <- prometheus.MustNewConstMetric(pidMembytesDesc,
+			prometheus.GaugeValue, float64(idinfo.VirtualBytes), gname, pid, name, "virtual")
+		ch <- prometheus.MustNewConstMetric(pidMembytesDesc,
+			prometheus.GaugeValue, float64(idinfo.VmSwapBytes), gname, pid, name, "swapped")
+		ch <- prometheus.MustNewConstMetric(pidReadBytesDesc,
+			prometheus.CounterValue, float64(idinfo.ReadBytes), gname, pid, name)
+		ch <- prometheus.MustNewConstMetric(pidWriteBytesDesc,
+			prometheus.CounterValue, float64(idinfo.WriteBytes), gname, pid, name)
+		if idinfo.Open >= 0 {
+			ch <- prometheus.MustNewConstMetric(pidOpenFDsDesc,
+				prometheus.GaugeValue, float64(idinfo.Open), gname, pid, name)
+		}
+		ch <- prometheus.MustNewConstMetric(pidNumThreadsDesc,
+			prometheus.GaugeValue, float64(idinfo.NumThreads), gname, pid, name)
+		ch <- prometheus.MustNewConstMetric(pidStartTimeDesc,
+			prometheus.GaugeValue, float64(idinfo.StartTime.Unix()), gname, pid, name)
+	}
 }
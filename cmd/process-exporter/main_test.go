@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ncabatoff/process-exporter/proc"
+)
+
+// TestReloadConfig verifies that a reload is refused if it would change the
+// sections of the config file that only take effect on a restart.
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+
+	opts := proc.Options{MaxAges: map[string]time.Duration{"report": 2 * time.Hour}}
+	pc := &NamedProcessCollector{
+		Grouper: proc.NewGrouper(nil, false, false, false, opts),
+		opts:    opts,
+		copts:   CollectorOptions{PerProcess: map[string]bool{"postgres": true}},
+	}
+
+	for i, tc := range []struct {
+		config     string
+		perProcess bool
+		wantErr    bool
+	}{
+		{"max_ages:\n  report: 2h\nper_process:\n  - postgres\n", true, false},
+		{"max_ages:\n  report: 3h\nper_process:\n  - postgres\n", true, true},
+		{"per_process:\n  - postgres\n", true, true},
+		{"max_ages:\n  report: 2h\n", true, true},
+		{"max_ages:\n  report: 2h\n", false, false},
+	} {
+		config := "process_names:\n  - exe:\n    - postgres\n" + tc.config
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := reloadConfig(pc, path, false, tc.perProcess, false, false, false)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%d: got error %v, want error %v", i, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const openMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// createdCounters holds the names of the group counters, which accumulate
+// from when the group was first seen.  They're the only ones for which a
+// _created sample is written.
+var createdCounters map[string]bool
+
+// newGroupCounterDesc returns a Desc for a group counter, adding it to
+// createdCounters.
+func newGroupCounterDesc(fqName, help string, variableLabels []string) *prometheus.Desc {
+	createdCounters[fqName] = true
+	return prometheus.NewDesc(fqName, help, variableLabels, nil)
+}
+
+var openMetricsEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
+// openMetricsHandler serves what gatherer collects in the OpenMetrics text
+// format to clients whose Accept header asks for it, and leaves other
+// requests to fallback.  created gives, by group name, the time from which
+// the counters of each group of the latest scrape have been accumulating.
+func openMetricsHandler(gatherer prometheus.Gatherer, created func() map[string]time.Time, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		mfs, err := gatherer.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred during metrics collection:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		writeOpenMetrics(&buf, mfs, created())
+		w.Header().Set("Content-Type", openMetricsType)
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	})
+}
+
+// writeOpenMetrics writes mfs to buf in the OpenMetrics text format, adding
+// a _created sample to each of createdCounters for the groups in created.
+func writeOpenMetrics(buf *bytes.Buffer, mfs []*dto.MetricFamily, created map[string]time.Time) {
+	w := bufio.NewWriter(buf)
+	for _, mf := range mfs {
+		name, typ := mf.GetName(), "unknown"
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			name, typ = strings.TrimSuffix(name, "_total"), "counter"
+		case dto.MetricType_GAUGE:
+			typ = "gauge"
+		case dto.MetricType_SUMMARY:
+			typ = "summary"
+		case dto.MetricType_HISTOGRAM:
+			typ = "histogram"
+		}
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+		if mf.Help != nil {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, openMetricsEscaper.Replace(mf.GetHelp()))
+		}
+
+		for _, m := range mf.Metric {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				writeSample(w, name+"_total", m.Label, "", "", m.Counter.GetValue())
+				if createdCounters[mf.GetName()] {
+					if t, ok := created[groupLabel(m.Label)]; ok {
+						writeSample(w, name+"_created", m.Label, "", "", float64(t.UnixNano())/1e9)
+					}
+				}
+			case dto.MetricType_GAUGE:
+				writeSample(w, name, m.Label, "", "", m.Gauge.GetValue())
+			case dto.MetricType_SUMMARY:
+				for _, q := range m.Summary.Quantile {
+					writeSample(w, name, m.Label, "quantile", formatFloat(q.GetQuantile()), q.GetValue())
+				}
+				writeSample(w, name+"_sum", m.Label, "", "", m.Summary.GetSampleSum())
+				writeSample(w, name+"_count", m.Label, "", "", float64(m.Summary.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				infSeen := false
+				for _, b := range m.Histogram.Bucket {
+					writeSample(w, name+"_bucket", m.Label, "le", formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+					infSeen = infSeen || math.IsInf(b.GetUpperBound(), 1)
+				}
+				if !infSeen {
+					writeSample(w, name+"_bucket", m.Label, "le", "+Inf", float64(m.Histogram.GetSampleCount()))
+				}
+				writeSample(w, name+"_sum", m.Label, "", "", m.Histogram.GetSampleSum())
+				writeSample(w, name+"_count", m.Label, "", "", float64(m.Histogram.GetSampleCount()))
+			default:
+				writeSample(w, name, m.Label, "", "", m.Untyped.GetValue())
+			}
+		}
+	}
+	w.WriteString("# EOF\n")
+	w.Flush()
+}
+
+// writeSample writes a sample line with the given labels, plus extraName if
+// it's non-empty.
+func writeSample(w *bufio.Writer, name string, labels []*dto.LabelPair, extraName, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extraName != "" {
+		sep := "{"
+		for _, lp := range labels {
+			fmt.Fprintf(w, "%s%s=\"%s\"", sep, lp.GetName(), openMetricsEscaper.Replace(lp.GetValue()))
+			sep = ","
+		}
+		if extraName != "" {
+			fmt.Fprintf(w, "%s%s=\"%s\"", sep, extraName, extraValue)
+		}
+		w.WriteString("}")
+	}
+	w.WriteString(" ")
+	w.WriteString(formatFloat(value))
+	w.WriteString("\n")
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// groupLabel returns the value of the groupname label, if any.
+func groupLabel(labels []*dto.LabelPair) string {
+	for _, lp := range labels {
+		if lp.GetName() == "groupname" {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
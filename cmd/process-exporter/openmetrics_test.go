@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// constCollector collects a fixed set of metrics.
+type constCollector []prometheus.Metric
+
+func (c constCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, m := range c {
+		ch <- m.Desc()
+	}
+}
+
+func (c constCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+// gatherer returns a Gatherer of metrics, using the default metric names.
+func gatherer(t *testing.T, metrics ...prometheus.Metric) prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(constCollector(metrics)); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+// TestWriteOpenMetrics verifies the output of writeOpenMetrics for each
+// metric type, and that only group counters get a _created sample.
+func TestWriteOpenMetrics(t *testing.T) {
+	initDescs("namedprocess", "namegroup")
+	histDesc := prometheus.NewDesc("test_latency_seconds", "a \"test\" histogram", nil, nil)
+
+	g := gatherer(t,
+		prometheus.MustNewConstMetric(numprocsDesc, prometheus.GaugeValue, 2, "g1"),
+		prometheus.MustNewConstMetric(numprocsDesc, prometheus.GaugeValue, 1, "a\"b\\c\nd"),
+		prometheus.MustNewConstMetric(cpuUserSecsDesc, prometheus.CounterValue, 1.5, "g1"),
+		prometheus.MustNewConstMetric(cpuUserSecsDesc, prometheus.CounterValue, 0.5, "gone"),
+		prometheus.MustNewConstMetric(threadCpuSecsDesc, prometheus.CounterValue, 1, "g1", "t1", "user"),
+		prometheus.MustNewConstMetric(scrapeErrorsDesc, prometheus.CounterValue, 3),
+		prometheus.MustNewConstHistogram(histDesc, 3, 4.5, map[float64]uint64{1: 1, 2: 3}),
+	)
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	writeOpenMetrics(&buf, mfs, map[string]time.Time{"g1": time.Unix(1500000000, 0)})
+	want := `# TYPE namedprocess_namegroup_cpu_user_seconds counter
+# HELP namedprocess_namegroup_cpu_user_seconds Cpu user usage in seconds
+namedprocess_namegroup_cpu_user_seconds_total{groupname="g1"} 1.5
+namedprocess_namegroup_cpu_user_seconds_created{groupname="g1"} 1.5e+09
+namedprocess_namegroup_cpu_user_seconds_total{groupname="gone"} 0.5
+# TYPE namedprocess_namegroup_num_procs gauge
+# HELP namedprocess_namegroup_num_procs number of processes in this group
+namedprocess_namegroup_num_procs{groupname="a\"b\\c\nd"} 1
+namedprocess_namegroup_num_procs{groupname="g1"} 2
+# TYPE namedprocess_namegroup_thread_cpu_seconds counter
+# HELP namedprocess_namegroup_thread_cpu_seconds Cpu user/system usage in seconds
+namedprocess_namegroup_thread_cpu_seconds_total{cpumode="user",groupname="g1",threadname="t1"} 1
+# TYPE namedprocess_scrape_errors counter
+# HELP namedprocess_scrape_errors general scrape errors: no proc metrics collected during a cycle
+namedprocess_scrape_errors_total 3
+# TYPE test_latency_seconds histogram
+# HELP test_latency_seconds a \"test\" histogram
+test_latency_seconds_bucket{le="1"} 1
+test_latency_seconds_bucket{le="2"} 3
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 4.5
+test_latency_seconds_count 3
+# EOF
+`
+	if diff := cmp.Diff(buf.String(), want); diff != "" {
+		t.Errorf("output differs: (-got +want)\n%s", diff)
+	}
+}
+
+// TestOpenMetricsHandler verifies that only requests asking for OpenMetrics
+// get it, and the rest are left to the fallback handler.
+func TestOpenMetricsHandler(t *testing.T) {
+	initDescs("namedprocess", "namegroup")
+	g := gatherer(t, prometheus.MustNewConstMetric(numprocsDesc, prometheus.GaugeValue, 2, "g1"))
+	created := func() map[string]time.Time { return nil }
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fallback"))
+	})
+	h := openMetricsHandler(g, created, fallback)
+
+	for _, tc := range []struct {
+		accept          string
+		wantOpenMetrics bool
+	}{
+		{"", false},
+		{"text/plain;version=0.0.4", false},
+		{"application/openmetrics-text; version=1.0.0,text/plain;q=0.5", true},
+	} {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept", tc.accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if tc.wantOpenMetrics {
+			if got := rec.Header().Get("Content-Type"); got != openMetricsType {
+				t.Errorf("%q: got content type %q, want %q", tc.accept, got, openMetricsType)
+			}
+			if !strings.HasSuffix(body, "# EOF\n") {
+				t.Errorf("%q: got body %q, want OpenMetrics", tc.accept, body)
+			}
+		} else if body != "fallback" {
+			t.Errorf("%q: got body %q, want fallback", tc.accept, body)
+		}
+	}
+}
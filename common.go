@@ -7,6 +7,59 @@ type (
 		Name     string
 		Cmdline  []string
 		Username string
+		// EffectiveUID is the proc's effective uid, which Username names.
+		// If the uid can't be resolved Username is the uid in decimal.
+		EffectiveUID int
+		// KernelThread is true if the proc is a kernel thread, which has no
+		// cmdline and is shown by ps with its name in brackets.
+		KernelThread bool
+		// ExePath is the resolved target of /proc/<pid>/exe, empty if unreadable.
+		ExePath string
+		// ExeDev and ExeInode identify the file backing the executable,
+		// zero if unknown.
+		ExeDev   uint64
+		ExeInode uint64
+		// Root is the resolved target of /proc/<pid>/root, i.e. "/" unless
+		// the proc is chrooted, or empty if unreadable.
+		Root string
+		// Cgroup is the path of the proc's cgroup, in the unified hierarchy
+		// if there is one, otherwise in the v1 systemd hierarchy.  It's
+		// empty if unknown.
+		Cgroup string
+		// Environ is the proc's environment, nil unless it was read.
+		Environ map[string]string
+		// ParentName is the comm of the proc's parent, empty if the parent
+		// has exited or its name isn't known.
+		ParentName string
+		// ListenPorts are the ports the proc is listening on, nil unless
+		// they were read.
+		ListenPorts []ListenPort
+		// ContainerID is the id of the Docker container the proc runs in,
+		// from its cgroup path, empty if it's not in one.
+		ContainerID string
+		// ContainerName is the name of that container, empty if it's not
+		// known.
+		ContainerName string
+		// Pod describes the Kubernetes pod the proc runs in, zero if it's
+		// not in one.
+		Pod Pod
+	}
+
+	// Pod identifies a container of a Kubernetes pod.  UID comes from the
+	// cgroup path, as does Container, which is the container's id unless
+	// it could be resolved to its name along with Namespace and Name.
+	Pod struct {
+		UID       string
+		Namespace string
+		Name      string
+		Container string
+	}
+
+	// ListenPort is a port on which a proc has a listening socket.
+	ListenPort struct {
+		// Proto is "tcp" or "udp", for both IPv4 and IPv6.
+		Proto string
+		Port  int
 	}
 
 	MatchNamer interface {
@@ -15,4 +68,24 @@ type (
 		MatchAndName(ProcAttributes) (bool, string)
 		fmt.Stringer
 	}
+
+	// RuleMatchNamer is a MatchNamer made up of a list of rules, which can
+	// tell which of them matched.
+	RuleMatchNamer interface {
+		MatchNamer
+		// MatchAndNameRule is like MatchAndName, but also returns the index
+		// of the rule that matched, or -1 if none did.
+		MatchAndNameRule(ProcAttributes) (bool, string, int)
+		// Rules describes each of the rules, in order.
+		Rules() []string
+	}
+
+	// PruningMatchNamer is a MatchNamer that remembers something about the
+	// procs it has named.  After each cycle Prune is called with the
+	// attributes of the procs then tracked, as far as they're known
+	// without matching, and may forget about any others.
+	PruningMatchNamer interface {
+		MatchNamer
+		Prune(tracked []ProcAttributes)
+	}
 )
@@ -6,9 +6,14 @@ import (
 	"io/ioutil"
 	"log"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"text/template/parse"
+	"time"
 
 	common "github.com/ncabatoff/process-exporter"
 	"gopkg.in/yaml.v2"
@@ -26,21 +31,106 @@ type (
 
 	Config struct {
 		MatchNamers FirstMatcher
+		// MaxAges gives the expected maximum lifetime of procs in some groups,
+		// keyed by group name.
+		MaxAges map[string]time.Duration
+		// PerProcess names the groups whose procs may also be reported
+		// individually.
+		PerProcess map[string]bool
 	}
 
 	commMatcher struct {
 		comms map[string]struct{}
 	}
 
+	// parentCommMatcher matches procs whose parent's comm is one of comms.
+	parentCommMatcher struct {
+		comms map[string]struct{}
+	}
+
+	// userMatcher matches procs whose effective user has one of the names
+	// or uids in users.
+	userMatcher struct {
+		users map[string]struct{}
+	}
+
 	exeMatcher struct {
 		exes map[string]string
 	}
 
-	cmdlineMatcher struct {
+	// capturingMatcher is a Matcher whose regexes' named captures are
+	// available to the name template as .Matches.
+	capturingMatcher interface {
+		Matcher
+		// captureRegexes returns the regexes defining the captures.
+		captureRegexes() []*regexp.Regexp
+		// lastCaptures returns the captures of the latest proc matched.
+		lastCaptures() map[string]string
+	}
+
+	// regexCaptures holds regexes that must all match some attribute of a
+	// proc, and the captures of the latest proc they matched.  It's embedded
+	// in the matchers of such attributes to make them capturingMatchers.
+	regexCaptures struct {
 		regexes  []*regexp.Regexp
 		captures map[string]string
 	}
 
+	cmdlineMatcher struct {
+		regexCaptures
+	}
+
+	// cgroupMatcher matches procs whose cgroup path matches all of regexes.
+	cgroupMatcher struct {
+		regexCaptures
+	}
+
+	// exePathMatcher matches procs whose resolved executable path matches
+	// all of regexes.
+	exePathMatcher struct {
+		regexCaptures
+	}
+
+	// unitMatcher matches procs belonging to a systemd unit whose name
+	// matches all of regexes.
+	unitMatcher struct {
+		regexCaptures
+	}
+
+	// envMatcher matches procs whose environment satisfies all of conds.
+	envMatcher struct {
+		conds    []envCond
+		captures map[string]string
+	}
+
+	// envCond requires an environment variable to be present.  If regex is
+	// non-nil its value must also match it, otherwise if hasValue is set it
+	// must equal value.
+	envCond struct {
+		key      string
+		value    string
+		hasValue bool
+		regex    *regexp.Regexp
+	}
+
+	// containerMatcher matches procs in a container whose name or id
+	// matches each of regexes.
+	containerMatcher struct {
+		regexes []*regexp.Regexp
+	}
+
+	// listenPortMatcher matches procs listening on any of ports.  A port
+	// with an empty Proto matches both TCP and UDP.
+	listenPortMatcher struct {
+		ports []common.ListenPort
+	}
+
+	// kernelThreadMatcher matches kernel threads if want is true, and other
+	// procs if it's false.
+	kernelThreadMatcher struct {
+		want bool
+	}
+
 	andMatcher []Matcher
 
 	templateNamer struct {
@@ -50,14 +140,42 @@ type (
 	matchNamer struct {
 		andMatcher
 		templateNamer
+		// maxGroups, if nonzero, limits how many distinct group names the
+		// rule may produce.  groups holds the names produced so far.
+		maxGroups int
+		groups    map[string]bool
+		// exclude makes the rule an exclusion: procs it matches are left
+		// unmatched, whatever the other rules say.
+		exclude bool
 	}
 
 	templateParams struct {
-		Comm     string
-		ExeBase  string
-		ExeFull  string
-		Username string
-		Matches  map[string]string
+		Comm string
+		// ParentComm is the comm of the proc's parent, empty if unknown.
+		ParentComm string
+		ExeBase    string
+		ExeFull    string
+		// ExePath and ExePathBase are the resolved path of the executable
+		// and its basename, empty if unreadable.
+		ExePath     string
+		ExePathBase string
+		Username    string
+		UID         int
+		Root        string
+		Cgroup      string
+		Unit        string
+		Matches     map[string]string
+		Env         map[string]string
+		// ContainerID and ContainerName identify the proc's container,
+		// empty if it's not in one or the name isn't known.
+		ContainerID   string
+		ContainerName string
+		// PodUID, PodNamespace, PodName and PodContainer describe the
+		// proc's Kubernetes pod container, see common.Pod.
+		PodUID       string
+		PodNamespace string
+		PodName      string
+		PodContainer string
 	}
 )
 
@@ -70,6 +188,68 @@ func (e *exeMatcher) String() string {
 	return fmt.Sprintf("exes: %+v", e.exes)
 }
 
+func (c *cgroupMatcher) String() string {
+	return fmt.Sprintf("cgroups: %+v", c.regexes)
+}
+
+func (e *exePathMatcher) String() string {
+	return fmt.Sprintf("exe_paths: %+v", e.regexes)
+}
+
+func (u *unitMatcher) String() string {
+	return fmt.Sprintf("units: %+v", u.regexes)
+}
+
+func (e *envMatcher) String() string {
+	conds := make([]string, len(e.conds))
+	for i, cond := range e.conds {
+		switch {
+		case cond.regex != nil:
+			conds[i] = cond.key + "=~" + cond.regex.String()
+		case cond.hasValue:
+			conds[i] = cond.key + "=" + cond.value
+		default:
+			conds[i] = cond.key
+		}
+	}
+	return fmt.Sprintf("env: %+v", conds)
+}
+
+func (c *containerMatcher) String() string {
+	return fmt.Sprintf("containers: %+v", c.regexes)
+}
+
+func (l *listenPortMatcher) String() string {
+	ports := make([]string, len(l.ports))
+	for i, lp := range l.ports {
+		ports[i] = strconv.Itoa(lp.Port)
+		if lp.Proto != "" {
+			ports[i] = lp.Proto + "/" + ports[i]
+		}
+	}
+	return fmt.Sprintf("listen_ports: %+v", ports)
+}
+
+func (k *kernelThreadMatcher) String() string {
+	return fmt.Sprintf("kernel_thread: %v", k.want)
+}
+
+func (u *userMatcher) String() string {
+	var users = make([]string, 0, len(u.users))
+	for user := range u.users {
+		users = append(users, user)
+	}
+	return fmt.Sprintf("users: %+v", users)
+}
+
+func (p *parentCommMatcher) String() string {
+	var comms = make([]string, 0, len(p.comms))
+	for cm := range p.comms {
+		comms = append(comms, cm)
+	}
+	return fmt.Sprintf("parent comms: %+v", comms)
+}
+
 func (c *commMatcher) String() string {
 	var comms = make([]string, 0, len(c.comms))
 	for cm := range c.comms {
@@ -83,15 +263,43 @@ func (f FirstMatcher) String() string {
 }
 
 func (f FirstMatcher) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	matched, name, _ := f.MatchAndNameRule(nacl)
+	return matched, name
+}
+
+// MatchAndNameRule implements common.RuleMatchNamer.  Rules are indexed in
+// the order they appear in the config.  A proc matching any exclusion rule
+// is unmatched, otherwise the first other rule to match it names it.
+func (f FirstMatcher) MatchAndNameRule(nacl common.ProcAttributes) (bool, string, int) {
 	for _, m := range f.matchers {
+		if mn, ok := m.(*matchNamer); ok && mn.exclude && mn.Match(nacl) {
+			return false, "", -1
+		}
+	}
+	for i, m := range f.matchers {
+		if mn, ok := m.(*matchNamer); ok && mn.exclude {
+			continue
+		}
 		if matched, name := m.MatchAndName(nacl); matched {
-			return true, name
+			return true, name, i
 		}
 	}
-	return false, ""
+	return false, "", -1
+}
+
+// Rules implements common.RuleMatchNamer.
+func (f FirstMatcher) Rules() []string {
+	rules := make([]string, len(f.matchers))
+	for i, m := range f.matchers {
+		rules[i] = m.String()
+	}
+	return rules
 }
 
 func (m *matchNamer) String() string {
+	if m.exclude {
+		return fmt.Sprintf("exclude %+v", m.andMatcher)
+	}
 	return fmt.Sprintf("%+v", m.andMatcher)
 }
 
@@ -102,8 +310,8 @@ func (m *matchNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
 
 	matches := make(map[string]string)
 	for _, m := range m.andMatcher {
-		if mc, ok := m.(*cmdlineMatcher); ok {
-			for k, v := range mc.captures {
+		if mc, ok := m.(capturingMatcher); ok {
+			for k, v := range mc.lastCaptures() {
 				matches[k] = v
 			}
 		}
@@ -115,15 +323,52 @@ func (m *matchNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
 		exebase = filepath.Base(exefull)
 	}
 
+	exepath, exepathbase := resolvedExe(nacl.ExePath), ""
+	if exepath != "" {
+		exepathbase = filepath.Base(exepath)
+	}
+
 	var buf bytes.Buffer
 	m.template.Execute(&buf, &templateParams{
-		Comm:     nacl.Name,
-		ExeBase:  exebase,
-		ExeFull:  exefull,
-		Matches:  matches,
-		Username: nacl.Username,
+		Comm:          nacl.Name,
+		ParentComm:    nacl.ParentName,
+		ExeBase:       exebase,
+		ExeFull:       exefull,
+		ExePath:       exepath,
+		ExePathBase:   exepathbase,
+		Matches:       matches,
+		Username:      nacl.Username,
+		UID:           nacl.EffectiveUID,
+		Root:          nacl.Root,
+		Cgroup:        nacl.Cgroup,
+		Unit:          systemdUnit(nacl.Cgroup),
+		Env:           nacl.Environ,
+		ContainerID:   nacl.ContainerID,
+		ContainerName: nacl.ContainerName,
+		PodUID:        nacl.Pod.UID,
+		PodNamespace:  nacl.Pod.Namespace,
+		PodName:       nacl.Pod.Name,
+		PodContainer:  nacl.Pod.Container,
 	})
-	return true, buf.String()
+	name := buf.String()
+
+	// Once the rule has produced as many names as it may, procs that would
+	// be given a new one are left for later rules to match.
+	if m.maxGroups > 0 && !m.groups[name] {
+		if len(m.groups) >= m.maxGroups {
+			return false, ""
+		}
+		m.groups[name] = true
+	}
+	return true, name
+}
+
+func (m *userMatcher) Match(nacl common.ProcAttributes) bool {
+	if _, found := m.users[nacl.Username]; found {
+		return true
+	}
+	_, found := m.users[strconv.Itoa(nacl.EffectiveUID)]
+	return found
 }
 
 func (m *commMatcher) Match(nacl common.ProcAttributes) bool {
@@ -131,6 +376,14 @@ func (m *commMatcher) Match(nacl common.ProcAttributes) bool {
 	return found
 }
 
+func (m *parentCommMatcher) Match(nacl common.ProcAttributes) bool {
+	if nacl.ParentName == "" {
+		return false
+	}
+	_, found := m.comms[nacl.ParentName]
+	return found
+}
+
 func (m *exeMatcher) Match(nacl common.ProcAttributes) bool {
 	if len(nacl.Cmdline) == 0 {
 		return false
@@ -148,23 +401,139 @@ func (m *exeMatcher) Match(nacl common.ProcAttributes) bool {
 }
 
 func (m *cmdlineMatcher) Match(nacl common.ProcAttributes) bool {
-	for _, regex := range m.regexes {
-		captures := regex.FindStringSubmatch(strings.Join(nacl.Cmdline, " "))
-		if m.captures == nil {
+	return m.matchAll(strings.Join(nacl.Cmdline, " "))
+}
+
+// newRegexCaptures returns a regexCaptures for regexes.
+func newRegexCaptures(regexes []*regexp.Regexp) regexCaptures {
+	return regexCaptures{regexes: regexes, captures: make(map[string]string)}
+}
+
+// matchAll returns true if all the regexes match s, recording their named
+// captures.
+func (r *regexCaptures) matchAll(s string) bool {
+	for _, regex := range r.regexes {
+		captures := regex.FindStringSubmatch(s)
+		if captures == nil {
+			return false
+		}
+		for i, name := range regex.SubexpNames() {
+			if name != "" {
+				r.captures[name] = captures[i]
+			}
+		}
+	}
+	return true
+}
+
+func (r *regexCaptures) captureRegexes() []*regexp.Regexp {
+	return r.regexes
+}
+
+func (r *regexCaptures) lastCaptures() map[string]string {
+	return r.captures
+}
+
+func (m *cgroupMatcher) Match(nacl common.ProcAttributes) bool {
+	return nacl.Cgroup != "" && m.matchAll(nacl.Cgroup)
+}
+
+func (m *exePathMatcher) Match(nacl common.ProcAttributes) bool {
+	exe := resolvedExe(nacl.ExePath)
+	return exe != "" && m.matchAll(exe)
+}
+
+// resolvedExe returns the path of the executable given the target of the
+// /proc/<pid>/exe symlink, which the kernel suffixes with " (deleted)" if
+// the file has since been deleted, e.g. by a package upgrade.
+func resolvedExe(exePath string) string {
+	return strings.TrimSuffix(exePath, " (deleted)")
+}
+
+func (m *unitMatcher) Match(nacl common.ProcAttributes) bool {
+	unit := systemdUnit(nacl.Cgroup)
+	return unit != "" && m.matchAll(unit)
+}
+
+// systemdUnit returns the innermost systemd unit (service, scope or slice)
+// in cgroup path, or the empty string if there is none.  Cgroups delegated
+// below a unit, e.g. by a container runtime, are attributed to that unit.
+func systemdUnit(cgroup string) string {
+	parts := strings.Split(cgroup, "/")
+	for i := len(parts) - 1; i >= 0; i-- {
+		p := parts[i]
+		if strings.HasSuffix(p, ".service") || strings.HasSuffix(p, ".scope") ||
+			strings.HasSuffix(p, ".slice") {
+			return p
+		}
+	}
+	return ""
+}
+
+func (m *envMatcher) Match(nacl common.ProcAttributes) bool {
+	for _, cond := range m.conds {
+		value, ok := nacl.Environ[cond.key]
+		if !ok {
 			return false
 		}
-		subexpNames := regex.SubexpNames()
-		if len(subexpNames) != len(captures) {
+		if cond.regex != nil {
+			captures := cond.regex.FindStringSubmatch(value)
+			if captures == nil {
+				return false
+			}
+			for i, name := range cond.regex.SubexpNames() {
+				if name != "" {
+					m.captures[name] = captures[i]
+				}
+			}
+		} else if cond.hasValue && value != cond.value {
 			return false
 		}
+	}
+	return true
+}
 
-		for i, name := range subexpNames {
-			m.captures[name] = captures[i]
+func (m *envMatcher) captureRegexes() []*regexp.Regexp {
+	var rs []*regexp.Regexp
+	for _, cond := range m.conds {
+		if cond.regex != nil {
+			rs = append(rs, cond.regex)
+		}
+	}
+	return rs
+}
+
+func (m *envMatcher) lastCaptures() map[string]string {
+	return m.captures
+}
+
+func (c *containerMatcher) Match(nacl common.ProcAttributes) bool {
+	if nacl.ContainerID == "" {
+		return false
+	}
+	for _, r := range c.regexes {
+		if !r.MatchString(nacl.ContainerID) && !(nacl.ContainerName != "" && r.MatchString(nacl.ContainerName)) {
+			return false
 		}
 	}
 	return true
 }
 
+func (l *listenPortMatcher) Match(nacl common.ProcAttributes) bool {
+	for _, have := range nacl.ListenPorts {
+		for _, want := range l.ports {
+			if have.Port == want.Port && (want.Proto == "" || have.Proto == want.Proto) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (k *kernelThreadMatcher) Match(nacl common.ProcAttributes) bool {
+	return nacl.KernelThread == k.want
+}
+
 func (m andMatcher) Match(nacl common.ProcAttributes) bool {
 	for _, matcher := range m {
 		if !matcher.Match(nacl) {
@@ -203,90 +572,362 @@ func GetConfig(content string, debug bool) (*Config, error) {
 		return nil, fmt.Errorf("error parsing YAML config: 'process_names' is not a list")
 	}
 
+	// Rather than stopping at the first error, report them all so they can
+	// be fixed in one go.
 	var cfg Config
+	var errs []string
 	for i, procname := range procnames {
 		mn, err := getMatchNamer(procname)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse process_name entry %d: %v", i, err)
+			errs = append(errs, fmt.Sprintf("unable to parse process_name entry %d: %v", i, err))
+			continue
 		}
 		cfg.MatchNamers.matchers = append(cfg.MatchNamers.matchers, mn)
 	}
 
+	if yamlMaxAges, ok := yamldata["max_ages"]; ok {
+		cfg.MaxAges, err = getMaxAges(yamlMaxAges)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("error parsing YAML config: 'max_ages': %v", err))
+		}
+	}
+
+	if yamlPerProcess, ok := yamldata["per_process"]; ok {
+		cfg.PerProcess, err = getPerProcess(yamlPerProcess)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("error parsing YAML config: 'per_process': %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "\n"))
+	}
 	return &cfg, nil
 }
 
+// parseEnvCond parses an env matcher condition, one of "KEY", "KEY=value" or
+// "KEY=~regex".
+func parseEnvCond(s string) (envCond, error) {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return envCond{key: s}, nil
+	}
+	if i == 0 {
+		return envCond{}, fmt.Errorf("bad env condition %q: empty key", s)
+	}
+	cond := envCond{key: s[:i], value: s[i+1:], hasValue: true}
+	if strings.HasPrefix(cond.value, "~") {
+		r, err := regexp.Compile(cond.value[1:])
+		if err != nil {
+			return envCond{}, fmt.Errorf("bad env regex %q: %v", cond.value[1:], err)
+		}
+		cond.regex = r
+	}
+	return cond, nil
+}
+
+// parseListenPort parses a listen_port value, either a port number or one
+// prefixed with "tcp/" or "udp/".
+func parseListenPort(s string) (common.ListenPort, error) {
+	var lp common.ListenPort
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		lp.Proto = s[:i]
+		if lp.Proto != "tcp" && lp.Proto != "udp" {
+			return common.ListenPort{}, fmt.Errorf("bad listen_port %q: protocol must be tcp or udp", s)
+		}
+		s = s[i+1:]
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil || port <= 0 || port > 65535 {
+		return common.ListenPort{}, fmt.Errorf("bad listen_port %q: want a port number", s)
+	}
+	lp.Port = port
+	return lp, nil
+}
+
+// NeedsListenPorts returns true if any rule matches on listening ports,
+// which must then be found for each proc.
+func (c *Config) NeedsListenPorts() bool {
+	for _, mn := range c.MatchNamers.matchers {
+		if m, ok := mn.(*matchNamer); ok {
+			for _, matcher := range m.andMatcher {
+				if _, ok := matcher.(*listenPortMatcher); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// NeedsEnviron returns true if any rule matches on the environment, which
+// must then be read for each proc.
+func (c *Config) NeedsEnviron() bool {
+	for _, mn := range c.MatchNamers.matchers {
+		if m, ok := mn.(*matchNamer); ok {
+			for _, matcher := range m.andMatcher {
+				if _, ok := matcher.(*envMatcher); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func getMaxAges(yamlma interface{}) (map[string]time.Duration, error) {
+	ma, ok := yamlma.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a map")
+	}
+
+	maxAges := make(map[string]time.Duration, len(ma))
+	for k, v := range ma {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string key %v", k)
+		}
+		value, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string value %v for key %q", v, key)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad duration %q for key %q: %v", value, key, err)
+		}
+		maxAges[key] = d
+	}
+	return maxAges, nil
+}
+
+func getPerProcess(yamlpp interface{}) (map[string]bool, error) {
+	pp, ok := yamlpp.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a list")
+	}
+
+	perProcess := make(map[string]bool, len(pp))
+	for i, v := range pp {
+		name, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("non-string value %v in list[%d]", v, i)
+		}
+		perProcess[name] = true
+	}
+	return perProcess, nil
+}
+
+// selectors are the keys of a process_names item that select procs, in the
+// order their matchers are applied, each with the function that makes its
+// matcher from the values given for it.  Those return the problems with all
+// the values rather than stopping at the first.
+var selectors = []struct {
+	key        string
+	newMatcher func(vals []string) (Matcher, []string)
+}{
+	{"comm", newCommMatcher},
+	{"parent_comm", newParentCommMatcher},
+	{"user", newUserMatcher},
+	{"exe", newExeMatcher},
+	{"cmdline", newCmdlineMatcher},
+	{"cgroup", newCgroupMatcher},
+	{"exe_path", newExePathMatcher},
+	{"unit", newUnitMatcher},
+	{"env", newEnvMatcher},
+	{"container", newContainerMatcher},
+	{"listen_port", newListenPortMatcher},
+}
+
+// isSelector returns true if key is one of the selectors.
+func isSelector(key string) bool {
+	for _, sel := range selectors {
+		if sel.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// stringSet returns the set of strs.
+func stringSet(strs []string) map[string]struct{} {
+	set := make(map[string]struct{}, len(strs))
+	for _, s := range strs {
+		set[s] = struct{}{}
+	}
+	return set
+}
+
+func newCommMatcher(comms []string) (Matcher, []string) {
+	return &commMatcher{stringSet(comms)}, nil
+}
+
+func newParentCommMatcher(comms []string) (Matcher, []string) {
+	return &parentCommMatcher{stringSet(comms)}, nil
+}
+
+func newUserMatcher(users []string) (Matcher, []string) {
+	return &userMatcher{stringSet(users)}, nil
+}
+
+func newExeMatcher(exe []string) (Matcher, []string) {
+	exes := make(map[string]string)
+	for _, e := range exe {
+		if strings.Contains(e, "/") {
+			exes[filepath.Base(e)] = e
+		} else {
+			exes[e] = ""
+		}
+	}
+	return &exeMatcher{exes}, nil
+}
+
+func newCmdlineMatcher(cmdlines []string) (Matcher, []string) {
+	rs, errs := compileRegexes("cmdline", cmdlines)
+	return &cmdlineMatcher{newRegexCaptures(rs)}, errs
+}
+
+func newCgroupMatcher(cgroups []string) (Matcher, []string) {
+	rs, errs := compileRegexes("cgroup", cgroups)
+	return &cgroupMatcher{newRegexCaptures(rs)}, errs
+}
+
+func newExePathMatcher(exePaths []string) (Matcher, []string) {
+	rs, errs := compileRegexes("exe_path", exePaths)
+	return &exePathMatcher{newRegexCaptures(rs)}, errs
+}
+
+func newUnitMatcher(units []string) (Matcher, []string) {
+	rs, errs := compileRegexes("unit", units)
+	return &unitMatcher{newRegexCaptures(rs)}, errs
+}
+
+func newEnvMatcher(env []string) (Matcher, []string) {
+	var conds []envCond
+	var errs []string
+	for _, e := range env {
+		cond, err := parseEnvCond(e)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		conds = append(conds, cond)
+	}
+	return &envMatcher{
+		conds:    conds,
+		captures: make(map[string]string),
+	}, errs
+}
+
+func newContainerMatcher(containers []string) (Matcher, []string) {
+	rs, errs := compileRegexes("container", containers)
+	return &containerMatcher{rs}, errs
+}
+
+func newListenPortMatcher(listenPorts []string) (Matcher, []string) {
+	var ports []common.ListenPort
+	var errs []string
+	for _, l := range listenPorts {
+		lp, err := parseListenPort(l)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		ports = append(ports, lp)
+	}
+	return &listenPortMatcher{ports}, errs
+}
+
 func getMatchNamer(yamlmn interface{}) (common.MatchNamer, error) {
 	nm, ok := yamlmn.(map[interface{}]interface{})
 	if !ok {
 		return nil, fmt.Errorf("not a map")
 	}
 
+	var errs []string
 	var smap = make(map[string][]string)
 	var nametmpl string
+	var maxGroups int
+	var exclude bool
+	var kernelThread *bool
 	for k, v := range nm {
 		key, ok := k.(string)
 		if !ok {
-			return nil, fmt.Errorf("non-string key %v", k)
+			errs = append(errs, fmt.Sprintf("non-string key %v", k))
+			continue
 		}
 
 		if key == "name" {
 			value, ok := v.(string)
 			if !ok {
-				return nil, fmt.Errorf("non-string value %v for key %q", v, key)
+				errs = append(errs, fmt.Sprintf("non-string value %v for key %q", v, key))
+				continue
 			}
 			nametmpl = value
+		} else if key == "max_groups" {
+			value, ok := v.(int)
+			if !ok || value <= 0 {
+				errs = append(errs, fmt.Sprintf("bad value %v for key %q, want a positive integer", v, key))
+				continue
+			}
+			maxGroups = value
+		} else if key == "exclude" {
+			value, ok := v.(bool)
+			if !ok {
+				errs = append(errs, fmt.Sprintf("non-boolean value %v for key %q", v, key))
+				continue
+			}
+			exclude = value
+		} else if key == "kernel_thread" {
+			value, ok := v.(bool)
+			if !ok {
+				errs = append(errs, fmt.Sprintf("non-boolean value %v for key %q", v, key))
+				continue
+			}
+			kernelThread = &value
 		} else {
 			vals, ok := v.([]interface{})
 			if !ok {
-				return nil, fmt.Errorf("non-string array value %v for key %q", v, key)
+				errs = append(errs, fmt.Sprintf("non-string array value %v for key %q", v, key))
+				continue
 			}
 			var strs []string
 			for i, si := range vals {
+				// Ports may be given unquoted.
+				if n, ok := si.(int); ok && key == "listen_port" {
+					si = strconv.Itoa(n)
+				}
 				s, ok := si.(string)
 				if !ok {
-					return nil, fmt.Errorf("non-string value %v in list[%d] for key %q", v, i, key)
+					errs = append(errs, fmt.Sprintf("non-string value %v in list[%d] for key %q", v, i, key))
+					continue
 				}
 				strs = append(strs, s)
 			}
 			smap[key] = strs
 		}
 	}
+	for key := range smap {
+		if !isSelector(key) {
+			errs = append(errs, fmt.Sprintf("unknown selector %q", key))
+		}
+	}
 
 	var matchers andMatcher
-	if comm, ok := smap["comm"]; ok {
-		comms := make(map[string]struct{})
-		for _, c := range comm {
-			comms[c] = struct{}{}
-		}
-		matchers = append(matchers, &commMatcher{comms})
-	}
-	if exe, ok := smap["exe"]; ok {
-		exes := make(map[string]string)
-		for _, e := range exe {
-			if strings.Contains(e, "/") {
-				exes[filepath.Base(e)] = e
-			} else {
-				exes[e] = ""
-			}
+	for _, sel := range selectors {
+		if vals, ok := smap[sel.key]; ok {
+			m, merrs := sel.newMatcher(vals)
+			errs = append(errs, merrs...)
+			matchers = append(matchers, m)
 		}
-		matchers = append(matchers, &exeMatcher{exes})
 	}
-	if cmdline, ok := smap["cmdline"]; ok {
-		var rs []*regexp.Regexp
-		for _, c := range cmdline {
-			r, err := regexp.Compile(c)
-			if err != nil {
-				return nil, fmt.Errorf("bad cmdline regex %q: %v", c, err)
-			}
-			rs = append(rs, r)
-		}
-		matchers = append(matchers, &cmdlineMatcher{
-			regexes:  rs,
-			captures: make(map[string]string),
-		})
+	if kernelThread != nil {
+		matchers = append(matchers, &kernelThreadMatcher{*kernelThread})
+	}
+	if len(smap) == 0 && kernelThread == nil {
+		errs = append(errs, "no matchers provided")
 	}
-	if len(matchers) == 0 {
-		return nil, fmt.Errorf("no matchers provided")
+	if exclude && (nametmpl != "" || maxGroups > 0) {
+		errs = append(errs, "an exclude rule can't have a name or max_groups")
 	}
 
 	if nametmpl == "" {
@@ -295,8 +936,113 @@ func getMatchNamer(yamlmn interface{}) (common.MatchNamer, error) {
 	tmpl := template.New("cmdname")
 	tmpl, err := tmpl.Parse(nametmpl)
 	if err != nil {
-		return nil, fmt.Errorf("bad name template %q: %v", nametmpl, err)
+		errs = append(errs, fmt.Sprintf("bad name template %q: %v", nametmpl, err))
+	} else {
+		errs = append(errs, checkTemplate(tmpl, matchers)...)
 	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	mn := &matchNamer{andMatcher: matchers, templateNamer: templateNamer{tmpl}, exclude: exclude}
+	if maxGroups > 0 {
+		mn.maxGroups = maxGroups
+		mn.groups = make(map[string]bool)
+	}
+	return mn, nil
+}
 
-	return &matchNamer{matchers, templateNamer{tmpl}}, nil
+// compileRegexes compiles the regexes given for the selector key, also
+// returning the problems with those that don't compile.
+func compileRegexes(key string, exprs []string) ([]*regexp.Regexp, []string) {
+	var rs []*regexp.Regexp
+	var errs []string
+	for _, e := range exprs {
+		r, err := regexp.Compile(e)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("bad %s regex %q: %v", key, e, err))
+			continue
+		}
+		rs = append(rs, r)
+	}
+	return rs, errs
+}
+
+// checkTemplate returns the problems with tmpl as the name template of a rule
+// with the given matchers: references to fields that don't exist, and to
+// captures in .Matches that none of the matchers' regexes define.
+func checkTemplate(tmpl *template.Template, matchers andMatcher) []string {
+	captures := make(map[string]bool)
+	for _, m := range matchers {
+		mc, ok := m.(capturingMatcher)
+		if !ok {
+			continue
+		}
+		for _, r := range mc.captureRegexes() {
+			for _, name := range r.SubexpNames() {
+				if name != "" {
+					captures[name] = true
+				}
+			}
+		}
+	}
+
+	var errs []string
+	params := reflect.TypeOf(templateParams{})
+	templateFields(tmpl.Tree.Root, func(path []string) {
+		if _, ok := params.FieldByName(path[0]); !ok {
+			errs = append(errs, fmt.Sprintf("name template refers to unknown field .%s", path[0]))
+		} else if path[0] == "Matches" && len(path) > 1 && !captures[path[1]] {
+			errs = append(errs, fmt.Sprintf("name template refers to .Matches.%s, but no regex captures %q", path[1], path[1]))
+		}
+	})
+	return errs
+}
+
+// templateFields calls visit with the path of each field of dot that node
+// refers to, either as {{.A.B}} or {{index .A "B"}}.  The bodies of range and
+// with, in which dot is something else, are skipped.
+func templateFields(node parse.Node, visit func(path []string)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			templateFields(c, visit)
+		}
+	case *parse.ActionNode:
+		templateFields(n.Pipe, visit)
+	case *parse.IfNode:
+		templateFields(n.Pipe, visit)
+		templateFields(n.List, visit)
+		templateFields(n.ElseList, visit)
+	case *parse.RangeNode:
+		templateFields(n.Pipe, visit)
+	case *parse.WithNode:
+		templateFields(n.Pipe, visit)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			templateFields(cmd, visit)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) == 3 {
+			id, ok1 := n.Args[0].(*parse.IdentifierNode)
+			field, ok2 := n.Args[1].(*parse.FieldNode)
+			key, ok3 := n.Args[2].(*parse.StringNode)
+			if ok1 && ok2 && ok3 && id.Ident == "index" {
+				visit(append(append([]string(nil), field.Ident...), key.Text))
+				return
+			}
+		}
+		for _, arg := range n.Args {
+			templateFields(arg, visit)
+		}
+	case *parse.FieldNode:
+		visit(n.Ident)
+	}
 }
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"strings"
+	"time"
+
 	// "github.com/kylelemons/godebug/pretty"
 	common "github.com/ncabatoff/process-exporter"
 	. "gopkg.in/check.v1"
@@ -75,3 +78,523 @@ process_names:
 	c.Check(found, Equals, true)
 	c.Check(name, Equals, "/usr/local/bin/prometheus")
 }
+
+func (s MySuite) TestExeInodeNamer(c *C) {
+	yml := `
+process_names:
+  - comm: 
+    - python
+    - python3
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	namer := NewExeInodeNamer(cfg.MatchNamers)
+
+	py := common.ProcAttributes{Name: "python", Cmdline: []string{"python"},
+		ExePath: "/usr/bin/python3.6", ExeDev: 1, ExeInode: 100}
+	py3 := common.ProcAttributes{Name: "python3", Cmdline: []string{"/usr/bin/python3"},
+		ExePath: "/usr/bin/python3.6", ExeDev: 1, ExeInode: 100}
+	moved := common.ProcAttributes{Name: "python", Cmdline: []string{"/opt/python"},
+		ExePath: "/opt/python", ExeDev: 1, ExeInode: 100}
+	other := common.ProcAttributes{Name: "python", Cmdline: []string{"/opt/python"},
+		ExePath: "/opt/python (deleted)", ExeDev: 1, ExeInode: 200}
+	unknown := common.ProcAttributes{Name: "python", Cmdline: []string{"python"}}
+	bash := common.ProcAttributes{Name: "bash", Cmdline: []string{"/bin/bash"},
+		ExePath: "/bin/bash", ExeDev: 1, ExeInode: 300}
+
+	for _, nacl := range []common.ProcAttributes{py, py3, moved} {
+		found, name := namer.MatchAndName(nacl)
+		c.Check(found, Equals, true)
+		c.Check(name, Equals, "/usr/bin/python3.6")
+	}
+
+	found, name := namer.MatchAndName(other)
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "/opt/python (deleted)")
+
+	found, name = namer.MatchAndName(unknown)
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "python")
+
+	found, _ = namer.MatchAndName(bash)
+	c.Check(found, Equals, false)
+
+	// Once py is no longer tracked, its binary is named anew.
+	namer.Prune([]common.ProcAttributes{other})
+	_, name = namer.MatchAndName(moved)
+	c.Check(name, Equals, "/opt/python")
+	_, name = namer.MatchAndName(other)
+	c.Check(name, Equals, "/opt/python (deleted)")
+}
+
+func (s MySuite) TestConfigMaxAges(c *C) {
+	yml := `
+process_names:
+  - exe:
+    - backup
+max_ages:
+  backup: 90m
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MaxAges, DeepEquals, map[string]time.Duration{"backup": 90 * time.Minute})
+
+	_, err = GetConfig(yml+"  other: soon\n", false)
+	c.Check(err, NotNil)
+}
+
+func (s MySuite) TestConfigPerProcess(c *C) {
+	yml := `
+process_names:
+  - exe:
+    - postgres
+per_process:
+  - postgres
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.PerProcess, DeepEquals, map[string]bool{"postgres": true})
+
+	_, err = GetConfig(yml+"  - 5\n", false)
+	c.Check(err, NotNil)
+}
+
+func (s MySuite) TestConfigRules(c *C) {
+	yml := `
+process_names:
+  - name: "shell"
+    exe:
+    - bash
+  - name: "shell"
+    exe:
+    - sh
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.MatchNamers.Rules(), HasLen, 2)
+
+	sh := common.ProcAttributes{Name: "sh", Cmdline: []string{"sh"}}
+	found, name, rule := cfg.MatchNamers.MatchAndNameRule(sh)
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "shell")
+	c.Check(rule, Equals, 1)
+
+	ksh := common.ProcAttributes{Name: "ksh", Cmdline: []string{"/bin/ksh"}}
+	found, _, rule = cfg.MatchNamers.MatchAndNameRule(ksh)
+	c.Check(found, Equals, false)
+	c.Check(rule, Equals, -1)
+}
+
+func (s MySuite) TestConfigEnv(c *C) {
+	yml := `
+process_names:
+  - name: "{{.Env.SERVICE_NAME}}-{{.Matches.Tier}}"
+    env:
+    - SERVICE_NAME
+    - DEPLOY_ENV=production
+    - TIER=~^tier-(?P<Tier>\d+)$
+  - name: "other"
+    comm:
+    - runner
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.NeedsEnviron(), Equals, true)
+
+	env := map[string]string{"SERVICE_NAME": "api", "DEPLOY_ENV": "production", "TIER": "tier-2"}
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "runner", Environ: env})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "api-2")
+
+	env["DEPLOY_ENV"] = "staging"
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "runner", Environ: env})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "other")
+
+	// An unreadable environment falls through to the next rule.
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "runner"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "other")
+
+	_, err = GetConfig("process_names:\n  - env:\n    - =x\n", false)
+	c.Check(err, NotNil)
+}
+
+func (s MySuite) TestConfigContainer(c *C) {
+	yml := `
+process_names:
+  - name: "{{or .ContainerName .ContainerID}}"
+    container:
+    - .
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	id := strings.Repeat("0a", 32)
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "nginx", ContainerID: id, ContainerName: "web"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "web")
+
+	// Without a name the id is used, and procs not in a container don't match.
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "nginx", ContainerID: id})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, id)
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "nginx"})
+	c.Check(found, Equals, false)
+
+	// Regexes may match either the name or the id.
+	cfg, err = GetConfig("process_names:\n  - container:\n    - ^web$\n    - ^0a\n", false)
+	c.Assert(err, IsNil)
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "nginx", ContainerID: id, ContainerName: "web"})
+	c.Check(found, Equals, true)
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "nginx", ContainerID: id, ContainerName: "db"})
+	c.Check(found, Equals, false)
+}
+
+func (s MySuite) TestConfigListenPort(c *C) {
+	yml := `
+process_names:
+  - name: "web"
+    listen_port:
+    - 8080
+    - tcp/8443
+  - name: "dns"
+    listen_port:
+    - udp/53
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+	c.Check(cfg.NeedsListenPorts(), Equals, true)
+	c.Check(cfg.NeedsEnviron(), Equals, false)
+
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "x",
+		ListenPorts: []common.ListenPort{{Proto: "udp", Port: 8080}}})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "web")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "x",
+		ListenPorts: []common.ListenPort{{Proto: "tcp", Port: 22}, {Proto: "udp", Port: 53}}})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "dns")
+
+	// The protocol must match if given, and procs without ports don't match.
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "x",
+		ListenPorts: []common.ListenPort{{Proto: "udp", Port: 8443}, {Proto: "tcp", Port: 53}}})
+	c.Check(found, Equals, false)
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "x"})
+	c.Check(found, Equals, false)
+
+	for _, bad := range []string{"sctp/80", "http", "0", "70000"} {
+		_, err = GetConfig("process_names:\n  - listen_port:\n    - "+bad+"\n", false)
+		c.Check(err, NotNil, Commentf("%s", bad))
+	}
+}
+
+func (s MySuite) TestConfigCgroup(c *C) {
+	yml := `
+process_names:
+  - name: "{{.Matches.Unit}}"
+    cgroup:
+    - ^/system\.slice/(?P<Unit>[^/]+)\.service$
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Cgroup: "/system.slice/nginx.service"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "nginx")
+
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Cgroup: "/user.slice/user-1000.slice"})
+	c.Check(found, Equals, false)
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{})
+	c.Check(found, Equals, false)
+}
+
+func (s MySuite) TestConfigUnit(c *C) {
+	yml := `
+process_names:
+  - name: "{{.Unit}}"
+    unit:
+    - \.service$
+  - name: "{{.Matches.Session}}"
+    unit:
+    - ^session-(?P<Session>\d+)\.scope$
+  - name: "{{.Unit}}"
+    unit:
+    - .
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Cgroup: "/system.slice/nginx.service"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "nginx.service")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Cgroup: "/system.slice/docker.service/payload"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "docker.service")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Cgroup: "/user.slice/user-1000.slice/session-3.scope"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "3")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Cgroup: "/user.slice/user-1000.slice"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "user-1000.slice")
+
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Cgroup: "/"})
+	c.Check(found, Equals, false)
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{})
+	c.Check(found, Equals, false)
+}
+
+func (s MySuite) TestConfigMaxGroups(c *C) {
+	yml := `
+process_names:
+  - name: "worker-{{.Matches.queue}}"
+    max_groups: 2
+    cmdline:
+    - --queue=(?P<queue>\w+)
+  - name: "worker-other"
+    cmdline:
+    - --queue=
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	for _, tc := range []struct {
+		queue, want string
+	}{
+		{"a", "worker-a"},
+		{"b", "worker-b"},
+		{"c", "worker-other"},
+		{"a", "worker-a"},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{
+			Name: "worker", Cmdline: []string{"worker", "--queue=" + tc.queue}})
+		c.Check(found, Equals, true)
+		c.Check(name, Equals, tc.want)
+	}
+
+	_, err = GetConfig(`
+process_names:
+  - max_groups: 0
+    comm:
+    - worker
+`, false)
+	c.Check(err, NotNil)
+}
+
+func (s MySuite) TestConfigExclude(c *C) {
+	yml := `
+process_names:
+  - name: "java-{{.Comm}}"
+    cmdline:
+    - ^java
+  - exclude: true
+    cmdline:
+    - --batch
+  - name: "other"
+    comm:
+    - java
+    - batchd
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	for _, tc := range []struct {
+		comm    string
+		cmdline []string
+		found   bool
+		want    string
+	}{
+		{"java", []string{"java", "-jar", "app.jar"}, true, "java-java"},
+		{"java", []string{"java", "-jar", "app.jar", "--batch"}, false, ""},
+		{"batchd", []string{"batchd", "--batch"}, false, ""},
+		{"batchd", []string{"batchd"}, true, "other"},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: tc.comm, Cmdline: tc.cmdline})
+		c.Check(found, Equals, tc.found)
+		c.Check(name, Equals, tc.want)
+	}
+
+	_, err = GetConfig(`
+process_names:
+  - exclude: true
+    name: "batch"
+    cmdline:
+    - --batch
+`, false)
+	c.Check(err, NotNil)
+}
+
+func (s MySuite) TestConfigParentComm(c *C) {
+	yml := `
+process_names:
+  - name: "{{.Comm}}-under-{{.ParentComm}}"
+    comm:
+    - worker
+    parent_comm:
+    - supervisord
+    - runsv
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	for _, tc := range []struct {
+		parent string
+		found  bool
+		want   string
+	}{
+		{"supervisord", true, "worker-under-supervisord"},
+		{"runsv", true, "worker-under-runsv"},
+		{"bash", false, ""},
+		{"", false, ""},
+	} {
+		found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{
+			Name: "worker", Cmdline: []string{"worker"}, ParentName: tc.parent})
+		c.Check(found, Equals, tc.found)
+		c.Check(name, Equals, tc.want)
+	}
+}
+
+func (s MySuite) TestConfigExePath(c *C) {
+	yml := `
+process_names:
+  - name: "{{.ExePathBase}}"
+    exe_path:
+    - ^/usr/bin/python3\.6$
+  - name: "java-{{.Matches.Version}}"
+    exe_path:
+    - ^/usr/lib/jvm/java-(?P<Version>\d+)-
+  - name: "other"
+    comm:
+    - python3
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "python3", ExePath: "/usr/bin/python3.6"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "python3.6")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "python3", ExePath: "/usr/bin/python3.6 (deleted)"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "python3.6")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "java", ExePath: "/usr/lib/jvm/java-11-openjdk-amd64/bin/java"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "java-11")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "python3"})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "other")
+}
+
+func (s MySuite) TestConfigUser(c *C) {
+	yml := `
+process_names:
+  - name: "{{.Comm}}-{{.Username}}"
+    user:
+    - postgres
+    - "0"
+  - name: "uid-{{.UID}}"
+    comm:
+    - bash
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "bash", Username: "postgres", EffectiveUID: 111})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "bash-postgres")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "bash", Username: "root", EffectiveUID: 0})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "bash-root")
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "bash", Username: "54321", EffectiveUID: 54321})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "uid-54321")
+}
+
+func (s MySuite) TestConfigValidation(c *C) {
+	yml := `
+process_names:
+  - name: "{{.Matches.Service}}"
+    cmdline:
+    - --service=(?P<Srv>\S+)
+  - comm:
+    - bash
+    shell:
+    - zsh
+  - name: "{{.Command}}"
+    exe:
+    - java
+  - cmdline:
+    - "(unclosed"
+  - name: "{{.ExeBase}}"
+    comm:
+    - postgres
+`
+	_, err := GetConfig(yml, false)
+	c.Assert(err, NotNil)
+	lines := strings.Split(err.Error(), "\n")
+	c.Assert(lines, HasLen, 4)
+	c.Check(lines[0], Equals, `unable to parse process_name entry 0: name template refers to .Matches.Service, but no regex captures "Service"`)
+	c.Check(lines[1], Equals, `unable to parse process_name entry 1: unknown selector "shell"`)
+	c.Check(lines[2], Equals, `unable to parse process_name entry 2: name template refers to unknown field .Command`)
+	c.Check(strings.HasPrefix(lines[3], "unable to parse process_name entry 3: "), Equals, true)
+	c.Check(strings.Contains(lines[3], "missing closing )"), Equals, true)
+
+	yml = `
+process_names:
+  - name: "{{.Matches.Srv}}-{{index .Matches \"Port\"}}"
+    cmdline:
+    - --service=(?P<Srv>\S+)
+    - --port=(?P<Port>\d+)
+  - name: "{{.Comm}}"
+    comm:
+    - bash
+`
+	_, err = GetConfig(yml, false)
+	c.Check(err, IsNil)
+}
+
+func (s MySuite) TestConfigKernelThread(c *C) {
+	yml := `
+process_names:
+  - exclude: true
+    kernel_thread: true
+    comm:
+    - kworker/0:1
+  - name: kernel
+    kernel_thread: true
+  - name: "{{.Comm}}"
+    kernel_thread: false
+    comm:
+    - bash
+`
+	cfg, err := GetConfig(yml, false)
+	c.Assert(err, IsNil)
+
+	found, _ := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "kworker/0:1", KernelThread: true})
+	c.Check(found, Equals, false)
+
+	found, name := cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "kthreadd", KernelThread: true})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "kernel")
+
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "bash", KernelThread: true})
+	c.Check(found, Equals, true)
+
+	found, name = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "bash", Cmdline: []string{"bash"}})
+	c.Check(found, Equals, true)
+	c.Check(name, Equals, "bash")
+
+	found, _ = cfg.MatchNamers.MatchAndName(common.ProcAttributes{Name: "sshd", Cmdline: []string{"sshd"}})
+	c.Check(found, Equals, false)
+
+	_, err = GetConfig("process_names:\n  - kernel_thread: yes please\n", false)
+	c.Check(err, ErrorMatches, `.*non-boolean value yes please for key "kernel_thread".*`)
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+
+	common "github.com/ncabatoff/process-exporter"
+)
+
+type (
+	exeID struct {
+		dev, inode uint64
+	}
+
+	// ExeInodeNamer wraps another MatchNamer, renaming the procs it matches
+	// based on the identity (device and inode) of their executable file.
+	// All procs running the same binary thus land in the same group, no
+	// matter which path or symlink was used to invoke it.  The group is
+	// named after the resolved path of the first such proc seen, for as
+	// long as any proc running the binary is tracked.  Procs whose
+	// executable can't be resolved keep the name given by the wrapped
+	// namer.
+	ExeInodeNamer struct {
+		namer common.MatchNamer
+		names map[exeID]string
+	}
+)
+
+// NewExeInodeNamer returns an ExeInodeNamer wrapping namer.
+func NewExeInodeNamer(namer common.MatchNamer) *ExeInodeNamer {
+	return &ExeInodeNamer{namer: namer, names: make(map[exeID]string)}
+}
+
+func (n *ExeInodeNamer) String() string {
+	return fmt.Sprintf("exe inode: %v", n.namer)
+}
+
+// MatchAndName implements common.MatchNamer.  A deleted binary can still be
+// identified by its inode, so each one gets its own group named after its
+// path, which the kernel suffixes with " (deleted)".
+func (n *ExeInodeNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	matched, name, _ := n.MatchAndNameRule(nacl)
+	return matched, name
+}
+
+// MatchAndNameRule implements common.RuleMatchNamer.  The rule index is -1
+// unless the wrapped namer is also a common.RuleMatchNamer.
+func (n *ExeInodeNamer) MatchAndNameRule(nacl common.ProcAttributes) (bool, string, int) {
+	var (
+		matched bool
+		name    string
+		rule    = -1
+	)
+	if rn, ok := n.namer.(common.RuleMatchNamer); ok {
+		matched, name, rule = rn.MatchAndNameRule(nacl)
+	} else {
+		matched, name = n.namer.MatchAndName(nacl)
+	}
+	if !matched || nacl.ExeInode == 0 {
+		return matched, name, rule
+	}
+
+	id := exeID{nacl.ExeDev, nacl.ExeInode}
+	if exeName, ok := n.names[id]; ok {
+		return true, exeName, rule
+	}
+	n.names[id] = nacl.ExePath
+	return true, nacl.ExePath, rule
+}
+
+// Prune implements common.PruningMatchNamer, forgetting the names of the
+// binaries no tracked proc runs.
+func (n *ExeInodeNamer) Prune(tracked []common.ProcAttributes) {
+	live := make(map[exeID]bool, len(tracked))
+	for _, nacl := range tracked {
+		live[exeID{nacl.ExeDev, nacl.ExeInode}] = true
+	}
+	for id := range n.names {
+		if !live[id] {
+			delete(n.names, id)
+		}
+	}
+}
+
+// Rules implements common.RuleMatchNamer, returning the rules of the wrapped
+// namer if it has any.
+func (n *ExeInodeNamer) Rules() []string {
+	if rn, ok := n.namer.(common.RuleMatchNamer); ok {
+		return rn.Rules()
+	}
+	return nil
+}
@@ -65,9 +65,92 @@ func (n namer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
 	return false, ""
 }
 
+// parentNamer matches procs whose parent has one of its names, naming them
+// after themselves.
+type parentNamer map[string]struct{}
+
+func (n parentNamer) String() string {
+	return fmt.Sprintf("parents %v", map[string]struct{}(n))
+}
+
+func (n parentNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	if _, ok := n[nacl.ParentName]; ok {
+		return true, nacl.Name
+	}
+	return false, ""
+}
+
+// containerNamer matches procs in containers, naming them after the
+// container's name if known, else its id.
+type containerNamer struct{}
+
+func (containerNamer) String() string {
+	return "containers"
+}
+
+func (containerNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	if nacl.ContainerName != "" {
+		return true, nacl.ContainerName
+	}
+	return nacl.ContainerID != "", nacl.ContainerID
+}
+
+// mapContainerNamer implements ContainerNamer, failing for unknown ids.
+type mapContainerNamer map[string]string
+
+func (m mapContainerNamer) ContainerName(id string) (string, error) {
+	if name, ok := m[id]; ok {
+		return name, nil
+	}
+	return "", fmt.Errorf("no such container %s", id)
+}
+
+func (m mapContainerNamer) EndCycle(map[string]bool) {}
+
+// mapPodResolver implements PodResolver, failing for unknown pod UIDs.
+type mapPodResolver map[string]common.Pod
+
+func (m mapPodResolver) ResolvePod(pod common.Pod) (common.Pod, error) {
+	if resolved, ok := m[pod.UID]; ok {
+		return resolved, nil
+	}
+	return pod, fmt.Errorf("no such pod %s", pod.UID)
+}
+
+// ruleNamer puts procs whose name is one of its rules in a single group.
+type ruleNamer []string
+
+func (n ruleNamer) String() string {
+	return fmt.Sprintf("%v", []string(n))
+}
+
+func (n ruleNamer) MatchAndName(nacl common.ProcAttributes) (bool, string) {
+	matched, name, _ := n.MatchAndNameRule(nacl)
+	return matched, name
+}
+
+func (n ruleNamer) MatchAndNameRule(nacl common.ProcAttributes) (bool, string, int) {
+	for i, name := range n {
+		if name == nacl.Name {
+			return true, "all", i
+		}
+	}
+	return false, "", -1
+}
+
+func (n ruleNamer) Rules() []string {
+	return n
+}
+
 func newProcIDStatic(pid, ppid int, startTime uint64, name string, cmdline []string) (ID, Static) {
 	return ID{pid, startTime},
-		Static{name, cmdline, ppid, time.Unix(int64(startTime), 0).UTC(), 1000}
+		Static{
+			Name:         name,
+			Cmdline:      cmdline,
+			ParentPid:    ppid,
+			StartTime:    time.Unix(int64(startTime), 0).UTC(),
+			EffectiveUID: 1000,
+		}
 }
 
 func newProc(pid int, name string, m Metrics) IDInfo {
@@ -98,8 +181,14 @@ func piinfo(pid int, name string, c Counts, m Memory, f Filedesc, t int) IDInfo
 func piinfost(pid int, name string, c Counts, m Memory, f Filedesc, t int, s States) IDInfo {
 	id, static := newProcIDStatic(pid, 0, 0, name, nil)
 	return IDInfo{
-		ID:      id,
-		Static:  static,
-		Metrics: Metrics{c, m, f, uint64(t), s, ""},
+		ID:     id,
+		Static: static,
+		Metrics: Metrics{
+			Counts:     c,
+			Memory:     m,
+			Filedesc:   f,
+			NumThreads: uint64(t),
+			States:     s,
+		},
 	}
 }
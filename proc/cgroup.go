@@ -0,0 +1,233 @@
+package proc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type (
+	// cgroupStats describes a single cgroup v2 cgroup.
+	cgroupStats struct {
+		// frozen is true if the cgroup's freezer reports it as frozen.
+		frozen bool
+		// pressure is nil if PSI isn't available for the cgroup.
+		pressure *Pressure
+		// dirtyBytes and writebackBytes are the file_dirty and
+		// file_writeback fields of memory.stat.
+		dirtyBytes     uint64
+		writebackBytes uint64
+		// soleProc is true if the cgroup contains exactly one proc, and
+		// memoryCurrent is then the value of memory.current, if readable.
+		// Both are only read if the reader's memory field is set.
+		soleProc      bool
+		memoryCurrent *uint64
+		// memoryLimit is the value of memory.max, or 0 if it's "max" or
+		// unreadable.
+		memoryLimit uint64
+	}
+
+	// Pressure holds the "some avg10" pressure stall information of a
+	// cgroup: the percentage of the last 10 seconds during which at least
+	// one task was stalled waiting on each resource.
+	Pressure struct {
+		CPU    float64
+		Memory float64
+		IO     float64
+	}
+
+	// cgroupReader reads cgroup interface files from a cgroup v2 hierarchy.
+	// Results are cached so that each cgroup is read at most once per cycle,
+	// no matter how many procs belong to it.
+	cgroupReader struct {
+		root  string
+		cache map[string]cgroupStats
+		// v1MemoryLimits caches memory.limit_in_bytes of cgroups in the
+		// v1 memory hierarchy.
+		v1MemoryLimits map[string]uint64
+		// memory enables reading the memory usage of single-proc cgroups.
+		memory bool
+	}
+)
+
+// v1MemoryUnlimited is the lowest memory.limit_in_bytes taken to mean no
+// limit.  The kernel reports an unlimited cgroup as the largest page-aligned
+// int64, which depends on the page size, so anything this large will do.
+const v1MemoryUnlimited = 1 << 62
+
+// parseCgroupPaths extracts from the contents of /proc/<pid>/cgroup the
+// unified (v2) hierarchy path and, on cgroup v1 hosts, the paths in the
+// hierarchy named "systemd", which is the one that follows systemd units,
+// and in that of the memory controller.  Any is empty if absent.
+func parseCgroupPaths(data []byte) (unified, systemd, memory string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		switch {
+		case fields[0] == "0" && fields[1] == "":
+			unified = fields[2]
+		case fields[1] == "name=systemd":
+			systemd = fields[2]
+		default:
+			// A v1 hierarchy may have several controllers, e.g. "memory,hugetlb".
+			for _, controller := range strings.Split(fields[1], ",") {
+				if controller == "memory" {
+					memory = fields[2]
+				}
+			}
+		}
+	}
+	return unified, systemd, memory
+}
+
+func newCgroupReader(root string, memory bool) *cgroupReader {
+	return &cgroupReader{
+		root:           root,
+		cache:          make(map[string]cgroupStats),
+		v1MemoryLimits: make(map[string]uint64),
+		memory:         memory,
+	}
+}
+
+// reset discards cached results, forcing cgroups to be reread.  It should be
+// called at the start of each cycle.
+func (c *cgroupReader) reset() {
+	c.cache = make(map[string]cgroupStats)
+	c.v1MemoryLimits = make(map[string]uint64)
+}
+
+// v1MemoryLimit returns the memory.limit_in_bytes of the cgroup at path in
+// the v1 memory hierarchy, which is expected to be mounted at memory below
+// the root, or 0 if it's unlimited or unreadable.
+func (c *cgroupReader) v1MemoryLimit(path string) uint64 {
+	if limit, ok := c.v1MemoryLimits[path]; ok {
+		return limit
+	}
+
+	var limit uint64
+	if data, err := ioutil.ReadFile(filepath.Join(c.root, "memory", path, "memory.limit_in_bytes")); err == nil {
+		if n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err == nil && n < v1MemoryUnlimited {
+			limit = n
+		}
+	}
+	c.v1MemoryLimits[path] = limit
+	return limit
+}
+
+// get returns the stats for the cgroup at path, relative to the hierarchy
+// root.  Interface files that are missing or unreadable yield zero values.
+func (c *cgroupReader) get(path string) cgroupStats {
+	if stats, ok := c.cache[path]; ok {
+		return stats
+	}
+
+	var stats cgroupStats
+	dir := filepath.Join(c.root, path)
+	// cgroup.events is absent on the root cgroup and on kernels older than
+	// 5.2 which lack the v2 freezer; either way the cgroup isn't frozen.
+	if events, err := c.readKeyed(dir, "cgroup.events"); err == nil {
+		stats.frozen = events["frozen"] == "1"
+	}
+
+	// The *.pressure files only exist if the kernel was built with PSI
+	// support (4.20+) and it wasn't disabled at boot.
+	var pressure Pressure
+	var found bool
+	for name, dest := range map[string]*float64{
+		"cpu.pressure":    &pressure.CPU,
+		"memory.pressure": &pressure.Memory,
+		"io.pressure":     &pressure.IO,
+	} {
+		if avg10, err := c.readPressure(dir, name); err == nil {
+			*dest = avg10
+			found = true
+		}
+	}
+	if found {
+		stats.pressure = &pressure
+	}
+
+	// memory.stat is absent unless the memory controller is enabled for the
+	// cgroup, and older kernels name these fields dirty and writeback.
+	if memstat, err := c.readKeyed(dir, "memory.stat"); err == nil {
+		stats.dirtyBytes = parseFirstUint(memstat, "file_dirty", "dirty")
+		stats.writebackBytes = parseFirstUint(memstat, "file_writeback", "writeback")
+	}
+
+	// memory.max is absent on the root cgroup, and holds "max" if unlimited.
+	if max, err := ioutil.ReadFile(filepath.Join(dir, "memory.max")); err == nil {
+		stats.memoryLimit, _ = strconv.ParseUint(strings.TrimSpace(string(max)), 10, 64)
+	}
+
+	if c.memory {
+		// cgroup.procs lists one pid per line.
+		if procs, err := ioutil.ReadFile(filepath.Join(dir, "cgroup.procs")); err == nil {
+			stats.soleProc = bytes.Count(procs, []byte("\n")) == 1
+		}
+		if stats.soleProc {
+			if current, err := ioutil.ReadFile(filepath.Join(dir, "memory.current")); err == nil {
+				if n, err := strconv.ParseUint(strings.TrimSpace(string(current)), 10, 64); err == nil {
+					stats.memoryCurrent = &n
+				}
+			}
+		}
+	}
+
+	c.cache[path] = stats
+	return stats
+}
+
+// readPressure returns the "some avg10" value from a PSI file.
+func (c *cgroupReader) readPressure(dir, name string) (float64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "some" || !strings.HasPrefix(fields[1], "avg10=") {
+			continue
+		}
+		return strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+	}
+	return 0, fmt.Errorf("no 'some avg10' in %s", name)
+}
+
+// readKeyed parses a cgroup interface file made of "key value" lines.
+func (c *cgroupReader) readKeyed(dir, name string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	kv := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			kv[fields[0]] = fields[1]
+		}
+	}
+	return kv, nil
+}
+
+// parseFirstUint returns the value of the first of keys present in kv, or 0
+// if none are present or the value isn't a number.
+func parseFirstUint(kv map[string]string, keys ...string) uint64 {
+	for _, key := range keys {
+		if v, ok := kv[key]; ok {
+			n, _ := strconv.ParseUint(v, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,156 @@
+package proc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dockerIDRegexp matches the cgroup path components holding a Docker
+// container's id: "docker-<id>.scope" with the systemd cgroup driver, or
+// "<id>" below a "docker" component with the cgroupfs driver.
+var dockerIDRegexp = regexp.MustCompile(`(?:/docker-|/docker/)([0-9a-f]{64})(?:\.scope)?(?:/|$)`)
+
+// ErrNameDeferred is returned by a ContainerNamer that has run out of time
+// for lookups this cycle.  The Tracker then leaves procs in the container
+// unmatched until a later cycle.
+var ErrNameDeferred = fmt.Errorf("container name lookup deferred")
+
+// dockerLookupBudget bounds the time a DockerNamer spends on lookups in a
+// cycle, not counting the one in progress when it runs out.
+const dockerLookupBudget = time.Second
+
+type (
+	// ContainerNamer resolves container ids to names.
+	ContainerNamer interface {
+		// ContainerName returns the name of container id, or
+		// ErrNameDeferred if it can't be looked up this cycle.
+		ContainerName(id string) (string, error)
+		// EndCycle is called by the Tracker after each Update with the ids
+		// of the containers of the tracked procs.  Containers neither in
+		// live nor asked about during the cycle may be forgotten.
+		EndCycle(live map[string]bool)
+	}
+
+	// DockerNamer is a ContainerNamer that asks the Docker daemon.  Names
+	// are cached for as long as their container is in use, since they
+	// can't change while a container exists.  Failed lookups aren't
+	// retried for a minute, so that an unreachable daemon doesn't slow
+	// down every cycle, and lookups are deferred to the next cycle once
+	// dockerLookupBudget is spent.
+	DockerNamer struct {
+		client   *http.Client
+		mu       sync.Mutex
+		names    map[string]string
+		failedAt map[string]time.Time
+		// asked holds the ids asked about this cycle, and spent the time
+		// taken by lookups.
+		asked map[string]bool
+		spent time.Duration
+	}
+
+	// dockerContainer is the part of the Docker API's container inspect
+	// response we use.
+	dockerContainer struct {
+		Name string
+	}
+)
+
+// containerID returns the id of the Docker container whose cgroup path is
+// cgroup, or "" if it's not a container's.
+func containerID(cgroup string) string {
+	m := dockerIDRegexp.FindStringSubmatch(cgroup)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// NewDockerNamer returns a DockerNamer using the Docker API socket at path.
+func NewDockerNamer(path string) *DockerNamer {
+	dialer := net.Dialer{Timeout: time.Second}
+	return &DockerNamer{
+		client: &http.Client{
+			Timeout: 2 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+		names:    make(map[string]string),
+		failedAt: make(map[string]time.Time),
+		asked:    make(map[string]bool),
+	}
+}
+
+// ContainerName implements ContainerNamer.
+func (d *DockerNamer) ContainerName(id string) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.asked[id] = true
+	if name, ok := d.names[id]; ok {
+		return name, nil
+	}
+	if t, ok := d.failedAt[id]; ok && time.Since(t) < time.Minute {
+		return "", fmt.Errorf("lookup of container %s failed recently", id)
+	}
+	if d.spent >= dockerLookupBudget {
+		return "", ErrNameDeferred
+	}
+
+	start := time.Now()
+	name, err := d.inspect(id)
+	d.spent += time.Since(start)
+	if err != nil {
+		d.failedAt[id] = time.Now()
+		return "", err
+	}
+	delete(d.failedAt, id)
+	d.names[id] = name
+	return name, nil
+}
+
+// EndCycle implements ContainerNamer, also renewing the lookup budget.
+func (d *DockerNamer) EndCycle(live map[string]bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id := range d.names {
+		if !live[id] && !d.asked[id] {
+			delete(d.names, id)
+		}
+	}
+	for id := range d.failedAt {
+		if !live[id] && !d.asked[id] {
+			delete(d.failedAt, id)
+		}
+	}
+	for id := range d.asked {
+		delete(d.asked, id)
+	}
+	d.spent = 0
+}
+
+// inspect asks the daemon for the name of container id.
+func (d *DockerNamer) inspect(id string) (string, error) {
+	resp, err := d.client.Get("http://docker/containers/" + url.PathEscape(id) + "/json")
+	if err != nil {
+		return "", fmt.Errorf("error inspecting container %s: %v", id, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error inspecting container %s: %s", id, resp.Status)
+	}
+	var c dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
+		return "", fmt.Errorf("error decoding container %s: %v", id, err)
+	}
+	return strings.TrimPrefix(c.Name, "/"), nil
+}
@@ -1,6 +1,12 @@
 package proc
 
 import (
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+	"sync"
 	"time"
 
 	seq "github.com/ncabatoff/go-seq/seq"
@@ -9,17 +15,280 @@ import (
 
 type (
 	// Grouper is the top-level interface to the process metrics.  All tracked
-	// procs sharing the same group name are aggregated.
+	// procs sharing the same group name are aggregated.  A Grouper is safe
+	// for concurrent use: Update is its only mutator, and the methods that
+	// report on the last Update wait for any Update in progress.
 	Grouper struct {
+		// mu guards all the state below, including that of tracker.
+		mu sync.Mutex
 		// groupAccum records the historical accumulation of a group so that
 		// we can avoid ever decreasing the counts we return.
-		groupAccum  map[string]Counts
+		groupAccum map[string]Counts
+		// starts accumulates Group.ProcStarts, and extraAccum the other
+		// counters of Group that aren't part of Counts.
+		starts     map[string]uint64
+		extraAccum map[string]extraCounters
+		// netDevs is the traffic last seen in each network namespace, from
+		// which the traffic of the current cycle is taken.
+		netDevs     map[uint64]NetDev
 		tracker     *Tracker
 		threadAccum map[string]map[string]Threads
-		debug       bool
+		// cgroups is nil unless cgroup metrics are enabled.
+		cgroups *cgroupReader
+		// lastSystem is the system usage seen last cycle, if any.
+		lastSystem *SystemUsage
+		// firstSeen records when each group was first observed with procs.
+		firstSeen map[string]time.Time
+		// warm records the groups which have been observed for at least
+		// Options.Warmup, and may thus be reported.
+		warm map[string]bool
+		// rssSamples holds the latest resident memory samples of each group,
+		// oldest first.  Only maintained when Options.LeakWindow is set.
+		rssSamples map[string][]rssSample
+		// scratch is reused by each cycle to reduce allocations.
+		scratch groupScratch
+		// exited records when each group known to have lost all its procs
+		// did so, and emptyCycles for how many cycles it's been without
+		// procs.  Only maintained when Options.Linger or LingerCycles is set.
+		exited      map[string]time.Time
+		emptyCycles map[string]int
+		// tracked holds the updates from the last cycle, whose storage is
+		// reused by the next.
+		tracked []Update
+		// lastStats describes the last Update.
+		lastStats UpdateStats
+		// snapshot is the result of the last successful Update.
+		snapshot GroupByName
+		// lastCycle is when the last cycle happened, zero before the first.
+		lastCycle time.Time
+		opts      Options
+		debug     bool
 	}
 
-	// GroupByName maps group name to group metrics.
+	// Options enables optional, typically more expensive, behaviour of the
+	// Grouper and its Tracker.  The zero value leaves it all disabled.
+	Options struct {
+		// CgroupRoot is where the cgroup v2 hierarchy is mounted.  If
+		// non-empty, per-group metrics based on the cgroups of member
+		// procs are collected.
+		CgroupRoot string
+		// CgroupMemory, if true, makes procs which are the only member of
+		// their cgroup report the cgroup's memory.current as their resident
+		// memory.  Unlike RSS this includes the page cache and kernel
+		// memory charged to the cgroup, making it a more accurate measure
+		// for single-process containers.  CgroupRoot must also be set.
+		CgroupMemory bool
+		// UntrackedGroupName, if non-empty, names a synthetic group holding
+		// the usage of the whole system minus that of all tracked groups.
+		// System must also be set.
+		UntrackedGroupName string
+		// System provides the system-wide usage for UntrackedGroupName.
+		System SystemSource
+		// DefaultGroup, if non-empty, names the group of procs that would
+		// otherwise be ignored: those the namer doesn't match and that
+		// aren't tracked with their parent.
+		DefaultGroup string
+		// Warmup is how long a group must have existed before it's reported.
+		// Groups that disappear before then are never reported at all.
+		Warmup time.Duration
+		// MaxAges gives the expected maximum lifetime of procs in some groups,
+		// keyed by group name.  Members of those groups that have been
+		// running for longer are counted in Group.ProcsExceedingMaxAge.
+		MaxAges map[string]time.Duration
+		// PidNamespace, if nonzero, restricts tracking to procs in the pid
+		// namespace with this inode.  Procs whose namespace can't be read
+		// aren't tracked.
+		PidNamespace uint64
+		// DetailDeadline, if nonzero, is how long a cycle may spend reading
+		// procs before it starts skipping the more expensive reads, such as
+		// enumerating open fds, for the remaining procs.  This way all procs
+		// get at least their basic metrics reported even when reading them
+		// is slow.  Skipped reads are counted in CollectErrors.DetailSkipped.
+		DetailDeadline time.Duration
+		// Linger, if nonzero, is how long a group whose procs have all exited
+		// continues to be reported, with Group.Final set, before it's
+		// forgotten.  By default such groups are reported forever.
+		Linger time.Duration
+		// LingerCycles, if nonzero, is how many cycles a group whose procs
+		// have all exited continues to be reported, with Group.Final set,
+		// before it's forgotten.  If Linger is also set, the group is
+		// forgotten as soon as either has been exceeded.
+		LingerCycles int
+		// StaleCycles is how many consecutive cycles a tracked proc may go
+		// unseen, e.g. because reading it failed, before it's forgotten.
+		// Meanwhile it's reported as last seen, with no increase in its
+		// counts, and if it reappears its counts continue where they left
+		// off.  By default procs are forgotten as soon as they're missed.
+		StaleCycles int
+		// SampleSize, if nonzero, limits how many procs in each group have
+		// their more expensive metrics, such as the number of open fds,
+		// read each cycle.  The procs with the lowest pids are chosen, and
+		// the group totals are extrapolated from them.  Procs are always
+		// fully read on the cycle they're first seen.
+		SampleSize int
+		// Workers, if greater than one, is how many goroutines read procs
+		// concurrently each cycle.  The procs read are then merged into
+		// the tracker's state serially, so the results don't depend on it.
+		Workers int
+		// Fingerprint, if true, enables computing Group.Fingerprint.
+		Fingerprint bool
+		// ExcludeSelf, if true, prevents tracking this process and all of its
+		// descendants, e.g. helpers it runs.
+		ExcludeSelf bool
+		// ContainerNamer, if set, resolves the ids of the containers procs
+		// run in to names, for matching.
+		ContainerNamer ContainerNamer
+		// PodResolver, if set, resolves the pods procs run in to their
+		// namespaces and names, and enables computing Group.Pods.
+		PodResolver PodResolver
+		// Reducers compute custom group metrics, reported in Group.Custom
+		// under the same names.
+		Reducers map[string]Reducer
+		// LeakWindow, if nonzero, is how many cycles of each group's
+		// resident memory to fit a linear trend to, giving
+		// Group.ResidentGrowthRate.
+		LeakWindow int
+		// LeakThreshold is the growth rate in bytes per second above which
+		// Group.LeakSuspected is set, once LeakWindow cycles are available.
+		LeakThreshold float64
+		// HungCycles, if nonzero, is how many consecutive cycles a proc must
+		// go without using CPU or doing I/O, while running or in
+		// uninterruptible sleep, before it's counted in Group.HungProcs.
+		HungCycles int
+		// AgeBuckets, if non-empty, are the upper bounds in seconds, in
+		// increasing order, of the buckets of Group.Ages.
+		AgeBuckets []float64
+		// VSZBloatRatio, if nonzero, is the ratio of virtual to resident
+		// memory above which a proc is counted in Group.ProcsWithVSZBloat.
+		// Runtimes that merely reserve address space, like Go or the JVM,
+		// typically stay below some per-runtime ratio, so exceeding it
+		// distinguishes a genuine virtual memory leak from reservation.
+		VSZBloatRatio float64
+		// ThreadStates, if true, enables computing Group.ThreadStates.
+		ThreadStates bool
+		// UserProcs, if true, enables computing Group.UserProcs.
+		UserProcs bool
+		// CounterWrap, if true, treats a counter that went backwards from
+		// close to the maximum value of its type as having wrapped around,
+		// rather than having been reset.  See Counts.SubWrapping.
+		CounterWrap bool
+		// MemberAggregates, if true, enables computing Group.Members.
+		MemberAggregates bool
+		// CPURatio, if true, enables computing Group.CPURatio.
+		CPURatio bool
+	}
+
+	// extraCounters accumulates the CPU time of a group by scheduling class,
+	// the traffic of its network namespaces and the time lived by its procs.
+	extraCounters struct {
+		realtime, normal float64
+		netRx, netTx     uint64
+		lifetime         float64
+	}
+
+	// groupScratch holds the working state of a single cycle of the
+	// Grouper, by group name.  Nothing in it may be referenced by the
+	// results of a cycle, since it's reused by the next one.
+	groupScratch struct {
+		threads map[string][]ThreadUpdate
+		updates map[string][]Update
+		cgroups map[string]map[string]bool
+		// netnsOwners holds the proc whose group each network namespace
+		// seen this cycle is attributed to, and netDevs their traffic.
+		netnsOwners map[uint64]ID
+		netDevs     map[uint64]NetDev
+		// fdsKnown and fdsSkipped count procs whose open fds are known and
+		// skipped, so that the totals of the expensive metrics can be
+		// extrapolated to include the latter.
+		fdsKnown   map[string]int
+		fdsSkipped map[string]int
+	}
+
+	// rssSample is the resident memory of a group at a point in time.
+	rssSample struct {
+		time time.Time
+		rss  uint64
+	}
+
+	// Reducer computes a custom group metric from the updates of the procs
+	// in a group.  It's never called with an empty slice, and mustn't retain
+	// the slice or the Wchans maps of its updates, whose storage is reused.
+	Reducer func(members []Update) float64
+
+	// GroupMemberStats describes the resource usage of a single member of a
+	// group, or a percentile of that usage across the group's members.
+	GroupMemberStats struct {
+		ResidentBytes uint64
+		// CPUSeconds is the user plus system CPU time used during the last
+		// cycle.
+		CPUSeconds float64
+	}
+
+	// MemberAggregates gives the minimum, maximum and average of some
+	// metrics of the members of a group, revealing outliers that sums hide.
+	// Each metric is aggregated separately, so Min and Max needn't describe
+	// any single proc.
+	MemberAggregates struct {
+		Min, Max, Avg MemberMetrics
+	}
+
+	// MemberMetrics holds metrics of a member of a group, or an aggregate of
+	// them.  Rates are per second over the last cycle, and are zero on the
+	// first cycle and for procs first seen in the last one.
+	MemberMetrics struct {
+		ResidentBytes float64
+		VirtualBytes  float64
+		SwapBytes     float64
+		// CPURate is the user plus system CPU seconds used per second.
+		CPURate        float64
+		ReadBytesRate  float64
+		WriteBytesRate float64
+	}
+
+	// UpdateStats describes the work done by a Grouper.Update.
+	UpdateStats struct {
+		// Duration is how long the Update took, including both reading the
+		// procs and aggregating them into groups.
+		Duration time.Duration
+		// Scanned is the number of procs read.
+		Scanned int
+		// ReadErrors is the number of procs skipped because their metrics
+		// couldn't be read, as in CollectErrors.Read.
+		ReadErrors int
+	}
+
+	// StateSizes gives the number of entries in the internal state of a
+	// Grouper and its Tracker.  It's meant for checking that this state
+	// doesn't grow without bound as procs come and go.
+	StateSizes struct {
+		// TrackedProcs and IgnoredProcs are the procs known to the Tracker.
+		TrackedProcs int
+		IgnoredProcs int
+		// TrackedThreads is the total over all tracked procs.
+		TrackedThreads int
+		ProcIds        int
+		Usernames      int
+		// The following are the number of groups with state of each kind.
+		GroupAccum  int
+		ThreadAccum int
+		FirstSeen   int
+		Warm        int
+		Exited      int
+		RssSamples  int
+	}
+
+	// AgeHistogram is a histogram of the ages of the procs in a group.
+	AgeHistogram struct {
+		// Buckets maps each of Options.AgeBuckets to the number of procs
+		// no older than it, in seconds.
+		Buckets map[float64]uint64
+		Count   uint64
+		// Sum is the total age of the procs in seconds.
+		Sum float64
+	}
+
+	// GroupByName maps group name to group metrics, as returned by
+	// Grouper.Update and Grouper.Snapshot.
 	GroupByName map[string]Group
 
 	// Threads collects metrics for threads in a group sharing a thread name.
@@ -29,32 +298,211 @@ type (
 		Counts
 	}
 
-	// Group describes the metrics of a single group.
+	// Group describes the metrics of a single group.  Counts accumulate
+	// from when the group was first seen and never decrease; everything
+	// else describes the group's procs as of the last Update, and is zero
+	// once they've all exited.
 	Group struct {
 		Counts
+		// States is how many of the group's procs are in each state.
 		States
+		// ThreadStates is how many of the threads of the group's procs are
+		// in each state, if Options.ThreadStates is set.
+		ThreadStates States
+		// UserProcs is how many of the group's procs each effective user
+		// owns, if Options.UserProcs is set.
+		UserProcs map[User]int
+		// Wchans is how many of the group's procs are waiting in each
+		// kernel function, omitting those that aren't waiting.
 		Wchans map[string]int
-		Procs  int
+		// Procs is the number of procs in the group.
+		Procs int
+		// MatchedViaParent is how many of Procs are in the group because
+		// their parent is, rather than being matched themselves; see
+		// MatchedDirect.
+		MatchedViaParent int
+		// ProcStarts is how many procs have joined the group since it was
+		// first seen, e.g. restarts of a crashing service.  The procs
+		// already running when the Grouper started, or when its namer was
+		// last set, aren't counted.
+		ProcStarts uint64
+		// CPURealtimeSeconds and CPUNormalSeconds split the group's CPU
+		// time by the scheduling class of the procs that used it.  Like
+		// Counts they accumulate from when the group was first seen.
+		CPURealtimeSeconds float64
+		CPUNormalSeconds   float64
+		// LifetimeSeconds is the process-seconds lived by the procs, which
+		// likewise accumulates from when the group was first seen.
+		LifetimeSeconds float64
+		// Memory sums the memory usage of the procs.
 		Memory
+		// OldestStartTime is the start time of the group's oldest proc.
 		OldestStartTime time.Time
-		OpenFDs         uint64
-		WorstFDratio    float64
-		NumThreads      uint64
-		Threads         []Threads
+		// OpenFDs is the number of open fds of the procs, extrapolated to
+		// those whose fds weren't read.
+		OpenFDs uint64
+		// OpenFDTypes breaks down OpenFDs, if FS.GatherFDTypes is set.
+		// Like OpenFDs, it's extrapolated.
+		OpenFDTypes FDTypes
+		// Inotify sums the inotify instances and watches of the procs, if
+		// FS.GatherInotify is set.  Like OpenFDs, it's extrapolated.
+		Inotify Inotify
+		// WorstFDratio is the highest ratio of open fds to fd soft limit
+		// amongst the procs.
+		WorstFDratio float64
+		// WorstFDPid and WorstFDName identify the proc with WorstFDratio,
+		// the lowest pid if several share it, and WorstFDOpen and
+		// WorstFDLimit are its open fds and fd limit.  WorstFDPid is 0 if
+		// no proc has any fds open.
+		WorstFDPid   int
+		WorstFDName  string
+		WorstFDOpen  uint64
+		WorstFDLimit uint64
+		// OpenFDLimit and OpenFDHardLimit are the lowest fd soft and hard
+		// limits amongst the procs, or 0 if none of them could be read.
+		OpenFDLimit     uint64
+		OpenFDHardLimit uint64
+		// WorstOOMScore is the highest oom_score amongst the procs, i.e. that
+		// of the member the OOM killer would pick first, and OOMScoreAdj is
+		// that member's oom_score_adj.  WorstOOMScore is -1 if none of the
+		// procs' scores could be read.
+		WorstOOMScore int64
+		OOMScoreAdj   int64
+		// MinNice and MaxNice are the lowest and highest nice values
+		// amongst the procs, i.e. those of the most and least favourably
+		// scheduled members.
+		MinNice int64
+		MaxNice int64
+		// MinPriority and MaxPriority are likewise the lowest and highest
+		// priorities, which are negative for realtime policies.
+		MinPriority int64
+		MaxPriority int64
+		// NumThreads is the total number of threads of the procs.
+		NumThreads uint64
+		// Threads breaks down the group's threads by thread name.
+		Threads []Threads
+		// ProcsFrozen is the number of procs whose cgroup is frozen.  Only
+		// computed when Options.CgroupRoot is set.
+		ProcsFrozen int
+		// Pressure is the worst PSI stall percentage for each resource among
+		// the cgroups of member procs, or nil if none of them have PSI.  Only
+		// computed when Options.CgroupRoot is set.
+		Pressure *Pressure
+		// DirtyBytes and WritebackBytes are the file memory of the cgroups
+		// of member procs that is dirty or under writeback, summed over
+		// distinct cgroups.  Only computed when Options.CgroupRoot is set.
+		DirtyBytes     uint64
+		WritebackBytes uint64
+		// MemoryLimitBytes is the lowest memory limit among the cgroups of
+		// member procs, from memory.max or, on cgroup v1 hosts,
+		// memory.limit_in_bytes.  It's 0 if none of them is limited.  Only
+		// computed when Options.CgroupRoot is set.
+		MemoryLimitBytes uint64
+		// NetRxBytes and NetTxBytes are the traffic of the network
+		// namespaces of member procs, each namespace counted once.  Like
+		// Counts they accumulate, counting a namespace's traffic only while
+		// it's in the group.  Only computed when FS.GatherNetDev is set.
+		NetRxBytes uint64
+		NetTxBytes uint64
+		// ProcsExceedingMaxAge is the number of procs that have been running
+		// for longer than the group's entry in Options.MaxAges, if any.
+		ProcsExceedingMaxAge int
+		// Ages is the histogram of the ages of the group's procs, if
+		// Options.AgeBuckets is set and the group has procs.
+		Ages *AgeHistogram
+		// ProcsWithVSZBloat is the number of procs whose virtual memory is
+		// more than Options.VSZBloatRatio times their resident memory.
+		ProcsWithVSZBloat int
+		// ProcsWithCoredumpEnabled is the number of procs with a nonzero
+		// soft limit on core file size.
+		ProcsWithCoredumpEnabled int
+		// ProcsBeingTraced is the number of procs with a tracer attached,
+		// e.g. a debugger.
+		ProcsBeingTraced int
+		// SetuidProcs is the number of procs whose executable is setuid or
+		// setgid.  Procs whose executable can't be read aren't counted.
+		SetuidProcs int
+		// ChrootedProcs is the number of procs whose root directory isn't
+		// "/".  Procs whose root can't be read aren't counted.
+		ChrootedProcs int
+		// HungProcs is the number of procs that appear to be hung, see
+		// Options.HungCycles.
+		HungProcs int
+		// ResidentGrowthRate is the slope in bytes per second of a least
+		// squares fit to the group's resident memory over the last
+		// Options.LeakWindow cycles.
+		ResidentGrowthRate float64
+		// LeakSuspected is true if ResidentGrowthRate exceeds
+		// Options.LeakThreshold over a full window.
+		LeakSuspected bool
+		// Fingerprint is a hash of the pids and start times of the procs
+		// in the group, which changes whenever its membership does.  Only
+		// computed when Options.Fingerprint is set.
+		Fingerprint uint64
+		// Pods are the distinct pod containers the procs run in, sorted,
+		// omitting procs not in a pod.  Only computed when
+		// Options.PodResolver is set.
+		Pods []common.Pod
+		// Custom holds the result of each of Options.Reducers, for groups
+		// which currently have procs.
+		Custom map[string]float64
+		// Members aggregates the metrics of the group's procs.  Only
+		// computed when Options.MemberAggregates is set, for groups which
+		// currently have procs.
+		Members *MemberAggregates
+		// CPURatio is the user plus system CPU seconds used by the group's
+		// procs per second since the last cycle, from 0 to the number of
+		// CPUs.  Only computed when Options.CPURatio is set, for groups
+		// which currently have procs, and not on the first cycle, for lack
+		// of an interval.
+		CPURatio *float64
+		// TrackedDurationSeconds is how long it's been since the group was
+		// first seen.  Dividing the CPU time by it gives the group's average
+		// CPU utilization since then.
+		TrackedDurationSeconds float64
+		// Final is true if the group no longer has any procs, and will be
+		// dropped once Options.Linger or LingerCycles has elapsed.  Only set
+		// when either of them is.
+		Final bool
 	}
 )
 
+// DefaultAgeBuckets are suggested Options.AgeBuckets, ranging from a second
+// to a week.
+var DefaultAgeBuckets = []float64{1, 10, 60, 600, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600}
+
 // Returns true if x < y.  Test designers should ensure they always have
 // a unique name/numthreads combination for each group.
 func lessThreads(x, y Threads) bool { return seq.Compare(x, y) < 0 }
 
 // NewGrouper creates a grouper.
-func NewGrouper(namer common.MatchNamer, trackChildren, alwaysRecheck, debug bool) *Grouper {
+func NewGrouper(namer common.MatchNamer, trackChildren, alwaysRecheck, debug bool, opts Options) *Grouper {
 	g := Grouper{
 		groupAccum:  make(map[string]Counts),
+		starts:      make(map[string]uint64),
+		extraAccum:  make(map[string]extraCounters),
+		netDevs:     make(map[uint64]NetDev),
 		threadAccum: make(map[string]map[string]Threads),
-		tracker:     NewTracker(namer, trackChildren, alwaysRecheck, debug),
-		debug:       debug,
+		firstSeen:   make(map[string]time.Time),
+		warm:        make(map[string]bool),
+		exited:      make(map[string]time.Time),
+		emptyCycles: make(map[string]int),
+		rssSamples:  make(map[string][]rssSample),
+		scratch: groupScratch{
+			threads:     make(map[string][]ThreadUpdate),
+			updates:     make(map[string][]Update),
+			cgroups:     make(map[string]map[string]bool),
+			netnsOwners: make(map[uint64]ID),
+			netDevs:     make(map[uint64]NetDev),
+			fdsKnown:    make(map[string]int),
+			fdsSkipped:  make(map[string]int),
+		},
+		tracker: NewTracker(namer, trackChildren, alwaysRecheck, debug, opts),
+		opts:    opts,
+		debug:   debug,
+	}
+	if opts.CgroupRoot != "" {
+		g.cgroups = newCgroupReader(opts.CgroupRoot, opts.CgroupMemory)
 	}
 	return &g
 }
@@ -63,19 +511,84 @@ func groupadd(grp Group, ts Update) Group {
 	var zeroTime time.Time
 
 	grp.Procs++
+	if ts.ViaParent {
+		grp.MatchedViaParent++
+	}
 	grp.Memory.ResidentBytes += ts.Memory.ResidentBytes
 	grp.Memory.VirtualBytes += ts.Memory.VirtualBytes
 	grp.Memory.VmSwapBytes += ts.Memory.VmSwapBytes
+	grp.Memory.LockedBytes += ts.Memory.LockedBytes
+	grp.Memory.StackBytes += ts.Memory.StackBytes
+	grp.Memory.DataBytes += ts.Memory.DataBytes
+	grp.Memory.TextBytes += ts.Memory.TextBytes
+	grp.Memory.ProportionalBytes += ts.Memory.ProportionalBytes
+	grp.Memory.ResidentPrivateBytes += ts.Memory.ResidentPrivateBytes
+	grp.Memory.ResidentSharedBytes += ts.Memory.ResidentSharedBytes
+	grp.Memory.ResidentPeak += ts.Memory.ResidentPeak
+	grp.Memory.VirtualPeak += ts.Memory.VirtualPeak
 	if ts.Filedesc.Open != -1 {
 		grp.OpenFDs += uint64(ts.Filedesc.Open)
 	}
+	grp.OpenFDTypes.Add(ts.FDTypes)
+	grp.Inotify.Add(ts.Inotify)
 	openratio := float64(ts.Filedesc.Open) / float64(ts.Filedesc.Limit)
 	if grp.WorstFDratio < openratio {
 		grp.WorstFDratio = openratio
 	}
+	grp.OpenFDLimit = minLimit(grp.OpenFDLimit, ts.Filedesc.Limit)
+	grp.OpenFDHardLimit = minLimit(grp.OpenFDHardLimit, ts.Filedesc.HardLimit)
+	if grp.Procs == 1 {
+		grp.WorstOOMScore = -1
+		grp.MinNice, grp.MaxNice = ts.Nice, ts.Nice
+		grp.MinPriority, grp.MaxPriority = ts.Priority, ts.Priority
+	}
+	if ts.Nice < grp.MinNice {
+		grp.MinNice = ts.Nice
+	}
+	if ts.Nice > grp.MaxNice {
+		grp.MaxNice = ts.Nice
+	}
+	if ts.Priority < grp.MinPriority {
+		grp.MinPriority = ts.Priority
+	}
+	if ts.Priority > grp.MaxPriority {
+		grp.MaxPriority = ts.Priority
+	}
+	if ts.OOMScore > grp.WorstOOMScore ||
+		ts.OOMScore >= 0 && ts.OOMScore == grp.WorstOOMScore && ts.OOMScoreAdj > grp.OOMScoreAdj {
+		grp.WorstOOMScore = ts.OOMScore
+		grp.OOMScoreAdj = ts.OOMScoreAdj
+	}
 	grp.NumThreads += ts.NumThreads
+	if ts.CoredumpEnabled {
+		grp.ProcsWithCoredumpEnabled++
+	}
+	if ts.Traced {
+		grp.ProcsBeingTraced++
+	}
+	if ts.Setuid {
+		grp.SetuidProcs++
+	}
+	if ts.Chrooted {
+		grp.ChrootedProcs++
+	}
+	if ts.Hung {
+		grp.HungProcs++
+	}
 	grp.Counts.Add(ts.Latest)
+	if ts.Realtime {
+		grp.CPURealtimeSeconds += ts.Latest.CPUUserTime + ts.Latest.CPUSystemTime
+	} else {
+		grp.CPUNormalSeconds += ts.Latest.CPUUserTime + ts.Latest.CPUSystemTime
+	}
 	grp.States.Add(ts.States)
+	grp.ThreadStates.Add(ts.ThreadStates)
+	if ts.User.Name != "" {
+		if grp.UserProcs == nil {
+			grp.UserProcs = make(map[User]int)
+		}
+		grp.UserProcs[ts.User]++
+	}
 	if grp.OldestStartTime == zeroTime || ts.Start.Before(grp.OldestStartTime) {
 		grp.OldestStartTime = ts.Start
 	}
@@ -90,6 +603,71 @@ func groupadd(grp Group, ts Update) Group {
 	return grp
 }
 
+// cgroupadd adds to grp the metrics derived from the cgroup of the proc
+// described by ts.  Metrics that describe the cgroup as a whole rather than
+// the proc are only added if first is true, i.e. if no previous member of
+// the group was in the same cgroup.
+func (g *Grouper) cgroupadd(grp Group, ts Update, first bool) Group {
+	if g.cgroups == nil {
+		return grp
+	}
+	if ts.Cgroup == "" {
+		if ts.CgroupV1Memory != "" {
+			grp.MemoryLimitBytes = minLimit(grp.MemoryLimitBytes, g.cgroups.v1MemoryLimit(ts.CgroupV1Memory))
+		}
+		return grp
+	}
+
+	stats := g.cgroups.get(ts.Cgroup)
+	grp.MemoryLimitBytes = minLimit(grp.MemoryLimitBytes, stats.memoryLimit)
+	if stats.frozen {
+		grp.ProcsFrozen++
+	}
+	if first {
+		grp.DirtyBytes += stats.dirtyBytes
+		grp.WritebackBytes += stats.writebackBytes
+	}
+	if stats.pressure != nil {
+		// Copy rather than modify the cached value shared with other groups.
+		var pressure Pressure
+		if grp.Pressure != nil {
+			pressure = *grp.Pressure
+		}
+		pressure.CPU = math.Max(pressure.CPU, stats.pressure.CPU)
+		pressure.Memory = math.Max(pressure.Memory, stats.pressure.Memory)
+		pressure.IO = math.Max(pressure.IO, stats.pressure.IO)
+		grp.Pressure = &pressure
+	}
+	return grp
+}
+
+// minLimit returns the lower of two limits, where 0 means unlimited or
+// unknown.
+func minLimit(a, b uint64) uint64 {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// Snapshot returns the groups computed by the last successful Update, or
+// nil if there hasn't been one.  It lets the groups be consumed by code other
+// than that driving the Updates, e.g. a sink other than Prometheus.  The
+// map is the caller's own, but the Groups share their slices and maps with
+// the result of that Update and mustn't be modified.
+func (g *Grouper) Snapshot() GroupByName {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.snapshot == nil {
+		return nil
+	}
+	groups := make(GroupByName, len(g.snapshot))
+	for gname, group := range g.snapshot {
+		groups[gname] = group
+	}
+	return groups
+}
+
 // Update asks the tracker to report on each tracked process by name.
 // These are aggregated by groupname, augmented by accumulated counts
 // from the past, and returned.  Note that while the Tracker reports
@@ -97,49 +675,755 @@ func groupadd(grp Group, ts Update) Group {
 // returns counts that never decrease.  Even once the last process
 // with name X disappears, name X will still appear in the results
 // with the same counts as before; of course, all non-count metrics
-// will be zero.
+// will be zero.  The returned GroupByName isn't modified by later calls, so
+// callers may retain it.
 func (g *Grouper) Update(iter Iter) (CollectErrors, GroupByName, error) {
-	cerrs, tracked, err := g.tracker.Update(iter)
-	if err != nil {
-		return cerrs, nil, err
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	start := time.Now()
+	cerrs, tracked, err := g.tracker.updateInto(iter, g.tracked[:0])
+	var groups GroupByName
+	if err == nil {
+		groups = g.groups(tracked, time.Now())
+		g.tracked = tracked
+		g.snapshot = groups
+	}
+	g.lastStats = UpdateStats{
+		Duration:   time.Since(start),
+		Scanned:    g.tracker.scanned,
+		ReadErrors: cerrs.Read,
+	}
+	return cerrs, groups, err
+}
+
+// LastUpdateStats describes the work done by the last Update, including one
+// that failed.
+func (g *Grouper) LastUpdateStats() UpdateStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.lastStats
+}
+
+// RawProcs returns the unaggregated details and metrics of each proc
+// currently in the named group, as of the last Update.  This allows callers
+// to compute their own aggregations.  It returns nil for unknown groups.
+func (g *Grouper) RawProcs(name string) []IDInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.tracker.Procs(name)
+}
+
+// SetNamer replaces the namer used to select and group procs, e.g. after the
+// config has been reloaded.  The accumulated counts of each group are kept,
+// so groups that exist under both namers continue where they left off, and
+// those that no longer match any procs are treated like any other group
+// whose procs have all exited.  See Tracker.SetNamer.
+func (g *Grouper) SetNamer(namer common.MatchNamer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.tracker.SetNamer(namer)
+}
+
+// RuleStats returns, for each rule of the namer, in order, how many of the
+// procs currently being tracked it matched, as of the last Update.  This helps
+// find rules that never match, or that match far more than intended.  It
+// returns nil unless the namer is a common.RuleMatchNamer.
+func (g *Grouper) RuleStats() []RuleStat {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.tracker.RuleStats()
+}
+
+// EnvironUnreadable reports whether the environment of any tracked proc
+// couldn't be read, as of the last Update.
+func (g *Grouper) EnvironUnreadable() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.tracker.EnvironUnreadable()
+}
+
+// StateSizes returns the sizes of the internal state of the Grouper and its
+// Tracker.  It's cheap enough to call every cycle.
+func (g *Grouper) StateSizes() StateSizes {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	sizes := StateSizes{
+		ProcIds:     len(g.tracker.procIds),
+		Usernames:   len(g.tracker.username),
+		GroupAccum:  len(g.groupAccum),
+		ThreadAccum: len(g.threadAccum),
+		FirstSeen:   len(g.firstSeen),
+		Warm:        len(g.warm),
+		Exited:      len(g.exited),
+		RssSamples:  len(g.rssSamples),
 	}
-	return cerrs, g.groups(tracked), nil
+	for _, tproc := range g.tracker.tracked {
+		if tproc == nil {
+			sizes.IgnoredProcs++
+		} else {
+			sizes.TrackedProcs++
+			sizes.TrackedThreads += len(tproc.threads)
+		}
+	}
+	return sizes
+}
+
+// GroupPercentiles returns, for each of the percentiles p (from 0 to 100), the
+// corresponding percentile of the resident memory and CPU usage of the procs
+// currently in the named group, as of the last Update.  Each metric is ranked
+// separately, so a result needn't describe any single proc.  This shows
+// whether a group's usage is driven by one big proc or by many medium ones.
+// The result is empty for unknown groups.
+func (g *Grouper) GroupPercentiles(name string, p ...float64) map[float64]GroupMemberStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var rss, cpu []float64
+	for _, tproc := range g.tracker.tracked {
+		if tproc != nil && tproc.groupName == name {
+			rss = append(rss, float64(tproc.metrics.ResidentBytes))
+			cpu = append(cpu, tproc.lastaccum.CPUUserTime+tproc.lastaccum.CPUSystemTime)
+		}
+	}
+
+	result := make(map[float64]GroupMemberStats, len(p))
+	if len(rss) == 0 {
+		return result
+	}
+	sort.Float64s(rss)
+	sort.Float64s(cpu)
+	for _, pct := range p {
+		result[pct] = GroupMemberStats{
+			ResidentBytes: uint64(percentile(rss, pct)),
+			CPUSeconds:    percentile(cpu, pct),
+		}
+	}
+	return result
+}
+
+// SumReducer returns a Reducer giving the sum of value over the members of a
+// group, like the built-in aggregation of counts and memory.
+func SumReducer(value func(Update) float64) Reducer {
+	return func(members []Update) float64 {
+		var sum float64
+		for _, u := range members {
+			sum += value(u)
+		}
+		return sum
+	}
+}
+
+// MaxReducer returns a Reducer giving the maximum of value over the members
+// of a group, like the built-in aggregation of the fd ratio.
+func MaxReducer(value func(Update) float64) Reducer {
+	return func(members []Update) float64 {
+		max := math.Inf(-1)
+		for _, u := range members {
+			max = math.Max(max, value(u))
+		}
+		return max
+	}
+}
+
+// fields returns pointers to each of m's metrics, in a fixed order.
+func (m *MemberMetrics) fields() []*float64 {
+	return []*float64{&m.ResidentBytes, &m.VirtualBytes, &m.SwapBytes,
+		&m.CPURate, &m.ReadBytesRate, &m.WriteBytesRate}
+}
+
+// memberAggregates returns the aggregates of the metrics of members, which
+// mustn't be empty.  interval is the time since the last cycle, zero if
+// there wasn't one.
+func memberAggregates(members []Update, interval time.Duration) *MemberAggregates {
+	var agg MemberAggregates
+	minf, maxf, avgf := agg.Min.fields(), agg.Max.fields(), agg.Avg.fields()
+	for i, u := range members {
+		m := MemberMetrics{
+			ResidentBytes: float64(u.ResidentBytes),
+			VirtualBytes:  float64(u.VirtualBytes),
+			SwapBytes:     float64(u.VmSwapBytes),
+		}
+		if secs := interval.Seconds(); secs > 0 {
+			m.CPURate = (u.Latest.CPUUserTime + u.Latest.CPUSystemTime) / secs
+			m.ReadBytesRate = float64(u.Latest.ReadBytes) / secs
+			m.WriteBytesRate = float64(u.Latest.WriteBytes) / secs
+		}
+		for j, v := range m.fields() {
+			if i == 0 || *v < *minf[j] {
+				*minf[j] = *v
+			}
+			if i == 0 || *v > *maxf[j] {
+				*maxf[j] = *v
+			}
+			*avgf[j] += *v / float64(len(members))
+		}
+	}
+	return &agg
+}
+
+// percentile returns the p-th percentile of the sorted values using the
+// nearest-rank method.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
 }
 
 // Translate the updates into a new GroupByName and update internal history.
-func (g *Grouper) groups(tracked []Update) GroupByName {
-	groups := make(GroupByName)
-	threadsByGroup := make(map[string][]ThreadUpdate)
+func (g *Grouper) groups(tracked []Update, now time.Time) GroupByName {
+	groups := make(GroupByName, len(g.groupAccum))
+	var interval time.Duration
+	if !g.lastCycle.IsZero() {
+		interval = now.Sub(g.lastCycle)
+	}
+	g.lastCycle = now
+	sc := &g.scratch
+	sc.reset()
+	if g.cgroups != nil {
+		g.cgroups.reset()
+	}
 
 	for _, update := range tracked {
-		groups[update.GroupName] = groupadd(groups[update.GroupName], update)
+		if g.opts.CgroupMemory && g.cgroups != nil && update.Cgroup != "" {
+			if stats := g.cgroups.get(update.Cgroup); stats.soleProc && stats.memoryCurrent != nil {
+				update.ResidentBytes = *stats.memoryCurrent
+			}
+		}
+
+		var first bool
+		if g.cgroups != nil {
+			cgroups := sc.cgroups[update.GroupName]
+			if cgroups == nil {
+				cgroups = make(map[string]bool)
+				sc.cgroups[update.GroupName] = cgroups
+			}
+			first = !cgroups[update.Cgroup]
+			cgroups[update.Cgroup] = true
+		}
+
+		grp := g.cgroupadd(groupadd(groups[update.GroupName], update), update, first)
+		if maxAge, ok := g.opts.MaxAges[update.GroupName]; ok && now.Sub(update.Start) > maxAge {
+			grp.ProcsExceedingMaxAge++
+		}
+		if len(g.opts.AgeBuckets) > 0 {
+			if grp.Ages == nil {
+				grp.Ages = &AgeHistogram{Buckets: make(map[float64]uint64, len(g.opts.AgeBuckets))}
+			}
+			grp.Ages.observe(g.opts.AgeBuckets, now.Sub(update.Start).Seconds())
+		}
+		if g.opts.VSZBloatRatio > 0 && update.ResidentBytes > 0 &&
+			float64(update.VirtualBytes) > g.opts.VSZBloatRatio*float64(update.ResidentBytes) {
+			grp.ProcsWithVSZBloat++
+		}
+		// Each proc has lived since the last cycle, or since it started if
+		// that's more recent.
+		if interval > 0 {
+			lived := now.Sub(update.Start)
+			if lived > interval {
+				lived = interval
+			}
+			grp.LifetimeSeconds += lived.Seconds()
+		}
+		groups[update.GroupName] = grp
+
+		if len(g.opts.Reducers) > 0 || g.opts.MemberAggregates {
+			sc.updates[update.GroupName] = append(sc.updates[update.GroupName], update)
+		}
+		if update.DetailSkipped {
+			sc.fdsSkipped[update.GroupName]++
+		} else if update.Filedesc.Open != -1 {
+			sc.fdsKnown[update.GroupName]++
+		}
 		if update.Threads != nil {
-			threadsByGroup[update.GroupName] =
-				append(threadsByGroup[update.GroupName], update.Threads...)
+			sc.threads[update.GroupName] =
+				append(sc.threads[update.GroupName], update.Threads...)
+		}
+	}
+	g.netTraffic(groups)
+
+	for gname, updates := range sc.updates {
+		if len(updates) == 0 {
+			continue
+		}
+		grp := groups[gname]
+		if len(g.opts.Reducers) > 0 {
+			grp.Custom = make(map[string]float64, len(g.opts.Reducers))
+			for name, reduce := range g.opts.Reducers {
+				grp.Custom[name] = reduce(updates)
+			}
+		}
+		if g.opts.MemberAggregates {
+			grp.Members = memberAggregates(updates, interval)
+		}
+		groups[gname] = grp
+	}
+
+	if g.opts.Fingerprint {
+		g.fingerprint(groups)
+	}
+	g.worstFD(groups)
+	if g.opts.PodResolver != nil {
+		g.pods(groups)
+	}
+
+	for gname, skipped := range sc.fdsSkipped {
+		if known := sc.fdsKnown[gname]; known > 0 {
+			grp := groups[gname]
+			extrapolate(&grp, float64(known+skipped)/float64(known))
+			groups[gname] = grp
+		}
+	}
+
+	if g.opts.UntrackedGroupName != "" && g.opts.System != nil {
+		if _, ok := groups[g.opts.UntrackedGroupName]; ok {
+			if g.debug {
+				log.Printf("not reporting untracked usage, group %q already exists", g.opts.UntrackedGroupName)
+			}
+		} else if untracked, ok := g.untracked(groups); ok {
+			groups[g.opts.UntrackedGroupName] = untracked
 		}
 	}
 
+	for gname := range groups {
+		if _, ok := g.firstSeen[gname]; !ok {
+			g.firstSeen[gname] = now
+		}
+	}
+	withheld := g.warmup(groups, now)
+
 	// Add any accumulated counts to what was just observed,
 	// and update the accumulators.
 	for gname, group := range groups {
+		if g.opts.CPURatio && interval > 0 {
+			ratio := (group.CPUUserTime + group.CPUSystemTime) / interval.Seconds()
+			group.CPURatio = &ratio
+		}
 		if oldcounts, ok := g.groupAccum[gname]; ok {
 			group.Counts.Add(Delta(oldcounts))
 		}
 		g.groupAccum[gname] = group.Counts
-		group.Threads = g.threads(gname, threadsByGroup[gname])
+		g.starts[gname] += uint64(g.tracker.started[gname])
+		group.ProcStarts = g.starts[gname]
+		extra := g.extraAccum[gname]
+		extra.realtime += group.CPURealtimeSeconds
+		extra.normal += group.CPUNormalSeconds
+		extra.netRx += group.NetRxBytes
+		extra.netTx += group.NetTxBytes
+		extra.lifetime += group.LifetimeSeconds
+		g.extraAccum[gname] = extra
+		group.CPURealtimeSeconds, group.CPUNormalSeconds = extra.realtime, extra.normal
+		group.NetRxBytes, group.NetTxBytes = extra.netRx, extra.netTx
+		group.LifetimeSeconds = extra.lifetime
+		group.Threads = g.threads(gname, sc.threads[gname])
 		groups[gname] = group
 	}
 
+	g.trend(groups, now)
+
 	// Now add any groups that were observed in the past but aren't running now.
 	for gname, gcounts := range g.groupAccum {
 		if _, ok := groups[gname]; !ok {
-			groups[gname] = Group{Counts: gcounts}
+			extra := g.extraAccum[gname]
+			groups[gname] = Group{Counts: gcounts, ProcStarts: g.starts[gname],
+				CPURealtimeSeconds: extra.realtime, CPUNormalSeconds: extra.normal,
+				NetRxBytes: extra.netRx, NetTxBytes: extra.netTx,
+				LifetimeSeconds: extra.lifetime}
+		}
+	}
+	for gname, group := range groups {
+		if first, ok := g.firstSeen[gname]; ok {
+			group.TrackedDurationSeconds = now.Sub(first).Seconds()
+			groups[gname] = group
 		}
 	}
+	g.linger(groups, now)
+
+	for _, gname := range withheld {
+		delete(groups, gname)
+	}
 
 	return groups
 }
 
+// observe adds a proc of the given age in seconds to the histogram.
+func (h *AgeHistogram) observe(buckets []float64, age float64) {
+	for _, bound := range buckets {
+		if age <= bound {
+			h.Buckets[bound]++
+		}
+	}
+	h.Count++
+	h.Sum += age
+}
+
+// fingerprint sets the Fingerprint of each of groups based on the procs the
+// tracker has in it.
+func (g *Grouper) fingerprint(groups GroupByName) {
+	members := make(map[string][]ID)
+	for id, tproc := range g.tracker.tracked {
+		if tproc != nil {
+			members[tproc.groupName] = append(members[tproc.groupName], id)
+		}
+	}
+
+	var buf [16]byte
+	for gname, ids := range members {
+		grp, ok := groups[gname]
+		if !ok {
+			continue
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i].Pid < ids[j].Pid })
+		h := fnv.New64a()
+		for _, id := range ids {
+			binary.LittleEndian.PutUint64(buf[:8], uint64(id.Pid))
+			binary.LittleEndian.PutUint64(buf[8:], id.StartTimeRel)
+			h.Write(buf[:])
+		}
+		grp.Fingerprint = h.Sum64()
+		groups[gname] = grp
+	}
+}
+
+// MatchedDirect returns how many of the group's procs were matched by the
+// namer themselves, as opposed to joining it because of their parent.
+func (grp Group) MatchedDirect() int {
+	return grp.Procs - grp.MatchedViaParent
+}
+
+// extrapolate multiplies by scale the metrics of grp that are only read for
+// procs whose details weren't skipped: open fds, their types, inotify, and
+// the memory read from smaps.
+func extrapolate(grp *Group, scale float64) {
+	scaleInt := func(n int) int { return int(float64(n) * scale) }
+	scaleUint := func(n uint64) uint64 { return uint64(float64(n) * scale) }
+	grp.OpenFDs = scaleUint(grp.OpenFDs)
+	grp.OpenFDTypes = FDTypes{
+		Files:    scaleInt(grp.OpenFDTypes.Files),
+		Sockets:  scaleInt(grp.OpenFDTypes.Sockets),
+		Pipes:    scaleInt(grp.OpenFDTypes.Pipes),
+		Eventfds: scaleInt(grp.OpenFDTypes.Eventfds),
+		Other:    scaleInt(grp.OpenFDTypes.Other),
+	}
+	grp.Inotify = Inotify{
+		Instances: scaleInt(grp.Inotify.Instances),
+		Watches:   scaleInt(grp.Inotify.Watches),
+	}
+	grp.ProportionalBytes = scaleUint(grp.ProportionalBytes)
+	grp.ResidentPrivateBytes = scaleUint(grp.ResidentPrivateBytes)
+	grp.ResidentSharedBytes = scaleUint(grp.ResidentSharedBytes)
+}
+
+// netTraffic adds to groups the traffic of the network namespaces of their
+// procs since the last cycle.  A namespace shared by several groups, such as
+// the host's, is attributed to just one of them each cycle, that of its
+// lowest pid, so that its traffic is only counted once.
+func (g *Grouper) netTraffic(groups GroupByName) {
+	sc := &g.scratch
+	for id, tproc := range g.tracker.tracked {
+		if tproc == nil || tproc.metrics.NetNamespace == 0 {
+			continue
+		}
+		if _, ok := groups[tproc.groupName]; !ok {
+			continue
+		}
+		ns := tproc.metrics.NetNamespace
+		if owner, ok := sc.netnsOwners[ns]; ok && owner.Pid < id.Pid {
+			continue
+		}
+		sc.netnsOwners[ns] = id
+	}
+
+	for ns, id := range sc.netnsOwners {
+		tproc := g.tracker.tracked[id]
+		cur := tproc.metrics.NetDev
+		// Only count traffic since the namespace was last seen, so that
+		// one appearing doesn't bring along its past.
+		if prev, ok := g.netDevs[ns]; ok {
+			grp := groups[tproc.groupName]
+			grp.NetRxBytes += subCounter(cur.RxBytes, prev.RxBytes, g.opts.CounterWrap)
+			grp.NetTxBytes += subCounter(cur.TxBytes, prev.TxBytes, g.opts.CounterWrap)
+			groups[tproc.groupName] = grp
+		}
+		sc.netDevs[ns] = cur
+	}
+	// Namespaces not seen this cycle are forgotten.
+	g.netDevs, sc.netDevs = sc.netDevs, g.netDevs
+}
+
+// worstFD sets the WorstFD fields of each of groups to identify the proc
+// which groupadd found to have the group's WorstFDratio.
+func (g *Grouper) worstFD(groups GroupByName) {
+	for id, tproc := range g.tracker.tracked {
+		if tproc == nil {
+			continue
+		}
+		grp, ok := groups[tproc.groupName]
+		if !ok || grp.WorstFDratio <= 0 {
+			continue
+		}
+		fd := tproc.metrics.Filedesc
+		if float64(fd.Open)/float64(fd.Limit) != grp.WorstFDratio {
+			continue
+		}
+		if grp.WorstFDPid != 0 && grp.WorstFDPid < id.Pid {
+			continue
+		}
+		grp.WorstFDPid = id.Pid
+		grp.WorstFDName = tproc.static.Name
+		grp.WorstFDOpen = uint64(fd.Open)
+		grp.WorstFDLimit = fd.Limit
+		groups[tproc.groupName] = grp
+	}
+}
+
+// pods sets the Pods field of each of groups from its tracked procs.  Pods
+// that couldn't be resolved when their procs were first seen are retried.
+func (g *Grouper) pods(groups GroupByName) {
+	seen := make(map[string]map[common.Pod]bool)
+	for _, tproc := range g.tracker.tracked {
+		if tproc == nil || tproc.pod.UID == "" {
+			continue
+		}
+		if tproc.pod.Name == "" {
+			if pod, err := g.opts.PodResolver.ResolvePod(tproc.pod); err == nil {
+				tproc.pod = pod
+			}
+		}
+		grp, ok := groups[tproc.groupName]
+		if !ok {
+			continue
+		}
+		if seen[tproc.groupName] == nil {
+			seen[tproc.groupName] = make(map[common.Pod]bool)
+		}
+		if !seen[tproc.groupName][tproc.pod] {
+			seen[tproc.groupName][tproc.pod] = true
+			grp.Pods = append(grp.Pods, tproc.pod)
+			groups[tproc.groupName] = grp
+		}
+	}
+	for gname := range seen {
+		pods := groups[gname].Pods
+		sort.Slice(pods, func(i, j int) bool {
+			a, b := pods[i], pods[j]
+			if a.UID != b.UID {
+				return a.UID < b.UID
+			}
+			return a.Container < b.Container
+		})
+	}
+}
+
+// reset prepares the scratch state for a new cycle.  Slices are truncated
+// rather than discarded so their storage can be reused, but entries left
+// empty by the previous cycle are dropped so that groups which are gone
+// don't accumulate.
+func (sc *groupScratch) reset() {
+	for gname, threads := range sc.threads {
+		if len(threads) == 0 {
+			delete(sc.threads, gname)
+		} else {
+			sc.threads[gname] = threads[:0]
+		}
+	}
+	for gname, updates := range sc.updates {
+		if len(updates) == 0 {
+			delete(sc.updates, gname)
+		} else {
+			sc.updates[gname] = updates[:0]
+		}
+	}
+	for gname, cgroups := range sc.cgroups {
+		if len(cgroups) == 0 {
+			delete(sc.cgroups, gname)
+		} else {
+			for cgroup := range cgroups {
+				delete(cgroups, cgroup)
+			}
+		}
+	}
+	for ns := range sc.netnsOwners {
+		delete(sc.netnsOwners, ns)
+	}
+	for ns := range sc.netDevs {
+		delete(sc.netDevs, ns)
+	}
+	for gname := range sc.fdsKnown {
+		delete(sc.fdsKnown, gname)
+	}
+	for gname := range sc.fdsSkipped {
+		delete(sc.fdsSkipped, gname)
+	}
+}
+
+// warmup enforces Options.Warmup.  It forgets all history of groups that
+// disappeared before warming up, and returns the names of those in groups
+// which mustn't be reported yet.  Their counts are still accumulated, so
+// once reported they include everything since they were first seen.
+func (g *Grouper) warmup(groups GroupByName, now time.Time) []string {
+	if g.opts.Warmup <= 0 {
+		return nil
+	}
+
+	for gname := range g.firstSeen {
+		if _, ok := groups[gname]; !ok && !g.warm[gname] {
+			delete(g.firstSeen, gname)
+			delete(g.groupAccum, gname)
+			delete(g.starts, gname)
+			delete(g.extraAccum, gname)
+			delete(g.threadAccum, gname)
+		}
+	}
+
+	var withheld []string
+	for gname := range groups {
+		if g.warm[gname] {
+			continue
+		}
+		if now.Sub(g.firstSeen[gname]) >= g.opts.Warmup {
+			g.warm[gname] = true
+		} else {
+			withheld = append(withheld, gname)
+		}
+	}
+	return withheld
+}
+
+// trend enforces Options.LeakWindow, recording the resident memory of each
+// of groups and fitting a trend to it.  The history of groups that are gone
+// is discarded.
+func (g *Grouper) trend(groups GroupByName, now time.Time) {
+	if g.opts.LeakWindow <= 0 {
+		return
+	}
+
+	for gname := range g.rssSamples {
+		if _, ok := groups[gname]; !ok {
+			delete(g.rssSamples, gname)
+		}
+	}
+
+	for gname, group := range groups {
+		samples := append(g.rssSamples[gname], rssSample{now, group.ResidentBytes})
+		if len(samples) > g.opts.LeakWindow {
+			samples = samples[len(samples)-g.opts.LeakWindow:]
+		}
+		g.rssSamples[gname] = samples
+
+		group.ResidentGrowthRate = slope(samples)
+		group.LeakSuspected = len(samples) == g.opts.LeakWindow &&
+			group.ResidentGrowthRate > g.opts.LeakThreshold
+		groups[gname] = group
+	}
+}
+
+// slope returns the slope in bytes per second of the least squares linear
+// fit to samples, or 0 if there are too few samples to fit.
+func slope(samples []rssSample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+
+	// Use times relative to the first sample to preserve precision.
+	n := float64(len(samples))
+	var sumx, sumy, sumxy, sumxx float64
+	for _, s := range samples {
+		x := s.time.Sub(samples[0].time).Seconds()
+		y := float64(s.rss)
+		sumx += x
+		sumy += y
+		sumxy += x * y
+		sumxx += x * x
+	}
+	denom := n*sumxx - sumx*sumx
+	if denom == 0 {
+		return 0
+	}
+	return (n*sumxy - sumx*sumy) / denom
+}
+
+// linger enforces Options.Linger and LingerCycles.  Groups in groups without
+// procs are marked as final, and those which have had no procs for longer
+// than Linger, or for more than LingerCycles cycles, are removed from groups
+// and their history forgotten.
+func (g *Grouper) linger(groups GroupByName, now time.Time) {
+	if g.opts.Linger <= 0 && g.opts.LingerCycles <= 0 {
+		return
+	}
+
+	for gname, group := range groups {
+		if group.Procs > 0 || gname == g.opts.UntrackedGroupName {
+			delete(g.exited, gname)
+			delete(g.emptyCycles, gname)
+			continue
+		}
+
+		exited, ok := g.exited[gname]
+		if !ok {
+			exited = now
+			g.exited[gname] = now
+		}
+		g.emptyCycles[gname]++
+		if (g.opts.Linger <= 0 || now.Sub(exited) < g.opts.Linger) &&
+			(g.opts.LingerCycles <= 0 || g.emptyCycles[gname] <= g.opts.LingerCycles) {
+			group.Final = true
+			groups[gname] = group
+			continue
+		}
+
+		if g.debug {
+			log.Printf("forgetting group %q, no procs since %v (%d cycles)", gname, exited, g.emptyCycles[gname])
+		}
+		delete(groups, gname)
+		delete(g.groupAccum, gname)
+		delete(g.starts, gname)
+		delete(g.extraAccum, gname)
+		delete(g.threadAccum, gname)
+		delete(g.firstSeen, gname)
+		delete(g.warm, gname)
+		delete(g.exited, gname)
+		delete(g.emptyCycles, gname)
+	}
+}
+
+// untracked returns a synthetic group describing the system usage that isn't
+// accounted for by groups, which must not yet include accumulated counts.
+// Since procs and the system aren't sampled at exactly the same moment, the
+// tracked usage may exceed the total, in which case we report zero.
+func (g *Grouper) untracked(groups GroupByName) (Group, bool) {
+	usage, err := g.opts.System.SystemUsage()
+	if err != nil {
+		if g.debug {
+			log.Printf("error reading system usage: %v", err)
+		}
+		return Group{}, false
+	}
+	last := g.lastSystem
+	g.lastSystem = &usage
+
+	var tracked Group
+	for _, group := range groups {
+		tracked.CPUUserTime += group.CPUUserTime
+		tracked.CPUSystemTime += group.CPUSystemTime
+		tracked.ResidentBytes += group.ResidentBytes
+	}
+
+	var grp Group
+	if usage.MemoryUsedBytes > tracked.ResidentBytes {
+		grp.ResidentBytes = usage.MemoryUsedBytes - tracked.ResidentBytes
+	}
+	// On the first cycle we have nothing to compute a delta from.
+	if last != nil {
+		grp.CPUUserTime = math.Max(0, usage.CPUUserTime-last.CPUUserTime-tracked.CPUUserTime)
+		grp.CPUSystemTime = math.Max(0, usage.CPUSystemTime-last.CPUSystemTime-tracked.CPUSystemTime)
+	}
+	return grp, true
+}
+
 func (g *Grouper) threads(gname string, tracked []ThreadUpdate) []Threads {
 	if len(tracked) == 0 {
 		delete(g.threadAccum, gname)
@@ -1,11 +1,17 @@
 package proc
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	common "github.com/ncabatoff/process-exporter"
 )
 
 type grouptest struct {
@@ -22,6 +28,11 @@ type grouptest struct {
 //	c.Check(got, DeepEquals, gt.want, Commentf("diff %s", pretty.Compare(got, gt.want)))
 //}
 
+// ignoreWallClock is for comparing the groups from Grouper.Update, which
+// runs in real time, making Group.TrackedDurationSeconds and LifetimeSeconds
+// unpredictable.
+var ignoreWallClock = cmpopts.IgnoreFields(Group{}, "TrackedDurationSeconds", "LifetimeSeconds")
+
 func rungroup(t *testing.T, gr *Grouper, procs Iter) GroupByName {
 	_, groups, err := gr.Update(procs)
 	if err != nil {
@@ -45,38 +56,42 @@ func TestGrouperBasic(t *testing.T) {
 	}{
 		{
 			[]IDInfo{
-				piinfost(p1, n1, Counts{1, 2, 3, 4, 5, 6, 0, 0}, Memory{7, 8, 0},
-					Filedesc{4, 400}, 2, States{Other: 1}),
-				piinfost(p2, n2, Counts{2, 3, 4, 5, 6, 7, 0, 0}, Memory{8, 9, 0},
-					Filedesc{40, 400}, 3, States{Waiting: 1}),
+				piinfost(p1, n1, Counts{CPUUserTime: 1, CPUSystemTime: 2, ReadBytes: 3, WriteBytes: 4, MajorPageFaults: 5, MinorPageFaults: 6}, Memory{ResidentBytes: 7, VirtualBytes: 8},
+					Filedesc{Open: 4, Limit: 400}, 2, States{Other: 1}),
+				piinfost(p2, n2, Counts{CPUUserTime: 2, CPUSystemTime: 3, ReadBytes: 4, WriteBytes: 5, MajorPageFaults: 6, MinorPageFaults: 7}, Memory{ResidentBytes: 8, VirtualBytes: 9},
+					Filedesc{Open: 40, Limit: 400}, 3, States{Waiting: 1}),
 			},
 			GroupByName{
-				"g1": Group{Counts{}, States{Other: 1}, msi{}, 1, Memory{7, 8, 0}, starttime,
-					4, 0.01, 2, nil},
-				"g2": Group{Counts{}, States{Waiting: 1}, msi{}, 1, Memory{8, 9, 0}, starttime,
-					40, 0.1, 3, nil},
+				"g1": Group{States: States{Other: 1}, Wchans: msi{}, Procs: 1, Memory: Memory{ResidentBytes: 7, VirtualBytes: 8},
+					OldestStartTime: starttime, OpenFDs: 4, WorstFDratio: 0.01, WorstFDPid: p1, WorstFDName: n1,
+					WorstFDOpen: 4, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 2},
+				"g2": Group{States: States{Waiting: 1}, Wchans: msi{}, Procs: 1, Memory: Memory{ResidentBytes: 8, VirtualBytes: 9},
+					OldestStartTime: starttime, OpenFDs: 40, WorstFDratio: 0.1, WorstFDPid: p2, WorstFDName: n2,
+					WorstFDOpen: 40, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 3},
 			},
 		},
 		{
 			[]IDInfo{
-				piinfost(p1, n1, Counts{2, 3, 4, 5, 6, 7, 0, 0},
-					Memory{6, 7, 0}, Filedesc{100, 400}, 4, States{Zombie: 1}),
-				piinfost(p2, n2, Counts{4, 5, 6, 7, 8, 9, 0, 0},
-					Memory{9, 8, 0}, Filedesc{400, 400}, 2, States{Running: 1}),
+				piinfost(p1, n1, Counts{CPUUserTime: 2, CPUSystemTime: 3, ReadBytes: 4, WriteBytes: 5, MajorPageFaults: 6, MinorPageFaults: 7},
+					Memory{ResidentBytes: 6, VirtualBytes: 7}, Filedesc{Open: 100, Limit: 400}, 4, States{Zombie: 1}),
+				piinfost(p2, n2, Counts{CPUUserTime: 4, CPUSystemTime: 5, ReadBytes: 6, WriteBytes: 7, MajorPageFaults: 8, MinorPageFaults: 9},
+					Memory{ResidentBytes: 9, VirtualBytes: 8}, Filedesc{Open: 400, Limit: 400}, 2, States{Running: 1}),
 			},
 			GroupByName{
-				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0}, States{Zombie: 1}, msi{}, 1,
-					Memory{6, 7, 0}, starttime, 100, 0.25, 4, nil},
-				"g2": Group{Counts{2, 2, 2, 2, 2, 2, 0, 0}, States{Running: 1}, msi{}, 1,
-					Memory{9, 8, 0}, starttime, 400, 1, 2, nil},
+				"g1": Group{Counts: Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, CPUNormalSeconds: 2, States: States{Zombie: 1}, Wchans: msi{}, Procs: 1, Memory: Memory{ResidentBytes: 6, VirtualBytes: 7},
+					OldestStartTime: starttime, OpenFDs: 100, WorstFDratio: 0.25, WorstFDPid: p1, WorstFDName: n1,
+					WorstFDOpen: 100, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 4},
+				"g2": Group{Counts: Counts{CPUUserTime: 2, CPUSystemTime: 2, ReadBytes: 2, WriteBytes: 2, MajorPageFaults: 2, MinorPageFaults: 2}, CPUNormalSeconds: 4, States: States{Running: 1}, Wchans: msi{}, Procs: 1, Memory: Memory{ResidentBytes: 9, VirtualBytes: 8},
+					OldestStartTime: starttime, OpenFDs: 400, WorstFDratio: 1, WorstFDPid: p2, WorstFDName: n2,
+					WorstFDOpen: 400, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 2},
 			},
 		},
 	}
 
-	gr := NewGrouper(newNamer(n1, n2), false, false, false)
+	gr := NewGrouper(newNamer(n1, n2), false, false, false, Options{})
 	for i, tc := range tests {
 		got := rungroup(t, gr, procInfoIter(tc.procs...))
-		if diff := cmp.Diff(got, tc.want); diff != "" {
+		if diff := cmp.Diff(got, tc.want, ignoreWallClock); diff != "" {
 			t.Errorf("%d: curgroups differs: (-got +want)\n%s", i, diff)
 		}
 	}
@@ -95,43 +110,47 @@ func TestGrouperProcJoin(t *testing.T) {
 	}{
 		{
 			[]IDInfo{
-				piinfo(p1, n1, Counts{1, 2, 3, 4, 5, 6, 0, 0}, Memory{3, 4, 0}, Filedesc{4, 400}, 2),
+				piinfo(p1, n1, Counts{CPUUserTime: 1, CPUSystemTime: 2, ReadBytes: 3, WriteBytes: 4, MajorPageFaults: 5, MinorPageFaults: 6}, Memory{ResidentBytes: 3, VirtualBytes: 4}, Filedesc{Open: 4, Limit: 400}, 2),
 			},
 			GroupByName{
-				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{3, 4, 0}, starttime, 4, 0.01, 2, nil},
+				"g1": Group{Wchans: msi{}, Procs: 1, Memory: Memory{ResidentBytes: 3, VirtualBytes: 4},
+					OldestStartTime: starttime, OpenFDs: 4, WorstFDratio: 0.01, WorstFDPid: p1, WorstFDName: n1,
+					WorstFDOpen: 4, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 2},
 			},
 		}, {
 			// The counts for pid2 won't be factored into the total yet because we only add
 			// to counts starting with the second time we see a proc. Memory and FDs are
 			// affected though.
 			[]IDInfo{
-				piinfost(p1, n1, Counts{3, 4, 5, 6, 7, 8, 0, 0},
-					Memory{3, 4, 0}, Filedesc{4, 400}, 2, States{Running: 1}),
-				piinfost(p2, n2, Counts{1, 1, 1, 1, 1, 1, 0, 0},
-					Memory{1, 2, 0}, Filedesc{40, 400}, 3, States{Sleeping: 1}),
+				piinfost(p1, n1, Counts{CPUUserTime: 3, CPUSystemTime: 4, ReadBytes: 5, WriteBytes: 6, MajorPageFaults: 7, MinorPageFaults: 8},
+					Memory{ResidentBytes: 3, VirtualBytes: 4}, Filedesc{Open: 4, Limit: 400}, 2, States{Running: 1}),
+				piinfost(p2, n2, Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1},
+					Memory{ResidentBytes: 1, VirtualBytes: 2}, Filedesc{Open: 40, Limit: 400}, 3, States{Sleeping: 1}),
 			},
 			GroupByName{
-				"g1": Group{Counts{2, 2, 2, 2, 2, 2, 0, 0}, States{Running: 1, Sleeping: 1}, msi{}, 2,
-					Memory{4, 6, 0}, starttime, 44, 0.1, 5, nil},
+				"g1": Group{Counts: Counts{CPUUserTime: 2, CPUSystemTime: 2, ReadBytes: 2, WriteBytes: 2, MajorPageFaults: 2, MinorPageFaults: 2}, CPUNormalSeconds: 4, States: States{Running: 1, Sleeping: 1}, Wchans: msi{}, Procs: 2, Memory: Memory{ResidentBytes: 4, VirtualBytes: 6},
+					OldestStartTime: starttime, OpenFDs: 44, WorstFDratio: 0.1, WorstFDPid: p2, WorstFDName: n2,
+					WorstFDOpen: 40, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 5, ProcStarts: 1},
 			},
 		}, {
 			[]IDInfo{
-				piinfost(p1, n1, Counts{4, 5, 6, 7, 8, 9, 0, 0},
-					Memory{1, 5, 0}, Filedesc{4, 400}, 2, States{Running: 1}),
-				piinfost(p2, n2, Counts{2, 2, 2, 2, 2, 2, 0, 0},
-					Memory{2, 4, 0}, Filedesc{40, 400}, 3, States{Running: 1}),
+				piinfost(p1, n1, Counts{CPUUserTime: 4, CPUSystemTime: 5, ReadBytes: 6, WriteBytes: 7, MajorPageFaults: 8, MinorPageFaults: 9},
+					Memory{ResidentBytes: 1, VirtualBytes: 5}, Filedesc{Open: 4, Limit: 400}, 2, States{Running: 1}),
+				piinfost(p2, n2, Counts{CPUUserTime: 2, CPUSystemTime: 2, ReadBytes: 2, WriteBytes: 2, MajorPageFaults: 2, MinorPageFaults: 2},
+					Memory{ResidentBytes: 2, VirtualBytes: 4}, Filedesc{Open: 40, Limit: 400}, 3, States{Running: 1}),
 			},
 			GroupByName{
-				"g1": Group{Counts{4, 4, 4, 4, 4, 4, 0, 0}, States{Running: 2}, msi{}, 2,
-					Memory{3, 9, 0}, starttime, 44, 0.1, 5, nil},
+				"g1": Group{Counts: Counts{CPUUserTime: 4, CPUSystemTime: 4, ReadBytes: 4, WriteBytes: 4, MajorPageFaults: 4, MinorPageFaults: 4}, CPUNormalSeconds: 8, States: States{Running: 2}, Wchans: msi{}, Procs: 2, Memory: Memory{ResidentBytes: 3, VirtualBytes: 9},
+					OldestStartTime: starttime, OpenFDs: 44, WorstFDratio: 0.1, WorstFDPid: p2, WorstFDName: n2,
+					WorstFDOpen: 40, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 5, ProcStarts: 1},
 			},
 		},
 	}
 
-	gr := NewGrouper(newNamer(n1), false, false, false)
+	gr := NewGrouper(newNamer(n1), false, false, false, Options{})
 	for i, tc := range tests {
 		got := rungroup(t, gr, procInfoIter(tc.procs...))
-		if diff := cmp.Diff(got, tc.want); diff != "" {
+		if diff := cmp.Diff(got, tc.want, ignoreWallClock); diff != "" {
 			t.Errorf("%d: curgroups differs: (-got +want)\n%s", i, diff)
 		}
 	}
@@ -150,36 +169,174 @@ func TestGrouperNonDecreasing(t *testing.T) {
 	}{
 		{
 			[]IDInfo{
-				piinfo(p1, n1, Counts{3, 4, 5, 6, 7, 8, 0, 0}, Memory{3, 4, 0}, Filedesc{4, 400}, 2),
-				piinfo(p2, n2, Counts{1, 1, 1, 1, 1, 1, 0, 0}, Memory{1, 2, 0}, Filedesc{40, 400}, 3),
+				piinfo(p1, n1, Counts{CPUUserTime: 3, CPUSystemTime: 4, ReadBytes: 5, WriteBytes: 6, MajorPageFaults: 7, MinorPageFaults: 8}, Memory{ResidentBytes: 3, VirtualBytes: 4}, Filedesc{Open: 4, Limit: 400}, 2),
+				piinfo(p2, n2, Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, Memory{ResidentBytes: 1, VirtualBytes: 2}, Filedesc{Open: 40, Limit: 400}, 3),
 			},
 			GroupByName{
-				"g1": Group{Counts{}, States{}, msi{}, 2, Memory{4, 6, 0}, starttime, 44, 0.1, 5, nil},
+				"g1": Group{Wchans: msi{}, Procs: 2, Memory: Memory{ResidentBytes: 4, VirtualBytes: 6},
+					OldestStartTime: starttime, OpenFDs: 44, WorstFDratio: 0.1, WorstFDPid: p2, WorstFDName: n2,
+					WorstFDOpen: 40, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 5},
 			},
 		}, {
 			[]IDInfo{
-				piinfo(p1, n1, Counts{4, 5, 6, 7, 8, 9, 0, 0}, Memory{1, 5, 0}, Filedesc{4, 400}, 2),
+				piinfo(p1, n1, Counts{CPUUserTime: 4, CPUSystemTime: 5, ReadBytes: 6, WriteBytes: 7, MajorPageFaults: 8, MinorPageFaults: 9}, Memory{ResidentBytes: 1, VirtualBytes: 5}, Filedesc{Open: 4, Limit: 400}, 2),
 			},
 			GroupByName{
-				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0}, States{}, msi{}, 1, Memory{1, 5, 0}, starttime, 4, 0.01, 2, nil},
+				"g1": Group{Counts: Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, CPUNormalSeconds: 2, Wchans: msi{}, Procs: 1, Memory: Memory{ResidentBytes: 1, VirtualBytes: 5},
+					OldestStartTime: starttime, OpenFDs: 4, WorstFDratio: 0.01, WorstFDPid: p1, WorstFDName: n1,
+					WorstFDOpen: 4, WorstFDLimit: 400, OpenFDLimit: 400, NumThreads: 2},
 			},
 		}, {
 			[]IDInfo{},
 			GroupByName{
-				"g1": Group{Counts{1, 1, 1, 1, 1, 1, 0, 0}, States{}, nil, 0, Memory{}, time.Time{}, 0, 0, 0, nil},
+				"g1": Group{Counts: Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, CPUNormalSeconds: 2},
 			},
 		},
 	}
 
-	gr := NewGrouper(newNamer(n1), false, false, false)
+	gr := NewGrouper(newNamer(n1), false, false, false, Options{})
 	for i, tc := range tests {
 		got := rungroup(t, gr, procInfoIter(tc.procs...))
-		if diff := cmp.Diff(got, tc.want); diff != "" {
+		if diff := cmp.Diff(got, tc.want, ignoreWallClock); diff != "" {
 			t.Errorf("%d: curgroups differs: (-got +want)\n%s", i, diff)
 		}
 	}
 }
 
+// TestGrouperPidReuse verifies that when a pid is recycled by a proc with a
+// later start time, the group's counts keep what the old proc contributed and
+// the new proc's counts aren't compared with the old proc's.
+func TestGrouperPidReuse(t *testing.T) {
+	tests := []struct {
+		start uint64
+		read  uint64
+		want  uint64
+	}{
+		{1, 10, 0},
+		{1, 20, 10},
+		{2, 5, 10},
+		{2, 8, 13},
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	for i, tc := range tests {
+		p := newProcStart(1, "g1", tc.start)
+		p.Counts = Counts{ReadBytes: tc.read}
+		got := rungroup(t, gr, procInfoIter(p))
+		if got["g1"].ReadBytes != tc.want {
+			t.Errorf("%d: got ReadBytes %d, want %d", i, got["g1"].ReadBytes, tc.want)
+		}
+	}
+}
+
+// TestGrouperSetNamer verifies that replacing the namer regroups procs while
+// keeping the counts accumulated by groups under the old namer.
+func TestGrouperSetNamer(t *testing.T) {
+	tests := []struct {
+		// names, if non-nil, are the groups of the namer to switch to.
+		names      []string
+		read1      uint64
+		read2      uint64
+		want1      uint64
+		want2      uint64
+		wantProcs2 int
+	}{
+		{nil, 10, 10, 0, 0, 0},
+		{nil, 20, 20, 10, 0, 0},
+		{[]string{"g1", "g2"}, 30, 30, 10, 0, 1},
+		{nil, 35, 34, 15, 4, 1},
+		{[]string{"g2"}, 40, 38, 15, 4, 1},
+		{nil, 40, 39, 15, 5, 1},
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	for i, tc := range tests {
+		if tc.names != nil {
+			gr.SetNamer(newNamer(tc.names...))
+		}
+		p1 := newProcStart(1, "g1", 1)
+		p1.Counts = Counts{ReadBytes: tc.read1}
+		p2 := newProcStart(2, "g2", 1)
+		p2.Counts = Counts{ReadBytes: tc.read2}
+		got := rungroup(t, gr, procInfoIter(p1, p2))
+		if got["g1"].ReadBytes != tc.want1 || got["g2"].ReadBytes != tc.want2 {
+			t.Errorf("%d: got ReadBytes %d, %d, want %d, %d", i,
+				got["g1"].ReadBytes, got["g2"].ReadBytes, tc.want1, tc.want2)
+		}
+		if got["g2"].Procs != tc.wantProcs2 {
+			t.Errorf("%d: got %d procs in g2, want %d", i, got["g2"].Procs, tc.wantProcs2)
+		}
+	}
+}
+
+// TestGrouperProcStarts verifies that procs joining a group are counted,
+// except those already running when the Grouper started or when its namer was
+// set, and that the count persists after the procs exit.
+func TestGrouperProcStarts(t *testing.T) {
+	tests := []struct {
+		pids     []int
+		setNamer bool
+		want     uint64
+	}{
+		{[]int{1, 2}, false, 0},
+		{[]int{1, 3}, false, 1},
+		{[]int{1, 4, 5}, false, 3},
+		{[]int{1, 4, 6}, true, 3},
+		{[]int{1, 7}, false, 4},
+		{nil, false, 4},
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	for i, tc := range tests {
+		if tc.setNamer {
+			gr.SetNamer(newNamer("g1"))
+		}
+		var procs []IDInfo
+		for _, pid := range tc.pids {
+			procs = append(procs, newProcStart(pid, "g1", 1))
+		}
+		got := rungroup(t, gr, procInfoIter(procs...))
+		if got["g1"].ProcStarts != tc.want {
+			t.Errorf("%d: got %d proc starts, want %d", i, got["g1"].ProcStarts, tc.want)
+		}
+	}
+}
+
+// TestGrouperConcurrent verifies, when run with -race, that the results of an
+// Update and the methods reporting on it can be read while further Updates
+// are in progress.
+func TestGrouperConcurrent(t *testing.T) {
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false,
+		Options{ThreadStates: true, AgeBuckets: DefaultAgeBuckets})
+	results := make(chan GroupByName)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		for groups := range results {
+			_ = fmt.Sprint(groups)
+			_ = gr.RawProcs("g1")
+			_ = fmt.Sprint(gr.Snapshot())
+			_ = gr.StateSizes()
+			_ = gr.GroupPercentiles("g2", 50, 99)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		c := Counts{CPUUserTime: float64(i), ReadBytes: uint64(i)}
+		procs := []IDInfo{
+			piinfot(1, "g1", c, Memory{ResidentBytes: uint64(i)}, Filedesc{Open: 1, Limit: 10}, []Thread{
+				{ThreadID(ID{1, 0}), "t1", c, "", States{Running: 1}},
+				{ThreadID(ID{i + 2, 0}), "t2", c, "", States{Sleeping: 1}},
+			}),
+			piinfo(i+2, "g2", c, Memory{}, Filedesc{Open: 1, Limit: 10}, 1),
+		}
+		results <- rungroup(t, gr, procInfoIter(procs...))
+	}
+	close(results)
+	<-done
+}
+
 func TestGrouperThreads(t *testing.T) {
 	p, n, tm := 1, "g1", time.Unix(0, 0).UTC()
 
@@ -188,47 +345,1297 @@ func TestGrouperThreads(t *testing.T) {
 		want GroupByName
 	}{
 		{
-			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{1, 2, 3, 4, 5, 6, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0}, "", States{}},
+			piinfot(p, n, Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, []Thread{
+				{ThreadID(ID{p, 0}), "t1", Counts{CPUUserTime: 1, CPUSystemTime: 2, ReadBytes: 3, WriteBytes: 4, MajorPageFaults: 5, MinorPageFaults: 6}, "", States{}},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, "", States{}},
 			}),
 			GroupByName{
-				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{}, tm, 1, 1, 2, []Threads{
-					Threads{"t1", 1, Counts{}},
-					Threads{"t2", 1, Counts{}},
-				}},
+				"g1": Group{Wchans: msi{}, Procs: 1,
+					OldestStartTime: tm, OpenFDs: 1, WorstFDratio: 1, WorstFDPid: p, WorstFDName: n,
+					WorstFDOpen: 1, WorstFDLimit: 1, OpenFDLimit: 1, NumThreads: 2, Threads: []Threads{
+						Threads{"t1", 1, Counts{}},
+						Threads{"t2", 1, Counts{}},
+					}},
 			},
 		}, {
-			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{2, 2, 2, 2, 2, 2, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0}, "", States{}},
+			piinfot(p, n, Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, []Thread{
+				{ThreadID(ID{p, 0}), "t1", Counts{CPUUserTime: 2, CPUSystemTime: 3, ReadBytes: 4, WriteBytes: 5, MajorPageFaults: 6, MinorPageFaults: 7}, "", States{}},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{CPUUserTime: 2, CPUSystemTime: 2, ReadBytes: 2, WriteBytes: 2, MajorPageFaults: 2, MinorPageFaults: 2}, "", States{}},
+				{ThreadID(ID{p + 2, 0}), "t2", Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, "", States{}},
 			}),
 			GroupByName{
-				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{}, tm, 1, 1, 3, []Threads{
-					Threads{"t1", 1, Counts{1, 1, 1, 1, 1, 1, 0, 0}},
-					Threads{"t2", 2, Counts{1, 1, 1, 1, 1, 1, 0, 0}},
-				}},
+				"g1": Group{Wchans: msi{}, Procs: 1,
+					OldestStartTime: tm, OpenFDs: 1, WorstFDratio: 1, WorstFDPid: p, WorstFDName: n,
+					WorstFDOpen: 1, WorstFDLimit: 1, OpenFDLimit: 1, NumThreads: 3, Threads: []Threads{
+						Threads{"t1", 1, Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}},
+						Threads{"t2", 2, Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}},
+					}},
 			},
 		}, {
-			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{4, 4, 4, 4, 4, 4, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 2, 0}), "t2", Counts{2, 3, 4, 5, 6, 7, 0, 0}, "", States{}},
+			piinfot(p, n, Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, []Thread{
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{CPUUserTime: 4, CPUSystemTime: 4, ReadBytes: 4, WriteBytes: 4, MajorPageFaults: 4, MinorPageFaults: 4}, "", States{}},
+				{ThreadID(ID{p + 2, 0}), "t2", Counts{CPUUserTime: 2, CPUSystemTime: 3, ReadBytes: 4, WriteBytes: 5, MajorPageFaults: 6, MinorPageFaults: 7}, "", States{}},
 			}),
 			GroupByName{
-				"g1": Group{Counts{}, States{}, msi{}, 1, Memory{}, tm, 1, 1, 2, []Threads{
-					Threads{"t2", 2, Counts{4, 5, 6, 7, 8, 9, 0, 0}},
-				}},
+				"g1": Group{Wchans: msi{}, Procs: 1,
+					OldestStartTime: tm, OpenFDs: 1, WorstFDratio: 1, WorstFDPid: p, WorstFDName: n,
+					WorstFDOpen: 1, WorstFDLimit: 1, OpenFDLimit: 1, NumThreads: 2, Threads: []Threads{
+						Threads{"t2", 2, Counts{CPUUserTime: 4, CPUSystemTime: 5, ReadBytes: 6, WriteBytes: 7, MajorPageFaults: 8, MinorPageFaults: 9}},
+					}},
 			},
 		},
 	}
 
 	opts := cmpopts.SortSlices(lessThreads)
-	gr := NewGrouper(newNamer(n), false, false, false)
+	gr := NewGrouper(newNamer(n), false, false, false, Options{})
 	for i, tc := range tests {
 		got := rungroup(t, gr, procInfoIter(tc.proc))
-		if diff := cmp.Diff(got, tc.want, opts); diff != "" {
+		if diff := cmp.Diff(got, tc.want, opts, ignoreWallClock); diff != "" {
 			t.Errorf("%d: curgroups differs: (-got +want)\n%s", i, diff)
 		}
 	}
 }
+
+// TestGrouperCgroupFrozen verifies that procs are counted as frozen based on
+// the freezer state of their cgroup, and that cgroups without a freezer are
+// treated as not frozen.
+func TestGrouperCgroupFrozen(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	for cg, events := range map[string]string{
+		"frozen": "populated 1\nfrozen 1\n",
+		"thawed": "populated 1\nfrozen 0\n",
+	} {
+		noerr(t, os.MkdirAll(filepath.Join(root, cg), 0755))
+		noerr(t, ioutil.WriteFile(filepath.Join(root, cg, "cgroup.events"), []byte(events), 0644))
+	}
+
+	procs := []IDInfo{
+		piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(4, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+	}
+	procs[0].Cgroup = "/frozen"
+	procs[1].Cgroup = "/frozen"
+	procs[2].Cgroup = "/thawed"
+	procs[3].Cgroup = "/nofreezer"
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{CgroupRoot: root})
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if got["g1"].ProcsFrozen != 2 {
+		t.Errorf("got %d frozen procs, want 2", got["g1"].ProcsFrozen)
+	}
+
+	noerr(t, ioutil.WriteFile(filepath.Join(root, "frozen", "cgroup.events"),
+		[]byte("populated 1\nfrozen 0\n"), 0644))
+	got = rungroup(t, gr, procInfoIter(procs...))
+	if got["g1"].ProcsFrozen != 0 {
+		t.Errorf("got %d frozen procs after thaw, want 0", got["g1"].ProcsFrozen)
+	}
+}
+
+type fakeSystem []SystemUsage
+
+func (f *fakeSystem) SystemUsage() (SystemUsage, error) {
+	usage := (*f)[0]
+	*f = (*f)[1:]
+	return usage, nil
+}
+
+// TestGrouperUntracked verifies that the synthetic untracked group gets
+// whatever system usage isn't accounted for by tracked groups, and never
+// goes negative.
+func TestGrouperUntracked(t *testing.T) {
+	p1, n1 := 1, "g1"
+	system := fakeSystem{
+		{CPUUserTime: 100, CPUSystemTime: 50, MemoryUsedBytes: 1000},
+		{CPUUserTime: 110, CPUSystemTime: 55, MemoryUsedBytes: 1200},
+		{CPUUserTime: 111, CPUSystemTime: 55, MemoryUsedBytes: 100},
+	}
+
+	tests := []struct {
+		procs []IDInfo
+		want  Group
+	}{
+		{
+			[]IDInfo{piinfo(p1, n1, Counts{CPUUserTime: 1, CPUSystemTime: 1}, Memory{ResidentBytes: 200}, Filedesc{Open: 1, Limit: 1}, 1)},
+			Group{Memory: Memory{ResidentBytes: 800}},
+		},
+		{
+			[]IDInfo{piinfo(p1, n1, Counts{CPUUserTime: 5, CPUSystemTime: 2}, Memory{ResidentBytes: 300}, Filedesc{Open: 1, Limit: 1}, 1)},
+			Group{Counts: Counts{CPUUserTime: 6, CPUSystemTime: 4}, Memory: Memory{ResidentBytes: 900}},
+		},
+		{
+			[]IDInfo{piinfo(p1, n1, Counts{CPUUserTime: 7, CPUSystemTime: 4}, Memory{ResidentBytes: 300}, Filedesc{Open: 1, Limit: 1}, 1)},
+			Group{Counts: Counts{CPUUserTime: 6, CPUSystemTime: 4}},
+		},
+	}
+
+	gr := NewGrouper(newNamer(n1), false, false, false,
+		Options{UntrackedGroupName: "untracked", System: &system})
+	for i, tc := range tests {
+		got := rungroup(t, gr, procInfoIter(tc.procs...))
+		if diff := cmp.Diff(got["untracked"], tc.want, ignoreWallClock); diff != "" {
+			t.Errorf("%d: untracked group differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestGrouperRawProcs verifies that RawProcs returns the latest metrics of
+// each member of a group without aggregation.
+func TestGrouperRawProcs(t *testing.T) {
+	p1, p2, p3 := 1, 2, 3
+	n1, n2 := "g1", "g2"
+
+	procs := []IDInfo{
+		piinfo(p2, n1, Counts{CPUUserTime: 2}, Memory{ResidentBytes: 20}, Filedesc{Open: 2, Limit: 10}, 2),
+		piinfo(p1, n1, Counts{CPUUserTime: 1}, Memory{ResidentBytes: 10}, Filedesc{Open: 1, Limit: 10}, 1),
+		piinfo(p3, n2, Counts{CPUUserTime: 3}, Memory{ResidentBytes: 30}, Filedesc{Open: 3, Limit: 10}, 3),
+	}
+	gr := NewGrouper(newNamer(n1, n2), false, false, false, Options{})
+	rungroup(t, gr, procInfoIter(procs...))
+
+	want := []IDInfo{procs[1], procs[0]}
+	if diff := cmp.Diff(gr.RawProcs(n1), want); diff != "" {
+		t.Errorf("raw procs differ: (-got +want)\n%s", diff)
+	}
+	if got := gr.RawProcs("unknown"); len(got) != 0 {
+		t.Errorf("got %d procs for unknown group, want 0", len(got))
+	}
+}
+
+// TestGrouperSnapshot verifies that Snapshot returns the result of the last
+// successful Update, in a map of the caller's own.
+func TestGrouperSnapshot(t *testing.T) {
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	if got := gr.Snapshot(); got != nil {
+		t.Errorf("got snapshot %v before any Update, want nil", got)
+	}
+
+	p1 := piinfo(1, "g1", Counts{CPUUserTime: 1}, Memory{ResidentBytes: 10}, Filedesc{Open: 1, Limit: 10}, 1)
+	want := rungroup(t, gr, procInfoIter(p1))
+	got := gr.Snapshot()
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("snapshot differs: (-got +want)\n%s", diff)
+	}
+
+	delete(got, "g1")
+	if _, ok := gr.Snapshot()["g1"]; !ok {
+		t.Errorf("modifying a snapshot changed the next one")
+	}
+}
+
+// TestGrouperCgroupMemory verifies that procs alone in their cgroup report
+// its memory.current as resident memory, while others report their RSS.
+func TestGrouperCgroupMemory(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	for file, content := range map[string]string{
+		"solo/cgroup.procs":    "1\n",
+		"solo/memory.current":  "10000\n",
+		"multi/cgroup.procs":   "2\n3\n",
+		"multi/memory.current": "20000\n",
+	} {
+		noerr(t, os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755))
+		noerr(t, ioutil.WriteFile(filepath.Join(root, file), []byte(content), 0644))
+	}
+
+	procs := []IDInfo{
+		piinfo(1, "g1", Counts{}, Memory{ResidentBytes: 100}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(2, "g2", Counts{}, Memory{ResidentBytes: 200}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(3, "g2", Counts{}, Memory{ResidentBytes: 300}, Filedesc{Open: 1, Limit: 1}, 1),
+	}
+	procs[0].Cgroup = "/solo"
+	procs[1].Cgroup = "/multi"
+	procs[2].Cgroup = "/multi"
+
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false, Options{CgroupRoot: root, CgroupMemory: true})
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if got["g1"].ResidentBytes != 10000 || got["g2"].ResidentBytes != 500 {
+		t.Errorf("got resident g1=%d g2=%d, want g1=10000 g2=500",
+			got["g1"].ResidentBytes, got["g2"].ResidentBytes)
+	}
+}
+
+// TestGrouperPercentiles verifies the percentiles of member usage.
+func TestGrouperPercentiles(t *testing.T) {
+	var procs1, procs2 []IDInfo
+	for i := 1; i <= 10; i++ {
+		procs1 = append(procs1, piinfo(i, "g1", Counts{}, Memory{ResidentBytes: uint64(i * 100)}, Filedesc{Open: 1, Limit: 1}, 1))
+		procs2 = append(procs2, piinfo(i, "g1", Counts{CPUUserTime: float64(i)}, Memory{ResidentBytes: uint64(i * 100)}, Filedesc{Open: 1, Limit: 1}, 1))
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	rungroup(t, gr, procInfoIter(procs1...))
+	rungroup(t, gr, procInfoIter(procs2...))
+
+	got := gr.GroupPercentiles("g1", 50, 95, 100)
+	want := map[float64]GroupMemberStats{
+		50:  {ResidentBytes: 500, CPUSeconds: 5},
+		95:  {ResidentBytes: 1000, CPUSeconds: 10},
+		100: {ResidentBytes: 1000, CPUSeconds: 10},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("percentiles differ: (-got +want)\n%s", diff)
+	}
+
+	if got := gr.GroupPercentiles("nosuchgroup", 50); len(got) != 0 {
+		t.Errorf("got %v for unknown group, want empty", got)
+	}
+}
+
+// TestGrouperCgroupPressure verifies that a group reports the worst PSI
+// values among its cgroups, and no PSI if none of them provide it.
+func TestGrouperCgroupPressure(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	psi := func(some float64) string {
+		return fmt.Sprintf("some avg10=%.2f avg60=0.00 avg300=0.00 total=0\n"+
+			"full avg10=0.00 avg60=0.00 avg300=0.00 total=0\n", some)
+	}
+	for file, content := range map[string]string{
+		"a/cpu.pressure":    psi(1.5),
+		"a/memory.pressure": psi(20),
+		"a/io.pressure":     psi(3),
+		"b/cpu.pressure":    psi(10.25),
+		"b/memory.pressure": psi(2),
+	} {
+		noerr(t, os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755))
+		noerr(t, ioutil.WriteFile(filepath.Join(root, file), []byte(content), 0644))
+	}
+
+	procs := []IDInfo{
+		piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(3, "g2", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+	}
+	procs[0].Cgroup = "/a"
+	procs[1].Cgroup = "/b"
+	procs[2].Cgroup = "/nopsi"
+
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false, Options{CgroupRoot: root})
+	got := rungroup(t, gr, procInfoIter(procs...))
+	want := &Pressure{CPU: 10.25, Memory: 20, IO: 3}
+	if diff := cmp.Diff(got["g1"].Pressure, want); diff != "" {
+		t.Errorf("pressure differs: (-got +want)\n%s", diff)
+	}
+	if got["g2"].Pressure != nil {
+		t.Errorf("got pressure %v for group without PSI, want nil", *got["g2"].Pressure)
+	}
+}
+
+// TestGrouperWarmup verifies that groups aren't reported until they've
+// existed for the warmup period, that they then include the counts
+// accumulated during warmup, and that groups which vanish during warmup are
+// never reported.
+func TestGrouperWarmup(t *testing.T) {
+	p1, p2 := 1, 2
+	n1, n2 := "g1", "g2"
+	t0 := time.Unix(1000, 0)
+
+	tests := []struct {
+		procs []IDInfo
+		now   time.Time
+		want  []string
+		cpu   float64
+	}{
+		{
+			[]IDInfo{
+				piinfo(p1, n1, Counts{CPUUserTime: 1}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+				piinfo(p2, n2, Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+			},
+			t0, nil, 0,
+		},
+		{
+			[]IDInfo{
+				piinfo(p1, n1, Counts{CPUUserTime: 2}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+			},
+			t0.Add(5 * time.Second), nil, 0,
+		},
+		{
+			[]IDInfo{
+				piinfo(p1, n1, Counts{CPUUserTime: 4}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+			},
+			t0.Add(10 * time.Second), []string{n1}, 3,
+		},
+		{
+			[]IDInfo{},
+			t0.Add(20 * time.Second), []string{n1}, 3,
+		},
+	}
+
+	gr := NewGrouper(newNamer(n1, n2), false, false, false, Options{Warmup: 10 * time.Second})
+	for i, tc := range tests {
+		_, tracked, err := gr.tracker.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		got := gr.groups(tracked, tc.now)
+
+		var names []string
+		for gname := range got {
+			names = append(names, gname)
+		}
+		if diff := cmp.Diff(names, tc.want); diff != "" {
+			t.Errorf("%d: groups differ: (-got +want)\n%s", i, diff)
+		}
+		if got[n1].CPUUserTime != tc.cpu {
+			t.Errorf("%d: got cpu %v, want %v", i, got[n1].CPUUserTime, tc.cpu)
+		}
+	}
+}
+
+// TestGrouperMaxAge verifies that procs older than their group's max age are
+// counted.
+func TestGrouperMaxAge(t *testing.T) {
+	n1, n2 := "g1", "g2"
+	now := time.Unix(1000, 0)
+
+	gr := NewGrouper(newNamer(n1, n2), false, false, false,
+		Options{MaxAges: map[string]time.Duration{n1: time.Minute}})
+	_, tracked, err := gr.tracker.Update(procInfoIter(
+		newProcStart(1, n1, 900),
+		newProcStart(2, n1, 950),
+		newProcStart(3, n1, 990),
+		newProcStart(4, n2, 900),
+	))
+	noerr(t, err)
+	got := gr.groups(tracked, now)
+
+	if got[n1].ProcsExceedingMaxAge != 1 {
+		t.Errorf("got %d procs exceeding max age in %s, want 1", got[n1].ProcsExceedingMaxAge, n1)
+	}
+	if got[n2].ProcsExceedingMaxAge != 0 {
+		t.Errorf("got %d procs exceeding max age in %s, want 0", got[n2].ProcsExceedingMaxAge, n2)
+	}
+}
+
+// TestGrouperCgroupWriteback verifies that dirty and writeback memory is
+// summed over the distinct cgroups of a group.
+func TestGrouperCgroupWriteback(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	for file, content := range map[string]string{
+		"a/memory.stat": "anon 100\nfile 200\nfile_dirty 4096\nfile_writeback 8192\n",
+		"b/memory.stat": "anon 100\nfile_dirty 1024\nfile_writeback 0\n",
+	} {
+		noerr(t, os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755))
+		noerr(t, ioutil.WriteFile(filepath.Join(root, file), []byte(content), 0644))
+	}
+
+	procs := []IDInfo{
+		piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(4, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+	}
+	procs[0].Cgroup = "/a"
+	procs[1].Cgroup = "/a"
+	procs[2].Cgroup = "/b"
+	procs[3].Cgroup = "/nomem"
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{CgroupRoot: root})
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if got["g1"].DirtyBytes != 5120 || got["g1"].WritebackBytes != 8192 {
+		t.Errorf("got dirty=%d writeback=%d, want dirty=5120 writeback=8192",
+			got["g1"].DirtyBytes, got["g1"].WritebackBytes)
+	}
+}
+
+// TestGrouperCgroupMemoryLimit verifies that a group reports the lowest
+// memory limit among its cgroups, v2 or v1, ignoring unlimited ones.
+func TestGrouperCgroupMemoryLimit(t *testing.T) {
+	root, err := ioutil.TempDir("", "cgroup")
+	noerr(t, err)
+	defer os.RemoveAll(root)
+	for file, content := range map[string]string{
+		"a/memory.max":                       "1073741824\n",
+		"b/memory.max":                       "536870912\n",
+		"unlimited/memory.max":               "max\n",
+		"memory/v1/memory.limit_in_bytes":    "268435456\n",
+		"memory/v1max/memory.limit_in_bytes": "9223372036854771712\n",
+	} {
+		noerr(t, os.MkdirAll(filepath.Join(root, filepath.Dir(file)), 0755))
+		noerr(t, ioutil.WriteFile(filepath.Join(root, file), []byte(content), 0644))
+	}
+
+	procs := []IDInfo{
+		piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(4, "g2", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(5, "g3", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(6, "g3", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+	}
+	procs[0].Cgroup = "/a"
+	procs[1].Cgroup = "/b"
+	procs[2].Cgroup = "/unlimited"
+	procs[3].Cgroup = "/unlimited"
+	procs[4].CgroupV1Memory = "/v1"
+	procs[5].CgroupV1Memory = "/v1max"
+
+	gr := NewGrouper(newNamer("g1", "g2", "g3"), false, false, false, Options{CgroupRoot: root})
+	got := rungroup(t, gr, procInfoIter(procs...))
+	for gname, want := range map[string]uint64{"g1": 536870912, "g2": 0, "g3": 268435456} {
+		if got[gname].MemoryLimitBytes != want {
+			t.Errorf("%s: got memory limit %d, want %d", gname, got[gname].MemoryLimitBytes, want)
+		}
+	}
+}
+
+// TestGrouperSampleSize verifies that only the lowest-pid procs have their
+// details read, and that the group's totals are extrapolated from them.
+func TestGrouperSampleSize(t *testing.T) {
+	procs := []IDInfo{
+		piinfo(1, "g1", Counts{}, Memory{ProportionalBytes: 100}, Filedesc{Open: 10, Limit: 100}, 1),
+		piinfo(2, "g1", Counts{}, Memory{ProportionalBytes: 200}, Filedesc{Open: 20, Limit: 100}, 1),
+		piinfo(3, "g1", Counts{}, Memory{ProportionalBytes: 900}, Filedesc{Open: 90, Limit: 100}, 1),
+		piinfo(4, "g1", Counts{}, Memory{ProportionalBytes: 900}, Filedesc{Open: 90, Limit: 100}, 1),
+	}
+	for i := range procs {
+		procs[i].FDTypes = FDTypes{Files: int(procs[i].Open)}
+		procs[i].Inotify = Inotify{Instances: 1, Watches: int(procs[i].Open)}
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{SampleSize: 2})
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if got["g1"].OpenFDs != 210 {
+		t.Errorf("first cycle: got %d open fds, want 210", got["g1"].OpenFDs)
+	}
+
+	cerrs, got, err := gr.Update(procInfoIter(procs...))
+	noerr(t, err)
+	if cerrs.DetailSkipped != 2 {
+		t.Errorf("got %d procs skipped, want 2", cerrs.DetailSkipped)
+	}
+	if got["g1"].OpenFDs != 60 || got["g1"].WorstFDratio != 0.2 {
+		t.Errorf("got %d open fds and worst ratio %v, want 60 and 0.2",
+			got["g1"].OpenFDs, got["g1"].WorstFDratio)
+	}
+	if got["g1"].OpenFDTypes.Files != 60 || got["g1"].ProportionalBytes != 600 {
+		t.Errorf("got %d open files and %d pss bytes, want 60 and 600",
+			got["g1"].OpenFDTypes.Files, got["g1"].ProportionalBytes)
+	}
+	if want := (Inotify{Instances: 4, Watches: 60}); got["g1"].Inotify != want {
+		t.Errorf("got inotify %+v, want %+v", got["g1"].Inotify, want)
+	}
+}
+
+// TestGrouperReducers verifies that custom reducers are applied to the
+// members of each group.
+func TestGrouperReducers(t *testing.T) {
+	rss := func(u Update) float64 { return float64(u.ResidentBytes) }
+	harmonicMean := func(members []Update) float64 {
+		var sum float64
+		for _, u := range members {
+			sum += 1 / rss(u)
+		}
+		return float64(len(members)) / sum
+	}
+
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false, Options{
+		Reducers: map[string]Reducer{
+			"rss_sum":   SumReducer(rss),
+			"rss_max":   MaxReducer(rss),
+			"rss_hmean": harmonicMean,
+		},
+	})
+	got := rungroup(t, gr, procInfoIter(
+		piinfo(1, "g1", Counts{}, Memory{ResidentBytes: 1}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(2, "g1", Counts{}, Memory{ResidentBytes: 4}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(3, "g1", Counts{}, Memory{ResidentBytes: 4}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(4, "g2", Counts{}, Memory{ResidentBytes: 5}, Filedesc{Open: 1, Limit: 1}, 1),
+	))
+	want := map[string]map[string]float64{
+		"g1": {"rss_sum": 9, "rss_max": 4, "rss_hmean": 2},
+		"g2": {"rss_sum": 5, "rss_max": 5, "rss_hmean": 5},
+	}
+	for gname, custom := range want {
+		if diff := cmp.Diff(got[gname].Custom, custom); diff != "" {
+			t.Errorf("%s: custom metrics differ: (-got +want)\n%s", gname, diff)
+		}
+	}
+}
+
+// TestGrouperFingerprint verifies that a group's fingerprint changes when
+// its membership does, and only then.
+func TestGrouperFingerprint(t *testing.T) {
+	tests := []struct {
+		procs   []IDInfo
+		changed bool
+	}{
+		{[]IDInfo{newProcStart(1, "g1", 1), newProcStart(2, "g1", 1)}, true},
+		{[]IDInfo{newProcStart(2, "g1", 1), newProcStart(1, "g1", 1)}, false},
+		{[]IDInfo{newProcStart(1, "g1", 1), newProcStart(2, "g1", 1), newProcStart(3, "g1", 1)}, true},
+		{[]IDInfo{newProcStart(1, "g1", 1), newProcStart(2, "g1", 1), newProcStart(3, "g1", 5)}, true},
+		{[]IDInfo{newProcStart(1, "g1", 1), newProcStart(2, "g1", 1), newProcStart(3, "g1", 5)}, false},
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{Fingerprint: true})
+	var last uint64
+	for i, tc := range tests {
+		got := rungroup(t, gr, procInfoIter(tc.procs...))["g1"].Fingerprint
+		if got == 0 {
+			t.Errorf("%d: got no fingerprint", i)
+		}
+		if changed := got != last; changed != tc.changed {
+			t.Errorf("%d: got changed=%v, want %v", i, changed, tc.changed)
+		}
+		last = got
+	}
+}
+
+// TestGrouperCoredump verifies that procs able to dump core are counted.
+func TestGrouperCoredump(t *testing.T) {
+	p1 := piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2.CoredumpEnabled = true
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(p1, p2))
+	if got["g1"].ProcsWithCoredumpEnabled != 1 {
+		t.Errorf("got %d procs with coredump enabled, want 1", got["g1"].ProcsWithCoredumpEnabled)
+	}
+}
+
+// TestGrouperSchedClass verifies that CPU usage is split by scheduling class.
+func TestGrouperSchedClass(t *testing.T) {
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	for _, cpu := range []float64{1, 3} {
+		p1 := piinfo(1, "g1", Counts{CPUUserTime: cpu, CPUSystemTime: cpu}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+		p2 := piinfo(2, "g1", Counts{CPUUserTime: 2 * cpu}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+		p2.Realtime = true
+		rungroup(t, gr, procInfoIter(p1, p2))
+	}
+
+	got := rungroup(t, gr, procInfoIter(
+		piinfo(1, "g1", Counts{CPUUserTime: 3, CPUSystemTime: 4}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)))
+	if got["g1"].CPUNormalSeconds != 5 || got["g1"].CPURealtimeSeconds != 4 {
+		t.Errorf("got normal=%v realtime=%v, want normal=5 realtime=4",
+			got["g1"].CPUNormalSeconds, got["g1"].CPURealtimeSeconds)
+	}
+}
+
+// TestGrouperSetuid verifies that procs running setuid executables are
+// counted.
+func TestGrouperSetuid(t *testing.T) {
+	p1 := piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2.ExeSetuid = true
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(p1, p2))
+	if got["g1"].SetuidProcs != 1 {
+		t.Errorf("got %d setuid procs, want 1", got["g1"].SetuidProcs)
+	}
+}
+
+// TestGrouperChrooted verifies that procs with a root other than / are
+// counted, and those whose root is unknown aren't.
+func TestGrouperChrooted(t *testing.T) {
+	procs := []IDInfo{
+		piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+	}
+	procs[0].Root = "/"
+	procs[1].Root = "/var/lib/jail"
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if got["g1"].ChrootedProcs != 1 {
+		t.Errorf("got %d chrooted procs, want 1", got["g1"].ChrootedProcs)
+	}
+}
+
+// TestGrouperVSZBloat verifies that procs whose virtual memory is out of
+// proportion to their resident memory are counted.
+func TestGrouperVSZBloat(t *testing.T) {
+	procs := []IDInfo{
+		piinfo(1, "g1", Counts{}, Memory{ResidentBytes: 100, VirtualBytes: 1000}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(2, "g1", Counts{}, Memory{ResidentBytes: 100, VirtualBytes: 100000}, Filedesc{Open: 1, Limit: 1}, 1),
+		piinfo(3, "g1", Counts{}, Memory{VirtualBytes: 100000}, Filedesc{Open: 1, Limit: 1}, 1),
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{VSZBloatRatio: 50})
+	got := rungroup(t, gr, procInfoIter(procs...))
+	if got["g1"].ProcsWithVSZBloat != 1 {
+		t.Errorf("got %d procs with VSZ bloat, want 1", got["g1"].ProcsWithVSZBloat)
+	}
+}
+
+// TestGrouperAges verifies that procs are counted in the age histogram
+// buckets they fit in, and that groups without procs get no histogram.
+func TestGrouperAges(t *testing.T) {
+	t0 := time.Unix(0, 0).UTC()
+	procs := []IDInfo{
+		newProcStart(1, "g1", 0),
+		newProcStart(2, "g1", 50),
+		newProcStart(3, "g1", 95),
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{AgeBuckets: []float64{10, 60, 3600}})
+	_, tracked, err := gr.tracker.Update(procInfoIter(procs...))
+	noerr(t, err)
+	got := gr.groups(tracked, t0.Add(100*time.Second))
+	want := &AgeHistogram{
+		Buckets: map[float64]uint64{10: 1, 60: 2, 3600: 3},
+		Count:   3,
+		Sum:     155,
+	}
+	if diff := cmp.Diff(got["g1"].Ages, want); diff != "" {
+		t.Errorf("ages differ: (-got +want)\n%s", diff)
+	}
+
+	_, tracked, err = gr.tracker.Update(procInfoIter())
+	noerr(t, err)
+	got = gr.groups(tracked, t0.Add(200*time.Second))
+	if got["g1"].Ages != nil {
+		t.Errorf("got ages %+v for group without procs, want none", got["g1"].Ages)
+	}
+}
+
+// TestGrouperTraced verifies that procs being traced are counted.
+func TestGrouperTraced(t *testing.T) {
+	p1 := piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p1.Traced = true
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(p1, p2))
+	if got["g1"].ProcsBeingTraced != 1 {
+		t.Errorf("got %d procs being traced, want 1", got["g1"].ProcsBeingTraced)
+	}
+}
+
+// TestGrouperNetDev verifies that the traffic of each network namespace is
+// counted once per group, however many of its procs share it, and only
+// while it's in the group, so that the totals never drop.
+func TestGrouperNetDev(t *testing.T) {
+	p1 := piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p3 := piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p4 := piinfo(4, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p5 := piinfo(5, "g2", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	netdev := func(p IDInfo, ns, rx, tx uint64) IDInfo {
+		p.NetNamespace, p.NetDev = ns, NetDev{RxBytes: rx, TxBytes: tx}
+		return p
+	}
+
+	tests := []struct {
+		procs []IDInfo
+		want  map[string]NetDev
+	}{
+		{
+			[]IDInfo{netdev(p1, 100, 10, 20), netdev(p2, 100, 10, 20), netdev(p3, 101, 1, 2),
+				netdev(p5, 100, 10, 20)},
+			map[string]NetDev{"g1": {}, "g2": {}},
+		},
+		{
+			// Namespace 101 leaves, and 102 appears with past traffic.
+			// Namespace 100 goes to g1, which has its lowest pid.
+			[]IDInfo{netdev(p1, 100, 15, 30), netdev(p2, 100, 15, 30), netdev(p4, 102, 1000, 2000),
+				netdev(p5, 100, 15, 30)},
+			map[string]NetDev{"g1": {RxBytes: 5, TxBytes: 10}, "g2": {}},
+		},
+		{
+			// Now that g1 has left namespace 100, it goes to g2.
+			[]IDInfo{netdev(p4, 102, 1010, 2020), netdev(p5, 100, 17, 33)},
+			map[string]NetDev{"g1": {RxBytes: 15, TxBytes: 30}, "g2": {RxBytes: 2, TxBytes: 3}},
+		},
+	}
+
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false, Options{})
+	for i, tc := range tests {
+		got := rungroup(t, gr, procInfoIter(tc.procs...))
+		for gname, want := range tc.want {
+			if got[gname].NetRxBytes != want.RxBytes || got[gname].NetTxBytes != want.TxBytes {
+				t.Errorf("%d: got %s net rx %d tx %d, want %d, %d", i, gname,
+					got[gname].NetRxBytes, got[gname].NetTxBytes, want.RxBytes, want.TxBytes)
+			}
+		}
+	}
+}
+
+// TestGrouperOOMScore verifies that a group reports the worst oom_score of
+// its procs along with that proc's oom_score_adj, ignoring unknown scores.
+func TestGrouperOOMScore(t *testing.T) {
+	p1 := piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p3 := piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p4 := piinfo(4, "g2", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p1.OOMScore, p1.OOMScoreAdj = 10, 0
+	p2.OOMScore, p2.OOMScoreAdj = 500, 300
+	p3.OOMScore = -1
+	p4.OOMScore = -1
+
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(p1, p2, p3, p4))
+	if got["g1"].WorstOOMScore != 500 || got["g1"].OOMScoreAdj != 300 {
+		t.Errorf("got worst oom score %d adj %d, want 500, 300", got["g1"].WorstOOMScore, got["g1"].OOMScoreAdj)
+	}
+	if got["g2"].WorstOOMScore != -1 {
+		t.Errorf("got worst oom score %d for unknown scores, want -1", got["g2"].WorstOOMScore)
+	}
+}
+
+// TestGrouperMatchedViaParent verifies that procs tracked because of their
+// parent are counted separately from those matched directly.
+func TestGrouperMatchedViaParent(t *testing.T) {
+	gr := NewGrouper(newNamer("g1"), true, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(
+		newProcParent(1, "g1", 0),
+		newProcParent(2, "sh", 1),
+		newProcParent(3, "sh", 2),
+		newProcParent(4, "g1", 0),
+		newProcParent(5, "sh", 0),
+	))
+	if g1 := got["g1"]; g1.Procs != 4 || g1.MatchedViaParent != 2 || g1.MatchedDirect() != 2 {
+		t.Errorf("got %d procs, %d via parent, %d direct, want 4, 2, 2",
+			g1.Procs, g1.MatchedViaParent, g1.MatchedDirect())
+	}
+}
+
+// TestGrouperWorstFD verifies that the proc with the worst fd ratio is
+// identified, preferring the lowest pid on ties, and that none is identified
+// for a group without open fds.
+func TestGrouperWorstFD(t *testing.T) {
+	p1 := piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 10, Limit: 100, HardLimit: 4096}, 1)
+	p2 := piinfo(5, "g1", Counts{}, Memory{}, Filedesc{Open: 100, Limit: 200, HardLimit: 1024}, 1)
+	p3 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 50, Limit: 100}, 1)
+	p4 := piinfo(4, "g2", Counts{}, Memory{}, Filedesc{Limit: 100}, 1)
+
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(p1, p2, p3, p4))
+	g1 := got["g1"]
+	if g1.WorstFDPid != 2 || g1.WorstFDName != "g1" || g1.WorstFDOpen != 50 || g1.WorstFDLimit != 100 {
+		t.Errorf("got worst fd proc %d %q %d/%d, want 2 \"g1\" 50/100",
+			g1.WorstFDPid, g1.WorstFDName, g1.WorstFDOpen, g1.WorstFDLimit)
+	}
+	if got["g2"].WorstFDPid != 0 {
+		t.Errorf("got worst fd pid %d for group without open fds, want 0", got["g2"].WorstFDPid)
+	}
+	// p3's hard limit is unknown, so it doesn't count.
+	if g1.OpenFDLimit != 100 || g1.OpenFDHardLimit != 1024 {
+		t.Errorf("got fd limits %d/%d, want 100/1024", g1.OpenFDLimit, g1.OpenFDHardLimit)
+	}
+}
+
+// TestGrouperPods verifies that each group lists the distinct pod containers
+// of its procs, and that pods which couldn't be resolved are retried.
+func TestGrouperPods(t *testing.T) {
+	uid := "0b1c2d3e-aaaa-bbbb-cccc-0123456789ab"
+	cid := strings.Repeat("c", 64)
+	p1 := piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p3 := piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p1.Cgroup = "/kubepods/besteffort/pod" + uid + "/" + cid
+	p2.Cgroup = p1.Cgroup
+	p3.Cgroup = "/system.slice/sshd.service"
+
+	resolver := mapPodResolver{}
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{PodResolver: resolver})
+	got := rungroup(t, gr, procInfoIter(p1, p2, p3))
+	want := []common.Pod{{UID: uid, Container: cid}}
+	if diff := cmp.Diff(got["g1"].Pods, want); diff != "" {
+		t.Errorf("unresolved pods differ: (-got +want)\n%s", diff)
+	}
+
+	resolver[uid] = common.Pod{UID: uid, Namespace: "ns", Name: "web-0", Container: "nginx"}
+	got = rungroup(t, gr, procInfoIter(p1, p2, p3))
+	want = []common.Pod{resolver[uid]}
+	if diff := cmp.Diff(got["g1"].Pods, want); diff != "" {
+		t.Errorf("resolved pods differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestGrouperLifetime verifies that the time lived by a group's procs
+// accumulates from when they're first seen or start, and doesn't go back down
+// when a proc exits.
+func TestGrouperLifetime(t *testing.T) {
+	started := func(pid int, start int64) IDInfo {
+		p := piinfo(pid, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+		p.StartTime = time.Unix(start, 0)
+		return p
+	}
+	t0 := time.Unix(1000, 0)
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	for i, tc := range []struct {
+		procs []IDInfo
+		now   time.Time
+		want  float64
+	}{
+		{[]IDInfo{started(1, 0), started(2, 990)}, t0, 0},
+		{[]IDInfo{started(1, 0), started(2, 990), started(3, 1010)}, t0.Add(15 * time.Second), 35},
+		{[]IDInfo{started(1, 0)}, t0.Add(30 * time.Second), 50},
+		{nil, t0.Add(45 * time.Second), 50},
+	} {
+		_, tracked, err := gr.tracker.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		got := gr.groups(tracked, tc.now)
+		if got["g1"].LifetimeSeconds != tc.want {
+			t.Errorf("%d: got lifetime %v, want %v", i, got["g1"].LifetimeSeconds, tc.want)
+		}
+	}
+}
+
+// TestGrouperMemoryPeak verifies that per-proc memory high-water marks are
+// summed over the group, with kernel threads contributing nothing.
+func TestGrouperMemoryPeak(t *testing.T) {
+	p1 := piinfo(1, "g1", Counts{}, Memory{ResidentPeak: 100, VirtualPeak: 1000}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{ResidentPeak: 20, VirtualPeak: 200}, Filedesc{Open: 1, Limit: 1}, 1)
+	p3 := piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(p1, p2, p3))
+	if got["g1"].ResidentPeak != 120 || got["g1"].VirtualPeak != 1200 {
+		t.Errorf("got peaks %d, %d, want 120, 1200", got["g1"].ResidentPeak, got["g1"].VirtualPeak)
+	}
+}
+
+// TestGrouperNice verifies that the ranges of nice values and priorities of a
+// group's procs are tracked, including negative ones.
+func TestGrouperNice(t *testing.T) {
+	p1 := piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p3 := piinfo(3, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p4 := piinfo(4, "g2", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p1.Nice, p2.Nice, p3.Nice, p4.Nice = 5, -10, 0, 19
+	p1.Priority, p2.Priority, p3.Priority, p4.Priority = 25, 10, -51, 39
+
+	gr := NewGrouper(newNamer("g1", "g2"), false, false, false, Options{})
+	got := rungroup(t, gr, procInfoIter(p1, p2, p3, p4))
+	if got["g1"].MinNice != -10 || got["g1"].MaxNice != 5 {
+		t.Errorf("got nice range %d..%d, want -10..5", got["g1"].MinNice, got["g1"].MaxNice)
+	}
+	if got["g2"].MinNice != 19 || got["g2"].MaxNice != 19 {
+		t.Errorf("got nice range %d..%d, want 19..19", got["g2"].MinNice, got["g2"].MaxNice)
+	}
+	if got["g1"].MinPriority != -51 || got["g1"].MaxPriority != 25 {
+		t.Errorf("got priority range %d..%d, want -51..25", got["g1"].MinPriority, got["g1"].MaxPriority)
+	}
+	if got["g2"].MinPriority != 39 || got["g2"].MaxPriority != 39 {
+		t.Errorf("got priority range %d..%d, want 39..39", got["g2"].MinPriority, got["g2"].MaxPriority)
+	}
+}
+
+// TestGrouperUserProcs verifies that procs are counted by effective user,
+// and that users with no name are identified by their uid.
+func TestGrouperUserProcs(t *testing.T) {
+	p1, p2, p3 := newProcStart(1, "g1", 0), newProcStart(2, "g1", 0), newProcStart(3, "g1", 0)
+	p1.EffectiveUID, p2.EffectiveUID, p3.EffectiveUID = 0, 0, 54321
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{UserProcs: true})
+	got := rungroup(t, gr, procInfoIter(p1, p2, p3))
+	want := map[User]int{{0, "root"}: 2, {54321, "54321"}: 1}
+	if diff := cmp.Diff(got["g1"].UserProcs, want); diff != "" {
+		t.Errorf("user procs differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestGrouperThreadStates verifies that each thread of the group's procs is
+// counted once in the group's thread states, and only when enabled.
+func TestGrouperThreadStates(t *testing.T) {
+	p1 := piinfot(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, []Thread{
+		{ThreadID(ID{1, 0}), "t1", Counts{}, "", States{Running: 1}},
+		{ThreadID(ID{3, 0}), "t2", Counts{}, "", States{Sleeping: 1}},
+		{ThreadID(ID{4, 0}), "t2", Counts{}, "", States{Sleeping: 1}},
+	})
+	p1.States = States{Running: 1}
+	p2 := piinfost(2, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1, States{Waiting: 1})
+
+	for _, enabled := range []bool{false, true} {
+		gr := NewGrouper(newNamer("g1"), false, false, false, Options{ThreadStates: enabled})
+		got := rungroup(t, gr, procInfoIter(p1, p2))
+		want := States{}
+		if enabled {
+			want = States{Running: 1, Sleeping: 2, Waiting: 1}
+		}
+		if diff := cmp.Diff(got["g1"].ThreadStates, want); diff != "" {
+			t.Errorf("enabled=%v: thread states differ: (-got +want)\n%s", enabled, diff)
+		}
+	}
+}
+
+// TestGrouperTrackedDuration verifies that a group's tracked duration counts
+// from when it was first seen, including after its procs have exited.
+func TestGrouperTrackedDuration(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+	tests := []struct {
+		procs []IDInfo
+		now   time.Time
+		want  float64
+	}{
+		{[]IDInfo{piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)}, t0, 0},
+		{[]IDInfo{piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)}, t0.Add(10 * time.Second), 10},
+		{[]IDInfo{}, t0.Add(30 * time.Second), 30},
+	}
+
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	for i, tc := range tests {
+		_, tracked, err := gr.tracker.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		got := gr.groups(tracked, tc.now)
+		if got["g1"].TrackedDurationSeconds != tc.want {
+			t.Errorf("%d: got tracked duration %v, want %v", i, got["g1"].TrackedDurationSeconds, tc.want)
+		}
+	}
+}
+
+// TestGrouperLinger verifies that a group without procs is reported as final
+// until the linger period has elapsed, then forgotten.
+func TestGrouperLinger(t *testing.T) {
+	n1 := "g1"
+	t0 := time.Unix(1000, 0)
+
+	tests := []struct {
+		procs []IDInfo
+		now   time.Time
+		want  []string
+		final bool
+		cpu   float64
+	}{
+		{
+			[]IDInfo{piinfo(1, n1, Counts{CPUUserTime: 1}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)},
+			t0, []string{n1}, false, 0,
+		},
+		{
+			[]IDInfo{piinfo(1, n1, Counts{CPUUserTime: 3}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)},
+			t0.Add(time.Second), []string{n1}, false, 2,
+		},
+		{
+			[]IDInfo{},
+			t0.Add(2 * time.Second), []string{n1}, true, 2,
+		},
+		{
+			[]IDInfo{},
+			t0.Add(6 * time.Second), []string{n1}, true, 2,
+		},
+		{
+			[]IDInfo{},
+			t0.Add(7 * time.Second), nil, false, 0,
+		},
+	}
+
+	gr := NewGrouper(newNamer(n1), false, false, false, Options{Linger: 5 * time.Second})
+	for i, tc := range tests {
+		_, tracked, err := gr.tracker.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		got := gr.groups(tracked, tc.now)
+
+		var names []string
+		for gname := range got {
+			names = append(names, gname)
+		}
+		if diff := cmp.Diff(names, tc.want); diff != "" {
+			t.Errorf("%d: groups differ: (-got +want)\n%s", i, diff)
+		}
+		if got[n1].Final != tc.final || got[n1].CPUUserTime != tc.cpu {
+			t.Errorf("%d: got final=%v cpu=%v, want final=%v cpu=%v",
+				i, got[n1].Final, got[n1].CPUUserTime, tc.final, tc.cpu)
+		}
+	}
+	if len(gr.groupAccum) != 0 {
+		t.Errorf("history not forgotten: %v", gr.groupAccum)
+	}
+}
+
+// TestGrouperLingerCycles verifies that a group without procs is reported as
+// final for LingerCycles cycles, then forgotten, and that the count restarts
+// if procs reappear in the meantime.
+func TestGrouperLingerCycles(t *testing.T) {
+	n1 := "g1"
+	p1 := piinfo(1, n1, Counts{CPUUserTime: 1}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+	p2 := piinfo(2, n1, Counts{CPUUserTime: 1}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+
+	tests := []struct {
+		procs []IDInfo
+		want  []string
+		final bool
+	}{
+		{[]IDInfo{p1}, []string{n1}, false},
+		{[]IDInfo{}, []string{n1}, true},
+		{[]IDInfo{p2}, []string{n1}, false},
+		{[]IDInfo{}, []string{n1}, true},
+		{[]IDInfo{}, []string{n1}, true},
+		{[]IDInfo{}, nil, false},
+		{[]IDInfo{}, nil, false},
+	}
+
+	gr := NewGrouper(newNamer(n1), false, false, false, Options{LingerCycles: 2})
+	for i, tc := range tests {
+		got := rungroup(t, gr, procInfoIter(tc.procs...))
+
+		var names []string
+		for gname := range got {
+			names = append(names, gname)
+		}
+		if diff := cmp.Diff(names, tc.want); diff != "" {
+			t.Errorf("%d: groups differ: (-got +want)\n%s", i, diff)
+		}
+		if got[n1].Final != tc.final {
+			t.Errorf("%d: got final=%v, want %v", i, got[n1].Final, tc.final)
+		}
+	}
+	if len(gr.groupAccum) != 0 || len(gr.emptyCycles) != 0 {
+		t.Errorf("history not forgotten: %v %v", gr.groupAccum, gr.emptyCycles)
+	}
+}
+
+// TestGrouperMemberAggregates verifies that the min, max and average of
+// member memory and rates are computed, with rates over the cycle interval.
+func TestGrouperMemberAggregates(t *testing.T) {
+	n1 := "g1"
+	t0 := time.Unix(1000, 0)
+	gr := NewGrouper(newNamer(n1), false, false, false, Options{MemberAggregates: true})
+
+	cycles := []struct {
+		procs []IDInfo
+		now   time.Time
+		want  *MemberAggregates
+	}{
+		{
+			[]IDInfo{
+				piinfo(1, n1, Counts{CPUUserTime: 1, ReadBytes: 100}, Memory{ResidentBytes: 100, VirtualBytes: 400}, Filedesc{Open: 1, Limit: 1}, 1),
+				piinfo(2, n1, Counts{CPUUserTime: 1, ReadBytes: 100}, Memory{ResidentBytes: 300, VirtualBytes: 200}, Filedesc{Open: 1, Limit: 1}, 1),
+			},
+			t0,
+			&MemberAggregates{
+				Min: MemberMetrics{ResidentBytes: 100, VirtualBytes: 200},
+				Max: MemberMetrics{ResidentBytes: 300, VirtualBytes: 400},
+				Avg: MemberMetrics{ResidentBytes: 200, VirtualBytes: 300},
+			},
+		},
+		{
+			[]IDInfo{
+				piinfo(1, n1, Counts{CPUUserTime: 2, ReadBytes: 300}, Memory{ResidentBytes: 100, VirtualBytes: 400}, Filedesc{Open: 1, Limit: 1}, 1),
+				piinfo(2, n1, Counts{CPUUserTime: 5, ReadBytes: 900}, Memory{ResidentBytes: 300, VirtualBytes: 200}, Filedesc{Open: 1, Limit: 1}, 1),
+			},
+			t0.Add(2 * time.Second),
+			&MemberAggregates{
+				Min: MemberMetrics{ResidentBytes: 100, VirtualBytes: 200, CPURate: 0.5, ReadBytesRate: 100},
+				Max: MemberMetrics{ResidentBytes: 300, VirtualBytes: 400, CPURate: 2, ReadBytesRate: 400},
+				Avg: MemberMetrics{ResidentBytes: 200, VirtualBytes: 300, CPURate: 1.25, ReadBytesRate: 250},
+			},
+		},
+		{
+			[]IDInfo{},
+			t0.Add(4 * time.Second),
+			nil,
+		},
+	}
+
+	for i, tc := range cycles {
+		_, tracked, err := gr.tracker.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		got := gr.groups(tracked, tc.now)
+		if diff := cmp.Diff(got[n1].Members, tc.want); diff != "" {
+			t.Errorf("%d: member aggregates differ: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestGrouperCPURatio verifies that the CPU ratio is the group's CPU usage
+// over the interval since the last cycle, and isn't computed on the first.
+func TestGrouperCPURatio(t *testing.T) {
+	n1 := "g1"
+	t0 := time.Unix(1000, 0)
+	gr := NewGrouper(newNamer(n1), false, false, false, Options{CPURatio: true})
+	ratio := func(f float64) *float64 { return &f }
+
+	cycles := []struct {
+		procs []IDInfo
+		now   time.Time
+		want  *float64
+	}{
+		{
+			[]IDInfo{
+				piinfo(1, n1, Counts{CPUUserTime: 1, CPUSystemTime: 1}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+				piinfo(2, n1, Counts{CPUUserTime: 1}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+			},
+			t0,
+			nil,
+		},
+		{
+			[]IDInfo{
+				piinfo(1, n1, Counts{CPUUserTime: 3, CPUSystemTime: 2}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+				piinfo(2, n1, Counts{CPUUserTime: 3}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+			},
+			t0.Add(2 * time.Second),
+			ratio(2.5),
+		},
+		{
+			[]IDInfo{},
+			t0.Add(4 * time.Second),
+			nil,
+		},
+	}
+
+	for i, tc := range cycles {
+		_, tracked, err := gr.tracker.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		got := gr.groups(tracked, tc.now)
+		if diff := cmp.Diff(got[n1].CPURatio, tc.want); diff != "" {
+			t.Errorf("%d: cpu ratio differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestGrouperLeak verifies that the resident memory growth rate is fitted
+// over the window, and that a leak is only suspected over a full window.
+func TestGrouperLeak(t *testing.T) {
+	n1 := "g1"
+	t0 := time.Unix(1000, 0)
+
+	tests := []struct {
+		rss  uint64
+		rate float64
+		leak bool
+	}{
+		{1000, 0, false},
+		{2000, 100, false},
+		{3000, 100, true},
+		{3000, 50, true},
+		{3000, 0, false},
+	}
+
+	gr := NewGrouper(newNamer(n1), false, false, false, Options{LeakWindow: 3, LeakThreshold: 10})
+	for i, tc := range tests {
+		p := piinfo(1, n1, Counts{}, Memory{ResidentBytes: tc.rss}, Filedesc{Open: 1, Limit: 1}, 1)
+		_, tracked, err := gr.tracker.Update(procInfoIter(p))
+		noerr(t, err)
+		got := gr.groups(tracked, t0.Add(time.Duration(i)*10*time.Second))
+		if got[n1].ResidentGrowthRate != tc.rate || got[n1].LeakSuspected != tc.leak {
+			t.Errorf("%d: got rate=%v leak=%v, want rate=%v leak=%v", i,
+				got[n1].ResidentGrowthRate, got[n1].LeakSuspected, tc.rate, tc.leak)
+		}
+	}
+}
+
+// TestGrouperUpdateStats verifies that every proc read is counted as scanned,
+// whether or not it's tracked.
+func TestGrouperUpdateStats(t *testing.T) {
+	gr := NewGrouper(newNamer("g1"), false, false, false, Options{})
+	rungroup(t, gr, procInfoIter(newProc(1, "g1", Metrics{}), newProc(2, "g2", Metrics{}),
+		newProc(3, "g1", Metrics{})))
+
+	got := gr.LastUpdateStats()
+	if got.Scanned != 3 || got.ReadErrors != 0 {
+		t.Errorf("got %+v, want 3 procs scanned and no read errors", got)
+	}
+	if got.Duration <= 0 {
+		t.Errorf("got duration %v, want positive", got.Duration)
+	}
+}
+
+// TestGrouperRuleStats verifies that tracked procs are counted against the
+// rule that matched them, and that procs tracked because of their parent
+// aren't counted.
+func TestGrouperRuleStats(t *testing.T) {
+	procs := []IDInfo{
+		newProcParent(1, "a", 0),
+		newProcParent(2, "a", 0),
+		newProcParent(3, "c", 0),
+		newProcParent(4, "d", 1),
+	}
+
+	gr := NewGrouper(ruleNamer{"a", "b", "c"}, true, false, false, Options{})
+	rungroup(t, gr, procInfoIter(procs...))
+	want := []RuleStat{{"a", 2}, {"b", 0}, {"c", 1}}
+	if diff := cmp.Diff(gr.RuleStats(), want); diff != "" {
+		t.Errorf("rule stats differ: (-got +want)\n%s", diff)
+	}
+	if got := rungroup(t, gr, procInfoIter(procs...))["all"].Procs; got != 4 {
+		t.Errorf("got %d procs, want 4", got)
+	}
+}
+
+// TestGrouperStateSizes verifies that the internal state of the grouper and
+// tracker stays bounded while short-lived procs, both tracked and ignored,
+// come and go.
+func TestGrouperStateSizes(t *testing.T) {
+	for _, children := range []bool{false, true} {
+		gr := NewGrouper(newNamer("g1"), children, false, false, Options{LeakWindow: 5})
+		var early StateSizes
+		for i := 0; i < 1000; i++ {
+			procs := []IDInfo{
+				piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+				piinfot(1000+i, "g1", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, []Thread{
+					{ThreadID(ID{1000 + i, 0}), "t1", Counts{}, "", States{}},
+					{ThreadID(ID{5000 + i, 0}), "t2", Counts{}, "", States{}},
+				}),
+				piinfo(10000+i, "other", Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+			}
+			rungroup(t, gr, procInfoIter(procs...))
+			if i == 10 {
+				early = gr.StateSizes()
+			}
+		}
+
+		got := gr.StateSizes()
+		if diff := cmp.Diff(got, early); diff != "" {
+			t.Errorf("children=%v: state grew while procs churned: (-got +want)\n%s", children, diff)
+		}
+		if got.TrackedProcs != 2 || got.ProcIds != 3 || got.GroupAccum != 1 {
+			t.Errorf("children=%v: got %+v, want 2 tracked procs, 3 pids and 1 group", children, got)
+		}
+	}
+}
+
+// BenchmarkGrouperGroups measures the aggregation of updates into groups on
+// a host with many groups.
+func BenchmarkGrouperGroups(b *testing.B) {
+	var names []string
+	var procs []IDInfo
+	for i := 0; i < 3000; i++ {
+		name := fmt.Sprintf("g%d", i/3)
+		if i%3 == 0 {
+			names = append(names, name)
+		}
+		procs = append(procs, piinfo(i+1, name, Counts{CPUUserTime: 1}, Memory{ResidentBytes: 1}, Filedesc{Open: 1, Limit: 10}, 1))
+	}
+
+	gr := NewGrouper(newNamer(names...), false, false, false, Options{})
+	_, tracked, err := gr.tracker.Update(procInfoIter(procs...))
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		gr.groups(tracked, now)
+	}
+}
+
+// BenchmarkGrouperUpdate measures a steady state cycle in which the same
+// procs are read and grouped again.
+func BenchmarkGrouperUpdate(b *testing.B) {
+	var names []string
+	var procs []IDInfo
+	for i := 0; i < 3000; i++ {
+		name := fmt.Sprintf("g%d", i/3)
+		if i%3 == 0 {
+			names = append(names, name)
+		}
+		procs = append(procs, piinfo(i+1, name, Counts{CPUUserTime: 1}, Memory{ResidentBytes: 1}, Filedesc{Open: 1, Limit: 10}, 1))
+	}
+
+	gr := NewGrouper(newNamer(names...), false, false, false, Options{})
+	if _, _, err := gr.Update(procInfoIter(procs...)); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := gr.Update(procInfoIter(procs...)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
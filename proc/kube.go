@@ -0,0 +1,189 @@
+package proc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	common "github.com/ncabatoff/process-exporter"
+)
+
+var (
+	// podUIDRegexp matches the cgroup path component of a Kubernetes pod:
+	// "pod<uid>" with the cgroupfs driver, or "kubepods-<qos>-pod<uid>.slice"
+	// with the systemd driver, which writes the uid's dashes as underscores.
+	podUIDRegexp = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})(?:\.slice)?/`)
+
+	// podContainerRegexp matches the cgroup path component of a container
+	// within a pod, optionally prefixed by its runtime and suffixed by
+	// ".scope" with the systemd driver.
+	podContainerRegexp = regexp.MustCompile(`^(?:[a-z-]+-)?([0-9a-f]{64})(?:\.scope)?$`)
+
+	// ErrPodDeferred is returned by a PodResolver that is fetching what it
+	// needs in the background.  Like for ErrNameDeferred, the Tracker then
+	// leaves procs in the pod unmatched until a later cycle.
+	ErrPodDeferred = fmt.Errorf("pod lookup deferred")
+)
+
+type (
+	// PodResolver completes the description of the pod container whose
+	// UID and Container, its container id, are known.
+	PodResolver interface {
+		ResolvePod(common.Pod) (common.Pod, error)
+	}
+
+	// KubeletPods is a PodResolver that lists pods from the kubelet's
+	// /pods endpoint.  The list is refetched in the background when asked
+	// about a pod it doesn't contain, at most every refresh, so that new
+	// pods are found without querying the kubelet for every proc, and
+	// callers never wait for the kubelet.
+	KubeletPods struct {
+		url     string
+		refresh time.Duration
+		client  *http.Client
+		mu      sync.Mutex
+		pods    map[string]kubeletPod
+		// fetched is when the last fetch started, fetching is true until
+		// it's done, and fetchErr is its error, if any.
+		fetched  time.Time
+		fetching bool
+		fetchErr error
+	}
+
+	// kubeletPod is what KubeletPods knows of a pod: its namespace and
+	// name, and the names of its containers keyed by id.
+	kubeletPod struct {
+		namespace, name string
+		containers      map[string]string
+	}
+
+	// kubeletPodList is the part of the kubelet's /pods response we use.
+	kubeletPodList struct {
+		Items []struct {
+			Metadata struct {
+				Name      string
+				Namespace string
+				UID       string
+			}
+			Status struct {
+				ContainerStatuses     []kubeletContainerStatus
+				InitContainerStatuses []kubeletContainerStatus
+			}
+		}
+	}
+
+	kubeletContainerStatus struct {
+		Name        string
+		ContainerID string
+	}
+)
+
+// podFromCgroup returns the UID and container id of the pod container whose
+// cgroup path is cgroup, or the zero Pod if it's not in a pod.  The container
+// id is empty for procs in the pod's own cgroup.
+func podFromCgroup(cgroup string) common.Pod {
+	loc := podUIDRegexp.FindStringSubmatchIndex(cgroup + "/")
+	if loc == nil {
+		return common.Pod{}
+	}
+	pod := common.Pod{UID: strings.Replace(cgroup[loc[2]:loc[3]], "_", "-", -1)}
+	if rest := strings.Trim(cgroup[loc[1]-1:], "/"); rest != "" {
+		if m := podContainerRegexp.FindStringSubmatch(strings.SplitN(rest, "/", 2)[0]); m != nil {
+			pod.Container = m[1]
+		}
+	}
+	return pod
+}
+
+// NewKubeletPods returns a KubeletPods fetching from the kubelet API at url,
+// e.g. http://localhost:10255.
+func NewKubeletPods(url string, refresh time.Duration) *KubeletPods {
+	return &KubeletPods{
+		url:     strings.TrimSuffix(url, "/") + "/pods",
+		refresh: refresh,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// ResolvePod implements PodResolver.  If the pod is known its Namespace and
+// Name are filled in, as is its Container if the container is known, in
+// which case it's replaced by the container's name.  ErrPodDeferred is
+// returned while a refetch prompted by an unknown pod is in progress.
+func (k *KubeletPods) ResolvePod(pod common.Pod) (common.Pod, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	kp, ok := k.pods[pod.UID]
+	_, known := kp.containers[pod.Container]
+	stale := !ok || (pod.Container != "" && !known)
+	if stale && !k.fetching && time.Since(k.fetched) >= k.refresh {
+		k.fetched, k.fetching = time.Now(), true
+		go k.fetch()
+	}
+	if stale && k.fetching {
+		return pod, ErrPodDeferred
+	}
+	if !ok {
+		if k.fetchErr != nil {
+			return pod, k.fetchErr
+		}
+		return pod, fmt.Errorf("pod %s not found", pod.UID)
+	}
+
+	pod.Namespace, pod.Name = kp.namespace, kp.name
+	if pod.Container != "" {
+		if name, ok := kp.containers[pod.Container]; ok {
+			pod.Container = name
+		}
+	}
+	return pod, nil
+}
+
+// fetch replaces the pods known with those listed by the kubelet, keeping
+// them if that fails.
+func (k *KubeletPods) fetch() {
+	pods, err := k.list()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.fetching, k.fetchErr = false, err
+	if err == nil {
+		k.pods = pods
+	}
+}
+
+// list lists the pods from the kubelet.
+func (k *KubeletPods) list() (map[string]kubeletPod, error) {
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error listing pods: %s", resp.Status)
+	}
+	var list kubeletPodList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error decoding pods: %v", err)
+	}
+
+	pods := make(map[string]kubeletPod, len(list.Items))
+	for _, item := range list.Items {
+		kp := kubeletPod{
+			namespace:  item.Metadata.Namespace,
+			name:       item.Metadata.Name,
+			containers: make(map[string]string),
+		}
+		statuses := append(item.Status.ContainerStatuses, item.Status.InitContainerStatuses...)
+		for _, cs := range statuses {
+			// Container ids are prefixed by the runtime, e.g. containerd://.
+			if i := strings.Index(cs.ContainerID, "://"); i >= 0 {
+				kp.containers[cs.ContainerID[i+3:]] = cs.Name
+			}
+		}
+		pods[item.Metadata.UID] = kp
+	}
+	return pods, nil
+}
@@ -0,0 +1,143 @@
+package proc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	common "github.com/ncabatoff/process-exporter"
+)
+
+// tcpListen is the st field of a listening socket in /proc/net/tcp.
+const tcpListen = "0A"
+
+// listenSockets maps the inodes of the listening sockets of a network
+// namespace to their ports.
+type listenSockets map[uint64]common.ListenPort
+
+// getListenPorts returns the ports the proc has listening TCP sockets or bound
+// but unconnected UDP sockets on, sorted and without duplicates.  Sockets are
+// found by matching the inodes of the proc's fds against those of the
+// listening sockets of its network namespace.
+func (p *proccache) getListenPorts() ([]common.ListenPort, error) {
+	socks, err := p.getListenSockets()
+	if err != nil {
+		return nil, err
+	}
+	if len(socks) == 0 {
+		return nil, nil
+	}
+
+	d, err := os.Open(p.path("fd"))
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[common.ListenPort]bool)
+	var ports []common.ListenPort
+	for _, name := range names {
+		target, err := os.Readlink(p.path("fd", name))
+		if err != nil || !strings.HasPrefix(target, "socket:[") {
+			continue
+		}
+		inode, err := strconv.ParseUint(strings.TrimSuffix(target[len("socket:["):], "]"), 10, 64)
+		if err != nil {
+			continue
+		}
+		if lp, ok := socks[inode]; ok && !seen[lp] {
+			seen[lp] = true
+			ports = append(ports, lp)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		if ports[i].Proto != ports[j].Proto {
+			return ports[i].Proto < ports[j].Proto
+		}
+		return ports[i].Port < ports[j].Port
+	})
+	return ports, nil
+}
+
+// getListenSockets returns the listening sockets of the proc's network
+// namespace, reading them only if they're not yet cached.
+func (p *proccache) getListenSockets() (listenSockets, error) {
+	netns := nsInode(p.path("ns", "net"))
+	if netns == 0 {
+		return nil, fmt.Errorf("unable to read network namespace of pid %d", p.PID)
+	}
+
+	fs := p.fs
+	fs.listenMu.Lock()
+	defer fs.listenMu.Unlock()
+	if socks, ok := fs.listenSocks[netns]; ok {
+		return socks, nil
+	}
+	socks := make(listenSockets)
+	for _, name := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		data, err := ioutil.ReadFile(p.path("net", name))
+		if os.IsNotExist(err) {
+			// No IPv6 support.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := parseListenSockets(data, strings.TrimSuffix(name, "6"), socks); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %v", p.path("net", name), err)
+		}
+	}
+	if fs.listenSocks == nil {
+		fs.listenSocks = make(map[uint64]listenSockets)
+	}
+	fs.listenSocks[netns] = socks
+	return socks, nil
+}
+
+// parseListenSockets adds to socks the listening sockets from the contents
+// of /proc/<pid>/net/tcp or one of its siblings, whose protocol is proto.
+// After a header line, each line gives the slot, local address, remote
+// address and state, then fields of which the 7th is the socket inode.
+// Addresses are hex IP and port separated by a colon.  For UDP, sockets with
+// no remote port are taken to be listening, as they're bound but unconnected.
+func parseListenSockets(data []byte, proto string, socks listenSockets) error {
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 10 {
+			return fmt.Errorf("bad line %q", line)
+		}
+		if proto == "tcp" && fields[3] != tcpListen {
+			continue
+		}
+		if proto == "udp" && !strings.HasSuffix(fields[2], ":0000") {
+			continue
+		}
+		colon := strings.LastIndexByte(fields[1], ':')
+		if colon < 0 {
+			return fmt.Errorf("bad local address %q", fields[1])
+		}
+		port, err := strconv.ParseUint(fields[1][colon+1:], 16, 16)
+		if err != nil {
+			return fmt.Errorf("bad local address %q: %v", fields[1], err)
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad inode %q: %v", fields[9], err)
+		}
+		if inode != 0 {
+			socks[inode] = common.ListenPort{Proto: proto, Port: int(port)}
+		}
+	}
+	return nil
+}
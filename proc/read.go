@@ -1,12 +1,21 @@
 package proc
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	common "github.com/ncabatoff/process-exporter"
 	"github.com/ncabatoff/procfs"
 )
 
@@ -14,6 +23,11 @@ import (
 // typically because it disappeared while we were reading it.
 var ErrProcNotExist = fmt.Errorf("process does not exist")
 
+// ErrProcFSUnavailable indicates that procfs itself couldn't be read, e.g.
+// because /proc isn't mounted where we expect it to be.  Unlike the per-proc
+// errors this is fatal for the whole collection cycle.
+var ErrProcFSUnavailable = fmt.Errorf("procfs unavailable")
+
 type (
 	// ID uniquely identifies a process.
 	ID struct {
@@ -33,6 +47,39 @@ type (
 		ParentPid    int
 		StartTime    time.Time
 		EffectiveUID int
+		// KernelThread is true if the proc is a kernel thread.
+		KernelThread bool
+		// ExePath is the target of the /proc/<pid>/exe symlink, empty if it
+		// couldn't be read.
+		ExePath string
+		// ExeDev and ExeInode identify the executable file, zero if unknown.
+		ExeDev   uint64
+		ExeInode uint64
+		// ExeSetuid is true if the executable file is setuid or setgid.
+		ExeSetuid bool
+		// Cgroup is the path of the proc's cgroup in the unified (v2)
+		// hierarchy, empty if unknown.
+		Cgroup string
+		// CgroupV1Systemd is the path of the proc's cgroup in the cgroup v1
+		// hierarchy named "systemd", empty if unknown or on v2-only hosts.
+		CgroupV1Systemd string
+		// CgroupV1Memory is the path of the proc's cgroup in the cgroup v1
+		// memory controller's hierarchy, empty if unknown or on v2-only hosts.
+		CgroupV1Memory string
+		// PidNamespace is the inode of the proc's pid namespace, zero if
+		// unknown.
+		PidNamespace uint64
+		// Root is the target of the /proc/<pid>/root symlink, which differs
+		// from "/" for chrooted procs.  It's empty if it couldn't be read.
+		Root string
+		// Environ is the proc's environment, if FS.GatherEnviron is set.
+		// It's nil if it couldn't be read, in which case EnvironUnreadable
+		// is set.
+		Environ           map[string]string
+		EnvironUnreadable bool
+		// ListenPorts are the ports the proc listens on, if
+		// FS.GatherListenPorts is set.
+		ListenPorts []common.ListenPort
 	}
 
 	// Counts are metric counters common to threads and processes and groups.
@@ -45,6 +92,29 @@ type (
 		MinorPageFaults       uint64
 		CtxSwitchVoluntary    uint64
 		CtxSwitchNonvoluntary uint64
+		CPUMigrations         uint64
+		// ReadChars and WriteChars are the bytes passed to read and write
+		// syscalls and the like, whether or not they caused disk I/O, and
+		// ReadSyscalls and WriteSyscalls count those syscalls.  They come
+		// from the rchar, wchar, syscr and syscw fields of /proc/<pid>/io.
+		ReadChars     uint64
+		WriteChars    uint64
+		ReadSyscalls  uint64
+		WriteSyscalls uint64
+		// CancelledWriteBytes is how much of WriteBytes never reached the
+		// storage layer because the dirty pages were truncated first.  It
+		// comes from the cancelled_write_bytes field of /proc/<pid>/io.
+		CancelledWriteBytes uint64
+		// CPUDelaySeconds, BlockIODelaySeconds and SwapInDelaySeconds are
+		// the time spent waiting for a CPU, for block I/O and for pages to
+		// be swapped in, from delay accounting.  Only read for procs, and
+		// only if FS.GatherDelays is set.
+		CPUDelaySeconds     float64
+		BlockIODelaySeconds float64
+		SwapInDelaySeconds  float64
+		// SchedWaitSeconds is the time spent runnable but waiting on a run
+		// queue, from /proc/<pid>/schedstat.
+		SchedWaitSeconds float64
 	}
 
 	// Memory describes a proc's memory usage.
@@ -52,14 +122,69 @@ type (
 		ResidentBytes uint64
 		VirtualBytes  uint64
 		VmSwapBytes   uint64
+		// LockedBytes is memory locked with mlock, which can't be swapped.
+		LockedBytes uint64
+		// StackBytes is the size of the main thread's stack.
+		StackBytes uint64
+		// DataBytes and TextBytes are the sizes of the data segment,
+		// including the heap, and of the text (code) segment, from the
+		// VmData and VmExe fields of /proc/<pid>/status.  Zero for kernel
+		// threads.
+		DataBytes uint64
+		TextBytes uint64
+		// ProportionalBytes is the proportional set size (PSS): resident
+		// memory, with each shared page divided among the procs sharing
+		// it.  Only read if FS.GatherSMaps is set.
+		ProportionalBytes uint64
+		// ResidentPrivateBytes and ResidentSharedBytes split resident
+		// memory into pages mapped only by this proc and those also mapped
+		// by others.  Only read if FS.GatherSMaps is set.
+		ResidentPrivateBytes uint64
+		ResidentSharedBytes  uint64
+		// ResidentPeak and VirtualPeak are the high-water marks of resident
+		// and virtual memory over the life of the proc, from the VmHWM and
+		// VmPeak fields of /proc/<pid>/status.  Zero for kernel threads.
+		ResidentPeak uint64
+		VirtualPeak  uint64
 	}
 
 	// Filedesc describes a proc's file descriptor usage and soft limit.
 	Filedesc struct {
 		// Open is the count of open file descriptors, -1 if unknown.
 		Open int64
-		// Limit is the fd soft limit for the process.
-		Limit uint64
+		// Limit and HardLimit are the fd soft and hard limits for the
+		// process.
+		Limit     uint64
+		HardLimit uint64
+	}
+
+	// FDTypes counts a proc's open file descriptors by what they refer to,
+	// based on the targets of the /proc/<pid>/fd symlinks.
+	FDTypes struct {
+		// Files are fds referring to anything with a path, including
+		// devices and deleted files.
+		Files   int
+		Sockets int
+		Pipes   int
+		// Eventfds are fds created by eventfd(2).
+		Eventfds int
+		// Other are fds for any other kind of anonymous inode, e.g. epoll,
+		// inotify or timerfd.
+		Other int
+	}
+
+	// Inotify counts a proc's inotify instances, i.e. the fds it got from
+	// inotify_init(2), and the watches added to them.
+	Inotify struct {
+		Instances int
+		Watches   int
+	}
+
+	// NetDev gives the traffic of a network namespace, summed over its
+	// interfaces other than loopback.
+	NetDev struct {
+		RxBytes uint64
+		TxBytes uint64
 	}
 
 	// States counts how many threads are in each state.
@@ -79,6 +204,35 @@ type (
 		NumThreads uint64
 		States
 		Wchan string
+		// FDTypes breaks down Filedesc.Open.  Only read if
+		// FS.GatherFDTypes is set.
+		FDTypes FDTypes
+		// Inotify counts the proc's inotify instances and watches.  Only
+		// read if FS.GatherInotify is set.
+		Inotify Inotify
+		// NetNamespace is the inode of the proc's network namespace, and
+		// NetDev is that namespace's traffic.  Only read if
+		// FS.GatherNetDev is set.
+		NetNamespace uint64
+		NetDev       NetDev
+		// CoredumpEnabled is true if the proc's soft RLIMIT_CORE is nonzero,
+		// i.e. it would dump core on a crash.
+		CoredumpEnabled bool
+		// Traced is true if the proc is being ptraced, i.e. the TracerPid
+		// in /proc/<pid>/status is nonzero.
+		Traced bool
+		// Realtime is true if the proc has a realtime scheduling policy,
+		// e.g. SCHED_FIFO or SCHED_RR.
+		Realtime bool
+		// Priority and Nice are the priority and nice fields of
+		// /proc/<pid>/stat.  Priority is negative for realtime policies.
+		Priority int64
+		Nice     int64
+		// OOMScore is the proc's /proc/<pid>/oom_score, i.e. how likely the
+		// OOM killer is to choose it, or -1 if unknown.  OOMScoreAdj is its
+		// oom_score_adj, which is only meaningful if OOMScore is known.
+		OOMScore    int64
+		OOMScoreAdj int64
 	}
 
 	// Thread contains per-thread data.
@@ -119,6 +273,9 @@ type (
 		// It returns an error on complete failure.  Otherwise, it returns metrics
 		// and 0 on complete success, 1 if some (like I/O) couldn't be read.
 		GetMetrics() (Metrics, int, error)
+		// GetBasicMetrics() is like GetMetrics() but skips the more expensive
+		// reads, such as enumerating open fds, leaving those metrics unknown.
+		GetBasicMetrics() (Metrics, int, error)
 		GetStates() (States, error)
 		GetWchan() (string, error)
 		GetCounts() (Counts, int, error)
@@ -136,6 +293,8 @@ type (
 		io      *procfs.ProcIO
 		fs      *FS
 		wchan   *string
+		// batch holds the batchFiles read ahead by FS.IOUring, if any.
+		batch *batchReads
 	}
 
 	proc struct {
@@ -152,8 +311,17 @@ type (
 	procfsprocs struct {
 		Procs []procfs.Proc
 		fs    *FS
+		// batches holds the batchFiles of each of Procs when FS.IOUring
+		// is set.  They're read a batch at a time as get reaches procs
+		// whose entries are still nil.
+		batches []*batchReads
 	}
 
+	// batchReads are the batchFiles of a proc, indexed like it.  Files
+	// that weren't read ahead, e.g. because they were too large, are nil
+	// and read as usual.
+	batchReads [len(batchFiles)]*fileRead
+
 	// Iter is an iterator over a sequence of procs.
 	Iter interface {
 		// Next returns true if the iterator is not exhausted.
@@ -189,7 +357,71 @@ type (
 		procfs.FS
 		BootTime   uint64
 		MountPoint string
-		debug      bool
+		// GatherSMaps makes GetMetrics read /proc/<pid>/smaps_rollup, or
+		// /proc/<pid>/smaps on kernels without it, to get memory usage
+		// figures not otherwise available, such as PSS.  Reading smaps
+		// is expensive for procs with many mappings.
+		GatherSMaps bool
+		// GatherEnviron makes GetStatic read /proc/<pid>/environ, which is
+		// only readable by the proc's owner or root.
+		GatherEnviron bool
+		// GatherFDTypes makes GetMetrics read the target of every
+		// /proc/<pid>/fd symlink to classify the open fds.
+		GatherFDTypes bool
+		// GatherInotify makes GetMetrics find the proc's inotify fds and
+		// read /proc/<pid>/fdinfo/<fd> for each to count its watches.
+		GatherInotify bool
+		// GatherNetDev makes GetMetrics read the traffic of each proc's
+		// network namespace from /proc/<pid>/net/dev.  Each namespace is
+		// read at most once per AllProcs.
+		GatherNetDev bool
+		// netDevs caches the traffic of the network namespaces read since
+		// the last AllProcs, keyed by inode.  It's guarded by netDevMu as
+		// procs may be read concurrently.
+		netDevMu sync.Mutex
+		netDevs  map[uint64]NetDev
+		// GatherListenPorts makes GetStatic find the ports each proc
+		// listens on, from its fds and /proc/<pid>/net/{tcp,udp}{,6}.
+		// Like GatherNetDev, each namespace is read at most once per
+		// AllProcs, and listenSocks is guarded by listenMu.
+		GatherListenPorts bool
+		listenMu          sync.Mutex
+		listenSocks       map[uint64]listenSockets
+		// GatherMigrations makes GetCounts read CPUMigrations from
+		// /proc/<pid>/sched.  Multi-threaded procs get theirs by summing
+		// those of their threads, so for them it's only read per thread.
+		GatherMigrations bool
+		// GatherSchedWait likewise makes GetCounts read SchedWaitSeconds
+		// from /proc/<pid>/schedstat.
+		GatherSchedWait bool
+		// GatherThreadIO makes GetThreads read each thread's I/O from
+		// /proc/<pid>/task/<tid>/io.  Otherwise threads report none.
+		GatherThreadIO bool
+		// GatherDelays makes GetMetrics query delay accounting through the
+		// taskstats netlink interface, which needs CAP_NET_ADMIN.  The
+		// socket is opened on first use, and if that fails taskstatsErr is
+		// kept and returned from then on.  They're guarded by taskstatsMu.
+		GatherDelays bool
+		taskstatsMu  sync.Mutex
+		taskstats    *taskstatsConn
+		taskstatsErr error
+		// IOUring makes AllProcs read batchFiles, which every proc needs
+		// on every cycle, for uringBatchProcs procs at a time through
+		// io_uring.  The ring is set up on first use, and if that fails
+		// uringErr is kept and procs are read as usual from then on.
+		// They're guarded by uringMu.
+		IOUring  bool
+		uringMu  sync.Mutex
+		uring    *uring
+		uringErr error
+		// denied records the optional reads, by metric family, that failed
+		// for some proc for lack of privileges since the last AllProcs.
+		// It's guarded by deniedMu.
+		deniedMu sync.Mutex
+		denied   map[string]bool
+		debug    bool
+		// threads is true if this FS is rooted at a proc's task directory.
+		threads bool
 	}
 )
 
@@ -207,19 +439,80 @@ func (c *Counts) Add(c2 Delta) {
 	c.MinorPageFaults += c2.MinorPageFaults
 	c.CtxSwitchVoluntary += c2.CtxSwitchVoluntary
 	c.CtxSwitchNonvoluntary += c2.CtxSwitchNonvoluntary
+	c.CPUMigrations += c2.CPUMigrations
+	c.ReadChars += c2.ReadChars
+	c.WriteChars += c2.WriteChars
+	c.ReadSyscalls += c2.ReadSyscalls
+	c.WriteSyscalls += c2.WriteSyscalls
+	c.CancelledWriteBytes += c2.CancelledWriteBytes
+	c.CPUDelaySeconds += c2.CPUDelaySeconds
+	c.BlockIODelaySeconds += c2.BlockIODelaySeconds
+	c.SwapInDelaySeconds += c2.SwapInDelaySeconds
+	c.SchedWaitSeconds += c2.SchedWaitSeconds
 }
 
-// Sub subtracts c2 from the counts.
+// Sub subtracts c2 from the counts.  Counters that went backwards, e.g.
+// because they were reset, yield a delta of zero rather than a negative one.
 func (c Counts) Sub(c2 Counts) Delta {
-	c.CPUUserTime -= c2.CPUUserTime
-	c.CPUSystemTime -= c2.CPUSystemTime
-	c.ReadBytes -= c2.ReadBytes
-	c.WriteBytes -= c2.WriteBytes
-	c.MajorPageFaults -= c2.MajorPageFaults
-	c.MinorPageFaults -= c2.MinorPageFaults
-	c.CtxSwitchVoluntary -= c2.CtxSwitchVoluntary
-	c.CtxSwitchNonvoluntary -= c2.CtxSwitchNonvoluntary
-	return Delta(c)
+	return c.sub(c2, false)
+}
+
+// SubWrapping is like Sub, except that an integer counter that went
+// backwards from close to the maximum value of its type is assumed to have
+// wrapped around, yielding the delta across the wrap.  Counters no greater
+// than math.MaxUint32 are assumed to be 32 bits wide, as they are on 32-bit
+// kernels.
+func (c Counts) SubWrapping(c2 Counts) Delta {
+	return c.sub(c2, true)
+}
+
+func (c Counts) sub(c2 Counts, wrap bool) Delta {
+	return Delta{
+		CPUUserTime:           subSeconds(c.CPUUserTime, c2.CPUUserTime),
+		CPUSystemTime:         subSeconds(c.CPUSystemTime, c2.CPUSystemTime),
+		ReadBytes:             subCounter(c.ReadBytes, c2.ReadBytes, wrap),
+		WriteBytes:            subCounter(c.WriteBytes, c2.WriteBytes, wrap),
+		MajorPageFaults:       subCounter(c.MajorPageFaults, c2.MajorPageFaults, wrap),
+		MinorPageFaults:       subCounter(c.MinorPageFaults, c2.MinorPageFaults, wrap),
+		CtxSwitchVoluntary:    subCounter(c.CtxSwitchVoluntary, c2.CtxSwitchVoluntary, wrap),
+		CtxSwitchNonvoluntary: subCounter(c.CtxSwitchNonvoluntary, c2.CtxSwitchNonvoluntary, wrap),
+		CPUMigrations:         subCounter(c.CPUMigrations, c2.CPUMigrations, wrap),
+		ReadChars:             subCounter(c.ReadChars, c2.ReadChars, wrap),
+		WriteChars:            subCounter(c.WriteChars, c2.WriteChars, wrap),
+		ReadSyscalls:          subCounter(c.ReadSyscalls, c2.ReadSyscalls, wrap),
+		WriteSyscalls:         subCounter(c.WriteSyscalls, c2.WriteSyscalls, wrap),
+		CancelledWriteBytes:   subCounter(c.CancelledWriteBytes, c2.CancelledWriteBytes, wrap),
+		CPUDelaySeconds:       subSeconds(c.CPUDelaySeconds, c2.CPUDelaySeconds),
+		BlockIODelaySeconds:   subSeconds(c.BlockIODelaySeconds, c2.BlockIODelaySeconds),
+		SwapInDelaySeconds:    subSeconds(c.SwapInDelaySeconds, c2.SwapInDelaySeconds),
+		SchedWaitSeconds:      subSeconds(c.SchedWaitSeconds, c2.SchedWaitSeconds),
+	}
+}
+
+func subSeconds(cur, prev float64) float64 {
+	if cur < prev {
+		return 0
+	}
+	return cur - prev
+}
+
+// subCounter returns cur-prev, or zero if cur is less than prev, unless wrap
+// is true and prev is within the top eighth of the counter's range, in which
+// case the counter is taken to have wrapped.
+func subCounter(cur, prev uint64, wrap bool) uint64 {
+	if cur >= prev {
+		return cur - prev
+	}
+	if wrap {
+		max := uint64(math.MaxUint32)
+		if prev > max {
+			max = math.MaxUint64
+		}
+		if cur <= max && max-prev < max/8 {
+			return max - prev + cur + 1
+		}
+	}
+	return 0
 }
 
 func (s *States) Add(s2 States) {
@@ -230,6 +523,37 @@ func (s *States) Add(s2 States) {
 	s.Zombie += s2.Zombie
 }
 
+// Add adds f2 to the fd type counts.
+func (f *FDTypes) Add(f2 FDTypes) {
+	f.Files += f2.Files
+	f.Sockets += f2.Sockets
+	f.Pipes += f2.Pipes
+	f.Eventfds += f2.Eventfds
+	f.Other += f2.Other
+}
+
+// Add adds i2 to the inotify counts.
+func (i *Inotify) Add(i2 Inotify) {
+	i.Instances += i2.Instances
+	i.Watches += i2.Watches
+}
+
+// count classifies the fd whose symlink points to target.
+func (f *FDTypes) count(target string) {
+	switch {
+	case strings.HasPrefix(target, "socket:"):
+		f.Sockets++
+	case strings.HasPrefix(target, "pipe:"):
+		f.Pipes++
+	case target == "anon_inode:[eventfd]":
+		f.Eventfds++
+	case strings.HasPrefix(target, "anon_inode:"):
+		f.Other++
+	default:
+		f.Files++
+	}
+}
+
 func (p IDInfo) GetThreads() ([]Thread, error) {
 	return p.Threads, nil
 }
@@ -259,6 +583,15 @@ func (p IDInfo) GetMetrics() (Metrics, int, error) {
 	return p.Metrics, 0, nil
 }
 
+// GetBasicMetrics implements Proc.
+func (p IDInfo) GetBasicMetrics() (Metrics, int, error) {
+	metrics := p.Metrics
+	metrics.Filedesc.Open = -1
+	metrics.FDTypes, metrics.Inotify = FDTypes{}, Inotify{}
+	metrics.ProportionalBytes, metrics.ResidentPrivateBytes, metrics.ResidentSharedBytes = 0, 0, 0
+	return metrics, 0, nil
+}
+
 // GetStates implements Proc.
 func (p IDInfo) GetStates() (States, error) {
 	return p.States, nil
@@ -272,9 +605,33 @@ func (p *proccache) GetPid() int {
 	return p.Proc.PID
 }
 
+// batchFile returns the given one of batchFiles if it was read ahead, or
+// nil.
+func (p *proccache) batchFile(file int) *fileRead {
+	if p.batch == nil {
+		return nil
+	}
+	return p.batch[file]
+}
+
+// readFile returns the contents of the given one of batchFiles, read ahead
+// if possible.
+func (p *proccache) readFile(file int) ([]byte, error) {
+	if r := p.batchFile(file); r != nil {
+		return r.data, r.err
+	}
+	return ioutil.ReadFile(p.path(batchFiles[file]))
+}
+
 func (p *proccache) getStat() (procfs.ProcStat, error) {
 	if p.stat == nil {
-		stat, err := p.Proc.NewStat()
+		var stat procfs.ProcStat
+		var err error
+		if r := p.batchFile(batchStat); r == nil {
+			stat, err = p.Proc.NewStat()
+		} else if err = r.err; err == nil {
+			stat, err = parseStat(p.PID, r.data)
+		}
 		if err != nil {
 			return procfs.ProcStat{}, err
 		}
@@ -286,7 +643,13 @@ func (p *proccache) getStat() (procfs.ProcStat, error) {
 
 func (p *proccache) getStatus() (procfs.ProcStatus, error) {
 	if p.status == nil {
-		status, err := p.Proc.NewStatus()
+		var status procfs.ProcStatus
+		var err error
+		if r := p.batchFile(batchStatus); r == nil {
+			status, err = p.Proc.NewStatus()
+		} else if err = r.err; err == nil {
+			status, err = parseStatus(r.data)
+		}
 		if err != nil {
 			return procfs.ProcStatus{}, err
 		}
@@ -296,6 +659,11 @@ func (p *proccache) getStatus() (procfs.ProcStatus, error) {
 	return *p.status, nil
 }
 
+// path returns the name of a file under /proc/<pid>/.
+func (p *proccache) path(elem ...string) string {
+	return filepath.Join(append([]string{p.fs.MountPoint, strconv.Itoa(p.PID)}, elem...)...)
+}
+
 // GetProcID implements Proc.
 func (p *proccache) GetProcID() (ID, error) {
 	if p.procid == nil {
@@ -322,10 +690,14 @@ func (p *proccache) getCmdLine() ([]string, error) {
 
 func (p *proccache) getWchan() (string, error) {
 	if p.wchan == nil {
-		wchan, err := p.Proc.Wchan()
+		data, err := p.readFile(batchWchan)
 		if err != nil {
 			return "", err
 		}
+		wchan := string(data)
+		if wchan == "0" {
+			wchan = ""
+		}
 		p.wchan = &wchan
 	}
 	return *p.wchan, nil
@@ -333,7 +705,13 @@ func (p *proccache) getWchan() (string, error) {
 
 func (p *proccache) getIo() (procfs.ProcIO, error) {
 	if p.io == nil {
-		io, err := p.Proc.NewIO()
+		var io procfs.ProcIO
+		var err error
+		if r := p.batchFile(batchIO); r == nil {
+			io, err = p.Proc.NewIO()
+		} else if err = r.err; err == nil {
+			io, err = parseIO(r.data)
+		}
 		if err != nil {
 			return procfs.ProcIO{}, err
 		}
@@ -342,6 +720,151 @@ func (p *proccache) getIo() (procfs.ProcIO, error) {
 	return *p.io, nil
 }
 
+// batchFiles are the files under /proc/<pid>/ that FS.IOUring reads ahead,
+// those read for every proc on every cycle.  The batch constants index it.
+var batchFiles = [...]string{"stat", "status", "io", "limits", "wchan", "oom_score", "oom_score_adj"}
+
+const (
+	batchStat = iota
+	batchStatus
+	batchIO
+	batchLimits
+	batchWchan
+	batchOOMScore
+	batchOOMScoreAdj
+)
+
+// uringBatchProcs is how many procs FS.IOUring reads ahead at a time, so
+// that their batchFiles fit in the ring.
+const uringBatchProcs = uringEntries / len(batchFiles)
+
+// The following parse the files read by FS.IOUring the way procfs parses
+// them when reading them itself, so that both give the same results.
+
+// parseStat parses the contents of /proc/<pid>/stat like procfs.Proc.NewStat.
+func parseStat(pid int, data []byte) (procfs.ProcStat, error) {
+	var (
+		ignore int
+
+		s = procfs.ProcStat{PID: pid}
+		l = bytes.Index(data, []byte("("))
+		r = bytes.LastIndex(data, []byte(")"))
+	)
+
+	if l < 0 || r < 0 {
+		return procfs.ProcStat{}, fmt.Errorf(
+			"unexpected format, couldn't extract comm: %s",
+			data,
+		)
+	}
+
+	s.Comm = string(data[l+1 : r])
+	_, err := fmt.Fscan(
+		bytes.NewBuffer(data[r+1:]),
+		&s.State,
+		&s.PPID,
+		&s.PGRP,
+		&s.Session,
+		&s.TTY,
+		&s.TPGID,
+		&s.Flags,
+		&s.MinFlt,
+		&s.CMinFlt,
+		&s.MajFlt,
+		&s.CMajFlt,
+		&s.UTime,
+		&s.STime,
+		&s.CUTime,
+		&s.CSTime,
+		&s.Priority,
+		&s.Nice,
+		&s.NumThreads,
+		&ignore,
+		&s.Starttime,
+		&s.VSize,
+		&s.RSS,
+	)
+	if err != nil {
+		return procfs.ProcStat{}, err
+	}
+	return s, nil
+}
+
+// statusFields are the fields of /proc/<pid>/status that procfs parses, with
+// the format of each and the fields of ProcStatus it fills in.
+var statusFields = map[string]struct {
+	format string
+	refs   func(*procfs.ProcStatus) []interface{}
+}{
+	"Pid":       {"%d", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.TID} }},
+	"TracerPid": {"%d", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.TracerPid} }},
+	"Uid": {"%d %d %d %d", func(s *procfs.ProcStatus) []interface{} {
+		return []interface{}{&s.UIDReal, &s.UIDEffective, &s.UIDSavedSet, &s.UIDFileSystem}
+	}},
+	"Gid": {"%d %d %d %d", func(s *procfs.ProcStatus) []interface{} {
+		return []interface{}{&s.GIDReal, &s.GIDEffective, &s.GIDSavedSet, &s.GIDFileSystem}
+	}},
+	"FDSize":                     {"%d", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.FDSize} }},
+	"VmPeak":                     {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmPeakKB} }},
+	"VmSize":                     {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmSizeKB} }},
+	"VmLck":                      {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmLckKB} }},
+	"VmHWM":                      {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmHWMKB} }},
+	"VmRSS":                      {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmRSSKB} }},
+	"VmData":                     {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmDataKB} }},
+	"VmStk":                      {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmStkKB} }},
+	"VmExe":                      {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmExeKB} }},
+	"VmLib":                      {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmLibKB} }},
+	"VmPTE":                      {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmPTEKB} }},
+	"VmSwap":                     {"%d kB", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VmSwapKB} }},
+	"voluntary_ctxt_switches":    {"%d", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.VoluntaryCtxtSwitches} }},
+	"nonvoluntary_ctxt_switches": {"%d", func(s *procfs.ProcStatus) []interface{} { return []interface{}{&s.NonvoluntaryCtxtSwitches} }},
+}
+
+// parseStatus parses the contents of /proc/<pid>/status like
+// procfs.Proc.NewStatus.  Fields that don't parse are left zero.
+func parseStatus(data []byte) (procfs.ProcStatus, error) {
+	s := string(data)
+	var ps procfs.ProcStatus
+	for lineno := 0; s != ""; lineno++ {
+		crpos := strings.IndexByte(s, '\n')
+		if crpos == -1 {
+			return procfs.ProcStatus{}, fmt.Errorf("line %d from status file without newline: %s", lineno, s)
+		}
+		line := strings.TrimSpace(s[:crpos])
+		s = s[crpos+1:]
+		if line == "" {
+			continue
+		}
+
+		pos := strings.IndexByte(line, ':')
+		if pos == -1 {
+			return procfs.ProcStatus{}, fmt.Errorf("line %d from status file without ':': %s", lineno, line)
+		}
+		if field, ok := statusFields[line[:pos]]; ok {
+			fmt.Sscanf(line[pos+1:], field.format, field.refs(&ps)...)
+		}
+	}
+	return ps, nil
+}
+
+// parseIO parses the contents of /proc/<pid>/io like procfs.Proc.NewIO.
+func parseIO(data []byte) (procfs.ProcIO, error) {
+	var pio procfs.ProcIO
+	_, err := fmt.Sscanf(string(data),
+		"rchar: %d\nwchar: %d\nsyscr: %d\nsyscw: %d\n"+
+			"read_bytes: %d\nwrite_bytes: %d\n"+
+			"cancelled_write_bytes: %d\n",
+		&pio.RChar, &pio.WChar, &pio.SyscR, &pio.SyscW,
+		&pio.ReadBytes, &pio.WriteBytes, &pio.CancelledWriteBytes)
+	return pio, err
+}
+
+// startTime returns when the proc with the given stat started.
+func (p *proccache) startTime(stat procfs.ProcStat) time.Time {
+	startTime := time.Unix(int64(p.fs.BootTime), 0).UTC()
+	return startTime.Add(time.Second / userHZ * time.Duration(stat.Starttime))
+}
+
 // GetStatic returns the ProcStatic corresponding to this proc.
 func (p *proccache) GetStatic() (Static, error) {
 	// /proc/<pid>/cmdline is normally world-readable.
@@ -355,8 +878,7 @@ func (p *proccache) GetStatic() (Static, error) {
 	if err != nil {
 		return Static{}, err
 	}
-	startTime := time.Unix(int64(p.fs.BootTime), 0).UTC()
-	startTime = startTime.Add(time.Second / userHZ * time.Duration(stat.Starttime))
+	startTime := p.startTime(stat)
 
 	// /proc/<pid>/status is normally world-readable.
 	status, err := p.getStatus()
@@ -364,13 +886,91 @@ func (p *proccache) GetStatic() (Static, error) {
 		return Static{}, err
 	}
 
-	return Static{
+	static := Static{
 		Name:         stat.Comm,
 		Cmdline:      cmdline,
 		ParentPid:    stat.PPID,
 		StartTime:    startTime,
 		EffectiveUID: status.UIDEffective,
-	}, nil
+		// An empty cmdline would also identify kernel threads, but it's
+		// empty for zombies too, and can be cleared by the proc itself.
+		KernelThread: stat.Flags&pfKthread != 0,
+	}
+
+	if p.fs.threads {
+		// Threads share these with their process, no need to read them again.
+		return static, nil
+	}
+
+	// /proc/<pid>/exe is only readable if we're allowed to ptrace the proc,
+	// and it doesn't exist for kernel threads, so failure isn't an error.
+	if exe, err := p.Proc.Executable(); err == nil {
+		static.ExePath = exe
+		// Stat follows the magic link to the file even if it has been deleted.
+		if fi, err := os.Stat(p.path("exe")); err == nil {
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				static.ExeDev, static.ExeInode = uint64(st.Dev), st.Ino
+			}
+			static.ExeSetuid = fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0
+		}
+	}
+
+	// Like exe, /proc/<pid>/ns/pid and /proc/<pid>/root require ptrace access.
+	static.PidNamespace = nsInode(p.path("ns", "pid"))
+	if root, err := os.Readlink(p.path("root")); err == nil {
+		static.Root = root
+	}
+
+	// /proc/<pid>/cgroup is normally world-readable, but may be absent if
+	// the kernel lacks cgroup support.
+	if cgroup, err := ioutil.ReadFile(p.path("cgroup")); err == nil {
+		static.Cgroup, static.CgroupV1Systemd, static.CgroupV1Memory = parseCgroupPaths(cgroup)
+	}
+
+	if p.fs.GatherEnviron {
+		if environ, err := ioutil.ReadFile(p.path("environ")); err == nil {
+			static.Environ = parseEnviron(environ)
+		} else {
+			static.EnvironUnreadable = true
+		}
+	}
+
+	// Like exe, /proc/<pid>/fd requires ptrace access, so procs we can't
+	// read simply have no ports.
+	if p.fs.GatherListenPorts {
+		if ports, err := p.getListenPorts(); err == nil {
+			static.ListenPorts = ports
+		} else if p.fs.debug {
+			log.Printf("error reading listening ports of pid %d: %v", p.PID, err)
+		}
+	}
+
+	return static, nil
+}
+
+// parseEnviron parses the contents of /proc/<pid>/environ, a list of
+// NUL-terminated KEY=value strings.
+func parseEnviron(environ []byte) map[string]string {
+	env := make(map[string]string)
+	for _, kv := range strings.Split(string(environ), "\x00") {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env
+}
+
+// nsInode returns the inode of the namespace file nspath, or 0 if it can't
+// be read.
+func nsInode(nspath string) uint64 {
+	fi, err := os.Stat(nspath)
+	if err != nil {
+		return 0
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
 }
 
 func (p proc) GetCounts() (Counts, int, error) {
@@ -390,10 +990,32 @@ func (p proc) GetCounts() (Counts, int, error) {
 		return Counts{}, 0, err
 	}
 
-	io, err := p.getIo()
+	var io procfs.ProcIO
 	softerrors := 0
-	if err != nil {
-		softerrors++
+	if !p.fs.threads || p.fs.GatherThreadIO {
+		io, err = p.getIo()
+		if err != nil {
+			p.fs.noteDenied("io", err)
+			softerrors++
+		}
+	}
+	var migrations uint64
+	var schedWait float64
+	// For multi-threaded procs the tracker sums those of the threads.
+	if p.fs.threads || stat.NumThreads == 1 {
+		if p.fs.GatherMigrations {
+			migrations = p.getMigrations()
+		}
+		if p.fs.GatherSchedWait {
+			schedWait = p.getSchedWait()
+		}
+	}
+	var d delays
+	if p.fs.GatherDelays {
+		d, err = p.fs.getDelays(p.PID)
+		if err != nil {
+			softerrors++
+		}
 	}
 	return Counts{
 		CPUUserTime:           float64(stat.UTime) / userHZ,
@@ -404,9 +1026,353 @@ func (p proc) GetCounts() (Counts, int, error) {
 		MinorPageFaults:       uint64(stat.MinFlt),
 		CtxSwitchVoluntary:    uint64(status.VoluntaryCtxtSwitches),
 		CtxSwitchNonvoluntary: uint64(status.NonvoluntaryCtxtSwitches),
+		CPUMigrations:         migrations,
+		ReadChars:             io.RChar,
+		WriteChars:            io.WChar,
+		ReadSyscalls:          io.SyscR,
+		WriteSyscalls:         io.SyscW,
+		CancelledWriteBytes:   uint64(io.CancelledWriteBytes),
+		CPUDelaySeconds:       d.cpu,
+		BlockIODelaySeconds:   d.blkio,
+		SwapInDelaySeconds:    d.swapin,
+		SchedWaitSeconds:      schedWait,
 	}, softerrors, nil
 }
 
+// getDelays returns the delays of the proc with the given pid from
+// taskstats.  If taskstats can't be used at all, e.g. for lack of privileges,
+// that's logged once and the same error returned for every proc.
+func (fs *FS) getDelays(pid int) (delays, error) {
+	fs.taskstatsMu.Lock()
+	defer fs.taskstatsMu.Unlock()
+	if fs.taskstatsErr != nil {
+		return delays{}, fs.taskstatsErr
+	}
+	if fs.taskstats == nil {
+		fs.taskstats, fs.taskstatsErr = newTaskstatsConn()
+		if fs.taskstatsErr != nil {
+			log.Printf("unable to gather delays: %v", fs.taskstatsErr)
+			return delays{}, fs.taskstatsErr
+		}
+	}
+	d, err := fs.taskstats.delays(pid)
+	if err == syscall.EPERM {
+		fs.taskstatsErr = fmt.Errorf("querying taskstats requires CAP_NET_ADMIN: %v", err)
+		log.Printf("unable to gather delays: %v", fs.taskstatsErr)
+		fs.taskstats.Close()
+	}
+	return d, err
+}
+
+// getMigrations returns how many times the task has migrated between CPUs,
+// based on /proc/<pid>/sched.  That file is only present if the kernel was
+// built with CONFIG_SCHED_DEBUG; if it's absent we return 0.
+func (p proc) getMigrations() uint64 {
+	f, err := os.Open(p.path("sched"))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "se.nr_migrations") {
+			continue
+		}
+		fields := strings.Fields(line)
+		migrations, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			return 0
+		}
+		return migrations
+	}
+	return 0
+}
+
+// getSchedWait returns how long the task has spent waiting on a run queue,
+// based on the second field of /proc/<pid>/schedstat.  That file is only
+// present if the kernel was built with CONFIG_SCHEDSTATS; if it's absent we
+// return 0.
+func (p proc) getSchedWait() float64 {
+	data, err := ioutil.ReadFile(p.path("schedstat"))
+	if err != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0
+	}
+	wait, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return float64(wait) / 1e9
+}
+
+// smapsTotals are the totals of some of the fields in /proc/<pid>/smaps.
+type smapsTotals struct {
+	pss, private, shared uint64
+}
+
+// getSMaps reads /proc/<pid>/smaps_rollup, or /proc/<pid>/smaps if the
+// former doesn't exist, summing the fields of interest over all mappings.
+func (p proc) getSMaps() (smapsTotals, error) {
+	f, err := os.Open(p.path("smaps_rollup"))
+	if os.IsNotExist(err) {
+		f, err = os.Open(p.path("smaps"))
+	}
+	if err != nil {
+		return smapsTotals{}, err
+	}
+	defer f.Close()
+
+	var totals smapsTotals
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || fields[2] != "kB" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "Pss:":
+			totals.pss += kb * 1024
+		case "Private_Clean:", "Private_Dirty:":
+			totals.private += kb * 1024
+		case "Shared_Clean:", "Shared_Dirty:":
+			totals.shared += kb * 1024
+		}
+	}
+	return totals, scanner.Err()
+}
+
+// getFDTypes classifies the open fds, also returning how many there are and
+// which are inotify instances, i.e. point to anon_inode:inotify.  Fds closed
+// while we're reading them are skipped.
+func (p proc) getFDTypes() (FDTypes, int, []string, error) {
+	d, err := os.Open(p.path("fd"))
+	if err != nil {
+		return FDTypes{}, 0, nil, err
+	}
+	defer d.Close()
+
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return FDTypes{}, 0, nil, err
+	}
+
+	var types FDTypes
+	var numfds int
+	var inotifyFDs []string
+	for _, name := range names {
+		target, err := os.Readlink(p.path("fd", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return FDTypes{}, 0, nil, err
+		}
+		types.count(target)
+		numfds++
+		if target == "anon_inode:inotify" {
+			inotifyFDs = append(inotifyFDs, name)
+		}
+	}
+	return types, numfds, inotifyFDs, nil
+}
+
+// getInotify counts the watches of the given inotify fds, as found by
+// getFDTypes.  Fds closed since then are skipped.
+func (p proc) getInotify(fds []string) (Inotify, error) {
+	var inotify Inotify
+	for _, name := range fds {
+		fdinfo, err := ioutil.ReadFile(p.path("fdinfo", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return Inotify{}, err
+		}
+		inotify.Instances++
+		inotify.Watches += countInotifyWatches(fdinfo)
+	}
+	return inotify, nil
+}
+
+// countInotifyWatches returns the number of watches listed in the contents
+// of /proc/<pid>/fdinfo/<fd> for an inotify fd, which after the fields
+// common to all fds has an "inotify" line for each watch.
+func countInotifyWatches(fdinfo []byte) int {
+	watches := 0
+	for _, line := range strings.Split(string(fdinfo), "\n") {
+		if strings.HasPrefix(line, "inotify ") {
+			watches++
+		}
+	}
+	return watches
+}
+
+// getNetDev returns the inode of the proc's network namespace and the
+// namespace's traffic, reading it only if it's not yet cached.
+func (p proc) getNetDev() (uint64, NetDev, error) {
+	netns := nsInode(p.path("ns", "net"))
+	if netns == 0 {
+		return 0, NetDev{}, fmt.Errorf("unable to read network namespace of pid %d", p.PID)
+	}
+
+	fs := p.fs
+	fs.netDevMu.Lock()
+	netdev, ok := fs.netDevs[netns]
+	fs.netDevMu.Unlock()
+	if ok {
+		return netns, netdev, nil
+	}
+	// The lock isn't held while reading, so procs sharing a namespace may
+	// occasionally both read it; they'll get much the same result.
+	data, err := ioutil.ReadFile(p.path("net", "dev"))
+	if err != nil {
+		return 0, NetDev{}, err
+	}
+	netdev, err = parseNetDev(data)
+	if err != nil {
+		return 0, NetDev{}, err
+	}
+	fs.netDevMu.Lock()
+	if fs.netDevs == nil {
+		fs.netDevs = make(map[uint64]NetDev)
+	}
+	fs.netDevs[netns] = netdev
+	fs.netDevMu.Unlock()
+	return netns, netdev, nil
+}
+
+// parseNetDev sums the bytes received and transmitted over all interfaces
+// but loopback from the contents of /proc/<pid>/net/dev.  After two header
+// lines, each line gives an interface name, a colon, then 8 receive and 8
+// transmit fields, the first of each being bytes.
+func parseNetDev(data []byte) (NetDev, error) {
+	var netdev NetDev
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if i < 2 || strings.TrimSpace(line) == "" {
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			return NetDev{}, fmt.Errorf("bad net/dev line %q", line)
+		}
+		if strings.TrimSpace(line[:colon]) == "lo" {
+			continue
+		}
+		fields := strings.Fields(line[colon+1:])
+		if len(fields) < 16 {
+			return NetDev{}, fmt.Errorf("bad net/dev line %q", line)
+		}
+		rx, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			return NetDev{}, fmt.Errorf("bad net/dev line %q: %v", line, err)
+		}
+		tx, err := strconv.ParseUint(fields[8], 10, 64)
+		if err != nil {
+			return NetDev{}, fmt.Errorf("bad net/dev line %q: %v", line, err)
+		}
+		netdev.RxBytes += rx
+		netdev.TxBytes += tx
+	}
+	return netdev, nil
+}
+
+// getOOMScore returns the proc's oom_score and oom_score_adj.
+func (p proc) getOOMScore() (int64, int64, error) {
+	var vals [2]int64
+	for i, file := range []int{batchOOMScore, batchOOMScoreAdj} {
+		data, err := p.readFile(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		vals[i], err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad %s for pid %d: %v", batchFiles[file], p.PID, err)
+		}
+	}
+	return vals[0], vals[1], nil
+}
+
+// rlimits are the resource limits of a proc that we use.  Unlimited values
+// are math.MaxUint64.
+type rlimits struct {
+	openFiles, openFilesHard, coreFileSize uint64
+}
+
+// getLimits returns the proc's resource limits.
+func (p proc) getLimits() (rlimits, error) {
+	data, err := p.readFile(batchLimits)
+	if err != nil {
+		return rlimits{}, err
+	}
+	limits, err := parseLimits(data)
+	if err != nil {
+		return rlimits{}, fmt.Errorf("bad limits for pid %d: %v", p.PID, err)
+	}
+	return limits, nil
+}
+
+// parseLimits parses the contents of /proc/<pid>/limits.  After a header
+// line, each line gives a limit's name, its soft and hard values, and
+// usually its units.  The columns are aligned with spaces, but their widths
+// have changed between kernel versions and some names are wider than their
+// column, so each line is split on whitespace and the values are taken to
+// be the first two fields that are numbers or "unlimited".
+func parseLimits(data []byte) (rlimits, error) {
+	var limits rlimits
+	found := false
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		i := 0
+		for i < len(fields) && !isLimitValue(fields[i]) {
+			i++
+		}
+		if i == 0 || i+1 >= len(fields) {
+			// The header, a blank line, or a limit we don't understand.
+			continue
+		}
+		switch strings.Join(fields[:i], " ") {
+		case "Max open files":
+			found = true
+			limits.openFiles = parseLimitValue(fields[i])
+			limits.openFilesHard = parseLimitValue(fields[i+1])
+		case "Max core file size":
+			limits.coreFileSize = parseLimitValue(fields[i])
+		}
+	}
+	if !found {
+		return rlimits{}, fmt.Errorf("no open files limit")
+	}
+	return limits, nil
+}
+
+// isLimitValue returns whether s is a value in /proc/<pid>/limits.
+func isLimitValue(s string) bool {
+	if s == "unlimited" {
+		return true
+	}
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// parseLimitValue returns the value of s, which isLimitValue accepts.
+func parseLimitValue(s string) uint64 {
+	if s == "unlimited" {
+		return math.MaxUint64
+	}
+	v, _ := strconv.ParseUint(s, 10, 64)
+	return v
+}
+
 func (p proc) GetWchan() (string, error) {
 	return p.getWchan()
 }
@@ -436,6 +1402,18 @@ func (p proc) GetStates() (States, error) {
 // GetMetrics returns the current metrics for the proc.  The results are
 // not cached.
 func (p proc) GetMetrics() (Metrics, int, error) {
+	return p.getMetrics(true)
+}
+
+// GetBasicMetrics returns the current metrics for the proc, except for the
+// number of open fds.  The results are not cached.
+func (p proc) GetBasicMetrics() (Metrics, int, error) {
+	return p.getMetrics(false)
+}
+
+// getMetrics reads the proc's metrics.  The fds are only enumerated if
+// detailed is true, otherwise their number is given as -1.
+func (p proc) getMetrics(detailed bool) (Metrics, int, error) {
 	counts, softerrors, err := p.GetCounts()
 	if err != nil {
 		return Metrics{}, 0, err
@@ -455,13 +1433,37 @@ func (p proc) GetMetrics() (Metrics, int, error) {
 		return Metrics{}, 0, err
 	}
 
-	numfds, err := p.Proc.FileDescriptorsLen()
-	if err != nil {
-		numfds = -1
-		softerrors |= 1
+	numfds := -1
+	var fdTypes FDTypes
+	var inotify Inotify
+	if detailed {
+		var inotifyFDs []string
+		if p.fs.GatherFDTypes || p.fs.GatherInotify {
+			// Finding the inotify fds takes the same readlinks.
+			fdTypes, numfds, inotifyFDs, err = p.getFDTypes()
+			if !p.fs.GatherFDTypes {
+				fdTypes = FDTypes{}
+			}
+		} else {
+			numfds, err = p.Proc.FileDescriptorsLen()
+		}
+		if err != nil {
+			p.fs.noteDenied("fd", err)
+			if p.fs.GatherInotify {
+				p.fs.noteDenied("inotify", err)
+			}
+			numfds = -1
+			softerrors |= 1
+		} else if p.fs.GatherInotify {
+			inotify, err = p.getInotify(inotifyFDs)
+			if err != nil {
+				p.fs.noteDenied("inotify", err)
+				softerrors |= 1
+			}
+		}
 	}
 
-	limits, err := p.Proc.NewLimits()
+	limits, err := p.getLimits()
 	if err != nil {
 		return Metrics{}, 0, err
 	}
@@ -471,24 +1473,80 @@ func (p proc) GetMetrics() (Metrics, int, error) {
 		softerrors |= 1
 	}
 
+	var smaps smapsTotals
+	if detailed && p.fs.GatherSMaps {
+		smaps, err = p.getSMaps()
+		if err != nil {
+			p.fs.noteDenied("smaps", err)
+			softerrors |= 1
+		}
+	}
+
+	// The oom files may be missing if the proc has just exited, in which
+	// case its score is merely unknown.
+	oomScore, oomScoreAdj, err := p.getOOMScore()
+	if err != nil {
+		oomScore, oomScoreAdj = -1, 0
+		if !os.IsNotExist(err) {
+			softerrors |= 1
+		}
+	}
+
+	var netns uint64
+	var netdev NetDev
+	if p.fs.GatherNetDev {
+		netns, netdev, err = p.getNetDev()
+		if err != nil {
+			softerrors |= 1
+		}
+	}
+
 	return Metrics{
 		Counts: counts,
 		Memory: Memory{
-			ResidentBytes: uint64(stat.ResidentMemory()),
-			VirtualBytes:  uint64(stat.VirtualMemory()),
-			VmSwapBytes:   uint64(status.VmSwapKB * 1024),
+			ResidentBytes:        uint64(stat.ResidentMemory()),
+			VirtualBytes:         uint64(stat.VirtualMemory()),
+			VmSwapBytes:          uint64(status.VmSwapKB * 1024),
+			LockedBytes:          uint64(status.VmLckKB * 1024),
+			StackBytes:           uint64(status.VmStkKB * 1024),
+			DataBytes:            uint64(status.VmDataKB * 1024),
+			TextBytes:            uint64(status.VmExeKB * 1024),
+			ProportionalBytes:    smaps.pss,
+			ResidentPrivateBytes: smaps.private,
+			ResidentSharedBytes:  smaps.shared,
+			ResidentPeak:         uint64(status.VmHWMKB * 1024),
+			VirtualPeak:          uint64(status.VmPeakKB * 1024),
 		},
 		Filedesc: Filedesc{
-			Open:  int64(numfds),
-			Limit: uint64(limits.OpenFiles),
+			Open:      int64(numfds),
+			Limit:     limits.openFiles,
+			HardLimit: limits.openFilesHard,
 		},
-		NumThreads: uint64(stat.NumThreads),
-		States:     states,
-		Wchan:      wchan,
+		NumThreads:      uint64(stat.NumThreads),
+		States:          states,
+		Wchan:           wchan,
+		FDTypes:         fdTypes,
+		Inotify:         inotify,
+		NetNamespace:    netns,
+		NetDev:          netdev,
+		CoredumpEnabled: limits.coreFileSize != 0,
+		Traced:          status.TracerPid != 0,
+		// The priority field of /proc/<pid>/stat is only negative for
+		// realtime policies, saving us reading the policy field itself.
+		Realtime:    stat.Priority < 0,
+		Priority:    int64(stat.Priority),
+		Nice:        int64(stat.Nice),
+		OOMScore:    oomScore,
+		OOMScoreAdj: oomScoreAdj,
 	}, softerrors, nil
 }
 
 func (p proc) GetThreads() ([]Thread, error) {
+	// Threads are only reported for multi-threaded procs, so don't read
+	// them otherwise.
+	if stat, err := p.getStat(); err == nil && stat.NumThreads < 2 {
+		return nil, nil
+	}
 	fs, err := p.fs.threadFs(p.PID)
 	if err != nil {
 		return nil, err
@@ -540,18 +1598,28 @@ func (p proc) GetThreads() ([]Thread, error) {
 // See https://github.com/prometheus/procfs/blob/master/proc_stat.go for details on userHZ.
 const userHZ = 100
 
-// NewFS returns a new FS mounted under the given mountPoint. It will error
-// if the mount point can't be read.
+// pfKthread is the PF_KTHREAD bit of the flags field of /proc/<pid>/stat,
+// set for kernel threads.
+const pfKthread = 0x00200000
+
+// NewFS returns a new FS mounted under the given mountPoint. It will return
+// ErrProcFSUnavailable if the mount point can't be read.
 func NewFS(mountPoint string, debug bool) (*FS, error) {
 	fs, err := procfs.NewFS(mountPoint)
 	if err != nil {
-		return nil, err
+		if debug {
+			log.Printf("error opening procfs at %q: %v", mountPoint, err)
+		}
+		return nil, ErrProcFSUnavailable
 	}
 	stat, err := fs.NewStat()
 	if err != nil {
-		return nil, err
+		if debug {
+			log.Printf("error reading stat from procfs at %q: %v", mountPoint, err)
+		}
+		return nil, ErrProcFSUnavailable
 	}
-	return &FS{fs, stat.BootTime, mountPoint, debug}, nil
+	return &FS{FS: fs, BootTime: stat.BootTime, MountPoint: mountPoint, debug: debug}, nil
 }
 
 func (fs *FS) threadFs(pid int) (*FS, error) {
@@ -560,21 +1628,137 @@ func (fs *FS) threadFs(pid int) (*FS, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &FS{tfs, fs.BootTime, mountPoint, false}, nil
+	return &FS{
+		FS:               tfs,
+		BootTime:         fs.BootTime,
+		MountPoint:       mountPoint,
+		GatherMigrations: fs.GatherMigrations,
+		GatherSchedWait:  fs.GatherSchedWait,
+		GatherThreadIO:   fs.GatherThreadIO,
+		threads:          true,
+	}, nil
+}
+
+// PidNamespace returns the inode of the pid namespace of the given pid, e.g.
+// pid 1 for the namespace of the host when the exporter can see all procs.
+func (fs *FS) PidNamespace(pid int) (uint64, error) {
+	nspath := filepath.Join(fs.MountPoint, strconv.Itoa(pid), "ns", "pid")
+	ino := nsInode(nspath)
+	if ino == 0 {
+		return 0, fmt.Errorf("unable to read pid namespace from %q", nspath)
+	}
+	return ino, nil
 }
 
-// AllProcs implements Source.
+// AllProcs implements Source.  If the mount point can't be listed the
+// iterator will be empty and Close will return ErrProcFSUnavailable.
 func (fs *FS) AllProcs() Iter {
+	fs.netDevMu.Lock()
+	fs.netDevs = nil
+	fs.netDevMu.Unlock()
+	fs.listenMu.Lock()
+	fs.listenSocks = nil
+	fs.listenMu.Unlock()
+	fs.deniedMu.Lock()
+	fs.denied = nil
+	fs.deniedMu.Unlock()
 	procs, err := fs.FS.AllProcs()
 	if err != nil {
-		err = fmt.Errorf("Error reading procs: %v", err)
+		if fs.debug {
+			log.Printf("error reading procs from %q: %v", fs.MountPoint, err)
+		}
+		err = ErrProcFSUnavailable
+	}
+	pp := procfsprocs{Procs: procs, fs: fs}
+	if fs.IOUring && !fs.threads {
+		pp.batches = make([]*batchReads, len(procs))
 	}
-	return &procIterator{procs: procfsprocs{procs, fs}, err: err, idx: -1}
+	return &procIterator{procs: pp, err: err, idx: -1}
+}
+
+// readBatch reads batchFiles for the first uringBatchProcs of procs through
+// io_uring, storing them in the corresponding entries of batches.  If
+// io_uring can't be used, that's logged once and the entries are left
+// empty, so the procs are read as usual.
+func (fs *FS) readBatch(procs []procfs.Proc, batches []*batchReads) {
+	if len(procs) > uringBatchProcs {
+		procs = procs[:uringBatchProcs]
+	}
+	for i := range procs {
+		batches[i] = &batchReads{}
+	}
+
+	fs.uringMu.Lock()
+	defer fs.uringMu.Unlock()
+	if fs.uringErr != nil {
+		return
+	}
+	if fs.uring == nil {
+		fs.uring, fs.uringErr = newUring()
+		if fs.uringErr != nil {
+			log.Printf("unable to read procs through io_uring: %v", fs.uringErr)
+			return
+		}
+	}
+
+	paths := make([]string, 0, len(procs)*len(batchFiles))
+	for _, proc := range procs {
+		for _, name := range batchFiles {
+			paths = append(paths, filepath.Join(fs.MountPoint, strconv.Itoa(proc.PID), name))
+		}
+	}
+	files, err := fs.uring.readFiles(paths)
+	if err != nil {
+		fs.uringErr = err
+		log.Printf("unable to read procs through io_uring: %v", fs.uringErr)
+		fs.uring.Close()
+		return
+	}
+	for i, file := range files {
+		batches[i/len(batchFiles)][i%len(batchFiles)] = file
+	}
+}
+
+// PermissionDenied returns the metric families which couldn't be read for
+// some proc for lack of privileges during the last cycle: "io" for
+// /proc/<pid>/io, "fd" for /proc/<pid>/fd, "smaps" for smaps_rollup or smaps,
+// and "inotify" for /proc/<pid>/fdinfo.  Those procs contribute zero to
+// metrics derived from them.  Since the environment is only read when a
+// proc is first seen, see Tracker.EnvironUnreadable for it instead.
+func (fs *FS) PermissionDenied() map[string]bool {
+	fs.deniedMu.Lock()
+	defer fs.deniedMu.Unlock()
+	denied := make(map[string]bool, len(fs.denied))
+	for family := range fs.denied {
+		denied[family] = true
+	}
+	return denied
+}
+
+// noteDenied records that family couldn't be read if err is due to a lack
+// of privileges.
+func (fs *FS) noteDenied(family string, err error) {
+	if !os.IsPermission(err) {
+		return
+	}
+	fs.deniedMu.Lock()
+	defer fs.deniedMu.Unlock()
+	if fs.denied == nil {
+		fs.denied = make(map[string]bool)
+	}
+	fs.denied[family] = true
 }
 
 // get implements procs.
 func (p procfsprocs) get(i int) Proc {
-	return &proc{proccache{Proc: p.Procs[i], fs: p.fs}}
+	pc := proccache{Proc: p.Procs[i], fs: p.fs}
+	if p.batches != nil {
+		if p.batches[i] == nil {
+			p.fs.readBatch(p.Procs[i:], p.batches[i:])
+		}
+		pc.batch = p.batches[i]
+	}
+	return &proc{pc}
 }
 
 // length implements procs.
@@ -1,13 +1,26 @@
 package proc
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	common "github.com/ncabatoff/process-exporter"
+	"github.com/ncabatoff/procfs"
 )
 
 type (
@@ -66,6 +79,8 @@ func TestReadFixture(t *testing.T) {
 		ParentPid:    10884,
 		StartTime:    stime,
 		EffectiveUID: 1000,
+		ExePath:      "/usr/bin/process-exporter",
+		Root:         "/srv/jail",
 	}
 	if diff := cmp.Diff(pii.Static, wantstatic); diff != "" {
 		t.Errorf("static differs: (-got +want)\n%s", diff)
@@ -81,30 +96,572 @@ func TestReadFixture(t *testing.T) {
 			MinorPageFaults:       0x643,
 			CtxSwitchVoluntary:    72,
 			CtxSwitchNonvoluntary: 6,
+			ReadChars:             1605958,
+			WriteChars:            69,
+			ReadSyscalls:          5534,
+			WriteSyscalls:         1,
 		},
 		Memory: Memory{
 			ResidentBytes: 0x7b1000,
 			VirtualBytes:  0x1061000,
 			VmSwapBytes:   0x2800,
+			LockedBytes:   0x4000,
+			StackBytes:    0x21000,
+			DataBytes:     9956 * 1024,
+			TextBytes:     3692 * 1024,
+			ResidentPeak:  7876 * 1024,
+			VirtualPeak:   16772 * 1024,
 		},
 		Filedesc: Filedesc{
-			Open:  5,
-			Limit: 0x400,
+			Open:      5,
+			Limit:     0x400,
+			HardLimit: 0x10000,
 		},
-		NumThreads: 7,
-		States:     States{Sleeping: 1},
+		NumThreads:  7,
+		States:      States{Sleeping: 1},
+		Priority:    20,
+		OOMScore:    104,
+		OOMScoreAdj: 100,
 	}
 	if diff := cmp.Diff(pii.Metrics, wantmetrics); diff != "" {
 		t.Errorf("metrics differs: (-got +want)\n%s", diff)
 	}
 }
 
+// TestReadSchedStats verifies that CPU migrations and run queue waits are
+// only read when enabled, and then only for threads and single-threaded
+// procs.  The fixture proc has several threads.
+func TestReadSchedStats(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	for _, tc := range []struct {
+		gather, threads bool
+		migrations      uint64
+		wait            float64
+	}{
+		{false, true, 0, 0},
+		{true, false, 0, 0},
+		{true, true, 12, 2.5},
+	} {
+		fs.GatherMigrations, fs.GatherSchedWait, fs.threads = tc.gather, tc.gather, tc.threads
+		procs := fs.AllProcs()
+		if !procs.Next() {
+			t.Fatalf("no procs found")
+		}
+		counts, _, err := procs.GetCounts()
+		noerr(t, err)
+		noerr(t, procs.Close())
+		if counts.CPUMigrations != tc.migrations || counts.SchedWaitSeconds != tc.wait {
+			t.Errorf("gather=%v threads=%v: got %d migrations and %vs wait, want %d and %vs",
+				tc.gather, tc.threads, counts.CPUMigrations, counts.SchedWaitSeconds, tc.migrations, tc.wait)
+		}
+	}
+}
+
+// TestReadThreadIO verifies that threads only read their I/O when enabled,
+// while procs always do.
+func TestReadThreadIO(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	for _, tc := range []struct {
+		gather, threads bool
+		readBytes       uint64
+	}{
+		{false, false, 1814455},
+		{false, true, 0},
+		{true, true, 1814455},
+	} {
+		fs.GatherThreadIO, fs.threads = tc.gather, tc.threads
+		procs := fs.AllProcs()
+		if !procs.Next() {
+			t.Fatalf("no procs found")
+		}
+		counts, softerrs, err := procs.GetCounts()
+		noerr(t, err)
+		noerr(t, procs.Close())
+		if counts.ReadBytes != tc.readBytes || softerrs != 0 {
+			t.Errorf("gather=%v threads=%v: got %d bytes read and %d soft errors, want %d and 0",
+				tc.gather, tc.threads, counts.ReadBytes, softerrs, tc.readBytes)
+		}
+	}
+}
+
+// TestReadFDTypes verifies that the fds are classified when FS.GatherFDTypes
+// is set, and that this doesn't change their count.
+func TestReadFDTypes(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	fs.GatherFDTypes = true
+
+	procs := fs.AllProcs()
+	if !procs.Next() {
+		t.Fatalf("no procs found")
+	}
+	metrics, _, err := procs.GetMetrics()
+	noerr(t, err)
+	noerr(t, procs.Close())
+
+	if metrics.Open != 5 {
+		t.Errorf("got %d open fds, want 5", metrics.Open)
+	}
+	if diff := cmp.Diff(metrics.FDTypes, FDTypes{Files: 5}); diff != "" {
+		t.Errorf("fd types differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestFDTypesCount verifies the classification of fd symlink targets.
+func TestFDTypesCount(t *testing.T) {
+	var got FDTypes
+	for _, target := range []string{
+		"/var/log/syslog",
+		"/dev/null",
+		"/tmp/x (deleted)",
+		"socket:[12345]",
+		"pipe:[23456]",
+		"pipe:[23457]",
+		"anon_inode:[eventfd]",
+		"anon_inode:[eventpoll]",
+		"anon_inode:inotify",
+	} {
+		got.count(target)
+	}
+
+	want := FDTypes{Files: 3, Sockets: 1, Pipes: 2, Eventfds: 1, Other: 2}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("fd types differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestCountInotifyWatches verifies that only the inotify lines of fdinfo are
+// counted as watches.
+func TestCountInotifyWatches(t *testing.T) {
+	fdinfo := "pos:\t0\nflags:\t02004000\nmnt_id:\t15\nino:\t1057\n" +
+		"inotify wd:2 ino:1e0d sdev:800013 mask:fc6 ignored_mask:0 fhandle-bytes:8 fhandle-type:1 f_handle:0d1e0000a5d2b1f0\n" +
+		"inotify wd:1 ino:2 sdev:800013 mask:fc6 ignored_mask:0 fhandle-bytes:8 fhandle-type:1 f_handle:0200000000000000\n"
+	if got := countInotifyWatches([]byte(fdinfo)); got != 2 {
+		t.Errorf("got %d watches, want 2", got)
+	}
+	if got := countInotifyWatches([]byte("pos:\t0\nflags:\t02004000\n")); got != 0 {
+		t.Errorf("got %d watches without inotify lines, want 0", got)
+	}
+}
+
+// TestReadInotify verifies that our own inotify instance and its watches are
+// found when FS.GatherInotify is set, without the fds being classified.
+func TestReadInotify(t *testing.T) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	noerr(t, err)
+	defer syscall.Close(fd)
+	dir, err := ioutil.TempDir("", "inotify")
+	noerr(t, err)
+	defer os.RemoveAll(dir)
+	for _, path := range []string{dir, filepath.Join(dir, "sub")} {
+		noerr(t, os.MkdirAll(path, 0755))
+		_, err := syscall.InotifyAddWatch(fd, path, syscall.IN_CREATE)
+		noerr(t, err)
+	}
+
+	fs, err := NewFS("/proc", false)
+	noerr(t, err)
+	fs.GatherInotify = true
+	procs := fs.AllProcs()
+	defer procs.Close()
+	for procs.Next() {
+		if procs.GetPid() != os.Getpid() {
+			continue
+		}
+		metrics, _, err := procs.GetMetrics()
+		noerr(t, err)
+		if metrics.Inotify.Instances < 1 || metrics.Inotify.Watches < 2 {
+			t.Errorf("got inotify %+v, want at least 1 instance and 2 watches", metrics.Inotify)
+		}
+		if metrics.FDTypes != (FDTypes{}) {
+			t.Errorf("got fd types %+v without FS.GatherFDTypes, want none", metrics.FDTypes)
+		}
+		return
+	}
+	t.Errorf("own pid not found")
+}
+
+// TestParseListenSockets verifies that only listening TCP sockets and
+// unconnected UDP sockets are taken from /proc/<pid>/net/{tcp,udp}, keyed by
+// inode.
+func TestParseListenSockets(t *testing.T) {
+	tcp := `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 101 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 102 1 0000000000000000 20 4 30 10 -1
+`
+	udp := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  10: 00000000:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 201 2 0000000000000000 0
+  11: 0100007F:A3C1 0100007F:0035 01 00000000:00000000 00:00000000 00000000   101        0 202 2 0000000000000000 0
+`
+	socks := make(listenSockets)
+	noerr(t, parseListenSockets([]byte(tcp), "tcp", socks))
+	noerr(t, parseListenSockets([]byte(udp), "udp", socks))
+	want := listenSockets{
+		101: {Proto: "tcp", Port: 8080},
+		201: {Proto: "udp", Port: 53},
+	}
+	if diff := cmp.Diff(want, socks); diff != "" {
+		t.Errorf("sockets differ: (-want +got)\n%s", diff)
+	}
+}
+
+// TestParseNlattrs verifies the decoding of nested netlink attributes,
+// including the padding of those whose length isn't a multiple of 4.
+func TestParseNlattrs(t *testing.T) {
+	var stats [taskstatsSwapinDelay + 8]byte
+	nativeEndian.PutUint64(stats[taskstatsCPUDelay:], 1500000000)
+	nativeEndian.PutUint64(stats[taskstatsSwapinDelay:], 2000000000)
+	// The first attribute has an odd length, to check padding is skipped.
+	b := append(nlattr(ctrlAttrFamilyName, []byte("abc")),
+		nlattr(taskstatsTypeAggrTGID, nlattr(taskstatsTypeStats, stats[:]))...)
+
+	attrs := parseNlattrs(b)
+	if diff := cmp.Diff([]byte("abc"), attrs[ctrlAttrFamilyName]); diff != "" {
+		t.Errorf("name differs: (-want +got)\n%s", diff)
+	}
+	got := parseNlattrs(attrs[taskstatsTypeAggrTGID])[taskstatsTypeStats]
+	if diff := cmp.Diff(stats[:], got); diff != "" {
+		t.Errorf("stats differ: (-want +got)\n%s", diff)
+	}
+}
+
+// TestReadSMaps verifies that smaps is only read when enabled, and that the
+// fields of interest are parsed.
+func TestReadSMaps(t *testing.T) {
+	for _, gather := range []bool{false, true} {
+		fs, err := NewFS("../fixtures", false)
+		noerr(t, err)
+		fs.GatherSMaps = gather
+
+		procs := fs.AllProcs()
+		if !procs.Next() {
+			t.Fatalf("no procs found")
+		}
+		metrics, _, err := procs.GetMetrics()
+		noerr(t, err)
+		noerr(t, procs.Close())
+
+		want := Memory{
+			ResidentBytes: 0x7b1000,
+			VirtualBytes:  0x1061000,
+			VmSwapBytes:   0x2800,
+			LockedBytes:   0x4000,
+			StackBytes:    0x21000,
+			DataBytes:     9956 * 1024,
+			TextBytes:     3692 * 1024,
+			ResidentPeak:  7876 * 1024,
+			VirtualPeak:   16772 * 1024,
+		}
+		if gather {
+			want.ProportionalBytes = 5120 * 1024
+			want.ResidentPrivateBytes = 4292 * 1024
+			want.ResidentSharedBytes = 3584 * 1024
+		}
+		if diff := cmp.Diff(metrics.Memory, want); diff != "" {
+			t.Errorf("gather=%v: memory differs: (-got +want)\n%s", gather, diff)
+		}
+	}
+}
+
+// TestReadEnviron verifies that the environment is only read when enabled.
+func TestReadEnviron(t *testing.T) {
+	for _, gather := range []bool{false, true} {
+		fs, err := NewFS("../fixtures", false)
+		noerr(t, err)
+		fs.GatherEnviron = gather
+
+		procs := fs.AllProcs()
+		if !procs.Next() {
+			t.Fatalf("no procs found")
+		}
+		static, err := procs.GetStatic()
+		noerr(t, err)
+		noerr(t, procs.Close())
+
+		var want map[string]string
+		if gather {
+			want = map[string]string{"HOME": "/home/user", "SERVICE_NAME": "api", "EMPTY": ""}
+		}
+		if diff := cmp.Diff(static.Environ, want); diff != "" {
+			t.Errorf("gather=%v: environ differs: (-got +want)\n%s", gather, diff)
+		}
+	}
+}
+
+// TestParseCgroupPaths verifies that the v2, v1 systemd and v1 memory cgroup
+// paths are extracted from each format of /proc/<pid>/cgroup.
+func TestParseCgroupPaths(t *testing.T) {
+	tests := []struct {
+		data                     string
+		unified, systemd, memory string
+	}{
+		{"0::/system.slice/nginx.service\n", "/system.slice/nginx.service", "", ""},
+		{"12:memory:/system.slice/nginx.service\n1:name=systemd:/system.slice/nginx.service\n",
+			"", "/system.slice/nginx.service", "/system.slice/nginx.service"},
+		{"1:name=systemd:/system.slice/a.service\n0::/system.slice/b.service\n",
+			"/system.slice/b.service", "/system.slice/a.service", ""},
+		{"5:hugetlb,memory:/docker/abc\n1:name=systemd:/docker/abc\n", "", "/docker/abc", "/docker/abc"},
+		{"", "", "", ""},
+	}
+
+	for i, tc := range tests {
+		unified, systemd, memory := parseCgroupPaths([]byte(tc.data))
+		if unified != tc.unified || systemd != tc.systemd || memory != tc.memory {
+			t.Errorf("%d: got %q, %q, %q, want %q, %q, %q", i, unified, systemd, memory,
+				tc.unified, tc.systemd, tc.memory)
+		}
+	}
+}
+
+func TestContainerID(t *testing.T) {
+	id := "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		cgroup, want string
+	}{
+		{"/system.slice/docker-" + id + ".scope", id},
+		{"/docker/" + id, id},
+		{"/docker/" + id + "/nested", id},
+		{"/kubepods.slice/kubepods-pod1.slice/docker-" + id + ".scope", id},
+		{"/system.slice/docker.service", ""},
+		{"/docker/" + id[:12], ""},
+		{"", ""},
+	}
+
+	for i, tc := range tests {
+		if got := containerID(tc.cgroup); got != tc.want {
+			t.Errorf("%d: got %q, want %q", i, got, tc.want)
+		}
+	}
+}
+
+func TestPodFromCgroup(t *testing.T) {
+	uid, cid := "0b1c2d3e-aaaa-bbbb-cccc-0123456789ab", strings.Repeat("c", 64)
+	tests := []struct {
+		cgroup string
+		want   common.Pod
+	}{
+		{"/kubepods/burstable/pod" + uid + "/" + cid, common.Pod{UID: uid, Container: cid}},
+		{"/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod" + strings.Replace(uid, "-", "_", -1) +
+			".slice/cri-containerd-" + cid + ".scope", common.Pod{UID: uid, Container: cid}},
+		{"/kubepods/pod" + uid, common.Pod{UID: uid}},
+		{"/kubepods/pod" + uid + "/other", common.Pod{UID: uid}},
+		{"/system.slice/docker-" + cid + ".scope", common.Pod{}},
+		{"", common.Pod{}},
+	}
+
+	for i, tc := range tests {
+		if diff := cmp.Diff(podFromCgroup(tc.cgroup), tc.want); diff != "" {
+			t.Errorf("%d: pod differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestKubeletPods verifies that pods and container names are resolved from
+// the kubelet's pod list, which is refetched in the background for unknown
+// pods, no more often than the refresh interval.
+func TestKubeletPods(t *testing.T) {
+	cid := strings.Repeat("c", 64)
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprintf(w, `{"items":[{"metadata":{"name":"web-0","namespace":"ns","uid":"u1"},
+			"status":{"containerStatuses":[{"name":"nginx","containerID":"containerd://%s"}]}}]}`, cid)
+	}))
+	defer srv.Close()
+
+	k := NewKubeletPods(srv.URL, time.Hour)
+	// resolve waits for any fetch prompted by pod to complete.
+	resolve := func(pod common.Pod) (common.Pod, error) {
+		for i := 0; i < 100; i++ {
+			got, err := k.ResolvePod(pod)
+			if err != ErrPodDeferred {
+				return got, err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("lookup of pod %s still deferred", pod.UID)
+		return pod, nil
+	}
+
+	if _, err := k.ResolvePod(common.Pod{UID: "u1", Container: cid}); err != ErrPodDeferred {
+		t.Errorf("got error %v before the first fetch, want %v", err, ErrPodDeferred)
+	}
+	got, err := resolve(common.Pod{UID: "u1", Container: cid})
+	noerr(t, err)
+	if diff := cmp.Diff(got, common.Pod{UID: "u1", Namespace: "ns", Name: "web-0", Container: "nginx"}); diff != "" {
+		t.Errorf("pod differs: (-got +want)\n%s", diff)
+	}
+	// A known container doesn't need a refetch, an unknown pod does once
+	// the refresh interval has passed.
+	_, err = k.ResolvePod(common.Pod{UID: "u1", Container: cid})
+	noerr(t, err)
+	if _, err := k.ResolvePod(common.Pod{UID: "u2"}); err == nil || err == ErrPodDeferred {
+		t.Errorf("got error %v for unknown pod within refresh interval", err)
+	}
+	k.mu.Lock()
+	k.fetched = time.Time{}
+	k.mu.Unlock()
+	if _, err := resolve(common.Pod{UID: "u2"}); err == nil {
+		t.Errorf("expected error for unknown pod")
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+}
+
+// TestDockerNamer verifies that container names are fetched from the Docker
+// API, that failures are remembered rather than retried at once, and that
+// names are forgotten once their container is no longer in use.
+func TestDockerNamer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker")
+	noerr(t, err)
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "docker.sock")
+	l, err := net.Listen("unix", sock)
+	noerr(t, err)
+	var requests int32
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path != "/containers/abc/json" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"Id":"abc","Name":"/web"}`)
+	})}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	d := NewDockerNamer(sock)
+	for i := 0; i < 2; i++ {
+		name, err := d.ContainerName("abc")
+		noerr(t, err)
+		if name != "web" {
+			t.Errorf("got name %q, want %q", name, "web")
+		}
+		if _, err := d.ContainerName("def"); err == nil {
+			t.Errorf("expected error for unknown container")
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("got %d requests, want 2", n)
+	}
+
+	// abc was asked about this cycle, and stays live in the next.
+	d.EndCycle(nil)
+	d.EndCycle(map[string]bool{"abc": true})
+	d.EndCycle(nil)
+	if len(d.names) != 0 || len(d.failedAt) != 0 {
+		t.Errorf("got names %v and failures %v, want none", d.names, d.failedAt)
+	}
+
+	d.spent = dockerLookupBudget
+	if _, err := d.ContainerName("abc"); err != ErrNameDeferred {
+		t.Errorf("got error %v once out of budget, want %v", err, ErrNameDeferred)
+	}
+	d.EndCycle(nil)
+	if _, err := d.ContainerName("abc"); err != nil {
+		t.Errorf("got error %v with renewed budget", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+}
+
+func TestParseNetDev(t *testing.T) {
+	header := "Inter-|   Receive                                                |  Transmit\n" +
+		" face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed\n"
+	tests := []struct {
+		data string
+		want NetDev
+		err  bool
+	}{
+		{header, NetDev{}, false},
+		{header +
+			"    lo:    1000      10    0    0    0     0          0         0     1000      10    0    0    0     0       0          0\n" +
+			"  eth0:     300       3    0    0    0     0          0         0      400       4    0    0    0     0       0          0\n" +
+			" wlan0:      30       1    0    0    0     0          0         0       40       1    0    0    0     0       0          0\n",
+			NetDev{RxBytes: 330, TxBytes: 440}, false},
+		{header + "  eth0: 300 3\n", NetDev{}, true},
+		{header + "  eth0 300\n", NetDev{}, true},
+	}
+
+	for i, tc := range tests {
+		got, err := parseNetDev([]byte(tc.data))
+		if (err != nil) != tc.err {
+			t.Errorf("%d: got error %v, want error %v", i, err, tc.err)
+		}
+		if diff := cmp.Diff(got, tc.want); diff != "" {
+			t.Errorf("%d: net dev differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	header := "Limit                     Soft Limit           Hard Limit           Units     \n"
+	tests := []struct {
+		data string
+		want rlimits
+		err  bool
+	}{
+		{header +
+			"Max core file size        0                    unlimited            bytes     \n" +
+			"Max open files            1024                 524288               files     \n",
+			rlimits{openFiles: 1024, openFilesHard: 524288}, false},
+		// Older kernels used narrower columns, and some names overflow them.
+		{"Limit Soft Limit Hard Limit Units\n" +
+			"Max core file size unlimited unlimited bytes\n" +
+			"Max open files 4096 4096 files\n" +
+			"Max realtime timeout unlimited unlimited us\n",
+			rlimits{openFiles: 4096, openFilesHard: 4096, coreFileSize: math.MaxUint64}, false},
+		{header + "Max open files            unlimited            unlimited\n",
+			rlimits{openFiles: math.MaxUint64, openFilesHard: math.MaxUint64}, false},
+		{header, rlimits{}, true},
+		{header + "Max open files            1024\n", rlimits{}, true},
+	}
+
+	for i, tc := range tests {
+		got, err := parseLimits([]byte(tc.data))
+		if (err != nil) != tc.err {
+			t.Errorf("%d: got error %v, want error %v", i, err, tc.err)
+		}
+		if got != tc.want {
+			t.Errorf("%d: got limits %+v, want %+v", i, got, tc.want)
+		}
+	}
+}
+
 func noerr(t *testing.T, err error) {
 	if err != nil {
 		t.Fatalf("error: %v", err)
 	}
 }
 
+// TestProcFSUnavailable verifies that a missing or vanished procfs is reported
+// using ErrProcFSUnavailable rather than some generic error.
+func TestProcFSUnavailable(t *testing.T) {
+	_, err := NewFS("/nonexistent/proc", false)
+	if err != ErrProcFSUnavailable {
+		t.Errorf("got error %v, want %v", err, ErrProcFSUnavailable)
+	}
+
+	dir, err := ioutil.TempDir("", "procfs")
+	noerr(t, err)
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "stat"), []byte("btime 1508449961\n"), 0644)
+	noerr(t, err)
+	fs, err := NewFS(dir, false)
+	noerr(t, err)
+
+	noerr(t, os.RemoveAll(dir))
+	tr := NewTracker(newNamer("p1"), false, false, false, Options{})
+	_, _, err = tr.Update(fs.AllProcs())
+	if err != ErrProcFSUnavailable {
+		t.Errorf("got error %v, want %v", err, ErrProcFSUnavailable)
+	}
+}
+
 // Basic test of proc reading: does AllProcs return at least two procs, one of which is us.
 func TestAllProcs(t *testing.T) {
 	procs := allprocs("/proc")
@@ -220,3 +777,242 @@ func TestIterator(t *testing.T) {
 		t.Errorf("procs differs: (-got +want)\n%s", diff)
 	}
 }
+
+// TestPermissionDenied verifies that only permission errors are recorded as
+// degrading a metric family, and that they're forgotten by AllProcs.
+func TestPermissionDenied(t *testing.T) {
+	fs, err := NewFS("../fixtures", false)
+	noerr(t, err)
+	fs.noteDenied("io", &os.PathError{Op: "open", Path: "/proc/1/io", Err: syscall.EACCES})
+	fs.noteDenied("fd", &os.PathError{Op: "open", Path: "/proc/1/fd", Err: syscall.ENOENT})
+	fs.noteDenied("smaps", &os.PathError{Op: "open", Path: "/proc/1/smaps", Err: syscall.EPERM})
+	if diff := cmp.Diff(fs.PermissionDenied(), map[string]bool{"io": true, "smaps": true}); diff != "" {
+		t.Errorf("denied differs: (-got +want)\n%s", diff)
+	}
+
+	fs.AllProcs()
+	if denied := fs.PermissionDenied(); len(denied) != 0 {
+		t.Errorf("got %v denied after AllProcs, want none", denied)
+	}
+}
+
+// skipWithoutIOUring skips tests of FS.IOUring where io_uring can't be used.
+func skipWithoutIOUring(tb testing.TB) {
+	r, err := newUring()
+	if err != nil {
+		tb.Skipf("io_uring unavailable: %v", err)
+	}
+	r.Close()
+}
+
+// uringTree writes a procfs-like tree to dir for comparing FS.IOUring with
+// reading procs as usual: snapshots of the live procs' files, enough copies
+// of the fixture proc to span several batches, and variants of it whose
+// files are missing, malformed or too large to be read ahead.
+func uringTree(t *testing.T, dir string) {
+	noerr(t, ioutil.WriteFile(filepath.Join(dir, "stat"), []byte("btime 1508449961\n"), 0644))
+	read := func(pdir string) map[string][]byte {
+		files := make(map[string][]byte)
+		for _, name := range append(batchFiles[:], "cmdline") {
+			if data, err := ioutil.ReadFile(filepath.Join(pdir, name)); err == nil {
+				files[name] = data
+			}
+		}
+		return files
+	}
+	write := func(pid int, files map[string][]byte) {
+		pdir := filepath.Join(dir, strconv.Itoa(pid))
+		noerr(t, os.Mkdir(pdir, 0755))
+		for name, data := range files {
+			noerr(t, ioutil.WriteFile(filepath.Join(pdir, name), data, 0644))
+		}
+	}
+
+	live, err := procfs.AllProcs()
+	noerr(t, err)
+	for _, p := range live {
+		write(p.PID, read(filepath.Join("/proc", strconv.Itoa(p.PID))))
+	}
+
+	fixture := read("../fixtures/14804")
+	for i := 0; i < 3*uringBatchProcs; i++ {
+		write(10000000+i, fixture)
+	}
+	variants := []struct {
+		name string
+		data []byte
+	}{
+		{"stat", nil},
+		{"stat", []byte("garbage\n")},
+		{"status", []byte("Name:\tp\nPid:\t1")},
+		{"status", []byte("Name:\tp\nPid 1\n")},
+		{"status", []byte("Pid:\tx\nVmLck:\t3 kB\n")},
+		{"io", nil},
+		{"io", []byte("rchar: 1\n")},
+		{"limits", append(bytes.Repeat([]byte("Max bogus  1  1  units\n"), 200), fixture["limits"]...)},
+		{"wchan", []byte("do_wait")},
+		{"wchan", []byte("0")},
+		{"oom_score", []byte("x\n")},
+	}
+	for i, v := range variants {
+		files := make(map[string][]byte)
+		for name, data := range fixture {
+			files[name] = data
+		}
+		if v.data == nil {
+			delete(files, v.name)
+		} else {
+			files[v.name] = v.data
+		}
+		write(20000000+i, files)
+	}
+}
+
+// procReading is everything read from a proc, with errors as strings.
+type procReading struct {
+	ID         ID
+	Static     Static
+	Metrics    Metrics
+	Softerrors int
+	Errs       [3]string
+}
+
+// readProcReadings reads all the procs of fs.
+func readProcReadings(t *testing.T, fs *FS) []procReading {
+	var readings []procReading
+	errstr := func(err error) string {
+		if err == nil {
+			return ""
+		}
+		return err.Error()
+	}
+	iter := fs.AllProcs()
+	for iter.Next() {
+		var r procReading
+		var err error
+		r.ID, err = iter.GetProcID()
+		r.Errs[0] = errstr(err)
+		r.Static, err = iter.GetStatic()
+		r.Errs[1] = errstr(err)
+		r.Metrics, r.Softerrors, err = iter.GetMetrics()
+		r.Errs[2] = errstr(err)
+		readings = append(readings, r)
+	}
+	noerr(t, iter.Close())
+	return readings
+}
+
+// TestIOUringMatchesSequential verifies that reading procs with FS.IOUring
+// gives exactly the same results, errors included, as reading them as usual.
+func TestIOUringMatchesSequential(t *testing.T) {
+	skipWithoutIOUring(t)
+	dir, err := ioutil.TempDir("", "procfs")
+	noerr(t, err)
+	defer os.RemoveAll(dir)
+	uringTree(t, dir)
+
+	seqfs, err := NewFS(dir, false)
+	noerr(t, err)
+	want := readProcReadings(t, seqfs)
+
+	fs, err := NewFS(dir, false)
+	noerr(t, err)
+	fs.IOUring = true
+	got := readProcReadings(t, fs)
+	if fs.uringErr != nil || fs.uring == nil || fs.uring.enters == 0 {
+		t.Fatalf("io_uring not used, error %v", fs.uringErr)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("procs differ: (-got +want)\n%s", diff)
+	}
+
+	// Where io_uring can't be used, procs are read as usual.
+	fs, err = NewFS(dir, false)
+	noerr(t, err)
+	fs.IOUring = true
+	fs.uringErr = fmt.Errorf("io_uring disabled")
+	got = readProcReadings(t, fs)
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("procs differ without io_uring: (-got +want)\n%s", diff)
+	}
+}
+
+// TestIOUringLive verifies that FS.IOUring reads our own proc from /proc.
+func TestIOUringLive(t *testing.T) {
+	skipWithoutIOUring(t)
+	fs, err := NewFS("/proc", false)
+	noerr(t, err)
+	fs.IOUring = true
+	iter := fs.AllProcs()
+	found := false
+	for iter.Next() {
+		if iter.GetPid() != os.Getpid() {
+			continue
+		}
+		found = true
+		static, err := iter.GetStatic()
+		noerr(t, err)
+		if static.ParentPid != os.Getppid() {
+			t.Errorf("got parent %d, want %d", static.ParentPid, os.Getppid())
+		}
+		metrics, softerrors, err := iter.GetMetrics()
+		noerr(t, err)
+		if softerrors != 0 || metrics.ResidentBytes == 0 || metrics.ReadSyscalls == 0 || metrics.Filedesc.Limit == 0 {
+			t.Errorf("got incomplete metrics %+v, %d soft errors", metrics, softerrors)
+		}
+	}
+	noerr(t, iter.Close())
+	if !found {
+		t.Errorf("didn't find our own proc")
+	}
+	if fs.uringErr != nil || fs.uring == nil || fs.uring.enters == 0 {
+		t.Errorf("io_uring not used, error %v", fs.uringErr)
+	}
+}
+
+// BenchmarkReadProcs measures reading the basic metrics of every proc in
+// /proc, as usual and with FS.IOUring.  Besides time, it reports the read
+// syscalls per op, from /proc/self/io, each of which comes with an open and
+// a close when reading as usual, and the io_uring_enter calls per op.
+func BenchmarkReadProcs(b *testing.B) {
+	syscr := func() uint64 {
+		data, err := ioutil.ReadFile("/proc/self/io")
+		if err != nil {
+			b.Fatal(err)
+		}
+		io, err := parseIO(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return io.SyscR
+	}
+	for _, uring := range []bool{false, true} {
+		b.Run(fmt.Sprintf("io_uring=%v", uring), func(b *testing.B) {
+			if uring {
+				skipWithoutIOUring(b)
+			}
+			fs, err := NewFS("/proc", false)
+			if err != nil {
+				b.Fatal(err)
+			}
+			fs.IOUring = uring
+			var enters int
+			reads := syscr()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				iter := fs.AllProcs()
+				for iter.Next() {
+					iter.GetProcID()
+					iter.GetBasicMetrics()
+				}
+				iter.Close()
+			}
+			b.StopTimer()
+			if fs.uring != nil {
+				enters = fs.uring.enters
+			}
+			b.ReportMetric(float64(syscr()-reads)/float64(b.N), "reads/op")
+			b.ReportMetric(float64(enters)/float64(b.N), "enters/op")
+		})
+	}
+}
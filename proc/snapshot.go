@@ -0,0 +1,97 @@
+package proc
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Values flattens the metrics of the group into a map from name to value,
+// for consumers that want simple key/value pairs rather than a Group.  Each
+// key is prefix followed by the name of a Group field.  Fields of embedded
+// structs such as Counts appear under their own names, other struct fields
+// and maps use the field name and the nested name or map key separated by a
+// dot, e.g. "Pressure.CPU" or "Wchans.futex_wait_queue_me".  Times are given
+// as seconds since the epoch.  Slices such as Threads are omitted.
+func (grp Group) Values(prefix string) map[string]float64 {
+	values := make(map[string]float64)
+	flatten(values, prefix, reflect.ValueOf(grp))
+	return values
+}
+
+// JSON serializes the groups as a JSON object mapping each group name to the
+// result of Values(prefix).
+func (gbn GroupByName) JSON(prefix string) ([]byte, error) {
+	groups := make(map[string]map[string]float64, len(gbn))
+	for gname, group := range gbn {
+		groups[gname] = group.Values(prefix)
+	}
+	return json.Marshal(groups)
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// flatten adds the numeric fields of struct v to values, with keys prefixed
+// by prefix.
+func flatten(values map[string]float64, prefix string, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := prefix + field.Name
+		if field.Anonymous {
+			name = prefix
+		}
+
+		if fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				continue
+			}
+			fv = fv.Elem()
+		}
+
+		switch {
+		case fv.Type() == timeType:
+			if tm := fv.Interface().(time.Time); !tm.IsZero() {
+				values[name] = float64(tm.Unix())
+			}
+		case fv.Kind() == reflect.Struct:
+			if field.Anonymous {
+				flatten(values, name, fv)
+			} else {
+				flatten(values, name+".", fv)
+			}
+		case fv.Kind() == reflect.Map:
+			for _, key := range fv.MapKeys() {
+				if f, ok := toFloat(fv.MapIndex(key)); ok {
+					values[name+"."+fmt.Sprint(key.Interface())] = f
+				}
+			}
+		default:
+			if f, ok := toFloat(fv); ok {
+				values[name] = f
+			}
+		}
+	}
+}
+
+// toFloat converts numeric and boolean values to float64.
+func toFloat(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Bool:
+		if v.Bool() {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
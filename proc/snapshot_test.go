@@ -0,0 +1,57 @@
+package proc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// TestGroupValues verifies that the prefix is applied to every key when
+// flattening a group.
+func TestGroupValues(t *testing.T) {
+	grp := Group{
+		Counts:          Counts{CPUUserTime: 1.5, ReadBytes: 2},
+		States:          States{Running: 1},
+		Wchans:          msi{"poll": 3},
+		Procs:           4,
+		Memory:          Memory{ResidentBytes: 5},
+		OldestStartTime: time.Unix(6, 0),
+		Pressure:        &Pressure{IO: 7},
+		Ages:            &AgeHistogram{Buckets: map[float64]uint64{60: 8}, Count: 8},
+		Threads:         []Threads{{"t1", 1, Counts{}}},
+	}
+
+	got := grp.Values("p_")
+	for key, want := range map[string]float64{
+		"p_CPUUserTime":     1.5,
+		"p_ReadBytes":       2,
+		"p_Running":         1,
+		"p_Wchans.poll":     3,
+		"p_Procs":           4,
+		"p_ResidentBytes":   5,
+		"p_OldestStartTime": 6,
+		"p_Pressure.IO":     7,
+		"p_Pressure.CPU":    0,
+		"p_Ages.Buckets.60": 8,
+		"p_Ages.Count":      8,
+	} {
+		if v, ok := got[key]; !ok || v != want {
+			t.Errorf("got %s=%v (present: %v), want %v", key, v, ok, want)
+		}
+	}
+	for key := range got {
+		if key[:2] != "p_" {
+			t.Errorf("key %q lacks prefix", key)
+		}
+	}
+
+	data, err := GroupByName{"g1": grp}.JSON("p_")
+	noerr(t, err)
+	var decoded map[string]map[string]float64
+	noerr(t, json.Unmarshal(data, &decoded))
+	if diff := cmp.Diff(decoded["g1"], got); diff != "" {
+		t.Errorf("JSON differs: (-got +want)\n%s", diff)
+	}
+}
@@ -0,0 +1,80 @@
+package proc
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type (
+	// SystemUsage describes the resource usage of the system as a whole.
+	SystemUsage struct {
+		// CPUUserTime and CPUSystemTime are the seconds spent by all CPUs
+		// in user and kernel mode since boot.
+		CPUUserTime   float64
+		CPUSystemTime float64
+		// MemoryUsedBytes is the memory in use, i.e. total minus available.
+		MemoryUsedBytes uint64
+	}
+
+	// SystemSource is a source of system-wide resource usage.
+	SystemSource interface {
+		SystemUsage() (SystemUsage, error)
+	}
+)
+
+// SystemUsage implements SystemSource based on /proc/stat and /proc/meminfo.
+func (fs *FS) SystemUsage() (SystemUsage, error) {
+	stat, err := fs.FS.NewStat()
+	if err != nil {
+		return SystemUsage{}, err
+	}
+	cpu := stat.CPUTotal
+
+	meminfo, err := fs.readMeminfo()
+	if err != nil {
+		return SystemUsage{}, err
+	}
+	available, ok := meminfo["MemAvailable"]
+	if !ok {
+		// Kernels before 3.14 don't provide MemAvailable.
+		available = meminfo["MemFree"] + meminfo["Buffers"] + meminfo["Cached"]
+	}
+	var used uint64
+	if total := meminfo["MemTotal"]; total > available {
+		used = total - available
+	}
+
+	return SystemUsage{
+		CPUUserTime:     cpu.User + cpu.Nice,
+		CPUSystemTime:   cpu.System + cpu.IRQ + cpu.SoftIRQ,
+		MemoryUsedBytes: used * 1024,
+	}, nil
+}
+
+// readMeminfo returns the fields of /proc/meminfo, which are all in kB.
+func (fs *FS) readMeminfo() (map[string]uint64, error) {
+	f, err := os.Open(filepath.Join(fs.MountPoint, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	meminfo := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing meminfo line %q: %v", scanner.Text(), err)
+		}
+		meminfo[strings.TrimSuffix(fields[0], ":")] = v
+	}
+	return meminfo, scanner.Err()
+}
@@ -0,0 +1,202 @@
+package proc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// The taskstats generic netlink interface is described in the kernel's
+// Documentation/accounting/taskstats.rst, and its messages in
+// include/uapi/linux/taskstats.h and genetlink.h.
+const (
+	genlIDCtrl         = 0x10
+	ctrlCmdGetFamily   = 3
+	ctrlAttrFamilyID   = 1
+	ctrlAttrFamilyName = 2
+
+	taskstatsCmdGet       = 1
+	taskstatsCmdAttrTGID  = 2
+	taskstatsTypeStats    = 3
+	taskstatsTypeAggrTGID = 5
+
+	nlmsgHdrLen = 16
+	genlHdrLen  = 4
+	nlaHdrLen   = 4
+
+	// Offsets into struct taskstats of the delay totals, in nanoseconds.
+	// They've been stable since version 1 of the struct.
+	taskstatsCPUDelay    = 24
+	taskstatsBlkioDelay  = 40
+	taskstatsSwapinDelay = 56
+)
+
+// nativeEndian is the byte order of netlink messages, i.e. that of the host.
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+type (
+	// taskstatsConn is a generic netlink socket for querying taskstats.
+	taskstatsConn struct {
+		fd     int
+		family uint16
+		seq    uint32
+		buf    []byte
+	}
+
+	// delays are the total times, in seconds, that a proc's tasks have
+	// spent waiting for a CPU, for block I/O and for swapping in pages.
+	delays struct {
+		cpu, blkio, swapin float64
+	}
+)
+
+// newTaskstatsConn opens a generic netlink socket and looks up the id of the
+// taskstats family.  It fails if the kernel wasn't built with
+// CONFIG_TASKSTATS, or if we're not in the initial network namespace, to
+// which the family is restricted.
+func newTaskstatsConn() (*taskstatsConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, fmt.Errorf("error opening netlink socket: %v", err)
+	}
+	c := &taskstatsConn{fd: fd, buf: make([]byte, os.Getpagesize())}
+	tv := syscall.NsecToTimeval(int64(time.Second))
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error setting netlink socket timeout: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error binding netlink socket: %v", err)
+	}
+
+	attrs, err := c.request(genlIDCtrl, ctrlCmdGetFamily, nlattr(ctrlAttrFamilyName, []byte("TASKSTATS\x00")))
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error looking up the taskstats netlink family: %v", err)
+	}
+	id, ok := attrs[ctrlAttrFamilyID]
+	if !ok || len(id) < 2 {
+		c.Close()
+		return nil, fmt.Errorf("no id for the taskstats netlink family")
+	}
+	c.family = nativeEndian.Uint16(id)
+	return c, nil
+}
+
+// Close closes the socket.
+func (c *taskstatsConn) Close() error {
+	return syscall.Close(c.fd)
+}
+
+// delays returns the delays accumulated by the threads of the thread group
+// tgid, including those that have exited.
+func (c *taskstatsConn) delays(tgid int) (delays, error) {
+	var pid [4]byte
+	nativeEndian.PutUint32(pid[:], uint32(tgid))
+	attrs, err := c.request(c.family, taskstatsCmdGet, nlattr(taskstatsCmdAttrTGID, pid[:]))
+	if err != nil {
+		return delays{}, err
+	}
+	aggr, ok := attrs[taskstatsTypeAggrTGID]
+	if !ok {
+		return delays{}, fmt.Errorf("no taskstats in reply for %d", tgid)
+	}
+	stats, ok := parseNlattrs(aggr)[taskstatsTypeStats]
+	if !ok || len(stats) < taskstatsSwapinDelay+8 {
+		return delays{}, fmt.Errorf("short taskstats in reply for %d", tgid)
+	}
+	return delays{
+		cpu:    float64(nativeEndian.Uint64(stats[taskstatsCPUDelay:])) / 1e9,
+		blkio:  float64(nativeEndian.Uint64(stats[taskstatsBlkioDelay:])) / 1e9,
+		swapin: float64(nativeEndian.Uint64(stats[taskstatsSwapinDelay:])) / 1e9,
+	}, nil
+}
+
+// request sends a generic netlink message with the given command and
+// attributes to family, returning the attributes of the reply.
+func (c *taskstatsConn) request(family uint16, cmd uint8, attrs []byte) (map[uint16][]byte, error) {
+	c.seq++
+	msg := make([]byte, nlmsgHdrLen+genlHdrLen+len(attrs))
+	nativeEndian.PutUint32(msg[0:], uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], family)
+	nativeEndian.PutUint16(msg[6:], syscall.NLM_F_REQUEST)
+	nativeEndian.PutUint32(msg[8:], c.seq)
+	msg[nlmsgHdrLen] = cmd
+	msg[nlmsgHdrLen+1] = 1 // version
+	copy(msg[nlmsgHdrLen+genlHdrLen:], attrs)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, c.buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(c.buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			// Skip replies to earlier requests that timed out.
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, fmt.Errorf("short netlink error")
+				}
+				if errno := -int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+					return nil, syscall.Errno(errno)
+				}
+				return nil, fmt.Errorf("unexpected netlink ack")
+			case family:
+				if len(m.Data) < genlHdrLen {
+					return nil, fmt.Errorf("short generic netlink message")
+				}
+				return parseNlattrs(m.Data[genlHdrLen:]), nil
+			}
+		}
+	}
+}
+
+// nlattr encodes a netlink attribute.
+func nlattr(typ uint16, data []byte) []byte {
+	l := nlaHdrLen + len(data)
+	b := make([]byte, (l+3)&^3)
+	nativeEndian.PutUint16(b[0:], uint16(l))
+	nativeEndian.PutUint16(b[2:], typ)
+	copy(b[nlaHdrLen:], data)
+	return b
+}
+
+// parseNlattrs decodes a sequence of netlink attributes, keyed by type.
+func parseNlattrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= nlaHdrLen {
+		l := int(nativeEndian.Uint16(b[0:]))
+		if l < nlaHdrLen || l > len(b) {
+			break
+		}
+		// Mask off the NLA_F_NESTED and NLA_F_NET_BYTEORDER flags.
+		attrs[nativeEndian.Uint16(b[2:])&0x3fff] = b[nlaHdrLen:l]
+		l = (l + 3) &^ 3
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return attrs
+}
@@ -3,8 +3,12 @@ package proc
 import (
 	"fmt"
 	"log"
+	"os"
 	"os/user"
+	"sort"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	seq "github.com/ncabatoff/go-seq/seq"
@@ -12,7 +16,8 @@ import (
 )
 
 type (
-	// Tracker tracks processes and records metrics.
+	// Tracker tracks processes and records metrics.  It isn't safe for
+	// concurrent use; Grouper serializes access to its Tracker.
 	Tracker struct {
 		// namer determines what processes to track and names them
 		namer common.MatchNamer
@@ -29,7 +34,56 @@ type (
 		// never ignore processes, i.e. always re-check untracked processes in case comm has changed
 		alwaysRecheck bool
 		username      map[int]string
-		debug         bool
+		// sample holds the procs whose expensive metrics are read this
+		// cycle when Options.SampleSize is set, otherwise it's nil.
+		sample map[ID]bool
+		// skipped holds the procs whose expensive metrics weren't read
+		// this cycle.
+		skipped map[ID]bool
+		// untrackedSeen holds the procs seen this cycle that aren't being
+		// tracked, i.e. that are either ignored or new, so that we can
+		// forget those that have exited.
+		untrackedSeen map[ID]bool
+		// names holds the comm of each proc known to the tracker, whether
+		// tracked or not, so that procs can be matched on their parent's.
+		names map[ID]string
+		// scanned is the number of procs read by the last update.
+		scanned int
+		// started counts, by group, the procs newly tracked by the last
+		// update.  Procs found by the first update since the namer was set
+		// aren't counted, since they're merely those already running; that
+		// only happens once countStarts is set.
+		started     map[string]int
+		countStarts bool
+		// selfPid is our own pid, and selfTree holds our known descendants.
+		// Both are used only if Options.ExcludeSelf is set.
+		selfPid  int
+		selfTree map[ID]bool
+		opts     Options
+		debug    bool
+	}
+
+	// Classified describes how a Tracker would handle a proc.
+	Classified struct {
+		ID
+		Static
+		// GroupName is the group the proc would be tracked in, or empty if
+		// it wouldn't be tracked.
+		GroupName string
+	}
+
+	// recordingIter is an Iter that records the static details of all the
+	// procs read.
+	recordingIter struct {
+		Iter
+		statics map[ID]Static
+	}
+
+	// RuleStat describes how many of the tracked procs a namer rule matched.
+	RuleStat struct {
+		// Rule describes the rule.
+		Rule  string
+		Procs int
 	}
 
 	// Delta is an alias of Counts used to signal that its contents are not
@@ -57,6 +111,22 @@ type (
 		// groupName is the tag for this proc given by the namer.
 		groupName string
 		threads   map[ThreadID]trackedThread
+		// rule is the index of the namer rule that matched the proc, or -1
+		// if unknown or if it's tracked because of its parent.
+		rule int
+		// viaParent is true if the proc is tracked because of its parent
+		// rather than being matched by the namer.
+		viaParent bool
+		// pod is the pod container the proc runs in, see Tracker.pod.
+		pod common.Pod
+		// threadStates is how many of the proc's threads are in each state.
+		threadStates States
+		// stagnantCycles is how many consecutive cycles the proc has made no
+		// progress, see stagnant.
+		stagnantCycles int
+		// missedCycles is how many consecutive cycles the proc hasn't been
+		// seen, see Options.StaleCycles.
+		missedCycles int
 	}
 
 	// ThreadUpdate describes what's changed for a thread since the last cycle.
@@ -77,6 +147,15 @@ type (
 		Memory
 		// Filedesc is the current fd usage/limit.
 		Filedesc
+		// FDTypes breaks down Filedesc.Open, if FS.GatherFDTypes is set.
+		FDTypes FDTypes
+		// Inotify counts inotify instances and watches, if
+		// FS.GatherInotify is set.
+		Inotify Inotify
+		// NetNamespace is the inode of the process's network namespace, and
+		// NetDev is that namespace's traffic, if FS.GatherNetDev is set.
+		NetNamespace uint64
+		NetDev       NetDev
 		// Start is the time the process started.
 		Start time.Time
 		// NumThreads is the number of threads.
@@ -85,8 +164,52 @@ type (
 		States
 		// Wchans is how many threads are in each non-zero wchan.
 		Wchans map[string]int
+		// ThreadStates is how many threads are in which run state.
+		ThreadStates States
 		// Threads are the thread updates for this process.
 		Threads []ThreadUpdate
+		// Cgroup is the process's cgroup v2 path.
+		Cgroup string
+		// CgroupV1Memory is the process's cgroup path in the v1 memory
+		// hierarchy.
+		CgroupV1Memory string
+		// CoredumpEnabled is true if the process would dump core on a crash.
+		CoredumpEnabled bool
+		// Traced is true if the process is being ptraced.
+		Traced bool
+		// Realtime is true if the process has a realtime scheduling policy.
+		Realtime bool
+		// Priority and Nice are the process's priority, negative for
+		// realtime policies, and nice value.
+		Priority int64
+		Nice     int64
+		// OOMScore and OOMScoreAdj are the process's oom_score, -1 if
+		// unknown, and oom_score_adj.
+		OOMScore    int64
+		OOMScoreAdj int64
+		// Setuid is true if the process's executable is setuid or setgid.
+		Setuid bool
+		// Chrooted is true if the process's root directory isn't "/".
+		Chrooted bool
+		// DetailSkipped is true if the more expensive metrics of the process,
+		// such as Filedesc.Open, weren't read this cycle.
+		DetailSkipped bool
+		// Hung is true if the process has made no progress for at least
+		// Options.HungCycles cycles.
+		Hung bool
+		// User is the effective user of the process, if Options.UserProcs
+		// is set.
+		User User
+		// ViaParent is true if the process is tracked because its parent
+		// is, rather than being matched itself.
+		ViaParent bool
+	}
+
+	// User identifies a user by uid and name.  Name is the uid in decimal if
+	// it can't be resolved.
+	User struct {
+		UID  int
+		Name string
 	}
 
 	// CollectErrors describes non-fatal errors found while collecting proc
@@ -100,25 +223,105 @@ type (
 		// some metrics (e.g. I/O) for a tracked proc, but we're still able
 		// to get the basic stuff like cmdline and core stats.
 		Partial int
+		// DetailSkipped is incremented every time the expensive reads for
+		// a proc are skipped, because Options.DetailDeadline has passed or
+		// the proc isn't part of the sample given by Options.SampleSize.
+		DetailSkipped int
+		// Failures breaks down the procs that couldn't be read by what
+		// failed and why.  Unlike Read it includes procs that vanished.
+		Failures ReadFailures
+	}
+
+	// ReadFailures counts the procs whose metrics (Metrics), or whose
+	// static details when first seen (Static), couldn't be read.
+	ReadFailures struct {
+		Metrics FailureReasons
+		Static  FailureReasons
+	}
+
+	// FailureReasons counts failures by cause: a lack of privileges, the
+	// proc having exited while being read, or anything else.
+	FailureReasons struct {
+		Permission int
+		Vanished   int
+		Other      int
 	}
 )
 
+// Add adds the counts of f2 to f.
+func (f *ReadFailures) Add(f2 ReadFailures) {
+	f.Metrics.add(f2.Metrics)
+	f.Static.add(f2.Static)
+}
+
+func (r *FailureReasons) add(r2 FailureReasons) {
+	r.Permission += r2.Permission
+	r.Vanished += r2.Vanished
+	r.Other += r2.Other
+}
+
+// count counts err as a failure of the appropriate reason.
+func (r *FailureReasons) count(err error) {
+	switch {
+	case err == ErrProcNotExist || os.IsNotExist(err) || isErrno(err, syscall.ESRCH):
+		r.Vanished++
+	case os.IsPermission(err):
+		r.Permission++
+	default:
+		r.Other++
+	}
+}
+
+// isErrno returns true if err is errno, or an *os.PathError or
+// *os.SyscallError wrapping it.
+func isErrno(err error, errno syscall.Errno) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	return err == errno
+}
+
 func lessUpdateGroupName(x, y Update) bool { return x.GroupName < y.GroupName }
 
 func lessThreadUpdate(x, y ThreadUpdate) bool { return seq.Compare(x, y) < 0 }
 
 func lessCounts(x, y Counts) bool { return seq.Compare(x, y) < 0 }
 
-func (tp *trackedProc) getUpdate() Update {
+// getUpdate reports on the proc.  If wchans is non-nil it must be empty, and
+// is used for Update.Wchans rather than allocating a new map.
+func (tp *trackedProc) getUpdate(hungCycles int, wchans map[string]int) Update {
+	if wchans == nil {
+		wchans = make(map[string]int)
+	}
 	u := Update{
-		GroupName:  tp.groupName,
-		Latest:     tp.lastaccum,
-		Memory:     tp.metrics.Memory,
-		Filedesc:   tp.metrics.Filedesc,
-		Start:      tp.static.StartTime,
-		NumThreads: tp.metrics.NumThreads,
-		States:     tp.metrics.States,
-		Wchans:     make(map[string]int),
+		GroupName:       tp.groupName,
+		Latest:          tp.lastaccum,
+		Memory:          tp.metrics.Memory,
+		Filedesc:        tp.metrics.Filedesc,
+		FDTypes:         tp.metrics.FDTypes,
+		Inotify:         tp.metrics.Inotify,
+		NetNamespace:    tp.metrics.NetNamespace,
+		NetDev:          tp.metrics.NetDev,
+		Start:           tp.static.StartTime,
+		NumThreads:      tp.metrics.NumThreads,
+		States:          tp.metrics.States,
+		Wchans:          wchans,
+		Cgroup:          tp.static.Cgroup,
+		CgroupV1Memory:  tp.static.CgroupV1Memory,
+		CoredumpEnabled: tp.metrics.CoredumpEnabled,
+		Traced:          tp.metrics.Traced,
+		Realtime:        tp.metrics.Realtime,
+		Priority:        tp.metrics.Priority,
+		Nice:            tp.metrics.Nice,
+		OOMScore:        tp.metrics.OOMScore,
+		OOMScoreAdj:     tp.metrics.OOMScoreAdj,
+		Setuid:          tp.static.ExeSetuid,
+		Chrooted:        tp.static.Root != "" && tp.static.Root != "/",
+		Hung:            hungCycles > 0 && tp.stagnantCycles >= hungCycles,
+		ViaParent:       tp.viaParent,
 	}
 	if tp.metrics.Wchan != "" {
 		u.Wchans[tp.metrics.Wchan] = 1
@@ -135,7 +338,7 @@ func (tp *trackedProc) getUpdate() Update {
 }
 
 // NewTracker creates a Tracker.
-func NewTracker(namer common.MatchNamer, trackChildren, alwaysRecheck, debug bool) *Tracker {
+func NewTracker(namer common.MatchNamer, trackChildren, alwaysRecheck, debug bool, opts Options) *Tracker {
 	return &Tracker{
 		namer:         namer,
 		tracked:       make(map[ID]*trackedProc),
@@ -143,16 +346,31 @@ func NewTracker(namer common.MatchNamer, trackChildren, alwaysRecheck, debug boo
 		trackChildren: trackChildren,
 		alwaysRecheck: alwaysRecheck,
 		username:      make(map[int]string),
+		skipped:       make(map[ID]bool),
+		untrackedSeen: make(map[ID]bool),
+		names:         make(map[ID]string),
+		started:       make(map[string]int),
+		selfPid:       os.Getpid(),
+		selfTree:      make(map[ID]bool),
+		opts:          opts,
 		debug:         debug,
 	}
 }
 
-func (t *Tracker) track(groupName string, idinfo IDInfo) {
+func (t *Tracker) track(groupName string, rule int, viaParent bool, idinfo IDInfo) {
 	tproc := trackedProc{
-		groupName: groupName,
-		static:    idinfo.Static,
-		metrics:   idinfo.Metrics,
+		groupName:    groupName,
+		rule:         rule,
+		viaParent:    viaParent,
+		static:       idinfo.Static,
+		metrics:      idinfo.Metrics,
+		threadStates: threadStates(idinfo.Metrics, idinfo.Threads),
 	}
+	// Procs tracked because of their parent may have their pod resolution
+	// deferred; Grouper.pods retries it.
+	tproc.pod, _ = t.pod(idinfo)
+	// The environment is only needed for matching, and can be large.
+	tproc.static.Environ = nil
 	if len(idinfo.Threads) > 0 {
 		tproc.threads = make(map[ThreadID]trackedThread)
 		for _, thr := range idinfo.Threads {
@@ -161,6 +379,9 @@ func (t *Tracker) track(groupName string, idinfo IDInfo) {
 		}
 	}
 	t.tracked[idinfo.ID] = &tproc
+	if t.countStarts {
+		t.started[groupName]++
+	}
 }
 
 func (t *Tracker) ignore(id ID) {
@@ -170,12 +391,23 @@ func (t *Tracker) ignore(id ID) {
 	}
 }
 
-func (tp *trackedProc) update(metrics Metrics, now time.Time, cerrs *CollectErrors, threads []Thread) {
+func (tp *trackedProc) update(metrics Metrics, now time.Time, cerrs *CollectErrors, threads []Thread, wrap bool) {
+	sub := Counts.Sub
+	if wrap {
+		sub = Counts.SubWrapping
+	}
 	// newcounts: resource consumption since last cycle
 	newcounts := metrics.Counts
-	tp.lastaccum = newcounts.Sub(tp.metrics.Counts)
+	tp.lastaccum = sub(newcounts, tp.metrics.Counts)
+	if stagnant(tp.lastaccum, tp.metrics.States, metrics.States) {
+		tp.stagnantCycles++
+	} else {
+		tp.stagnantCycles = 0
+	}
 	tp.metrics = metrics
+	tp.threadStates = threadStates(metrics, threads)
 	tp.lastUpdate = now
+	tp.missedCycles = 0
 	if len(threads) > 1 {
 		if tp.threads == nil {
 			tp.threads = make(map[ThreadID]trackedThread)
@@ -183,7 +415,7 @@ func (tp *trackedProc) update(metrics Metrics, now time.Time, cerrs *CollectErro
 		for _, thr := range threads {
 			tt := trackedThread{thr.ThreadName, thr.Counts, Delta{}, now, thr.Wchan}
 			if old, ok := tp.threads[thr.ThreadID]; ok {
-				tt.latest, tt.accum = thr.Counts.Sub(old.accum), thr.Counts
+				tt.latest, tt.accum = sub(thr.Counts, old.accum), thr.Counts
 			}
 			tp.threads[thr.ThreadID] = tt
 		}
@@ -197,65 +429,160 @@ func (tp *trackedProc) update(metrics Metrics, now time.Time, cerrs *CollectErro
 	}
 }
 
+// threadStates returns how many of the threads of a proc with the given
+// metrics and threads are in each state.  Single-threaded procs have no
+// threads, their only thread being described by the proc's own state.
+func threadStates(metrics Metrics, threads []Thread) States {
+	if len(threads) == 0 {
+		return metrics.States
+	}
+	var states States
+	for _, thread := range threads {
+		states.Add(thread.States)
+	}
+	return states
+}
+
+// stagnant returns true if a proc that used latest since the last cycle and
+// was then in states before and now in states after made no progress: it
+// used no CPU and did no I/O, and is still running or in uninterruptible
+// sleep.  Procs sleeping interruptibly are normally just idle, waiting for
+// work, so they aren't considered stagnant.
+func stagnant(latest Delta, before, after States) bool {
+	return latest.CPUUserTime == 0 && latest.CPUSystemTime == 0 &&
+		latest.ReadBytes == 0 && latest.WriteBytes == 0 &&
+		before == after && after.Running+after.Waiting > 0
+}
+
+// procRead holds what readProc found out about a proc, for mergeProc.
+type procRead struct {
+	procID ID
+	// ok is false if there's nothing to merge, e.g. because the proc
+	// exited while being read.
+	ok      bool
+	known   bool
+	ignored bool
+	skipped bool
+	metrics Metrics
+	threads []Thread
+	// static is only read for procs that aren't known.
+	static Static
+	cerrs  CollectErrors
+}
+
 // handleProc updates the tracker if it's a known and not ignored proc.
 // If it's neither known nor ignored, newProc will be non-nil.
 // It is not an error if the process disappears while we are reading
 // its info out of /proc, it just means nothing will be returned and
-// the tracker will be unchanged.
-func (t *Tracker) handleProc(proc Proc, updateTime time.Time) (*IDInfo, CollectErrors) {
-	var cerrs CollectErrors
-	procID, err := proc.GetProcID()
+// the tracker will be unchanged.  Unless detailed is true, the more
+// expensive metrics aren't read.
+func (t *Tracker) handleProc(proc Proc, updateTime time.Time, detailed bool) (*IDInfo, CollectErrors) {
+	return t.mergeProc(t.readProc(proc, detailed), updateTime)
+}
+
+// readProc does the reading for handleProc.  It doesn't modify the tracker,
+// so may be called concurrently.
+func (t *Tracker) readProc(proc Proc, detailed bool) procRead {
+	var r procRead
+	var err error
+	r.procID, err = proc.GetProcID()
 	if err != nil {
-		return nil, cerrs
+		return r
 	}
 
 	// Do nothing if we're ignoring this proc.
-	last, known := t.tracked[procID]
+	last, known := t.tracked[r.procID]
 	if known && last == nil {
-		return nil, cerrs
+		r.ok, r.ignored = true, true
+		return r
+	}
+	r.known = known
+
+	if detailed && known && t.sample != nil {
+		detailed = t.sample[r.procID]
 	}
 
-	metrics, softerrors, err := proc.GetMetrics()
+	var softerrors int
+	if detailed {
+		r.metrics, softerrors, err = proc.GetMetrics()
+	} else {
+		r.metrics, softerrors, err = proc.GetBasicMetrics()
+		r.cerrs.DetailSkipped++
+		r.skipped = true
+	}
 	if err != nil {
 		if t.debug {
-			log.Printf("error reading metrics for %+v: %v", procID, err)
+			log.Printf("error reading metrics for %+v: %v", r.procID, err)
 		}
 		// This usually happens due to the proc having exited, i.e.
 		// we lost the race.  We don't count that as an error.
 		if err != ErrProcNotExist {
-			cerrs.Read++
+			r.cerrs.Read++
 		}
-		return nil, cerrs
+		r.cerrs.Failures.Metrics.count(err)
+		return r
 	}
 
-	var threads []Thread
-	threads, err = proc.GetThreads()
+	r.threads, err = proc.GetThreads()
 	if err != nil {
 		softerrors |= 1
 	}
-	cerrs.Partial += softerrors
+	r.cerrs.Partial += softerrors
 
-	if len(threads) > 0 {
+	// The proc-level values of these are only read for single-threaded
+	// procs, but the proc may have gained threads since.
+	if len(r.threads) > 0 {
+		metrics := &r.metrics
 		metrics.Counts.CtxSwitchNonvoluntary, metrics.Counts.CtxSwitchVoluntary = 0, 0
-		for _, thread := range threads {
+		metrics.Counts.CPUMigrations = 0
+		metrics.Counts.SchedWaitSeconds = 0
+		for _, thread := range r.threads {
 			metrics.Counts.CtxSwitchNonvoluntary += thread.Counts.CtxSwitchNonvoluntary
 			metrics.Counts.CtxSwitchVoluntary += thread.Counts.CtxSwitchVoluntary
+			metrics.Counts.CPUMigrations += thread.Counts.CPUMigrations
+			metrics.Counts.SchedWaitSeconds += thread.Counts.SchedWaitSeconds
 			metrics.States.Add(thread.States)
 		}
 	}
 
-	var newProc *IDInfo
-	if known {
-		last.update(metrics, updateTime, &cerrs, threads)
-	} else {
-		static, err := proc.GetStatic()
+	if !known {
+		r.static, err = proc.GetStatic()
 		if err != nil {
 			if t.debug {
-				log.Printf("error reading static details for %+v: %v", procID, err)
+				log.Printf("error reading static details for %+v: %v", r.procID, err)
 			}
-			return nil, cerrs
+			r.cerrs.Failures.Static.count(err)
+			return r
 		}
-		newProc = &IDInfo{procID, static, metrics, threads}
+		if r.static.EnvironUnreadable {
+			r.cerrs.Partial++
+		}
+	}
+	r.ok = true
+	return r
+}
+
+// mergeProc applies what readProc found to the tracker.
+func (t *Tracker) mergeProc(r procRead, updateTime time.Time) (*IDInfo, CollectErrors) {
+	cerrs := r.cerrs
+	if r.skipped {
+		t.skipped[r.procID] = true
+	}
+	if !r.ok {
+		return nil, cerrs
+	}
+	if r.ignored {
+		t.untrackedSeen[r.procID] = true
+		return nil, cerrs
+	}
+
+	procID := r.procID
+	var newProc *IDInfo
+	if r.known {
+		t.tracked[procID].update(r.metrics, updateTime, &cerrs, r.threads, t.opts.CounterWrap)
+	} else {
+		newProc = &IDInfo{procID, r.static, r.metrics, r.threads}
+		t.untrackedSeen[procID] = true
 		if t.debug {
 			log.Printf("found new proc: %s", newProc)
 		}
@@ -271,6 +598,70 @@ func (t *Tracker) handleProc(proc Proc, updateTime time.Time) (*IDInfo, CollectE
 	return newProc, cerrs
 }
 
+// detailed returns true if procs read now should have their expensive
+// metrics read, given Options.DetailDeadline for a cycle that started at
+// start.
+func (t *Tracker) detailed(start time.Time) bool {
+	return t.opts.DetailDeadline <= 0 || time.Since(start) < t.opts.DetailDeadline
+}
+
+// readProcs reads all the procs of pi using Options.Workers goroutines,
+// returning the results in the order pi gave the procs.
+func (t *Tracker) readProcs(pi *procIterator, start time.Time) []procRead {
+	var list []Proc
+	for pi.Next() {
+		list = append(list, pi.Proc)
+	}
+
+	reads := make([]procRead, len(list))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < t.opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				reads[i] = t.readProc(list[i], t.detailed(start))
+			}
+		}()
+	}
+	for i := range list {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return reads
+}
+
+// sampleProcs returns the procs whose expensive metrics should be read this
+// cycle, given Options.SampleSize: the tracked procs with the lowest pids in
+// each group.  Choosing by pid keeps the sample stable across cycles.  It
+// returns nil if sampling is disabled.
+func (t *Tracker) sampleProcs() map[ID]bool {
+	if t.opts.SampleSize <= 0 {
+		return nil
+	}
+
+	byGroup := make(map[string][]ID)
+	for id, tproc := range t.tracked {
+		if tproc != nil {
+			byGroup[tproc.groupName] = append(byGroup[tproc.groupName], id)
+		}
+	}
+
+	sample := make(map[ID]bool)
+	for _, ids := range byGroup {
+		sort.Slice(ids, func(i, j int) bool { return ids[i].Pid < ids[j].Pid })
+		if len(ids) > t.opts.SampleSize {
+			ids = ids[:t.opts.SampleSize]
+		}
+		for _, id := range ids {
+			sample[id] = true
+		}
+	}
+	return sample
+}
+
 // update scans procs and updates metrics for those which are tracked. Processes
 // that have gone away get removed from the Tracked map. New processes are
 // returned, along with the count of nonfatal errors.
@@ -278,17 +669,39 @@ func (t *Tracker) update(procs Iter) ([]IDInfo, CollectErrors, error) {
 	var newProcs []IDInfo
 	var colErrs CollectErrors
 	var now = time.Now()
+	t.sample = t.sampleProcs()
+	for id := range t.skipped {
+		delete(t.skipped, id)
+	}
+	for id := range t.untrackedSeen {
+		delete(t.untrackedSeen, id)
+	}
+	t.scanned = 0
 
-	for procs.Next() {
-		newProc, cerrs := t.handleProc(procs, now)
+	merge := func(newProc *IDInfo, cerrs CollectErrors) {
+		t.scanned++
 		if newProc != nil {
 			newProcs = append(newProcs, *newProc)
 		}
 		colErrs.Read += cerrs.Read
 		colErrs.Partial += cerrs.Partial
+		colErrs.DetailSkipped += cerrs.DetailSkipped
+		colErrs.Failures.Add(cerrs.Failures)
+	}
+	if pi, ok := procs.(*procIterator); ok && t.opts.Workers > 1 {
+		for _, r := range t.readProcs(pi, now) {
+			merge(t.mergeProc(r, now))
+		}
+	} else {
+		for procs.Next() {
+			merge(t.handleProc(procs, now, t.detailed(now)))
+		}
 	}
 
 	err := procs.Close()
+	if err == ErrProcFSUnavailable {
+		return nil, colErrs, err
+	}
 	if err != nil {
 		return nil, colErrs, fmt.Errorf("Error reading procs: %v", err)
 	}
@@ -299,13 +712,44 @@ func (t *Tracker) update(procs Iter) ([]IDInfo, CollectErrors, error) {
 	// stale procs and removing them.
 	for procID, pinfo := range t.tracked {
 		if pinfo == nil {
-			// TODO is this a bug? we're not tracking the proc so we don't see it go away so ProcIds
-			// and Tracked are leaking?
+			if !t.untrackedSeen[procID] {
+				delete(t.tracked, procID)
+			}
 			continue
 		}
 		if pinfo.lastUpdate != now {
-			delete(t.tracked, procID)
-			delete(t.procIds, procID.Pid)
+			pinfo.missedCycles++
+			if pinfo.missedCycles > t.opts.StaleCycles {
+				delete(t.tracked, procID)
+				delete(t.procIds, procID.Pid)
+				continue
+			}
+			// Keep reporting the proc as it was last seen, but without
+			// counting its last increments again.
+			pinfo.lastaccum = Delta{}
+			for tid, tt := range pinfo.threads {
+				tt.latest = Delta{}
+				pinfo.threads[tid] = tt
+			}
+		}
+	}
+	// Procs that are neither tracked nor ignored get a new procIds entry
+	// each cycle they're seen.
+	for pid, procID := range t.procIds {
+		if _, ok := t.tracked[procID]; !ok && !t.untrackedSeen[procID] {
+			delete(t.procIds, pid)
+		}
+	}
+	for id := range t.names {
+		if t.procIds[id.Pid] != id {
+			delete(t.names, id)
+		}
+	}
+	// Descendants of ours are ignored, so we can't tell directly that they've
+	// exited, but we do know once their pid has been reused.
+	for procID := range t.selfTree {
+		if t.procIds[procID.Pid] != procID {
+			delete(t.selfTree, procID)
 		}
 	}
 
@@ -336,7 +780,7 @@ func (t *Tracker) checkAncestry(idinfo IDInfo, newprocs map[ID]IDInfo) string {
 					ptproc.groupName, pProcID, idinfo)
 			}
 			// We've found a tracked parent.
-			t.track(ptproc.groupName, idinfo)
+			t.track(ptproc.groupName, -1, true, idinfo)
 			return ptproc.groupName
 		}
 		// We've found an untracked parent.
@@ -352,7 +796,7 @@ func (t *Tracker) checkAncestry(idinfo IDInfo, newprocs map[ID]IDInfo) string {
 					name, pProcID, idinfo)
 			}
 			// We've found a tracked parent, which implies this entire lineage should be tracked.
-			t.track(name, idinfo)
+			t.track(name, -1, true, idinfo)
 			return name
 		}
 	}
@@ -365,6 +809,22 @@ func (t *Tracker) checkAncestry(idinfo IDInfo, newprocs map[ID]IDInfo) string {
 	return ""
 }
 
+// inSelfTree returns true if idinfo is us or one of our descendants.  Its
+// ancestors are looked up among our known descendants and the new procs in
+// newByPid.
+func (t *Tracker) inSelfTree(idinfo IDInfo, newByPid map[int]IDInfo) bool {
+	if idinfo.Pid == t.selfPid || idinfo.ParentPid == t.selfPid {
+		return true
+	}
+	if pProcID, ok := t.procIds[idinfo.ParentPid]; ok && t.selfTree[pProcID] {
+		return true
+	}
+	if parent, ok := newByPid[idinfo.ParentPid]; ok && parent.ID != idinfo.ID {
+		return t.inSelfTree(parent, newByPid)
+	}
+	return false
+}
+
 func (t *Tracker) lookupUid(uid int) string {
 	if name, ok := t.username[uid]; ok {
 		return name
@@ -382,30 +842,293 @@ func (t *Tracker) lookupUid(uid int) string {
 	return name
 }
 
+// containerName returns the name of the container with the given id, or ""
+// if there's none or it can't be resolved.  deferred is true if the lookup
+// was put off until a later cycle.
+func (t *Tracker) containerName(id string) (name string, deferred bool) {
+	if id == "" || t.opts.ContainerNamer == nil {
+		return "", false
+	}
+	name, err := t.opts.ContainerNamer.ContainerName(id)
+	if err == ErrNameDeferred {
+		return "", true
+	}
+	if err != nil && t.debug {
+		log.Printf("error resolving container name: %v", err)
+	}
+	return name, false
+}
+
+// trackedAttributes returns the attributes of the tracked procs that come
+// from their Static, for common.PruningMatchNamer.
+func (t *Tracker) trackedAttributes() []common.ProcAttributes {
+	nacls := make([]common.ProcAttributes, 0, len(t.tracked))
+	for _, tproc := range t.tracked {
+		if tproc == nil {
+			continue
+		}
+		static := tproc.static
+		cgroup := static.Cgroup
+		if cgroup == "" {
+			cgroup = static.CgroupV1Systemd
+		}
+		nacls = append(nacls, common.ProcAttributes{
+			Name:         static.Name,
+			Cmdline:      static.Cmdline,
+			EffectiveUID: static.EffectiveUID,
+			KernelThread: static.KernelThread,
+			ExePath:      static.ExePath,
+			ExeDev:       static.ExeDev,
+			ExeInode:     static.ExeInode,
+			Root:         static.Root,
+			Cgroup:       cgroup,
+			ListenPorts:  static.ListenPorts,
+			ContainerID:  containerID(cgroup),
+		})
+	}
+	return nacls
+}
+
+// liveContainers returns the ids of the containers of the tracked procs.
+func (t *Tracker) liveContainers() map[string]bool {
+	live := make(map[string]bool)
+	for _, tproc := range t.tracked {
+		if tproc == nil {
+			continue
+		}
+		cgroup := tproc.static.Cgroup
+		if cgroup == "" {
+			cgroup = tproc.static.CgroupV1Systemd
+		}
+		if id := containerID(cgroup); id != "" {
+			live[id] = true
+		}
+	}
+	return live
+}
+
+// pod returns the pod container the proc runs in, resolved if possible, or
+// the zero Pod if it's not in one.  deferred is true if resolving it was
+// put off until a later cycle.
+func (t *Tracker) pod(idinfo IDInfo) (resolved common.Pod, deferred bool) {
+	cgroup := idinfo.Cgroup
+	if cgroup == "" {
+		cgroup = idinfo.CgroupV1Systemd
+	}
+	pod := podFromCgroup(cgroup)
+	if pod.UID == "" || t.opts.PodResolver == nil {
+		return pod, false
+	}
+	resolved, err := t.opts.PodResolver.ResolvePod(pod)
+	if err == ErrPodDeferred {
+		return pod, true
+	}
+	if err != nil && t.debug {
+		log.Printf("error resolving pod: %v", err)
+	}
+	return resolved, false
+}
+
+// GetStatic implements Proc.
+func (ri *recordingIter) GetStatic() (Static, error) {
+	static, err := ri.Iter.GetStatic()
+	if err != nil {
+		return static, err
+	}
+	id, err := ri.Iter.GetProcID()
+	if err != nil {
+		return static, err
+	}
+	ri.statics[id] = static
+	return static, nil
+}
+
+// Classify reads the procs from iter once and reports, in pid order, which
+// group each would be tracked in by a new Tracker using the given namer and
+// options.  Since the procs go through a real Tracker update, the result
+// reflects exactly what the exporter would do, e.g. with trackChildren set
+// children of tracked procs are included in their parent's group.  Procs
+// that can't be read, typically because they exited, are omitted.
+func Classify(iter Iter, namer common.MatchNamer, trackChildren bool, opts Options) ([]Classified, error) {
+	ri := &recordingIter{Iter: iter, statics: make(map[ID]Static)}
+	t := NewTracker(namer, trackChildren, false, false, opts)
+	if _, _, err := t.Update(ri); err != nil {
+		return nil, err
+	}
+
+	classified := make([]Classified, 0, len(ri.statics))
+	for id, static := range ri.statics {
+		c := Classified{ID: id, Static: static}
+		if tproc := t.tracked[id]; tproc != nil {
+			c.GroupName = tproc.groupName
+		}
+		classified = append(classified, c)
+	}
+	sort.Slice(classified, func(i, j int) bool { return classified[i].Pid < classified[j].Pid })
+	return classified, nil
+}
+
+// SetNamer replaces the namer.  Since the old namer's verdicts no longer
+// apply, all procs are forgotten and matched anew by the next Update, just
+// like procs seen for the first time.  Consequently whatever they consume
+// during that cycle isn't counted.
+func (t *Tracker) SetNamer(namer common.MatchNamer) {
+	t.namer = namer
+	t.countStarts = false
+	for id := range t.tracked {
+		delete(t.tracked, id)
+	}
+}
+
+// matchAndName asks the namer whether to track a proc and how to name it.
+// The index of the namer rule that matched is also returned if the namer is a
+// common.RuleMatchNamer, otherwise it's -1.
+func (t *Tracker) matchAndName(nacl common.ProcAttributes) (bool, string, int) {
+	if rn, ok := t.namer.(common.RuleMatchNamer); ok {
+		return rn.MatchAndNameRule(nacl)
+	}
+	wanted, gname := t.namer.MatchAndName(nacl)
+	return wanted, gname, -1
+}
+
+// RuleStats returns, for each rule of the namer, how many of the currently
+// tracked procs it matched.  Procs tracked because their parent is aren't
+// counted.  It returns nil unless the namer is a common.RuleMatchNamer.
+func (t *Tracker) RuleStats() []RuleStat {
+	rn, ok := t.namer.(common.RuleMatchNamer)
+	if !ok {
+		return nil
+	}
+	rules := rn.Rules()
+	stats := make([]RuleStat, len(rules))
+	for i, rule := range rules {
+		stats[i].Rule = rule
+	}
+	for _, tproc := range t.tracked {
+		if tproc != nil && tproc.rule >= 0 && tproc.rule < len(stats) {
+			stats[tproc.rule].Procs++
+		}
+	}
+	return stats
+}
+
+// EnvironUnreadable reports whether the environment of any tracked proc
+// couldn't be read, see Static.EnvironUnreadable.
+func (t *Tracker) EnvironUnreadable() bool {
+	for _, tproc := range t.tracked {
+		if tproc != nil && tproc.static.EnvironUnreadable {
+			return true
+		}
+	}
+	return false
+}
+
+// Procs returns the current static details and metrics of the tracked procs
+// in the named group, in pid order.  Thread details aren't included.  It
+// returns nil if there are no such procs.
+func (t *Tracker) Procs(groupName string) []IDInfo {
+	var procs []IDInfo
+	for id, tproc := range t.tracked {
+		if tproc != nil && tproc.groupName == groupName {
+			procs = append(procs, IDInfo{ID: id, Static: tproc.static, Metrics: tproc.metrics})
+		}
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Pid < procs[j].Pid })
+	return procs
+}
+
 // Update modifies the tracker's internal state based on what it reads from
 // iter.  Tracks any new procs the namer wants tracked, and updates
 // its metrics for existing tracked procs.  Returns nonfatal errors
-// and the status of all tracked procs, or an error if fatal.
+// and the status of all tracked procs, or an error if fatal.  If procfs
+// can't be read at all the error is ErrProcFSUnavailable.
 func (t *Tracker) Update(iter Iter) (CollectErrors, []Update, error) {
+	return t.updateInto(iter, make([]Update, 0, len(t.tracked)))
+}
+
+// updateInto is like Update, but appends the updates to tp, whose storage
+// and any Wchans maps in it are reused.
+func (t *Tracker) updateInto(iter Iter, tp []Update) (CollectErrors, []Update, error) {
 	newProcs, colErrs, err := t.update(iter)
 	if err != nil {
 		return colErrs, nil, err
 	}
+	for gname := range t.started {
+		delete(t.started, gname)
+	}
+
+	var newByPid map[int]IDInfo
+	if t.opts.ExcludeSelf {
+		newByPid = make(map[int]IDInfo, len(newProcs))
+		for _, idinfo := range newProcs {
+			newByPid[idinfo.Pid] = idinfo
+		}
+	}
+
+	// Record the names of all new procs first, so that a proc's parent can
+	// be found even if it's new too.
+	for _, idinfo := range newProcs {
+		t.names[idinfo.ID] = idinfo.Name
+	}
 
 	// Step 1: track any new proc that should be tracked based on its name and cmdline.
 	untracked := make(map[ID]IDInfo)
 	for _, idinfo := range newProcs {
+		if t.opts.ExcludeSelf && t.inSelfTree(idinfo, newByPid) {
+			if t.debug {
+				log.Printf("ignoring our own descendant: %+v", idinfo)
+			}
+			t.selfTree[idinfo.ID] = true
+			t.ignore(idinfo.ID)
+			continue
+		}
+
+		if t.opts.PidNamespace != 0 && idinfo.PidNamespace != t.opts.PidNamespace {
+			if t.debug {
+				log.Printf("ignoring proc in pid namespace %d: %+v", idinfo.PidNamespace, idinfo)
+			}
+			t.ignore(idinfo.ID)
+			continue
+		}
+
+		cgroup := idinfo.Cgroup
+		if cgroup == "" {
+			cgroup = idinfo.CgroupV1Systemd
+		}
 		nacl := common.ProcAttributes{
-			Name:     idinfo.Name,
-			Cmdline:  idinfo.Cmdline,
-			Username: t.lookupUid(idinfo.EffectiveUID),
+			Name:         idinfo.Name,
+			Cmdline:      idinfo.Cmdline,
+			Username:     t.lookupUid(idinfo.EffectiveUID),
+			EffectiveUID: idinfo.EffectiveUID,
+			KernelThread: idinfo.KernelThread,
+			ExePath:      idinfo.ExePath,
+			ExeDev:       idinfo.ExeDev,
+			ExeInode:     idinfo.ExeInode,
+			Root:         idinfo.Root,
+			Cgroup:       cgroup,
+			Environ:      idinfo.Environ,
+			ParentName:   t.names[t.procIds[idinfo.ParentPid]],
+			ListenPorts:  idinfo.ListenPorts,
+			ContainerID:  containerID(cgroup),
 		}
-		wanted, gname := t.namer.MatchAndName(nacl)
+		var deferred bool
+		nacl.ContainerName, deferred = t.containerName(nacl.ContainerID)
+		if !deferred {
+			nacl.Pod, deferred = t.pod(idinfo)
+		}
+		if deferred {
+			// Neither tracked nor ignored, the proc is new again next cycle.
+			if t.debug {
+				log.Printf("deferring proc until its container or pod is resolved: %+v", idinfo)
+			}
+			continue
+		}
+		wanted, gname, rule := t.matchAndName(nacl)
 		if wanted {
 			if t.debug {
 				log.Printf("matched as %q: %+v", gname, idinfo)
 			}
-			t.track(gname, idinfo)
+			t.track(gname, rule, false, idinfo)
 		} else {
 			untracked[idinfo.ID] = idinfo
 		}
@@ -421,13 +1144,54 @@ func (t *Tracker) Update(iter Iter) (CollectErrors, []Update, error) {
 
 			t.checkAncestry(idinfo, untracked)
 		}
+	} else {
+		// The namer's verdict won't change unless alwaysRecheck is set, so
+		// avoid rereading unwanted procs every cycle.
+		for id := range untracked {
+			t.ignore(id)
+		}
 	}
 
-	tp := []Update{}
-	for _, tproc := range t.tracked {
+	// Step 3: track whatever is left in the default group.
+	if t.opts.DefaultGroup != "" {
+		for id, idinfo := range untracked {
+			if t.tracked[id] == nil {
+				if t.debug {
+					log.Printf("matched as default group %q: %+v", t.opts.DefaultGroup, idinfo)
+				}
+				t.track(t.opts.DefaultGroup, -1, false, idinfo)
+			}
+		}
+	}
+
+	if pn, ok := t.namer.(common.PruningMatchNamer); ok {
+		pn.Prune(t.trackedAttributes())
+	}
+
+	for id, tproc := range t.tracked {
 		if tproc != nil {
-			tp = append(tp, tproc.getUpdate())
+			var wchans map[string]int
+			if n := len(tp); n < cap(tp) {
+				wchans = tp[:n+1][n].Wchans
+				for wchan := range wchans {
+					delete(wchans, wchan)
+				}
+			}
+			u := tproc.getUpdate(t.opts.HungCycles, wchans)
+			u.DetailSkipped = t.skipped[id]
+			if t.opts.ThreadStates {
+				u.ThreadStates = tproc.threadStates
+			}
+			if t.opts.UserProcs {
+				uid := tproc.static.EffectiveUID
+				u.User = User{UID: uid, Name: t.lookupUid(uid)}
+			}
+			tp = append(tp, u)
 		}
 	}
+	if t.opts.ContainerNamer != nil {
+		t.opts.ContainerNamer.EndCycle(t.liveContainers())
+	}
+	t.countStarts = true
 	return colErrs, tp, nil
 }
@@ -1,11 +1,18 @@
 package proc
 
 import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	common "github.com/ncabatoff/process-exporter"
 )
 
 // Verify that the tracker finds and tracks or ignores procs based on the
@@ -36,7 +43,7 @@ func TestTrackerBasic(t *testing.T) {
 		},
 	}
 	// Note that n3 should not be tracked according to our namer.
-	tr := NewTracker(newNamer(n1, n2, n4), false, false, false)
+	tr := NewTracker(newNamer(n1, n2, n4), false, false, false, Options{})
 
 	opts := cmpopts.SortSlices(lessUpdateGroupName)
 	for i, tc := range tests {
@@ -74,12 +81,299 @@ func TestTrackerChildren(t *testing.T) {
 				newProcParent(p2, n2, p1),
 				newProcParent(p3, n3, p2),
 			},
-			[]Update{{GroupName: n2, Start: t1, Wchans: msi{}}, {GroupName: n2, Start: t1, Wchans: msi{}}},
+			[]Update{{GroupName: n2, Start: t1, Wchans: msi{}}, {GroupName: n2, Start: t1, Wchans: msi{}, ViaParent: true}},
 		},
 	}
 	// Only n2 and children of n2s should be tracked
-	tr := NewTracker(newNamer(n2), true, false, false)
+	tr := NewTracker(newNamer(n2), true, false, false, Options{})
+	opts := cmpopts.SortSlices(func(x, y Update) bool { return !x.ViaParent && y.ViaParent })
 
+	for i, tc := range tests {
+		_, got, err := tr.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		if diff := cmp.Diff(got, tc.want, opts); diff != "" {
+			t.Errorf("%d: update differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestClassify verifies that each proc is reported with the group a tracker
+// would put it in, including children of tracked procs, or none.
+func TestClassify(t *testing.T) {
+	procs := []IDInfo{
+		newProcParent(3, "g3", 2),
+		newProcParent(1, "g1", 0),
+		newProcParent(2, "g2", 1),
+		newProcParent(4, "g1", 0),
+	}
+
+	got, err := Classify(procInfoIter(procs...), newNamer("g2"), true, Options{})
+	noerr(t, err)
+	var gotGroups []string
+	for i, c := range got {
+		if c.Pid != i+1 {
+			t.Errorf("%d: got pid %d, want %d", i, c.Pid, i+1)
+		}
+		gotGroups = append(gotGroups, c.GroupName)
+	}
+	want := []string{"", "g2", "g2", ""}
+	if diff := cmp.Diff(gotGroups, want); diff != "" {
+		t.Errorf("groups differ: (-got +want)\n%s", diff)
+	}
+}
+
+// TestTrackerDefaultGroup verifies that procs neither matched nor tracked
+// with their parent are put in the default group.
+func TestTrackerDefaultGroup(t *testing.T) {
+	procs := []IDInfo{
+		newProcParent(1, "g1", 0),
+		newProcParent(2, "g2", 1),
+		newProcParent(3, "g3", 2),
+		newProcParent(4, "g1", 0),
+	}
+
+	for _, tc := range []struct {
+		children bool
+		want     []string
+	}{
+		{false, []string{"other", "g2", "other", "other"}},
+		{true, []string{"other", "g2", "g2", "other"}},
+	} {
+		got, err := Classify(procInfoIter(procs...), newNamer("g2"), tc.children, Options{DefaultGroup: "other"})
+		noerr(t, err)
+		var gotGroups []string
+		for _, c := range got {
+			gotGroups = append(gotGroups, c.GroupName)
+		}
+		if diff := cmp.Diff(gotGroups, tc.want); diff != "" {
+			t.Errorf("children %v: groups differ: (-got +want)\n%s", tc.children, diff)
+		}
+	}
+}
+
+// TestTrackerParentName verifies that procs can be matched on the name of
+// their parent, whether the parent is new or was ignored in an earlier cycle,
+// and that they don't match once the parent is gone.
+func TestTrackerParentName(t *testing.T) {
+	tr := NewTracker(parentNamer{"supervisord": {}}, false, false, false, Options{})
+	for i, tc := range []struct {
+		procs []IDInfo
+		want  []string
+	}{
+		{
+			[]IDInfo{
+				newProcParent(2, "worker", 1),
+				newProcParent(1, "supervisord", 0),
+				newProcParent(3, "worker", 0),
+			},
+			[]string{"worker"},
+		},
+		{
+			[]IDInfo{
+				newProcParent(1, "supervisord", 0),
+				newProcParent(4, "cron", 1),
+			},
+			[]string{"cron"},
+		},
+		{
+			[]IDInfo{
+				newProcParent(5, "worker", 1),
+			},
+			nil,
+		},
+	} {
+		_, got, err := tr.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		var gotNames []string
+		for _, u := range got {
+			gotNames = append(gotNames, u.GroupName)
+		}
+		if diff := cmp.Diff(gotNames, tc.want); diff != "" {
+			t.Errorf("%d: groups differ: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestTrackerContainerName verifies that procs in containers are given
+// their container's id and name, or just the id if it can't be resolved.
+func TestTrackerContainerName(t *testing.T) {
+	id1, id2 := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	opts := Options{ContainerNamer: mapContainerNamer{id1: "web"}}
+	tr := NewTracker(containerNamer{}, false, false, false, opts)
+	p1, p2, p3 := newProc(1, "nginx", Metrics{}), newProc(2, "redis", Metrics{}), newProc(3, "sshd", Metrics{})
+	p1.Cgroup = "/system.slice/docker-" + id1 + ".scope"
+	p2.Cgroup = "/docker/" + id2
+	p3.Cgroup = "/system.slice/sshd.service"
+
+	_, got, err := tr.Update(procInfoIter(p1, p2, p3))
+	noerr(t, err)
+	var gotNames []string
+	for _, u := range got {
+		gotNames = append(gotNames, u.GroupName)
+	}
+	sort.Strings(gotNames)
+	if diff := cmp.Diff(gotNames, []string{id2, "web"}); diff != "" {
+		t.Errorf("groups differ: (-got +want)\n%s", diff)
+	}
+}
+
+// deferringContainerNamer is a mapContainerNamer that defers all lookups
+// during its first cycle, and records the live containers.
+type deferringContainerNamer struct {
+	mapContainerNamer
+	cycles int
+	live   map[string]bool
+}
+
+func (d *deferringContainerNamer) ContainerName(id string) (string, error) {
+	if d.cycles == 0 {
+		return "", ErrNameDeferred
+	}
+	return d.mapContainerNamer.ContainerName(id)
+}
+
+func (d *deferringContainerNamer) EndCycle(live map[string]bool) {
+	d.cycles++
+	d.live = live
+}
+
+// TestTrackerContainerNameDeferred verifies that a proc whose container
+// lookup is deferred is matched on a later cycle, and that the tracker
+// reports which containers are in use.
+func TestTrackerContainerNameDeferred(t *testing.T) {
+	id1 := strings.Repeat("a", 64)
+	namer := &deferringContainerNamer{mapContainerNamer: mapContainerNamer{id1: "web"}}
+	tr := NewTracker(containerNamer{}, false, false, false, Options{ContainerNamer: namer})
+	p1 := newProc(1, "nginx", Metrics{})
+	p1.Cgroup = "/system.slice/docker-" + id1 + ".scope"
+
+	_, got, err := tr.Update(procInfoIter(p1))
+	noerr(t, err)
+	if len(got) != 0 {
+		t.Errorf("got %d updates while deferred, want none", len(got))
+	}
+
+	_, got, err = tr.Update(procInfoIter(p1))
+	noerr(t, err)
+	if len(got) != 1 || got[0].GroupName != "web" {
+		t.Errorf("got updates %+v, want one for group web", got)
+	}
+	if diff := cmp.Diff(namer.live, map[string]bool{id1: true}); diff != "" {
+		t.Errorf("live containers differ: (-got +want)\n%s", diff)
+	}
+}
+
+// deferringPodResolver is a mapPodResolver that defers all lookups until
+// ready is set.
+type deferringPodResolver struct {
+	mapPodResolver
+	ready bool
+}
+
+func (d *deferringPodResolver) ResolvePod(pod common.Pod) (common.Pod, error) {
+	if !d.ready {
+		return pod, ErrPodDeferred
+	}
+	return d.mapPodResolver.ResolvePod(pod)
+}
+
+// TestTrackerPodDeferred verifies that a proc whose pod lookup is deferred
+// is matched on a later cycle, once the pod is known.
+func TestTrackerPodDeferred(t *testing.T) {
+	uid := "12345678-1234-1234-1234-123456789abc"
+	resolver := &deferringPodResolver{mapPodResolver: mapPodResolver{
+		uid: {UID: uid, Namespace: "ns", Name: "web-0"}}}
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{PodResolver: resolver})
+	p1 := newProc(1, "g1", Metrics{})
+	p1.Cgroup = "/kubepods/pod" + uid
+
+	_, got, err := tr.Update(procInfoIter(p1))
+	noerr(t, err)
+	if len(got) != 0 {
+		t.Errorf("got %d updates while deferred, want none", len(got))
+	}
+
+	resolver.ready = true
+	_, got, err = tr.Update(procInfoIter(p1))
+	noerr(t, err)
+	if len(got) != 1 {
+		t.Errorf("got %d updates, want 1", len(got))
+	}
+	if pod := tr.tracked[p1.ID].pod; pod.Name != "web-0" {
+		t.Errorf("got pod %+v, want web-0", pod)
+	}
+}
+
+// TestTrackerEnvironUnreadable verifies that an unreadable environment is
+// reported for as long as its proc is tracked, not just when it's read.
+func TestTrackerEnvironUnreadable(t *testing.T) {
+	p1, p2 := newProc(1, "g1", Metrics{}), newProc(2, "g1", Metrics{})
+	p2.EnvironUnreadable = true
+
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{})
+	for i, tc := range []struct {
+		procs []IDInfo
+		want  bool
+	}{
+		{[]IDInfo{p1, p2}, true},
+		{[]IDInfo{p1, p2}, true},
+		{[]IDInfo{p1}, false},
+	} {
+		_, _, err := tr.Update(procInfoIter(tc.procs...))
+		noerr(t, err)
+		if got := tr.EnvironUnreadable(); got != tc.want {
+			t.Errorf("%d: got environ unreadable %v, want %v", i, got, tc.want)
+		}
+	}
+}
+
+// TestTrackerPidNamespace verifies that when restricted to a pid namespace,
+// the tracker ignores procs in other namespaces.
+func TestTrackerPidNamespace(t *testing.T) {
+	p1, p2 := newProcStart(1, "g1", 0), newProcStart(2, "g1", 0)
+	p1.PidNamespace, p2.PidNamespace = 100, 200
+
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{PidNamespace: 100})
+	_, got, err := tr.Update(procInfoIter(p1, p2))
+	noerr(t, err)
+	want := []Update{{GroupName: "g1", Start: time.Unix(0, 0).UTC(), Wchans: msi{}}}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("update differs: (-got +want)\n%s", diff)
+	}
+}
+
+// TestTrackerExcludeSelf verifies that when asked, the tracker ignores
+// itself and its descendants, including those appearing later.
+func TestTrackerExcludeSelf(t *testing.T) {
+	n := "g1"
+	tm := time.Unix(0, 0).UTC()
+	tests := []struct {
+		procs []IDInfo
+		want  []Update
+	}{
+		{
+			[]IDInfo{
+				newProcParent(12, n, 11),
+				newProcParent(10, n, 1),
+				newProcParent(11, n, 10),
+				newProcParent(13, n, 1),
+			},
+			[]Update{{GroupName: n, Start: tm, Wchans: msi{}}},
+		},
+		{
+			[]IDInfo{
+				newProcParent(10, n, 1),
+				newProcParent(11, n, 10),
+				newProcParent(12, n, 11),
+				newProcParent(13, n, 1),
+				newProcParent(14, n, 12),
+			},
+			[]Update{{GroupName: n, Start: tm, Wchans: msi{}}},
+		},
+	}
+
+	tr := NewTracker(newNamer(n), false, false, false, Options{ExcludeSelf: true})
+	tr.selfPid = 10
 	for i, tc := range tests {
 		_, got, err := tr.Update(procInfoIter(tc.procs...))
 		noerr(t, err)
@@ -89,6 +383,352 @@ func TestTrackerChildren(t *testing.T) {
 	}
 }
 
+// TestTrackerDetailDeadline verifies that once the deadline has passed, the
+// expensive metrics aren't read.
+func TestTrackerDetailDeadline(t *testing.T) {
+	p1 := piinfo(1, "g1", Counts{}, Memory{}, Filedesc{Open: 2, Limit: 10}, 1)
+	p2 := piinfo(2, "g1", Counts{}, Memory{}, Filedesc{Open: 3, Limit: 10}, 1)
+
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{DetailDeadline: time.Nanosecond})
+	cerrs, got, err := tr.Update(procInfoIter(p1, p2))
+	noerr(t, err)
+	if cerrs.DetailSkipped != 1 && cerrs.DetailSkipped != 2 {
+		t.Errorf("got %d procs with skipped details, want 1 or 2", cerrs.DetailSkipped)
+	}
+	for _, u := range got {
+		if u.Filedesc.Open == -1 {
+			return
+		}
+	}
+	t.Errorf("no update had open fds unknown: %+v", got)
+}
+
+// TestTrackerCounterWrap verifies that a counter going backwards is treated
+// as a reset, yielding no delta, unless wrap detection is enabled and the
+// counter was close to its maximum, in which case the delta spans the wrap.
+func TestTrackerCounterWrap(t *testing.T) {
+	tests := []struct {
+		name   string
+		wrap   bool
+		before uint64
+		after  uint64
+		want   uint64
+	}{
+		{"reset", false, 100, 5, 0},
+		{"reset-wrapaware", true, 100, 5, 0},
+		{"wrap32", false, math.MaxUint32 - 10, 5, 0},
+		{"wrap32-wrapaware", true, math.MaxUint32 - 10, 5, 16},
+		{"wrap64-wrapaware", true, math.MaxUint64 - 1, 3, 5},
+		{"increase-wrapaware", true, 5, 100, 95},
+	}
+
+	for _, tc := range tests {
+		tr := NewTracker(newNamer("g1"), false, false, false, Options{CounterWrap: tc.wrap})
+		for i, faults := range []uint64{tc.before, tc.after} {
+			p := piinfo(1, "g1", Counts{MinorPageFaults: faults}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+			_, got, err := tr.Update(procInfoIter(p))
+			noerr(t, err)
+			if i == 1 && got[0].Latest.MinorPageFaults != tc.want {
+				t.Errorf("%s: got delta %d, want %d", tc.name, got[0].Latest.MinorPageFaults, tc.want)
+			}
+		}
+	}
+}
+
+// TestTrackerCounterReset verifies that when a proc's I/O and CPU counters go
+// backwards, the reset contributes nothing rather than a huge bogus delta, and
+// that later deltas are taken relative to the new values.
+func TestTrackerCounterReset(t *testing.T) {
+	seq := []Counts{
+		{CPUUserTime: 10, ReadBytes: 1000, WriteBytes: 2000},
+		{CPUUserTime: 12, ReadBytes: 1500, WriteBytes: 2500},
+		{CPUUserTime: 3, ReadBytes: 100, WriteBytes: 50},
+		{CPUUserTime: 4, ReadBytes: 300, WriteBytes: 60},
+	}
+	want := Counts{CPUUserTime: 3, ReadBytes: 700, WriteBytes: 510}
+
+	for _, wrap := range []bool{false, true} {
+		tr := NewTracker(newNamer("g1"), false, false, false, Options{CounterWrap: wrap})
+		var accum Counts
+		for i, c := range seq {
+			p := piinfo(1, "g1", c, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+			_, got, err := tr.Update(procInfoIter(p))
+			noerr(t, err)
+			next := accum
+			next.Add(got[0].Latest)
+			if next.CPUUserTime < accum.CPUUserTime || next.ReadBytes < accum.ReadBytes ||
+				next.WriteBytes < accum.WriteBytes {
+				t.Errorf("wrap=%v: %d: accumulator went backwards: %+v to %+v", wrap, i, accum, next)
+			}
+			accum = next
+		}
+		if diff := cmp.Diff(accum, want); diff != "" {
+			t.Errorf("wrap=%v: accumulated delta differs: (-got +want)\n%s", wrap, diff)
+		}
+	}
+}
+
+// TestTrackerCPUModes verifies that user and system CPU deltas are computed
+// independently, and that neither goes negative when a counter goes
+// backwards.
+func TestTrackerCPUModes(t *testing.T) {
+	tests := []struct {
+		user, system float64
+		want         Delta
+	}{
+		{1, 5, Delta{}},
+		{3, 6, Delta{CPUUserTime: 2, CPUSystemTime: 1}},
+		{4, 2, Delta{CPUUserTime: 1}},
+	}
+
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{})
+	for i, tc := range tests {
+		p := piinfo(1, "g1", Counts{CPUUserTime: tc.user, CPUSystemTime: tc.system}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1)
+		_, got, err := tr.Update(procInfoIter(p))
+		noerr(t, err)
+		if diff := cmp.Diff(got[0].Latest, tc.want); diff != "" {
+			t.Errorf("%d: delta differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestTrackerStaleCycles verifies that a proc missed for up to
+// Options.StaleCycles cycles is still reported, without counting anything
+// twice, and that its counts continue where they left off if it reappears.
+func TestTrackerStaleCycles(t *testing.T) {
+	tests := []struct {
+		present bool
+		read    uint64
+		want    []uint64
+	}{
+		{true, 10, []uint64{0}},
+		{false, 0, []uint64{0}},
+		{true, 25, []uint64{15}},
+		{false, 0, []uint64{0}},
+		{false, 0, nil},
+		{true, 30, []uint64{0}},
+	}
+
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{StaleCycles: 1})
+	for i, tc := range tests {
+		var procs []IDInfo
+		if tc.present {
+			p := newProcStart(1, "g1", 1)
+			p.Counts = Counts{ReadBytes: tc.read}
+			procs = append(procs, p)
+		}
+		_, got, err := tr.Update(procInfoIter(procs...))
+		noerr(t, err)
+		var gotReads []uint64
+		for _, u := range got {
+			gotReads = append(gotReads, u.Latest.ReadBytes)
+		}
+		if diff := cmp.Diff(gotReads, tc.want); diff != "" {
+			t.Errorf("%d: reads differ: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestTrackerPidReuse verifies that a new proc reusing the pid of an exited
+// one starts its counters afresh, rather than being compared with those of
+// the old proc.
+func TestTrackerPidReuse(t *testing.T) {
+	tests := []struct {
+		start  uint64
+		faults uint64
+		want   uint64
+	}{
+		{1, 1000, 0},
+		{2, 5, 0},
+		{2, 8, 3},
+	}
+
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{})
+	for i, tc := range tests {
+		p := newProcStart(1, "g1", tc.start)
+		p.Counts = Counts{MajorPageFaults: tc.faults, MinorPageFaults: tc.faults}
+		_, got, err := tr.Update(procInfoIter(p))
+		noerr(t, err)
+		want := Delta{MajorPageFaults: tc.want, MinorPageFaults: tc.want}
+		if diff := cmp.Diff(got[0].Latest, want); diff != "" {
+			t.Errorf("%d: delta differs: (-got +want)\n%s", i, diff)
+		}
+	}
+}
+
+// TestTrackerWorkers verifies that reading procs concurrently gives the same
+// results as reading them serially, as procs come and go, are ignored, and
+// have their pids reused.
+func TestTrackerWorkers(t *testing.T) {
+	var names []string
+	for pid := 1; pid <= 200; pid++ {
+		if pid%5 != 0 {
+			names = append(names, fmt.Sprintf("g%d", pid))
+		}
+	}
+	serial := NewTracker(newNamer(names...), false, false, false, Options{})
+	concurrent := NewTracker(newNamer(names...), false, false, false, Options{Workers: 8})
+
+	opts := cmpopts.SortSlices(lessUpdateGroupName)
+	for cycle := 0; cycle < 6; cycle++ {
+		var procs []IDInfo
+		for pid := 1; pid <= 200; pid++ {
+			if (pid+cycle)%7 == 0 {
+				continue
+			}
+			start := uint64(1)
+			if pid%11 == 0 {
+				start += uint64(cycle / 3)
+			}
+			p := newProcStart(pid, fmt.Sprintf("g%d", pid), start)
+			p.Counts = Counts{CPUUserTime: float64(cycle * pid), ReadBytes: uint64(cycle * pid)}
+			procs = append(procs, p)
+		}
+
+		wantErrs, want, err := serial.Update(procInfoIter(procs...))
+		noerr(t, err)
+		gotErrs, got, err := concurrent.Update(procInfoIter(procs...))
+		noerr(t, err)
+		if diff := cmp.Diff(got, want, opts); diff != "" {
+			t.Errorf("%d: update differs: (-got +want)\n%s", cycle, diff)
+		}
+		if gotErrs != wantErrs {
+			t.Errorf("%d: got errors %+v, want %+v", cycle, gotErrs, wantErrs)
+		}
+	}
+}
+
+// countingProc is a Proc that counts the calls to GetStatic.
+type countingProc struct {
+	*IDInfo
+	statics map[ID]int
+}
+
+func (p countingProc) GetStatic() (Static, error) {
+	p.statics[p.ID]++
+	return p.IDInfo.GetStatic()
+}
+
+// countingProcs implements procs using countingProc.
+type countingProcs struct {
+	procIDInfos
+	statics map[ID]int
+}
+
+func (p countingProcs) get(i int) Proc {
+	return countingProc{&p.procIDInfos[i], p.statics}
+}
+
+// TestTrackerStaticOnce verifies that the static details of a proc, tracked
+// or ignored, are only read the first time it's seen, and again if its pid
+// is reused.
+func TestTrackerStaticOnce(t *testing.T) {
+	statics := make(map[ID]int)
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{})
+	for _, start := range []uint64{1, 1, 1, 2, 2} {
+		procs := countingProcs{procIDInfos{newProcStart(1, "g1", start), newProcStart(2, "g2", 1)}, statics}
+		_, _, err := tr.Update(&procIterator{procs: procs, idx: -1})
+		noerr(t, err)
+	}
+
+	want := map[ID]int{{1, 1}: 1, {1, 2}: 1, {2, 1}: 1}
+	if diff := cmp.Diff(statics, want); diff != "" {
+		t.Errorf("static reads differ: (-got +want)\n%s", diff)
+	}
+}
+
+// failingProc is an IDInfo whose metrics or static details can't be read.
+type failingProc struct {
+	*IDInfo
+	metricsErr, staticErr error
+}
+
+func (p failingProc) GetStatic() (Static, error) {
+	if p.staticErr != nil {
+		return Static{}, p.staticErr
+	}
+	return p.IDInfo.GetStatic()
+}
+
+func (p failingProc) GetMetrics() (Metrics, int, error) {
+	if p.metricsErr != nil {
+		return Metrics{}, 0, p.metricsErr
+	}
+	return p.IDInfo.GetMetrics()
+}
+
+// failingProcs implements procs using failingProc, with the errors of the
+// proc with each pid.
+type failingProcs struct {
+	procIDInfos
+	metricsErrs, staticErrs map[int]error
+}
+
+func (p failingProcs) get(i int) Proc {
+	pid := p.procIDInfos[i].Pid
+	return failingProc{&p.procIDInfos[i], p.metricsErrs[pid], p.staticErrs[pid]}
+}
+
+// TestTrackerReadFailures verifies that procs which can't be read are
+// counted by stage and reason, including those that vanished.
+func TestTrackerReadFailures(t *testing.T) {
+	procs := failingProcs{
+		procIDInfos{newProc(1, "g1", Metrics{}), newProc(2, "g1", Metrics{}),
+			newProc(3, "g1", Metrics{}), newProc(4, "g1", Metrics{}),
+			newProc(5, "g1", Metrics{}), newProc(6, "g1", Metrics{})},
+		map[int]error{
+			1: &os.PathError{Op: "open", Path: "/proc/1/stat", Err: syscall.EACCES},
+			2: ErrProcNotExist,
+			3: &os.PathError{Op: "read", Path: "/proc/3/stat", Err: syscall.ESRCH},
+			4: fmt.Errorf("bad stat"),
+		},
+		map[int]error{
+			5: &os.PathError{Op: "open", Path: "/proc/5/cmdline", Err: syscall.EPERM},
+		},
+	}
+
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{})
+	cerrs, _, err := tr.Update(&procIterator{procs: procs, idx: -1})
+	noerr(t, err)
+	want := ReadFailures{
+		Metrics: FailureReasons{Permission: 1, Vanished: 2, Other: 1},
+		Static:  FailureReasons{Permission: 1},
+	}
+	if diff := cmp.Diff(cerrs.Failures, want); diff != "" {
+		t.Errorf("read failures differ: (-got +want)\n%s", diff)
+	}
+	if cerrs.Read != 3 {
+		t.Errorf("got %d read errors, want 3", cerrs.Read)
+	}
+}
+
+// TestTrackerHung verifies that procs making no progress while blocked are
+// reported as hung after the configured number of cycles, and that progress
+// resets this.
+func TestTrackerHung(t *testing.T) {
+	blocked := States{Waiting: 1}
+	tests := []struct {
+		cpu  float64
+		hung bool
+	}{
+		{1, false},
+		{1, false},
+		{1, true},
+		{2, false},
+		{2, false},
+	}
+
+	tr := NewTracker(newNamer("g1"), false, false, false, Options{HungCycles: 2})
+	for i, tc := range tests {
+		p := piinfost(1, "g1", Counts{CPUUserTime: tc.cpu}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1, blocked)
+		_, got, err := tr.Update(procInfoIter(p))
+		noerr(t, err)
+		if got[0].Hung != tc.hung {
+			t.Errorf("%d: got hung=%v, want %v", i, got[0].Hung, tc.hung)
+		}
+	}
+}
+
 // TestTrackerMetrics verifies that the updates returned by the tracker
 // match the input we're giving it.
 func TestTrackerMetrics(t *testing.T) {
@@ -99,19 +739,19 @@ func TestTrackerMetrics(t *testing.T) {
 		want Update
 	}{
 		{
-			piinfost(p, n, Counts{1, 2, 3, 4, 5, 6, 0, 0}, Memory{7, 8, 0},
-				Filedesc{1, 10}, 9, States{Sleeping: 1}),
-			Update{n, Delta{}, Memory{7, 8, 0}, Filedesc{1, 10}, tm,
-				9, States{Sleeping: 1}, msi{}, nil},
+			piinfost(p, n, Counts{CPUUserTime: 1, CPUSystemTime: 2, ReadBytes: 3, WriteBytes: 4, MajorPageFaults: 5, MinorPageFaults: 6}, Memory{ResidentBytes: 7, VirtualBytes: 8},
+				Filedesc{Open: 1, Limit: 10}, 9, States{Sleeping: 1}),
+			Update{GroupName: n, Memory: Memory{ResidentBytes: 7, VirtualBytes: 8}, Filedesc: Filedesc{Open: 1, Limit: 10},
+				Start: tm, NumThreads: 9, States: States{Sleeping: 1}, Wchans: msi{}},
 		},
 		{
-			piinfost(p, n, Counts{2, 3, 4, 5, 6, 7, 0, 0}, Memory{1, 2, 0},
-				Filedesc{2, 20}, 1, States{Running: 1}),
-			Update{n, Delta{1, 1, 1, 1, 1, 1, 0, 0}, Memory{1, 2, 0},
-				Filedesc{2, 20}, tm, 1, States{Running: 1}, msi{}, nil},
+			piinfost(p, n, Counts{CPUUserTime: 2, CPUSystemTime: 3, ReadBytes: 4, WriteBytes: 5, MajorPageFaults: 6, MinorPageFaults: 7}, Memory{ResidentBytes: 1, VirtualBytes: 2},
+				Filedesc{Open: 2, Limit: 20}, 1, States{Running: 1}),
+			Update{GroupName: n, Latest: Delta{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, Memory: Memory{ResidentBytes: 1, VirtualBytes: 2}, Filedesc: Filedesc{Open: 2, Limit: 20},
+				Start: tm, NumThreads: 1, States: States{Running: 1}, Wchans: msi{}},
 		},
 	}
-	tr := NewTracker(newNamer(n), false, false, false)
+	tr := NewTracker(newNamer(n), false, false, false, Options{})
 
 	for i, tc := range tests {
 		_, got, err := tr.Update(procInfoIter(tc.proc))
@@ -130,46 +770,43 @@ func TestTrackerThreads(t *testing.T) {
 		want Update
 	}{
 		{
-			piinfo(p, n, Counts{}, Memory{}, Filedesc{1, 1}, 1),
-			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 1, States{}, msi{}, nil},
+			piinfo(p, n, Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, 1),
+			Update{GroupName: n, Filedesc: Filedesc{Open: 1, Limit: 1}, Start: tm, NumThreads: 1, Wchans: msi{}},
 		}, {
-			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{1, 2, 3, 4, 5, 6, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0}, "", States{}},
+			piinfot(p, n, Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, []Thread{
+				{ThreadID(ID{p, 0}), "t1", Counts{CPUUserTime: 1, CPUSystemTime: 2, ReadBytes: 3, WriteBytes: 4, MajorPageFaults: 5, MinorPageFaults: 6}, "", States{}},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, "", States{}},
 			}),
-			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 2, States{}, msi{},
-				[]ThreadUpdate{
+			Update{GroupName: n, Filedesc: Filedesc{Open: 1, Limit: 1},
+				Start: tm, NumThreads: 2, Wchans: msi{}, Threads: []ThreadUpdate{
 					{"t1", Delta{}},
 					{"t2", Delta{}},
-				},
-			},
+				}},
 		}, {
-			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 1, 0}), "t2", Counts{2, 2, 2, 2, 2, 2, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 1, 1, 1, 1, 1, 0, 0}, "", States{}},
+			piinfot(p, n, Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, []Thread{
+				{ThreadID(ID{p, 0}), "t1", Counts{CPUUserTime: 2, CPUSystemTime: 3, ReadBytes: 4, WriteBytes: 5, MajorPageFaults: 6, MinorPageFaults: 7}, "", States{}},
+				{ThreadID(ID{p + 1, 0}), "t2", Counts{CPUUserTime: 2, CPUSystemTime: 2, ReadBytes: 2, WriteBytes: 2, MajorPageFaults: 2, MinorPageFaults: 2}, "", States{}},
+				{ThreadID(ID{p + 2, 0}), "t2", Counts{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}, "", States{}},
 			}),
-			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 3, States{}, msi{},
-				[]ThreadUpdate{
-					{"t1", Delta{1, 1, 1, 1, 1, 1, 0, 0}},
-					{"t2", Delta{1, 1, 1, 1, 1, 1, 0, 0}},
+			Update{GroupName: n, Filedesc: Filedesc{Open: 1, Limit: 1},
+				Start: tm, NumThreads: 3, Wchans: msi{}, Threads: []ThreadUpdate{
+					{"t1", Delta{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}},
+					{"t2", Delta{CPUUserTime: 1, CPUSystemTime: 1, ReadBytes: 1, WriteBytes: 1, MajorPageFaults: 1, MinorPageFaults: 1}},
 					{"t2", Delta{}},
-				},
-			},
+				}},
 		}, {
-			piinfot(p, n, Counts{}, Memory{}, Filedesc{1, 1}, []Thread{
-				{ThreadID(ID{p, 0}), "t1", Counts{2, 3, 4, 5, 6, 7, 0, 0}, "", States{}},
-				{ThreadID(ID{p + 2, 0}), "t2", Counts{1, 2, 3, 4, 5, 6, 0, 0}, "", States{}},
+			piinfot(p, n, Counts{}, Memory{}, Filedesc{Open: 1, Limit: 1}, []Thread{
+				{ThreadID(ID{p, 0}), "t1", Counts{CPUUserTime: 2, CPUSystemTime: 3, ReadBytes: 4, WriteBytes: 5, MajorPageFaults: 6, MinorPageFaults: 7}, "", States{}},
+				{ThreadID(ID{p + 2, 0}), "t2", Counts{CPUUserTime: 1, CPUSystemTime: 2, ReadBytes: 3, WriteBytes: 4, MajorPageFaults: 5, MinorPageFaults: 6}, "", States{}},
 			}),
-			Update{n, Delta{}, Memory{}, Filedesc{1, 1}, tm, 2, States{}, msi{},
-				[]ThreadUpdate{
+			Update{GroupName: n, Filedesc: Filedesc{Open: 1, Limit: 1},
+				Start: tm, NumThreads: 2, Wchans: msi{}, Threads: []ThreadUpdate{
 					{"t1", Delta{}},
-					{"t2", Delta{0, 1, 2, 3, 4, 5, 0, 0}},
-				},
-			},
+					{"t2", Delta{CPUSystemTime: 1, ReadBytes: 2, WriteBytes: 3, MajorPageFaults: 4, MinorPageFaults: 5}},
+				}},
 		},
 	}
-	tr := NewTracker(newNamer(n), false, false, false)
+	tr := NewTracker(newNamer(n), false, false, false, Options{})
 
 	opts := cmpopts.SortSlices(lessThreadUpdate)
 	for i, tc := range tests {
@@ -180,3 +817,58 @@ func TestTrackerThreads(t *testing.T) {
 		}
 	}
 }
+
+// slowProc is a Proc whose reads take a while, like those of a real proc.
+type slowProc struct {
+	*IDInfo
+	delay time.Duration
+}
+
+func (p slowProc) GetMetrics() (Metrics, int, error) {
+	time.Sleep(p.delay)
+	return p.IDInfo.GetMetrics()
+}
+
+// slowProcs implements procs using slowProc.
+type slowProcs struct {
+	procIDInfos
+	delay time.Duration
+}
+
+func (p slowProcs) get(i int) Proc {
+	return slowProc{&p.procIDInfos[i], p.delay}
+}
+
+// BenchmarkTrackerUpdate measures a cycle reading thousands of procs, each
+// read taking a little time as if from /proc, with various numbers of
+// workers.
+func BenchmarkTrackerUpdate(b *testing.B) {
+	var names []string
+	var procs []IDInfo
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("g%d", i/10)
+		if i%10 == 0 {
+			names = append(names, name)
+		}
+		procs = append(procs, piinfo(i+1, name, Counts{CPUUserTime: 1}, Memory{ResidentBytes: 1}, Filedesc{Open: 1, Limit: 10}, 1))
+	}
+
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			tr := NewTracker(newNamer(names...), false, false, false, Options{Workers: workers})
+			iter := func() Iter {
+				return &procIterator{procs: slowProcs{procIDInfos(procs), 20 * time.Microsecond}, idx: -1}
+			}
+			if _, _, err := tr.Update(iter()); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := tr.Update(iter()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}